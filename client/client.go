@@ -0,0 +1,292 @@
+// Package client is a Go client for the Flickinfo v1 API.
+//
+// It wraps each endpoint with typed requests and responses, manages the authentication token, retries
+// requests which fail with 429 or 5xx responses (with exponential backoff), and provides iterators for the
+// paginated list endpoints. The response types are shared with the API itself, so they can't drift apart.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/micypac/flick-info/internal/data"
+)
+
+// Types shared with the API handlers.
+type (
+	Movie               = data.Movie
+	Runtime             = data.Runtime
+	User                = data.User
+	Metadata            = data.Metadata
+	MovieSearchResult   = data.MovieSearchResult
+	Token               = data.Token
+	PersonalAccessToken = data.PersonalAccessToken
+	APIKey              = data.APIKey
+)
+
+// APIError is returned when the API responds with an error status code. Message holds the "error" value from
+// the response body, which is either a string or, for failed validation, a map of field names to messages.
+type APIError struct {
+	StatusCode int
+	Message    interface{}
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("flickinfo: %d %s: %v", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// ValidationErrors returns the field errors for a 422 Unprocessable Entity response, or nil otherwise.
+func (e *APIError) ValidationErrors() map[string]string {
+	fields, ok := e.Message.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	errs := make(map[string]string, len(fields))
+	for k, v := range fields {
+		errs[k] = fmt.Sprint(v)
+	}
+
+	return errs
+}
+
+// IsNotFound reports whether err is an APIError with a 404 Not Found status.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Client is a Flickinfo API client. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu    sync.RWMutex
+	token string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the underlying HTTP client. The default has a 30 second timeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithRetries sets the maximum number of retries and the backoff range. The backoff doubles on each attempt,
+// starting at min and capped at max, with random jitter. Set retries to 0 to disable retrying.
+func WithRetries(retries int, min, max time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = retries
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithToken sets the token sent in the Authorization header. This can be a session token or a personal access token.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New returns a client for the API at baseURL, e.g. "https://api.flickinfo.example".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("flickinfo: base url %q must include a scheme and host", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxRetries: 3,
+		minBackoff: 250 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// SetToken replaces the token sent in the Authorization header. An empty token sends anonymous requests.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = token
+}
+
+// Token returns the token currently sent in the Authorization header.
+func (c *Client) Token() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.token
+}
+
+// do sends a request to the API, encoding in (if not nil) as the JSON body and decoding the JSON response
+// into out (if not nil). Requests which fail with a 429, or a 5xx for idempotent methods, are retried.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body []byte
+
+	if in != nil {
+		var err error
+
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	u := c.baseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Accept", "application/json")
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token := c.Token(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			// Network errors are retried for idempotent methods only, as the request may have been processed.
+			if attempt < c.maxRetries && idempotent(method) && ctx.Err() == nil {
+				if err := c.sleep(ctx, attempt, 0); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+
+		if retryable(method, resp.StatusCode) && attempt < c.maxRetries {
+			retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+			drain(resp)
+
+			if err := c.sleep(ctx, attempt, retryAfter); err != nil {
+				return err
+			}
+			continue
+		}
+
+		return decodeResponse(resp, out)
+	}
+}
+
+// decodeResponse reads the response body into out, or returns an *APIError for error status codes.
+func decodeResponse(resp *http.Response, out interface{}) error {
+	defer drain(resp)
+
+	if resp.StatusCode >= 400 {
+		var env struct {
+			Error interface{} `json:"error"`
+		}
+
+		err := json.NewDecoder(resp.Body).Decode(&env)
+		if err != nil || env.Error == nil {
+			env.Error = http.StatusText(resp.StatusCode)
+		}
+
+		return &APIError{StatusCode: resp.StatusCode, Message: env.Error}
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// sleep waits before the next attempt, for retryAfter if the server asked for it, or an exponential backoff
+// with full jitter otherwise. It returns early if the context is cancelled.
+func (c *Client) sleep(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	delay := retryAfter
+
+	if delay <= 0 {
+		backoff := c.minBackoff << attempt
+		if backoff <= 0 || backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+
+		delay = time.Duration(rand.Int63n(int64(backoff) + 1))
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryable reports whether a response status is worth retrying. A 429 means the request wasn't processed, so
+// it's always safe to retry. A 5xx might have been processed, so only idempotent requests are retried.
+func retryable(method string, status int) bool {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return true
+	case status >= 500:
+		return idempotent(method)
+	default:
+		return false
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds. HTTP-dates aren't used by the API.
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// drain reads and closes the response body, so the underlying connection can be reused.
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,317 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CreateMovieInput holds the fields for a new movie. The synopsis, language, country and external IDs are
+// optional, and the other fields are required.
+type CreateMovieInput struct {
+	Title    string   `json:"title"`
+	Year     int32    `json:"year"`
+	Runtime  Runtime  `json:"runtime"`
+	Genres   []string `json:"genres"`
+	Synopsis string   `json:"synopsis,omitempty"`
+	Language string   `json:"language,omitempty"` // ISO 639-1 code, such as "en".
+	Country  string   `json:"country,omitempty"`  // ISO 3166-1 alpha-2 code, such as "US".
+	IMDbID   string   `json:"imdb_id,omitempty"`  // Such as "tt0111161".
+	TMDbID   int64    `json:"tmdb_id,omitempty"`
+}
+
+// UpdateMovieInput holds the fields to change on a movie. Nil fields are left untouched.
+type UpdateMovieInput struct {
+	Title    *string  `json:"title,omitempty"`
+	Year     *int32   `json:"year,omitempty"`
+	Runtime  *Runtime `json:"runtime,omitempty"`
+	Genres   []string `json:"genres,omitempty"`
+	Synopsis *string  `json:"synopsis,omitempty"`
+	Language *string  `json:"language,omitempty"`
+	Country  *string  `json:"country,omitempty"`
+	IMDbID   *string  `json:"imdb_id,omitempty"`
+	TMDbID   *int64   `json:"tmdb_id,omitempty"`
+}
+
+// ListMoviesParams holds the filters, sorting and pagination for ListMovies. Zero values use the API defaults.
+type ListMoviesParams struct {
+	Title    string
+	Genres   []string
+	Language string // ISO 639-1 code of the original language.
+	IMDbID   string // Look up the movie with an IMDb ID, such as "tt0111161".
+	TMDbID   int64  // Look up the movie with a TMDB ID.
+	Director int64  // The ID of a person credited as a director.
+
+	// Only the movies' fields with these JSON names, such as "id" and "title", are sent. The others are left
+	// as zero values.
+	Fields []string
+
+	// Inclusive ranges of release year and runtime in minutes. A zero end is left open.
+	YearMin    int
+	YearMax    int
+	RuntimeMin int
+	RuntimeMax int
+
+	Sort     string // e.g. "title", or "-year,title" to sort on several fields.
+	Page     int
+	PageSize int
+}
+
+func (p ListMoviesParams) query() url.Values {
+	qs := url.Values{}
+
+	if p.Title != "" {
+		qs.Set("title", p.Title)
+	}
+	if len(p.Genres) > 0 {
+		qs.Set("genres", strings.Join(p.Genres, ","))
+	}
+	if p.Language != "" {
+		qs.Set("language", p.Language)
+	}
+	if p.IMDbID != "" {
+		qs.Set("imdb_id", p.IMDbID)
+	}
+	if p.TMDbID > 0 {
+		qs.Set("tmdb_id", strconv.FormatInt(p.TMDbID, 10))
+	}
+	if p.Director > 0 {
+		qs.Set("director", strconv.FormatInt(p.Director, 10))
+	}
+	if len(p.Fields) > 0 {
+		qs.Set("fields", strings.Join(p.Fields, ","))
+	}
+	if p.YearMin > 0 {
+		qs.Set("year_min", strconv.Itoa(p.YearMin))
+	}
+	if p.YearMax > 0 {
+		qs.Set("year_max", strconv.Itoa(p.YearMax))
+	}
+	if p.RuntimeMin > 0 {
+		qs.Set("runtime_min", strconv.Itoa(p.RuntimeMin))
+	}
+	if p.RuntimeMax > 0 {
+		qs.Set("runtime_max", strconv.Itoa(p.RuntimeMax))
+	}
+	if p.Sort != "" {
+		qs.Set("sort", p.Sort)
+	}
+	if p.Page > 0 {
+		qs.Set("page", strconv.Itoa(p.Page))
+	}
+	if p.PageSize > 0 {
+		qs.Set("page_size", strconv.Itoa(p.PageSize))
+	}
+
+	return qs
+}
+
+// SearchMovies returns a page of the movies whose titles match the query, most relevant first. Matching is by
+// word prefix and tolerates typos, and each result has its title highlighted as HTML. Page and pageSize can be
+// zero to use the API defaults.
+func (c *Client) SearchMovies(ctx context.Context, query string, page, pageSize int) ([]*MovieSearchResult, Metadata, error) {
+	qs := url.Values{"q": {query}}
+	if page > 0 {
+		qs.Set("page", strconv.Itoa(page))
+	}
+	if pageSize > 0 {
+		qs.Set("page_size", strconv.Itoa(pageSize))
+	}
+
+	var resp struct {
+		Results  []*MovieSearchResult `json:"results"`
+		Metadata Metadata             `json:"metadata"`
+	}
+
+	err := c.do(ctx, http.MethodGet, "/v1/search/movies", qs, nil, &resp)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return resp.Results, resp.Metadata, nil
+}
+
+// ListMovies returns a single page of movies matching the params, along with the pagination metadata.
+func (c *Client) ListMovies(ctx context.Context, params ListMoviesParams) ([]*Movie, Metadata, error) {
+	var resp struct {
+		Movies   []*Movie `json:"movies"`
+		Metadata Metadata `json:"metadata"`
+	}
+
+	err := c.do(ctx, http.MethodGet, "/v1/movies", params.query(), nil, &resp)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return resp.Movies, resp.Metadata, nil
+}
+
+// Movies returns an iterator over every movie matching the params, fetching pages as needed. Any Page value in
+// params is used as the starting page.
+//
+//	it := c.Movies(client.ListMoviesParams{Genres: []string{"drama"}})
+//	for it.Next(ctx) {
+//		fmt.Println(it.Movie().Title)
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (c *Client) Movies(params ListMoviesParams) *MovieIterator {
+	if params.Page < 1 {
+		params.Page = 1
+	}
+
+	return &MovieIterator{client: c, params: params}
+}
+
+// MovieIterator iterates over the pages of a movie listing.
+type MovieIterator struct {
+	client *Client
+	params ListMoviesParams
+	page   []*Movie
+	index  int
+	done   bool
+	err    error
+}
+
+// Next advances to the next movie, fetching the next page if necessary. It returns false when there are no more
+// movies or an error occurs.
+func (it *MovieIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.index++
+
+	for it.index >= len(it.page) {
+		if it.done {
+			return false
+		}
+
+		movies, metadata, err := it.client.ListMovies(ctx, it.params)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.page = movies
+		it.index = 0
+
+		// Stop after the last page, or an empty page (when there are no results metadata is empty).
+		if len(movies) == 0 || metadata.CurrentPage >= metadata.LastPage {
+			it.done = true
+		}
+		it.params.Page++
+	}
+
+	return true
+}
+
+// Movie returns the current movie. It must only be called after Next returns true.
+func (it *MovieIterator) Movie() *Movie {
+	return it.page[it.index]
+}
+
+// Err returns the error, if any, which stopped the iteration.
+func (it *MovieIterator) Err() error {
+	return it.err
+}
+
+// GetMovie returns the movie with the given ID. Include names the related resources to embed in it, any of
+// "cast", "crew", "ratings" and "reviews"; without any, the cast and crew are embedded.
+func (c *Client) GetMovie(ctx context.Context, id int64, include ...string) (*Movie, error) {
+	var resp struct {
+		Movie *Movie `json:"movie"`
+	}
+
+	var qs url.Values
+	if len(include) > 0 {
+		qs = url.Values{"include": {strings.Join(include, ",")}}
+	}
+
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/v1/movies/%d", id), qs, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Movie, nil
+}
+
+// CreateMovie creates a new movie and returns it.
+func (c *Client) CreateMovie(ctx context.Context, input CreateMovieInput) (*Movie, error) {
+	var resp struct {
+		Movie *Movie `json:"movie"`
+	}
+
+	err := c.do(ctx, http.MethodPost, "/v1/movies", nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Movie, nil
+}
+
+// UpdateMovie changes the given fields of a movie and returns the updated movie.
+func (c *Client) UpdateMovie(ctx context.Context, id int64, input UpdateMovieInput) (*Movie, error) {
+	var resp struct {
+		Movie *Movie `json:"movie"`
+	}
+
+	err := c.do(ctx, http.MethodPatch, fmt.Sprintf("/v1/movies/%d", id), nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Movie, nil
+}
+
+// DeleteMovie deletes the movie with the given ID.
+func (c *Client) DeleteMovie(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/v1/movies/%d", id), nil, nil, nil)
+}
+
+// ShareMovie creates a signed, read-only link to a movie which expires after ttl. The returned URL is relative
+// to the API base URL, and can be fetched without authentication using GetSharedMovie.
+func (c *Client) ShareMovie(ctx context.Context, id int64, ttl time.Duration) (string, time.Time, error) {
+	var resp struct {
+		Share struct {
+			URL     string    `json:"url"`
+			Expires time.Time `json:"expires"`
+		} `json:"share"`
+	}
+
+	qs := url.Values{}
+	if ttl > 0 {
+		qs.Set("expires_in", ttl.String())
+	}
+
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/v1/movies/%d/share", id), qs, nil, &resp)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return resp.Share.URL, resp.Share.Expires, nil
+}
+
+// GetSharedMovie fetches a movie through a signed link returned by ShareMovie.
+func (c *Client) GetSharedMovie(ctx context.Context, signedURL string) (*Movie, error) {
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Movie *Movie `json:"movie"`
+	}
+
+	err = c.do(ctx, http.MethodGet, u.Path, u.Query(), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Movie, nil
+}
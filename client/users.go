@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Health holds the response from the healthcheck endpoint.
+type Health struct {
+	Status     string            `json:"status"`
+	SystemInfo map[string]string `json:"system_info"`
+	Uptime     string            `json:"uptime"`
+	Timestamp  time.Time         `json:"timestamp"`
+}
+
+// Healthcheck returns the status of the API.
+func (c *Client) Healthcheck(ctx context.Context) (*Health, error) {
+	var health Health
+
+	err := c.do(ctx, http.MethodGet, "/v1/healthcheck", nil, nil, &health)
+	if err != nil {
+		return nil, err
+	}
+
+	return &health, nil
+}
+
+// RegisterUser creates a new, unactivated user account. An activation token is emailed to the user.
+func (c *Client) RegisterUser(ctx context.Context, name, email, password string) (*User, error) {
+	input := map[string]string{"name": name, "email": email, "password": password}
+
+	var resp struct {
+		User *User `json:"user"`
+	}
+
+	err := c.do(ctx, http.MethodPost, "/v1/users", nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.User, nil
+}
+
+// ActivateUser activates the account for the given activation token.
+func (c *Client) ActivateUser(ctx context.Context, token string) (*User, error) {
+	input := map[string]string{"token": token}
+
+	var resp struct {
+		User *User `json:"user"`
+	}
+
+	err := c.do(ctx, http.MethodPut, "/v1/users/activated", nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.User, nil
+}
+
+// ResendActivation emails a new activation token to an unactivated account.
+func (c *Client) ResendActivation(ctx context.Context, email string) error {
+	input := map[string]string{"email": email}
+
+	return c.do(ctx, http.MethodPost, "/v1/tokens/activation", nil, input, nil)
+}
+
+// GetCurrentUser returns the account details of the authenticated user.
+func (c *Client) GetCurrentUser(ctx context.Context) (*User, error) {
+	var resp struct {
+		User *User `json:"user"`
+	}
+
+	err := c.do(ctx, http.MethodGet, "/v1/users/me", nil, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.User, nil
+}
+
+// UpdateCurrentUserInput holds the account details to change. Nil fields are left untouched.
+type UpdateCurrentUserInput struct {
+	Name  *string `json:"name,omitempty"`
+	Email *string `json:"email,omitempty"`
+}
+
+// UpdateCurrentUser changes the authenticated user's name or email address. A new email address only takes
+// effect once it's confirmed with ConfirmEmailChange and the token emailed to it.
+func (c *Client) UpdateCurrentUser(ctx context.Context, input UpdateCurrentUserInput) (*User, error) {
+	var resp struct {
+		User *User `json:"user"`
+	}
+
+	err := c.do(ctx, http.MethodPatch, "/v1/users/me", nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.User, nil
+}
+
+// ConfirmEmailChange replaces the user's email address with the new one the given token was emailed to.
+func (c *Client) ConfirmEmailChange(ctx context.Context, token string) (*User, error) {
+	input := map[string]string{"token": token}
+
+	var resp struct {
+		User *User `json:"user"`
+	}
+
+	err := c.do(ctx, http.MethodPut, "/v1/users/email", nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.User, nil
+}
+
+// Authenticate logs in with an email address and password, and uses the returned authentication token for
+// all further requests made by the client. The deviceName is optional.
+func (c *Client) Authenticate(ctx context.Context, email, password, deviceName string) (*Token, error) {
+	input := map[string]string{"email": email, "password": password}
+	if deviceName != "" {
+		input["device_name"] = deviceName
+	}
+
+	var resp struct {
+		Token *Token `json:"authentication_token"`
+	}
+
+	err := c.do(ctx, http.MethodPost, "/v1/tokens/authentication", nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetToken(resp.Token.Plaintext)
+
+	return resp.Token, nil
+}
+
+// CreatePersonalAccessTokenInput holds the settings for a new personal access token.
+type CreatePersonalAccessTokenInput struct {
+	Name        string     `json:"name"`
+	Expiry      *time.Time `json:"expiry,omitempty"` // Nil for a token which never expires.
+	Permissions []string   `json:"permissions"`
+}
+
+// CreatePersonalAccessToken creates a long-lived token for scripts. The plaintext token is only returned here.
+// This must be called with a session token from Authenticate, not another personal access token.
+func (c *Client) CreatePersonalAccessToken(ctx context.Context, input CreatePersonalAccessTokenInput) (*PersonalAccessToken, error) {
+	var resp struct {
+		Token *PersonalAccessToken `json:"personal_access_token"`
+	}
+
+	err := c.do(ctx, http.MethodPost, "/v1/users/me/pat", nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Token, nil
+}
+
+// ListPersonalAccessTokens returns the current user's personal access tokens, without their plaintext values.
+func (c *Client) ListPersonalAccessTokens(ctx context.Context) ([]*PersonalAccessToken, error) {
+	var resp struct {
+		Tokens []*PersonalAccessToken `json:"personal_access_tokens"`
+	}
+
+	err := c.do(ctx, http.MethodGet, "/v1/users/me/pat", nil, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Tokens, nil
+}
+
+// DeletePersonalAccessToken revokes one of the current user's personal access tokens.
+func (c *Client) DeletePersonalAccessToken(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/v1/users/me/pat/%d", id), nil, nil, nil)
+}
+
+// CreateAPIKeyInput holds the settings for a new API key.
+type CreateAPIKeyInput struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// CreateAPIKey creates a long-lived key for a server integration. The plaintext key is only returned here. This
+// must be called with a session token from Authenticate.
+func (c *Client) CreateAPIKey(ctx context.Context, input CreateAPIKeyInput) (*APIKey, error) {
+	var resp struct {
+		Key *APIKey `json:"api_key"`
+	}
+
+	err := c.do(ctx, http.MethodPost, "/v1/users/me/api-keys", nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Key, nil
+}
+
+// ListAPIKeys returns the current user's API keys, without their plaintext values.
+func (c *Client) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	var resp struct {
+		Keys []*APIKey `json:"api_keys"`
+	}
+
+	err := c.do(ctx, http.MethodGet, "/v1/users/me/api-keys", nil, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Keys, nil
+}
+
+// DeleteAPIKey revokes one of the current user's API keys.
+func (c *Client) DeleteAPIKey(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/v1/users/me/api-keys/%d", id), nil, nil, nil)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// listUsersHandler() returns a page of users for an administrator, with their permissions. They can be filtered
+// by part of their name or email address (q), whether they are activated, and a permission they hold.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filter := data.AdminUserFilter{
+		Search:     strings.TrimSpace(app.readString(qs, "q", "")),
+		Permission: app.readString(qs, "permission", ""),
+	}
+
+	if qs.Has("activated") {
+		activated := app.readBool(qs, "activated", false, v)
+		filter.Activated = &activated
+	}
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafeList: []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"},
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.AdminUsers.GetAll(r.Context(), filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"users": users, "metadata": metadata}, app.paginationHeaders(r, metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUserHandler() returns the user with the ID in the URL for an administrator, with their permissions.
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.AdminUsers.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserHandler() lets an administrator activate or deactivate the user with the ID in the URL, and grant or
+// revoke their permissions. Administrators can't deactivate themselves or revoke their own users:admin
+// permission, so that they can't lock every administrator out by mistake.
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Activated *bool    `json:"activated"`
+		Grant     []string `json:"grant"`
+		Revoke    []string `json:"revoke"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	codes, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	self := app.contextGetUser(r).ID == user.ID
+
+	v := validator.New()
+
+	for key, list := range map[string][]string{"grant": input.Grant, "revoke": input.Revoke} {
+		v.Check(validator.Unique(list), key, "must not contain duplicate values")
+
+		for _, code := range list {
+			v.Check(codes.Include(code), key, "must only contain existing permissions")
+		}
+	}
+
+	for _, code := range input.Grant {
+		v.Check(!data.Permissions(input.Revoke).Include(code), "revoke", "must not contain permissions being granted")
+	}
+
+	if self {
+		v.Check(input.Activated == nil || *input.Activated, "activated", "you can't deactivate your own account")
+		v.Check(!data.Permissions(input.Revoke).Include("users:admin"), "revoke", "you can't revoke your own users:admin permission")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.Activated != nil && *input.Activated != user.Activated {
+		before := *user
+		user.Activated = *input.Activated
+
+		err = app.models.Users.Update(r.Context(), user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.audit(r, data.AuditEntityUser, user.ID, data.AuditUpdate, &before, user)
+	}
+
+	// Keep the permissions as they were, for the audit log.
+	var permissionsBefore data.Permissions
+
+	if len(input.Grant) > 0 || len(input.Revoke) > 0 {
+		permissionsBefore, err = app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if len(input.Grant) > 0 {
+		err = app.models.Permissions.AddForUser(r.Context(), user.ID, input.Grant...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if len(input.Revoke) > 0 {
+		err = app.models.Permissions.RemoveForUser(r.Context(), user.ID, input.Revoke...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.logger.PrintInfo("updated user", map[string]string{
+		"user_id":      strconv.FormatInt(user.ID, 10),
+		"requested_by": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+		"activated":    strconv.FormatBool(user.Activated),
+		"granted":      strings.Join(input.Grant, ","),
+		"revoked":      strings.Join(input.Revoke, ","),
+	})
+
+	updated, err := app.models.AdminUsers.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if len(input.Grant) > 0 || len(input.Revoke) > 0 {
+		app.audit(r, data.AuditEntityUserPermissions, user.ID, data.AuditUpdate, auditPermissions(permissionsBefore), auditPermissions(updated.Permissions))
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": updated}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteUserHandler() deletes the account of the user with the ID in the URL, and everything belonging to it.
+// Administrators can't delete their own account this way.
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	requestedBy := app.contextGetUser(r).ID
+
+	if id == requestedBy {
+		v := validator.New()
+		v.AddError("id", "you can't delete your own account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Fetch the user first, to record what was deleted in the audit log.
+	user, err := app.models.AdminUsers.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.AdminUsers.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditEntityUser, id, data.AuditDelete, user, nil)
+
+	app.logger.PrintInfo("deleted user", map[string]string{
+		"user_id":      strconv.FormatInt(id, 10),
+		"requested_by": strconv.FormatInt(requestedBy, 10),
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
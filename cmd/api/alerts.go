@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/micypac/flick-info/internal/httpclient"
+)
+
+// alertClient is used to deliver alerts to the webhook. Its timeouts and circuit breaker mean a slow or broken
+// receiver can't hold up a graceful shutdown for long, or pile up goroutines while alerts keep firing.
+var alertClient = httpclient.New(httpclient.DefaultConfig())
+
+// alert() raises an alert for something which needs an operator's attention. The alert is always logged at the
+// ERROR level and, if an alert webhook URL is configured, POSTed to it as JSON in the background.
+func (app *application) alert(message string, properties map[string]string) {
+	props := map[string]string{"alert": "true"}
+	for k, v := range properties {
+		props[k] = v
+	}
+
+	app.logger.PrintError(errors.New(message), props)
+
+	if app.config.alerts.webhookURL == "" {
+		return
+	}
+
+	app.background("send_alert_webhook", func() {
+		body, err := json.Marshal(map[string]interface{}{
+			"alert":       message,
+			"properties":  properties,
+			"environment": app.config.env,
+			"time":        app.clock.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		req, err := http.NewRequest(http.MethodPost, app.config.alerts.webhookURL, bytes.NewReader(body))
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := alertClient.Do(req)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"alert_webhook": "request failed"})
+			return
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode >= 300 {
+			app.logger.PrintError(fmt.Errorf("alert webhook responded with %s", res.Status), nil)
+		}
+	})
+}
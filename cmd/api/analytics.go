@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// The time ranges which can be requested from the analytics endpoint, in days, keyed by the value of the range
+// query string parameter.
+var analyticsRanges = map[string]int{
+	"1d":  1,
+	"7d":  7,
+	"30d": 30,
+	"90d": 90,
+}
+
+// analyticsRecorder counts requests by route and views of each movie in memory, per day. The counts are added
+// to the analytics tables, and reset, each time they are flushed, so that recording a request doesn't need a
+// database write.
+type analyticsRecorder struct {
+	mu       sync.Mutex
+	requests map[data.RequestCountKey]int64
+	views    map[data.MovieViewKey]int64
+}
+
+func newAnalyticsRecorder() *analyticsRecorder {
+	return &analyticsRecorder{
+		requests: make(map[data.RequestCountKey]int64),
+		views:    make(map[data.MovieViewKey]int64),
+	}
+}
+
+func (a *analyticsRecorder) recordRequest(now time.Time, method, route string) {
+	key := data.RequestCountKey{Day: now.UTC().Format(data.AnalyticsDayLayout), Method: method, Route: route}
+
+	a.mu.Lock()
+	a.requests[key]++
+	a.mu.Unlock()
+}
+
+func (a *analyticsRecorder) recordMovieView(now time.Time, movieID int64) {
+	key := data.MovieViewKey{Day: now.UTC().Format(data.AnalyticsDayLayout), MovieID: movieID}
+
+	a.mu.Lock()
+	a.views[key]++
+	a.mu.Unlock()
+}
+
+// take() returns the counts recorded since the last call, and starts new ones.
+func (a *analyticsRecorder) take() (map[data.RequestCountKey]int64, map[data.MovieViewKey]int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	requests, views := a.requests, a.views
+	a.requests = make(map[data.RequestCountKey]int64)
+	a.views = make(map[data.MovieViewKey]int64)
+
+	return requests, views
+}
+
+// restore() adds counts which couldn't be saved back onto the current counts, so that they are saved with the
+// next flush instead.
+func (a *analyticsRecorder) restore(requests map[data.RequestCountKey]int64, views map[data.MovieViewKey]int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, n := range requests {
+		a.requests[key] += n
+	}
+
+	for key, n := range views {
+		a.views[key] += n
+	}
+}
+
+// flushAnalytics() saves the recorded counts to the analytics tables. If saving fails, the counts are kept to be
+// saved with the next flush. Counts recorded since the last flush are lost if the server stops.
+func (app *application) flushAnalytics(ctx context.Context) error {
+	requests, views := app.analytics.take()
+
+	err := app.models.Analytics.AddRequestCounts(ctx, requests)
+	if err != nil {
+		app.analytics.restore(requests, views)
+		return err
+	}
+
+	err = app.models.Analytics.AddMovieViews(ctx, views)
+	if err != nil {
+		app.analytics.restore(nil, views)
+		return err
+	}
+
+	return nil
+}
+
+// analyticsCache holds the most recent report for each time range, so that an admin dashboard polling the
+// endpoint doesn't run the aggregate queries on every request.
+type analyticsCache struct {
+	mu      sync.Mutex
+	reports map[string]*data.AnalyticsReport
+}
+
+func (c *analyticsCache) get(key string, now time.Time, ttl time.Duration) *data.AnalyticsReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report, ok := c.reports[key]
+	if !ok || now.Sub(report.GeneratedAt) >= ttl {
+		return nil
+	}
+
+	return report
+}
+
+// set() caches the report, and drops any reports generated more than ttl before it, such as those for
+// previous days.
+func (c *analyticsCache) set(key string, report *data.AnalyticsReport, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reports == nil {
+		c.reports = make(map[string]*data.AnalyticsReport)
+	}
+
+	for k, cached := range c.reports {
+		if report.GeneratedAt.Sub(cached.GeneratedAt) >= ttl {
+			delete(c.reports, k)
+		}
+	}
+
+	c.reports[key] = report
+}
+
+// showAnalyticsHandler() returns signups per day, active users, ratings, request volume by endpoint and the most
+// viewed movies over the time range in the range query string parameter, ending today (UTC). Reports are cached
+// for the configured time, and generated_at in the response says when the report was made.
+func (app *application) showAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	key := app.readString(r.URL.Query(), "range", "7d")
+
+	days, ok := analyticsRanges[key]
+	if !ok {
+		v.AddError("range", "must be one of 1d, 7d, 30d or 90d")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	now := app.clock.Now().UTC()
+	to := now.Format(data.AnalyticsDayLayout)
+
+	// Cache each range per day, so that a report is never served for the wrong period after midnight.
+	cacheKey := key + " " + to
+
+	report := app.analyticsCache.get(cacheKey, now, app.config.analytics.cacheTTL)
+
+	if report == nil {
+		from := now.AddDate(0, 0, 1-days).Format(data.AnalyticsDayLayout)
+
+		var err error
+
+		report, err = app.models.Analytics.Report(r.Context(), from, to)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		report.GeneratedAt = now
+		app.analyticsCache.set(cacheKey, report, app.config.analytics.cacheTTL)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(app.config.analytics.cacheTTL.Seconds())))
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"analytics": report}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
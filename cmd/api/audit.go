@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// audit() records the change from before to after, either of which may be nil for a create or delete, in the
+// audit log. See recordAudit().
+func (app *application) audit(r *http.Request, entity string, entityID int64, action string, before, after interface{}) {
+	changes, err := data.AuditDiff(before, after)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	app.recordAudit(r, &data.AuditEntry{Entity: entity, EntityID: entityID, Action: action, Changes: changes})
+}
+
+// recordAudit() adds the entry to the audit log, attributed to the authenticated user, if there is one, and the
+// request. The change has already been made by the time it is recorded, so a failure to record it is logged
+// rather than failing the request.
+func (app *application) recordAudit(r *http.Request, entry *data.AuditEntry) {
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		entry.UserID = &user.ID
+	}
+
+	entry.RequestID = app.contextGetRequestID(r)
+
+	err := app.models.Audit.Insert(r.Context(), entry)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// listAuditLogHandler() returns a page of the audit log, newest first by default. It can be filtered by entity,
+// entity_id, user_id and action.
+func (app *application) listAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filter := data.AuditFilter{
+		Entity:   app.readString(qs, "entity", ""),
+		EntityID: int64(app.readInt(qs, "entity_id", 0, v)),
+		UserID:   int64(app.readInt(qs, "user_id", 0, v)),
+		Action:   app.readString(qs, "action", ""),
+	}
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "-id"),
+		SortSafeList: []string{"id", "created_at", "-id", "-created_at"},
+	}
+
+	data.ValidateAuditFilter(v, filter)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, metadata, err := app.models.Audit.GetAll(r.Context(), filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"audit_log": entries, "metadata": metadata}, app.paginationHeaders(r, metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// auditPermissions() returns the user's permissions in the form recorded in the audit log, sorted so that the
+// order they were read in doesn't show up as a change.
+func auditPermissions(permissions data.Permissions) map[string]interface{} {
+	sorted := append(data.Permissions{}, permissions...)
+	sort.Strings(sorted)
+
+	return map[string]interface{}{"permissions": sorted}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+)
+
+// Headers which are never recorded, as they carry credentials.
+var capturedHeaderDenyList = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// Keys of JSON bodies whose values are always redacted, as they hold credentials without "password" or "token" in
+// their names, such as the plaintext of a new API key.
+var capturedSecretKeys = []string{"key", "api_key"}
+
+// Bodies up to this size are held in full while a request is in flight, so that JSON can be parsed and have
+// its secrets redacted before being truncated to the configured length.
+const captureParseLimit = 64 * 1024
+
+// capturedHeader is a single header value.
+type capturedHeader struct {
+	Name  string `json:"name" xml:"name,attr"`
+	Value string `json:"value" xml:",chardata"`
+}
+
+// capturedExchange is a recorded request and the response which was sent to it.
+type capturedExchange struct {
+	XMLName         xml.Name         `json:"-" xml:"exchange"`
+	Time            time.Time        `json:"time" xml:"time"`
+	Duration        string           `json:"duration" xml:"duration"`
+	Method          string           `json:"method" xml:"method"`
+	URL             string           `json:"url" xml:"url"`
+	RequestHeaders  []capturedHeader `json:"request_headers" xml:"request_headers>header"`
+	RequestBody     string           `json:"request_body" xml:"request_body"`
+	Status          int              `json:"status" xml:"status"`
+	ResponseHeaders []capturedHeader `json:"response_headers" xml:"response_headers>header"`
+	ResponseBody    string           `json:"response_body" xml:"response_body"`
+}
+
+// captureBuffer is a fixed-size ring buffer of the most recent exchanges. Once it is full, each new exchange
+// replaces the oldest.
+type captureBuffer struct {
+	mu        sync.Mutex
+	exchanges []capturedExchange
+	next      int
+	full      bool
+}
+
+func newCaptureBuffer(size int) *captureBuffer {
+	return &captureBuffer{exchanges: make([]capturedExchange, size)}
+}
+
+func (b *captureBuffer) add(exchange capturedExchange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.exchanges[b.next] = exchange
+	b.next = (b.next + 1) % len(b.exchanges)
+
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// recent() returns the recorded exchanges, newest first.
+func (b *captureBuffer) recent() []capturedExchange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.next
+	if b.full {
+		n = len(b.exchanges)
+	}
+
+	exchanges := make([]capturedExchange, 0, n)
+	for i := 1; i <= n; i++ {
+		exchanges = append(exchanges, b.exchanges[(b.next-i+len(b.exchanges))%len(b.exchanges)])
+	}
+
+	return exchanges
+}
+
+// limitedBuffer keeps the first limit bytes written to it, and counts the rest.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	total int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	lb.total += len(p)
+
+	if room := lb.limit - lb.buf.Len(); room > 0 {
+		if len(p) > room {
+			lb.buf.Write(p[:room])
+		} else {
+			lb.buf.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
+
+// captureRequests() records each request and its response in the capture buffer, for the debug endpoint. The
+// credential headers are left out, secrets in JSON bodies are redacted, bodies in other formats are left out, and
+// bodies are truncated. Requests for the debug endpoint itself aren't recorded. This runs before authenticate(),
+// so that requests rejected for a bad token are recorded too.
+func (app *application) captureRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/admin/debug/requests" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+
+		reqBody := &limitedBuffer{limit: captureParseLimit}
+		if r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+
+		respBody := &limitedBuffer{limit: captureParseLimit}
+		status := http.StatusOK
+		headerWritten := false
+
+		ww := httpsnoop.Wrap(w, httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					if !headerWritten {
+						status = code
+						headerWritten = true
+					}
+					next(code)
+				}
+			},
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(p []byte) (int, error) {
+					headerWritten = true
+					respBody.Write(p)
+					return next(p)
+				}
+			},
+		})
+
+		// Record the exchange even if the handler panics, before the panic carries on up to recoverPanic().
+		defer func() {
+			exchange := capturedExchange{
+				Time:            start,
+				Duration:        time.Since(start).String(),
+				Method:          r.Method,
+				URL:             r.URL.String(),
+				RequestHeaders:  capturedHeaders(r.Header),
+				RequestBody:     app.capturedBody(r.Header, reqBody),
+				Status:          status,
+				ResponseHeaders: capturedHeaders(w.Header()),
+				ResponseBody:    app.capturedBody(w.Header(), respBody),
+			}
+
+			app.captures.add(exchange)
+		}()
+
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// capturedHeaders() flattens the headers into a sorted list, leaving out those carrying credentials.
+func capturedHeaders(header http.Header) []capturedHeader {
+	headers := []capturedHeader{}
+
+	for name, values := range header {
+		denied := false
+		for _, d := range capturedHeaderDenyList {
+			if strings.EqualFold(name, d) {
+				denied = true
+				break
+			}
+		}
+		if denied {
+			continue
+		}
+
+		for _, value := range values {
+			headers = append(headers, capturedHeader{Name: name, Value: value})
+		}
+	}
+
+	sort.SliceStable(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+
+	return headers
+}
+
+// capturedBody() returns the body to record. JSON bodies have the values of any keys which look like they hold
+// a password or token redacted. Request bodies are read as JSON whatever their Content-Type says, so one without
+// a Content-Type is treated as JSON too. Any other body, such as an XML, MessagePack or protobuf response, is left
+// out altogether, as is a JSON body too large to parse, since it can't be redacted. The result is truncated to
+// the configured length.
+func (app *application) capturedBody(header http.Header, lb *limitedBuffer) string {
+	body := lb.buf.Bytes()
+
+	if lb.total == 0 {
+		return ""
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType != "" && !strings.HasPrefix(contentType, mediaTypeJSON) {
+		return fmt.Sprintf("[%d bytes of %s omitted]", lb.total, contentType)
+	}
+
+	if lb.total > lb.buf.Len() {
+		return fmt.Sprintf("[%d bytes of JSON omitted]", lb.total)
+	}
+
+	redacted, ok := redactJSON(body)
+	if !ok {
+		return fmt.Sprintf("[%d bytes of invalid JSON omitted]", lb.total)
+	}
+	body = redacted
+
+	if limit := app.config.capture.bodyBytes; len(body) > limit {
+		// Drop any multi-byte character cut in half at the limit.
+		return fmt.Sprintf("%s... [truncated, %d bytes total]", strings.ToValidUTF8(string(body[:limit]), ""), lb.total)
+	}
+
+	return string(body)
+}
+
+// redactJSON() replaces the value of every object key containing "password" or "token" (including nested ones
+// such as "authentication_token"), or in capturedSecretKeys, with "[REDACTED]". It reports false if the body isn't
+// valid JSON.
+func redactJSON(body []byte) ([]byte, bool) {
+	if len(body) == 0 {
+		return body, true
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+
+	var redact func(v interface{})
+	redact = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				lower := strings.ToLower(key)
+				if strings.Contains(lower, "password") || strings.Contains(lower, "token") || isCapturedSecretKey(lower) {
+					v[key] = "[REDACTED]"
+					continue
+				}
+				redact(value)
+			}
+		case []interface{}:
+			for _, value := range v {
+				redact(value)
+			}
+		}
+	}
+
+	redact(v)
+
+	redacted, err := json.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+
+	return redacted, true
+}
+
+// isCapturedSecretKey() reports whether the lowercased JSON key is in capturedSecretKeys.
+func isCapturedSecretKey(key string) bool {
+	for _, secret := range capturedSecretKeys {
+		if key == secret {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listCapturedRequestsHandler() returns the recently captured requests and responses, newest first.
+func (app *application) listCapturedRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"requests": app.captures.recent()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
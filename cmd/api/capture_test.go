@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/micypac/flick-info/internal/data"
+)
+
+func TestCapturedBody(t *testing.T) {
+	var app application
+	app.config.capture.bodyBytes = 2048
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"empty", mediaTypeJSON, "", ""},
+		{"JSON", mediaTypeJSON, `{"email":"a@example.com","password":"pa55word1234"}`, `{"email":"a@example.com","password":"[REDACTED]"}`},
+		{"JSON without a content type", "", `{"token":"ABCDEFGHIJKLMNOPQRSTUVWXYZ"}`, `{"token":"[REDACTED]"}`},
+		{"invalid JSON", mediaTypeJSON, `password=pa55word1234`, "[21 bytes of invalid JSON omitted]"},
+		{"XML", "application/xml; charset=utf-8", `<password>pa55word1234</password>`, "[33 bytes of application/xml; charset=utf-8 omitted]"},
+		{"protobuf", mediaTypeProtobuf, "\x0a\x0cpa55word1234", "[14 bytes of application/x-protobuf omitted]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+
+			lb := &limitedBuffer{limit: captureParseLimit}
+			lb.Write([]byte(tt.body))
+
+			got := app.capturedBody(header, lb)
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+			if strings.Contains(got, "pa55word1234") {
+				t.Errorf("captured body %q contains the password", got)
+			}
+		})
+	}
+}
+
+func TestCaptureRedactsNewAPIKey(t *testing.T) {
+	app := newMemoryTestApplication(t)
+	app.config.capture.bodyBytes = 2048
+	app.captures = newCaptureBuffer(10)
+
+	_, token := insertTestUser(t, app, "capture")
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/users/me/api-keys", strings.NewReader(`{"name":"ci","permissions":["movies:read"]}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+
+	var resp struct {
+		APIKey struct {
+			Key string `json:"key"`
+		} `json:"api_key"`
+	}
+
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.APIKey.Key, data.APIKeyPrefix) {
+		t.Fatalf("response %s has no API key", rr.Body)
+	}
+
+	exchanges := app.captures.recent()
+	if len(exchanges) != 1 {
+		t.Fatalf("got %d captured exchanges; want 1", len(exchanges))
+	}
+
+	captured, err := json.Marshal(exchanges[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(captured), resp.APIKey.Key) {
+		t.Errorf("captured exchange contains the plaintext API key: %s", captured)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Kinds of fault which can be injected.
+const (
+	faultLatency = "latency"
+	faultError   = "error"
+	faultDrop    = "drop"
+)
+
+// chaosRule injects a fault into a percentage of the requests for a route. The route is a method and a route
+// pattern, as registered with the router, or "*" for every request.
+type chaosRule struct {
+	route   string
+	fault   string
+	latency time.Duration
+	status  int
+	percent float64
+}
+
+// parseChaosRule() parses a rule in the form "<route> <fault> <percent>%", for example:
+//
+//	GET /v1/movies/:id latency=500ms 25%
+//	POST /v1/movies error=503 10%
+//	* drop 1%
+func parseChaosRule(s string) (chaosRule, error) {
+	fields := strings.Fields(s)
+
+	var rule chaosRule
+
+	switch {
+	case len(fields) == 3 && fields[0] == "*":
+		rule.route = "*"
+	case len(fields) == 4:
+		rule.route = strings.ToUpper(fields[0]) + " " + fields[1]
+	default:
+		return rule, fmt.Errorf("chaos rule %q must be in the form \"<method> <route> <fault> <percent>%%\" or \"* <fault> <percent>%%\"", s)
+	}
+
+	fault, percent := fields[len(fields)-2], fields[len(fields)-1]
+
+	kind, arg, _ := strings.Cut(fault, "=")
+	switch kind {
+	case faultLatency:
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 {
+			return rule, fmt.Errorf("chaos rule %q: latency must be a positive duration, such as latency=500ms", s)
+		}
+		rule.latency = d
+	case faultError:
+		status, err := strconv.Atoi(arg)
+		if err != nil || status < 500 || status > 599 {
+			return rule, fmt.Errorf("chaos rule %q: error must be a 5xx status code, such as error=503", s)
+		}
+		rule.status = status
+	case faultDrop:
+		if arg != "" {
+			return rule, fmt.Errorf("chaos rule %q: drop doesn't take a value", s)
+		}
+	default:
+		return rule, fmt.Errorf("chaos rule %q: fault must be latency=<duration>, error=<status> or drop", s)
+	}
+	rule.fault = kind
+
+	p, err := strconv.ParseFloat(strings.TrimSuffix(percent, "%"), 64)
+	if err != nil || !strings.HasSuffix(percent, "%") || p <= 0 || p > 100 {
+		return rule, fmt.Errorf("chaos rule %q: percent must be between 0 and 100, such as 10%%", s)
+	}
+	rule.percent = p
+
+	return rule, nil
+}
+
+// injectFaults() applies the configured chaos rules to each request. Latency is added before the request is
+// handled, and every matching latency rule which fires adds to the delay. An error or dropped connection
+// replaces the response, and the first such rule to fire wins. Each fault is counted in the faults_injected
+// expvar map, keyed by the fault kind.
+func (app *application) injectFaults(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method + " " + routePattern(router, r)
+
+		for _, rule := range app.config.chaos.rules {
+			if (rule.route != "*" && rule.route != route) || rand.Float64()*100 >= rule.percent {
+				continue
+			}
+
+			app.faultsInjected.Add(rule.fault, 1)
+
+			switch rule.fault {
+			case faultLatency:
+				select {
+				case <-time.After(rule.latency):
+				case <-r.Context().Done():
+					return
+				}
+
+			case faultError:
+				w.Header().Set("Connection", "close")
+				app.errorResponse(w, r, rule.status, "injected fault")
+				return
+
+			case faultDrop:
+				// Close the connection without writing a response, as if the server had crashed. If the
+				// connection can't be hijacked (e.g. HTTP/2), abort the handler, which resets the stream.
+				hj, ok := w.(http.Hijacker)
+				if !ok {
+					panic(http.ErrAbortHandler)
+				}
+
+				conn, _, err := hj.Hijack()
+				if err != nil {
+					panic(http.ErrAbortHandler)
+				}
+
+				conn.Close()
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
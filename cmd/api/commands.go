@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/micypac/flick-info/internal/dbmigrate"
+	"github.com/micypac/flick-info/migrations"
+)
+
+// runCommand() runs the subcommand named by the first command-line argument, if there is one, and returns the
+// exit code. It reports false if the argument isn't a subcommand, in which case the server is started as usual.
+//
+// The subcommands let a container image use the binary itself for its probes, without shipping curl:
+//
+//	api version
+//	api healthcheck --addr=localhost:4000
+//	api migrate up
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	switch args[0] {
+	case "version":
+		printVersion(os.Stdout)
+		return 0, true
+	case "healthcheck":
+		return runHealthcheck(args[1:], os.Stderr), true
+	case "migrate":
+		return runMigrate(args[1:], os.Stdout, os.Stderr), true
+	default:
+		return 0, false
+	}
+}
+
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "Version:\t%s\n", version)
+	fmt.Fprintf(w, "Build time:\t%s\n", buildTime)
+}
+
+// runHealthcheck() probes the healthcheck endpoint of a running server, returning 0 if it responds with 200 OK
+// and 1 otherwise. With --deep, the deep healthcheck is used, so that an unreachable database also fails the
+// probe.
+func runHealthcheck(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	addr := fs.String("addr", "localhost:4000", "Address of the API server to probe, as host:port or a URL")
+	timeout := fs.Duration("timeout", 5*time.Second, "Maximum time to wait for a response")
+	deep := fs.Bool("deep", false, "Probe the deep healthcheck, which also checks the database")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	target := *addr
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+
+	target = strings.TrimSuffix(target, "/") + "/v1/healthcheck"
+	if *deep {
+		target += "/deep"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "healthcheck: %v\n", err)
+		return 1
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "healthcheck: %v\n", err)
+		return 1
+	}
+	defer res.Body.Close()
+
+	// Drain the body so the probe doesn't leave the server writing to a closed connection.
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintf(stderr, "healthcheck: %s returned %s\n", target, res.Status)
+		return 1
+	}
+
+	return 0
+}
+
+// runMigrate() runs the migrations embedded in the binary against the database, so that a deployment can migrate
+// it without installing the migrate CLI. The commands are:
+//
+//	api migrate up               apply every pending migration
+//	api migrate down [N]         roll back the newest N migrations (1 by default)
+//	api migrate version          print the database's schema version
+//	api migrate force VERSION    set the version after fixing a failed migration by hand (-1 for none)
+//
+// The database is given with --db-dsn, or the FLICKINFO_DB_DSN environment variable like the server's -db-dsn.
+// It returns 0 on success, 1 if the command failed and 2 for invalid arguments.
+func runMigrate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: api migrate [--db-dsn=DSN] up | down [N] | version | force VERSION")
+		fs.PrintDefaults()
+	}
+
+	dsn := fs.String("db-dsn", os.Getenv(configEnvName("db-dsn")), "PostgreSQL DSN (defaults to $"+configEnvName("db-dsn")+")")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	command, operands := fs.Arg(0), fs.Args()
+	if len(operands) > 0 {
+		operands = operands[1:]
+	}
+
+	// Check the arguments before connecting to the database.
+	var number int64
+
+	switch {
+	case command == "up" && len(operands) == 0, command == "version" && len(operands) == 0:
+	case command == "down" && len(operands) == 0:
+		number = 1
+	case command == "down" && len(operands) == 1:
+		number, err = strconv.ParseInt(operands[0], 10, 0)
+		if err != nil || number < 1 {
+			fmt.Fprintln(stderr, "migrate: the number of migrations to roll back must be a positive integer")
+			return 2
+		}
+	case command == "force" && len(operands) == 1:
+		number, err = strconv.ParseInt(operands[0], 10, 64)
+		if err != nil || number < -1 {
+			fmt.Fprintln(stderr, "migrate: the version must be an integer, or -1 for none")
+			return 2
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	if *dsn == "" {
+		fmt.Fprintln(stderr, "migrate: no database DSN given with --db-dsn or $"+configEnvName("db-dsn"))
+		return 2
+	}
+
+	db, err := sql.Open("postgres", *dsn)
+	if err != nil {
+		fmt.Fprintf(stderr, "migrate: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	var ran []dbmigrate.Migration
+
+	switch command {
+	case "up":
+		ran, err = dbmigrate.Up(db, migrations.FS)
+	case "down":
+		ran, err = dbmigrate.Down(db, migrations.FS, int(number))
+	case "force":
+		err = dbmigrate.Force(db, number)
+	}
+
+	// List the migrations which ran, even if a later one failed, as they've been committed.
+	for _, m := range ran {
+		fmt.Fprintf(stdout, "ran %s\n", m.Name)
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "migrate: %v\n", err)
+		return 1
+	}
+
+	version, dirty, err := dbmigrate.Version(db)
+	if err != nil {
+		fmt.Fprintf(stderr, "migrate: %v\n", err)
+		return 1
+	}
+
+	switch {
+	case version == -1:
+		fmt.Fprintln(stdout, "version: none")
+	case dirty:
+		fmt.Fprintf(stdout, "version: %d (dirty)\n", version)
+	default:
+		fmt.Fprintf(stdout, "version: %d\n", version)
+	}
+
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// representationETag() returns the strong entity tag for an encoded response body, made from a hash of the body
+// and its content type. Any change to what the client would receive changes the tag, including values such as
+// a movie's average rating or cast which are stored outside the movie, and the fields and format requested.
+func representationETag(contentType string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(contentType))
+	h.Write([]byte{0})
+	h.Write(body)
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagListContains() reports whether the list of entity tags in an If-Match or If-None-Match header contains
+// the tag, or is "*". If-None-Match uses the weak comparison, which ignores a "W/" prefix on the listed tags,
+// and If-Match the strong comparison, which never matches them.
+func etagListContains(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified() reports whether the request's If-None-Match header matches the entity tag, in which case the
+// client's copy is up to date and a 304 Not Modified response has been sent.
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !etagListContains(header, etag, true) {
+		return false
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+
+	return true
+}
+
+// preconditionFailed() reports whether the request has an If-Match header which doesn't match the entity tag,
+// in which case the client's copy is out of date and a 412 Precondition Failed response has been sent.
+func (app *application) preconditionFailed(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" || etagListContains(header, etag, false) {
+		return false
+	}
+
+	app.preconditionFailedResponse(w, r)
+
+	return true
+}
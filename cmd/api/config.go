@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Every setting can be given as a flag, as an environment variable named after the flag with this prefix (for
+// example FLICKINFO_DB_DSN for -db-dsn), or in a config file. Flags take precedence over environment variables,
+// which take precedence over the config file.
+const configEnvPrefix = "FLICKINFO_"
+
+// Flags which only make sense on the command line.
+var commandLineOnlyFlags = []string{"config", "version", "bcrypt-benchmark"}
+
+// configKeyRX matches the setting names in a config file, which are the flag names.
+var configKeyRX = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// configEnvName() returns the name of the environment variable for the flag, such as FLICKINFO_DB_DSN for
+// db-dsn.
+func configEnvName(flagName string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyConfigSources() sets the flags which weren't given on the command line from the environment and then from
+// the config file at path, or the one named by the FLICKINFO_CONFIG environment variable if path is empty. It
+// must be called after fs has been parsed. Settings in the config file which don't match a flag are an error.
+func applyConfigSources(fs *flag.FlagSet, path string, lookupEnv func(string) (string, bool)) error {
+	if path == "" {
+		path, _ = lookupEnv(configEnvName("config"))
+	}
+
+	var file map[string][]string
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("config file: %w", err)
+		}
+		defer f.Close()
+
+		file, err = parseConfigFile(f)
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+
+		for key := range file {
+			if fs.Lookup(key) == nil || validator.In(key, commandLineOnlyFlags...) {
+				return fmt.Errorf("config file %s: unknown setting %q", path, key)
+			}
+		}
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || validator.In(f.Name, commandLineOnlyFlags...) {
+			return
+		}
+
+		if value, ok := lookupEnv(configEnvName(f.Name)); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, configEnvName(f.Name), setErr)
+			}
+			return
+		}
+
+		// Arrays in the config file set repeatable flags once for each value.
+		for _, value := range file[f.Name] {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("config file %s: invalid value %q for %s: %w", path, value, f.Name, setErr)
+				return
+			}
+		}
+	})
+
+	return err
+}
+
+// parseConfigFile() reads a config file in a subset of TOML: one "name = value" setting per line, where the name
+// is a flag name and the value is a string, number, boolean, or a single-line array of them. Comments start with
+// #. Tables, multi-line strings and multi-line arrays aren't supported. Each setting's values are returned as
+// they would be given on the command line.
+func parseConfigFile(r io.Reader) (map[string][]string, error) {
+	settings := make(map[string][]string)
+
+	scanner := bufio.NewScanner(r)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables are not supported", n)
+		}
+
+		key, rest, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !configKeyRX.MatchString(key) {
+			return nil, fmt.Errorf("line %d: expected name = value", n)
+		}
+
+		if _, exists := settings[key]; exists {
+			return nil, fmt.Errorf("line %d: %s is set more than once", n, key)
+		}
+
+		values, err := parseConfigValue(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		settings[key] = values
+	}
+
+	return settings, scanner.Err()
+}
+
+// parseConfigValue() parses a config file value, and any comment following it. An array returns each of its
+// elements, and anything else a single value.
+func parseConfigValue(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") {
+		value, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkConfigTrailer(rest); err != nil {
+			return nil, err
+		}
+
+		return []string{value}, nil
+	}
+
+	values := []string{}
+	s = strings.TrimSpace(s[1:])
+
+	for !strings.HasPrefix(s, "]") {
+		value, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+		s = strings.TrimSpace(rest)
+
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = strings.TrimSpace(s[1:])
+		case !strings.HasPrefix(s, "]"):
+			return nil, errors.New("expected , or ] in array")
+		}
+	}
+
+	return values, checkConfigTrailer(s[1:])
+}
+
+// parseConfigScalar() parses a string, number or boolean at the start of s, and returns it along with the rest
+// of s.
+func parseConfigScalar(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		// Find the closing quote, skipping escaped characters. TOML's escapes are a subset of Go's.
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				value, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", errors.New("invalid string")
+				}
+				return value, s[i+1:], nil
+			}
+		}
+		return "", "", errors.New("unterminated string")
+
+	case strings.HasPrefix(s, "'"):
+		value, rest, ok := strings.Cut(s[1:], "'")
+		if !ok {
+			return "", "", errors.New("unterminated string")
+		}
+		return value, rest, nil
+
+	default:
+		end := strings.IndexAny(s, ",]# \t")
+		if end == -1 {
+			end = len(s)
+		}
+
+		value := s[:end]
+		if value == "" {
+			return "", "", errors.New("missing value")
+		}
+
+		// Numbers can use underscores as digit separators.
+		if value[0] == '+' || value[0] == '-' || (value[0] >= '0' && value[0] <= '9') {
+			value = strings.ReplaceAll(value, "_", "")
+		}
+
+		return value, s[end:], nil
+	}
+}
+
+// checkConfigTrailer() checks that only whitespace or a comment follows a value.
+func checkConfigTrailer(s string) error {
+	s = strings.TrimSpace(s)
+	if s != "" && !strings.HasPrefix(s, "#") {
+		return fmt.Errorf("unexpected %q after value", s)
+	}
+
+	return nil
+}
@@ -14,8 +14,33 @@ type contextKey string
 // Use this constant as the key for getting and setting user info from request context.
 const userContextKey = contextKey("user")
 
+// Key for the personal access token used to authenticate the request, if any.
+const personalAccessTokenContextKey = contextKey("personalAccessToken")
+
+// Key for the API key used to authenticate the request, if any.
+const apiKeyContextKey = contextKey("apiKey")
+
+// Key for the plaintext of the authentication token used to authenticate the request, if any.
+const sessionTokenContextKey = contextKey("sessionToken")
+
+// Key for the request's entry in the access log.
+const requestLogContextKey = contextKey("requestLog")
+
+// requestLogEntry holds the details of a request for its access log entry. The entry is added to the context by
+// the logRequest() middleware, and details only known further down the middleware chain, such as the user, are
+// filled in as they are found.
+type requestLogEntry struct {
+	id     string
+	userID int64
+}
+
 // This method returns a new copy of the request with the provided User struct added to the context.
+// The user's ID is also recorded for the request's access log entry.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if entry, ok := r.Context().Value(requestLogContextKey).(*requestLogEntry); ok && !user.IsAnonymous() {
+		entry.userID = user.ID
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -29,3 +54,60 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// This method returns a new copy of the request with the personal access token used to authenticate it added to the context.
+func (app *application) contextSetPersonalAccessToken(r *http.Request, token *data.PersonalAccessToken) *http.Request {
+	ctx := context.WithValue(r.Context(), personalAccessTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPersonalAccessToken method retrieves the personal access token from the request context.
+// Unlike the user, this is optional, so nil is returned if the request wasn't authenticated with one.
+func (app *application) contextGetPersonalAccessToken(r *http.Request) *data.PersonalAccessToken {
+	token, _ := r.Context().Value(personalAccessTokenContextKey).(*data.PersonalAccessToken)
+	return token
+}
+
+// This method returns a new copy of the request with the API key used to authenticate it added to the context.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey method retrieves the API key from the request context, or nil if the request wasn't
+// authenticated with one.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// This method returns a new copy of the request with the plaintext of the authentication token used to
+// authenticate it added to the context, so that the token can be revoked.
+func (app *application) contextSetSessionToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetSessionToken method retrieves the plaintext of the authentication token from the request
+// context, or an empty string if the request wasn't authenticated with one.
+func (app *application) contextGetSessionToken(r *http.Request) string {
+	token, _ := r.Context().Value(sessionTokenContextKey).(string)
+	return token
+}
+
+// This method returns a new copy of the request with the access log entry added to the context.
+func (app *application) contextSetRequestLogEntry(r *http.Request, entry *requestLogEntry) *http.Request {
+	ctx := context.WithValue(r.Context(), requestLogContextKey, entry)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID method returns the ID assigned to the request by the logRequest() middleware, or an
+// empty string if it hasn't been through it.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	entry, ok := r.Context().Value(requestLogContextKey).(*requestLogEntry)
+	if !ok {
+		return ""
+	}
+
+	return entry.id
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/micypac/flick-info/internal/metrics"
+)
+
+// debugRoutes() returns the handler of the debug server, which exposes the internals of the process for
+// operators: the expvar metrics, in JSON and the Prometheus format, the pprof profiles, and the verbose
+// healthcheck. None of them require authentication, so the debug server should only listen on an address which
+// isn't reachable from outside, such as the default localhost:4001.
+func (app *application) debugRoutes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthcheck", app.verboseHealthcheckHandler)
+
+	// Register the pprof handlers on this mux, rather than the http.DefaultServeMux which importing
+	// net/http/pprof registers them on, as that isn't served.
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+
+	return app.recoverPanic(mux)
+}
+
+// listenDebug() starts the debug server on the configured address, returning the server so that it can be shut
+// down with the API server, or nil if it isn't enabled. The address is bound before returning, so that a port
+// which is already in use stops the API from starting.
+func (app *application) listenDebug() (*http.Server, error) {
+	if app.config.debug.addr == "" {
+		return nil, nil
+	}
+
+	ln, err := net.Listen("tcp", app.config.debug.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// There's no write timeout, as CPU profiles and execution traces take as long as the seconds parameter
+	// asks for.
+	srv := &http.Server{
+		Handler:     app.debugRoutes(),
+		IdleTimeout: time.Minute,
+		ReadTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			app.logger.PrintError(err, map[string]string{"server": "debug"})
+		}
+	}()
+
+	app.logger.PrintInfo("starting debug server", map[string]string{
+		"addr": ln.Addr().String(),
+	})
+
+	return srv, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// deprecation holds the metadata for an endpoint which is being phased out.
+type deprecation struct {
+	since     time.Time // When the endpoint was deprecated.
+	sunset    time.Time // When the endpoint will stop working. Optional.
+	successor string    // URL of the endpoint which replaces it. Optional.
+	docs      string    // URL of a page describing the deprecation. Optional.
+}
+
+// deprecatedRoutes holds the deprecation metadata for routes, keyed by the method and route pattern in the same
+// format used for the metrics, e.g. "GET /v1/movies/:id". Add an entry here to deprecate an endpoint, e.g.
+//
+//	"GET /v1/movies/:id": {
+//		since:     time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+//		sunset:    time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC),
+//		successor: "/v2/movies/:id",
+//	},
+var deprecatedRoutes = map[string]deprecation{}
+
+func (app *application) deprecationHeaders(router *httprouter.Router, next http.Handler) http.Handler {
+	// Count the requests made to each deprecated endpoint, so we know who still needs to migrate.
+	deprecatedRequests := expvar.NewMap("deprecated_endpoint_requests")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Skip the route lookup entirely when nothing is deprecated.
+		if len(deprecatedRoutes) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Method + " " + routePattern(router, r)
+
+		d, ok := deprecatedRoutes[key]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		deprecatedRequests.Add(key, 1)
+
+		// The Deprecation header (RFC 9745) carries the deprecation date as a Unix timestamp, and the Sunset
+		// header (RFC 8594) the date the endpoint goes away as an HTTP-date.
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.since.Unix()))
+
+		if !d.sunset.IsZero() {
+			w.Header().Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+		}
+
+		if d.successor != "" {
+			w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, d.successor))
+		}
+
+		if d.docs != "" {
+			w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"; type="text/html"`, d.docs))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
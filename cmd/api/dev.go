@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+
+	"github.com/micypac/flick-info/fixtures"
+	fixtureloader "github.com/micypac/flick-info/internal/fixtures"
+	"github.com/micypac/flick-info/internal/jsonlog"
+)
+
+// bootstrapDev() gets the database ready for local development. It enables the extensions, applies any
+// pending migrations, and loads the sample fixtures if there are no users or movies yet. A database which
+// already holds data is never truncated.
+func bootstrapDev(db *sql.DB, logger *jsonlog.Logger) error {
+	// The migrations need citext for case-insensitive email addresses, and pg_trgm for finding duplicate movies,
+	// but don't create them, as that needs extra privileges in production.
+	for _, extension := range []string{"citext", "pg_trgm"} {
+		_, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS ` + extension)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := migrateDB(db, logger)
+	if err != nil {
+		return err
+	}
+
+	empty, err := fixtureloader.Empty(db)
+	if err != nil || !empty {
+		return err
+	}
+
+	f, err := fixtures.FS.Open("development.json")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	set, err := fixtureloader.Parse(f)
+	if err != nil {
+		return err
+	}
+
+	err = set.Apply(db)
+	if err != nil {
+		return err
+	}
+
+	logger.PrintInfo("loaded sample data", map[string]string{
+		"users":   strconv.Itoa(len(set.Users)),
+		"movies":  strconv.Itoa(len(set.Movies)),
+		"reviews": strconv.Itoa(len(set.Reviews)),
+	})
+
+	return nil
+}
+
+// isLocalOrigin() reports whether a CORS origin is a page served from the local machine, on any port.
+func isLocalOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	default:
+		return false
+	}
+}
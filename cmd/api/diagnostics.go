@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// runtimeDump holds the stacks of every goroutine along with some key runtime stats, for diagnosing a process
+// which has hung or is leaking goroutines.
+type runtimeDump struct {
+	Goroutines   int    `json:"goroutines"`
+	HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Sys          uint64 `json:"sys_bytes"`
+	NumGC        uint32 `json:"num_gc"`
+	LastGC       string `json:"last_gc,omitempty"`
+	PauseTotal   string `json:"gc_pause_total"`
+	Uptime       string `json:"uptime"`
+	Stacks       string `json:"stacks"`
+	StacksTotal  int    `json:"stacks_bytes"`
+	StacksCapped bool   `json:"stacks_truncated"`
+}
+
+// Upper bound on the size of the stack dump, so a runaway number of goroutines can't produce an enormous log line.
+const maxStackDumpBytes = 8 << 20
+
+// dumpRuntime() captures the stacks of all goroutines and the current runtime stats.
+func (app *application) dumpRuntime() runtimeDump {
+	// runtime.Stack() truncates to the size of the buffer, so keep doubling it until the dump fits.
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStackDumpBytes {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	dump := runtimeDump{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		PauseTotal:   time.Duration(mem.PauseTotalNs).String(),
+		Uptime:       app.clock.Now().Sub(app.startedAt).Round(time.Second).String(),
+		Stacks:       string(buf),
+		StacksTotal:  len(buf),
+		StacksCapped: len(buf) >= maxStackDumpBytes,
+	}
+
+	if mem.LastGC != 0 {
+		dump.LastGC = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339)
+	}
+
+	return dump
+}
+
+// logRuntimeDump() writes a runtime dump to the logger as a single entry, recording what triggered it.
+func (app *application) logRuntimeDump(trigger string, dump runtimeDump) {
+	app.logger.PrintInfo("runtime dump", map[string]string{
+		"trigger":          trigger,
+		"goroutines":       strconv.Itoa(dump.Goroutines),
+		"heap_alloc_bytes": strconv.FormatUint(dump.HeapAlloc, 10),
+		"heap_objects":     strconv.FormatUint(dump.HeapObjects, 10),
+		"sys_bytes":        strconv.FormatUint(dump.Sys, 10),
+		"num_gc":           strconv.FormatUint(uint64(dump.NumGC), 10),
+		"last_gc":          dump.LastGC,
+		"gc_pause_total":   dump.PauseTotal,
+		"uptime":           dump.Uptime,
+		"stacks_truncated": strconv.FormatBool(dump.StacksCapped),
+		"stacks":           dump.Stacks,
+	})
+}
+
+// handleDumpSignal() logs a runtime dump each time the process receives SIGQUIT. This replaces Go's default
+// behavior of printing the stacks to stderr and exiting, so the dump ends up in the structured logs and the
+// server carries on running.
+func (app *application) handleDumpSignal() {
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGQUIT)
+
+	go func() {
+		for {
+			select {
+			case <-dump:
+				app.logRuntimeDump("SIGQUIT", app.dumpRuntime())
+			case <-app.shutdown:
+				signal.Stop(dump)
+				return
+			}
+		}
+	}()
+}
+
+// showRuntimeDumpHandler() logs a runtime dump and also returns it in the response.
+func (app *application) showRuntimeDumpHandler(w http.ResponseWriter, r *http.Request) {
+	dump := app.dumpRuntime()
+
+	app.logRuntimeDump("GET "+r.URL.Path, dump)
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"runtime": dump}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// The most duplicates which can be merged into a movie in one request.
+const maxMergeDuplicates = 20
+
+// listMovieDuplicatesHandler() returns a page of the pairs of movies which are likely duplicates, by default the
+// most similar first.
+func (app *application) listMovieDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-similarity")
+
+	input.Filters.SortSafeList = []string{"similarity", "-similarity"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	duplicates, metadata, err := app.models.Duplicates.GetAll(r.Context(), input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"duplicates": duplicates, "metadata": metadata}, app.paginationHeaders(r, metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// mergeMoviesHandler() merges the duplicate movies in the request body into the movie in the URL, which is kept.
+// The duplicates' ratings, watch history, watchlist and list entries move to the kept movie, and the duplicates
+// are deleted.
+func (app *application) mergeMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		DuplicateIDs []int64 `json:"duplicate_ids"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.DuplicateIDs) > 0, "duplicate_ids", "must contain at least one movie ID")
+	v.Check(len(input.DuplicateIDs) <= maxMergeDuplicates, "duplicate_ids", "must not contain more than "+strconv.Itoa(maxMergeDuplicates)+" movie IDs")
+
+	seen := make(map[int64]bool)
+	for _, duplicateID := range input.DuplicateIDs {
+		v.Check(duplicateID > 0, "duplicate_ids", "must only contain positive movie IDs")
+		v.Check(duplicateID != id, "duplicate_ids", "must not contain the ID of the movie being kept")
+		v.Check(!seen[duplicateID], "duplicate_ids", "must not contain duplicate values")
+		seen[duplicateID] = true
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Fetch the duplicates first, to record what was deleted in the audit log. The merge fails if any is missing.
+	duplicates := make([]*data.Movie, 0, len(input.DuplicateIDs))
+
+	for _, duplicateID := range input.DuplicateIDs {
+		duplicate, err := app.models.Movies.Get(r.Context(), duplicateID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		duplicates = append(duplicates, duplicate)
+	}
+
+	report, err := app.models.Duplicates.Merge(r.Context(), id, input.DuplicateIDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for _, duplicate := range duplicates {
+		app.audit(r, data.AuditEntityMovie, duplicate.ID, data.AuditDelete, duplicate, nil)
+		app.deletePoster(r, duplicate.PosterKey)
+	}
+
+	app.logger.PrintInfo("merged duplicate movies", map[string]string{
+		"movie_id":  strconv.FormatInt(id, 10),
+		"merged":    strconv.Itoa(len(input.DuplicateIDs)),
+		"merged_by": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"merge": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/mailer"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Outbox worker settings. Each worker claims a batch of due emails at a time, and checks for more every
+// outboxPollInterval, or straight away when an email is queued. A claimed email isn't claimed again until its
+// lease runs out, which is long enough to send the batch even with the mailer's own retries, so that the email
+// of a worker which died mid-send is retried by another.
+const (
+	outboxBatchSize    = 10
+	outboxPollInterval = 5 * time.Second
+	outboxLease        = 5 * time.Minute
+	outboxMaxBackoff   = time.Hour
+)
+
+// sendEmail() queues an email to the user in the outbox, to be sent by the outbox workers, so that it survives a
+// restart and is retried if it can't be sent. The variant of the template for the user's locale is used, if
+// there is one. With in-memory storage, or if it can't be queued, the email is sent from a background task
+// instead, logging any error. The template data is stored as JSON, so it must only hold strings and numbers.
+func (app *application) sendEmail(task string, user *data.User, templateFile string, emailData map[string]interface{}) {
+	recipient := user.Email
+	templateFile = mailer.Localize(templateFile, user.Locale)
+
+	if app.config.db.backend != "memory" {
+		err := app.models.EmailOutbox.Insert(context.Background(), &data.OutboxEmail{
+			Task:      task,
+			Recipient: recipient,
+			Template:  templateFile,
+			Data:      emailData,
+		})
+		if err == nil {
+			app.wakeOutbox()
+			return
+		}
+
+		app.logger.PrintError(err, map[string]string{"task": task, "template": templateFile, "outbox": "queue failed"})
+	}
+
+	app.background(task, func() {
+		err := app.mailer.Send(recipient, templateFile, emailData)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"task": task, "template": templateFile})
+		}
+	})
+}
+
+// wakeOutbox() tells an idle outbox worker to check for due emails, without waiting if they're all busy, as a
+// busy worker checks again once it's done.
+func (app *application) wakeOutbox() {
+	select {
+	case app.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// startOutboxWorkers() starts the background workers which send the emails queued in the outbox, until the
+// application starts shutting down. The emails sent, retried, and failed are counted in the email_outbox
+// expvar variable.
+func (app *application) startOutboxWorkers() {
+	stats := expvar.NewMap("email_outbox")
+
+	for i := 0; i < app.config.outbox.workers; i++ {
+		app.background("outbox_worker", func() {
+			ticker := app.clock.NewTicker(outboxPollInterval)
+			defer ticker.Stop()
+
+			for {
+				app.drainOutbox(stats)
+
+				select {
+				case <-app.shutdown:
+					return
+				case <-ticker.C():
+				case <-app.outboxWake:
+				}
+			}
+		})
+	}
+}
+
+// drainOutbox() claims and sends batches of due emails until there are none left, or the application starts
+// shutting down. The rest of a claimed batch is left to be sent after its lease runs out, by this instance or
+// another.
+func (app *application) drainOutbox(stats *expvar.Map) {
+	for {
+		emails, err := app.models.EmailOutbox.Claim(context.Background(), outboxBatchSize, outboxLease)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"task": "outbox_worker"})
+			return
+		}
+
+		for _, email := range emails {
+			select {
+			case <-app.shutdown:
+				return
+			default:
+			}
+
+			app.deliverOutboxEmail(email, stats)
+		}
+
+		if len(emails) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// deliverOutboxEmail() sends a claimed email and records the outcome: the email is deleted once sent, retried
+// with an exponential backoff if the send failed, or marked as failed after its last attempt, or straight away
+// if its template is broken, as retrying wouldn't fix that. An email which the mailer's circuit breaker refused
+// wasn't tried at all, so it's always retried.
+func (app *application) deliverOutboxEmail(email *data.OutboxEmail, stats *expvar.Map) {
+	ctx := context.Background()
+
+	err := app.mailer.Send(email.Recipient, email.Template, email.Data)
+	if err == nil {
+		stats.Add("sent", 1)
+
+		err = app.models.EmailOutbox.Sent(ctx, email.ID)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"task": email.Task, "email_id": strconv.FormatInt(email.ID, 10)})
+		}
+
+		return
+	}
+
+	props := map[string]string{
+		"task":     email.Task,
+		"template": email.Template,
+		"email_id": strconv.FormatInt(email.ID, 10),
+		"attempts": strconv.Itoa(email.Attempts),
+	}
+
+	lastAttempt := email.Attempts >= app.config.outbox.attempts && !errors.Is(err, mailer.ErrCircuitOpen)
+
+	if errors.Is(err, mailer.ErrTemplate) || lastAttempt {
+		stats.Add("failed", 1)
+		app.logger.PrintError(err, props)
+
+		err = app.models.EmailOutbox.Fail(ctx, email.ID, err.Error())
+		if err != nil {
+			app.logger.PrintError(err, props)
+		}
+
+		return
+	}
+
+	stats.Add("retried", 1)
+
+	delay := app.config.outbox.backoff << (email.Attempts - 1)
+	if delay <= 0 || delay > outboxMaxBackoff {
+		delay = outboxMaxBackoff
+	}
+
+	props["retry_in"] = delay.String()
+	app.logger.PrintError(err, props)
+
+	err = app.models.EmailOutbox.Retry(ctx, email.ID, delay, err.Error())
+	if err != nil {
+		app.logger.PrintError(err, props)
+	}
+}
+
+// listOutboxEmailsHandler() returns a page of the emails in the outbox with the status in the status query
+// string parameter, failed by default, oldest first. The template data isn't included, as it may hold tokens.
+func (app *application) listOutboxEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", data.OutboxFailed)
+	if status != "all" {
+		data.ValidateOutboxStatus(v, status)
+	}
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "created_at"),
+		SortSafeList: []string{"id", "created_at", "next_attempt_at", "-id", "-created_at", "-next_attempt_at"},
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if status == "all" {
+		status = ""
+	}
+
+	emails, metadata, err := app.models.EmailOutbox.GetAll(r.Context(), status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"emails": emails, "metadata": metadata}, app.paginationHeaders(r, metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// requeueOutboxEmailHandler() puts a failed email back in the outbox, to be sent straight away with a fresh set
+// of attempts.
+func (app *application) requeueOutboxEmailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	email, err := app.models.EmailOutbox.Requeue(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.wakeOutbox()
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// eraseCurrentUserHandler() erases the authenticated user's personal data. The user must confirm their password,
+// as the erasure can't be undone.
+func (app *application) eraseCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	app.eraseUser(w, r, user.ID)
+}
+
+// eraseUserHandler() erases the personal data of the user with the ID in the URL, on behalf of an administrator.
+func (app *application) eraseUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.eraseUser(w, r, id)
+}
+
+// eraseUser() erases the user's personal data, logs the erasure and records it in the audit log, and sends the
+// completion report.
+func (app *application) eraseUser(w http.ResponseWriter, r *http.Request, userID int64) {
+	requestedBy := app.contextGetUser(r).ID
+
+	report, err := app.models.Erasures.Erase(r.Context(), userID, requestedBy)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfo("erased user data", map[string]string{
+		"erasure_id":   strconv.FormatInt(report.ID, 10),
+		"user_id":      strconv.FormatInt(userID, 10),
+		"requested_by": strconv.FormatInt(requestedBy, 10),
+	})
+
+	// The audit entry is attributed to whoever asked for the erasure, and holds the report's counts. It's added
+	// after Erase() has cleared the changes in the user's earlier entries, so it's kept.
+	app.audit(r, data.AuditEntityUser, userID, data.AuditErase, nil, report)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"erasure": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
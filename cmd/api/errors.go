@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 )
@@ -8,6 +10,7 @@ import (
 // Generic helper for logging error message.
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
+		"request_id":     app.contextGetRequestID(r),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
@@ -17,7 +20,7 @@ func (app *application) logError(r *http.Request, err error) {
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	env := envelope{"error": message}
 
-	err := app.writeJSON(w, status, env, nil)
+	err := app.writeResponse(w, r, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -26,13 +29,28 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 
 // Used when the app encounters an unexpected problem at runtime. It logs the detailed error message, then uses
 // the errorResponse() helper to send a 500 Internal Server Error status code and JSON response to the client.
+//
+// If the deadline set by the client's X-Request-Timeout header has passed, the error is almost certainly caused by
+// the cancelled context, so a 504 Gateway Timeout response is sent instead, and nothing is logged.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		app.requestTimeoutResponse(w, r)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusNotFound, message)
 }
 
+// Used to send a 504 Gateway Timeout status code and JSON response when the request didn't complete before the
+// deadline the client asked for.
+func (app *application) requestTimeoutResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the request did not complete within the time requested by the X-Request-Timeout header"
+	app.errorResponse(w, r, http.StatusGatewayTimeout, message)
+}
+
 // Used to send a 400 Bad Request status code and JSON response to the client.
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
@@ -45,8 +63,15 @@ func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request)
 }
 
 // Used to send a 405 Method Not Allowed status code and JSON response to the client.
+// The router sets the Allow header to the methods registered for the path before calling this, and the
+// header is kept on the response by writeResponse(). The same methods are listed in the message for convenience.
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
+
+	if allow := w.Header().Get("Allow"); allow != "" {
+		message = fmt.Sprintf("%s (allowed methods: %s)", message, allow)
+	}
+
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
@@ -90,3 +115,33 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "Your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) sessionTokenRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with a personal access token or API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) emailRateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "too many emails have been sent to this account, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) invalidSignatureResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or missing url signature"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) signedURLExpiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this link has expired"
+	app.errorResponse(w, r, http.StatusGone, message)
+}
+
+func (app *application) databaseRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource isn't available when the server is using in-memory storage"
+	app.errorResponse(w, r, http.StatusNotImplemented, message)
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has been modified since the version given in the If-Match header"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
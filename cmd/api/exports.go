@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// The columns of a CSV export of the movie catalog. Genres are joined with "|", and the runtime is in minutes.
+var movieExportColumns = []string{"id", "title", "year", "runtime", "genres", "version", "synopsis", "language", "country", "imdb_id", "tmdb_id",
+	"poster_url"}
+
+// exportMoviesHandler() downloads every movie matching the title and genres filters, as CSV or as
+// newline-delimited JSON depending on the format parameter, so that the catalog can be backed up or analyzed
+// elsewhere. Like streamMoviesHandler() the movies are read in batches and flushed to the client as they're
+// written, rather than loaded into memory.
+//
+// If an NDJSON export is interrupted, a final line describes the error and the ID to resume from with
+// after_id. A CSV file has nowhere to put that, so an interrupted CSV export is cut off without the end of the
+// response instead, for the client to report as a failed download rather than a complete but short file.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	format := app.readString(qs, "format", "csv")
+	title := app.readString(qs, "title", "")
+	genres := app.readCSV(qs, "genres", []string{})
+	afterID := app.readInt(qs, "after_id", 0, v)
+
+	v.Check(validator.In(format, "csv", "ndjson"), "format", "must be csv or ndjson")
+	v.Check(afterID >= 0, "after_id", "must not be negative")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="movies.`+format+`"`)
+
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+
+		enc := json.NewEncoder(w)
+
+		lastID, err := app.streamMovies(w, r, title, genres, int64(afterID), func(movie *data.Movie) error {
+			return enc.Encode(movie)
+		}, nil)
+		if err != nil && r.Context().Err() == nil {
+			app.logError(r, err)
+			enc.Encode(envelope{"error": "the export was interrupted", "resume_after_id": lastID})
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+
+	cw := csv.NewWriter(w)
+
+	// The header row stays in the writer's buffer until the first flush, so it's sent after the status code.
+	cw.Write(movieExportColumns)
+
+	_, err := app.streamMovies(w, r, title, genres, int64(afterID), func(movie *data.Movie) error {
+		// Leave the TMDB ID empty rather than 0 for movies without one, like the IMDb ID.
+		tmdbID := ""
+		if movie.TMDbID != 0 {
+			tmdbID = strconv.FormatInt(movie.TMDbID, 10)
+		}
+
+		return cw.Write([]string{
+			strconv.FormatInt(movie.ID, 10),
+			movie.Title,
+			strconv.FormatInt(int64(movie.Year), 10),
+			strconv.FormatInt(int64(movie.Runtime), 10),
+			strings.Join(movie.Genres, "|"),
+			strconv.FormatInt(int64(movie.Version), 10),
+			movie.Synopsis,
+			movie.Language,
+			movie.Country,
+			movie.IMDbID,
+			tmdbID,
+			movie.PosterURL,
+		})
+	}, func() error {
+		cw.Flush()
+		return cw.Error()
+	})
+
+	// Send the header row of an empty export.
+	cw.Flush()
+
+	if err != nil && r.Context().Err() == nil {
+		app.logError(r, err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// readFields() reads the comma-separated fields query parameter of a sparse fieldset, such as
+// fields=id,title,year, for responses with items like the sample struct. Each field must be the JSON name of
+// one of the sample's fields. Nil is returned when the parameter is missing, for the full response.
+func (app *application) readFields(qs url.Values, sample interface{}, v *validator.Validator) []string {
+	fields := app.readCSV(qs, "fields", nil)
+
+	names := jsonFieldNames(reflect.TypeOf(sample))
+
+	for _, field := range fields {
+		v.Check(validator.In(field, names...), "fields", "must only contain the names of fields in the response, such as id")
+	}
+
+	v.Check(validator.Unique(fields), "fields", "must not contain duplicate values")
+
+	return fields
+}
+
+// jsonFieldNames() returns the names the fields of the struct type t are encoded with in JSON.
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+
+	for i := 0; i < t.NumField(); i++ {
+		if name, ok := jsonFieldName(t.Field(i)); ok {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// jsonFieldName() returns the name the struct field is encoded with in JSON, and false if it isn't encoded.
+func jsonFieldName(f reflect.StructField) (string, bool) {
+	if !f.IsExported() || f.Anonymous {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+
+	switch name {
+	case "-":
+		return "", false
+	case "":
+		return f.Name, true
+	default:
+		return name, true
+	}
+}
+
+// selectFields() shapes a response value for a sparse fieldset, returning a copy of the value (a struct,
+// pointer to a struct, or slice of them) with only the fields whose JSON names are listed. The copy is of a
+// struct type made with reflect.StructOf() from the selected fields, and the XMLName if there is one, keeping
+// their tags, so it's encoded exactly as the original would be in every format, minus the fields which weren't
+// asked for. Protocol Buffers have a fixed message per response, so responses with a sparse fieldset fall back
+// to JSON for them. The value is returned unchanged when there are no fields.
+func selectFields(value interface{}, fields []string) interface{} {
+	if len(fields) == 0 {
+		return value
+	}
+
+	rv := reflect.ValueOf(value)
+
+	if rv.Kind() == reflect.Slice {
+		elem := rv.Type().Elem()
+		if elem.Kind() == reflect.Pointer {
+			elem = elem.Elem()
+		}
+
+		sparse, indexes := sparseType(elem, fields)
+
+		items := reflect.MakeSlice(reflect.SliceOf(sparse), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			copySparse(items.Index(i), reflect.Indirect(rv.Index(i)), indexes)
+		}
+
+		return items.Interface()
+	}
+
+	rv = reflect.Indirect(rv)
+
+	sparse, indexes := sparseType(rv.Type(), fields)
+
+	item := reflect.New(sparse).Elem()
+	copySparse(item, rv, indexes)
+
+	return item.Interface()
+}
+
+// sparseType() returns a struct type with the fields of t which are selected, in their original order, and
+// the indexes in t of each of its fields.
+func sparseType(t reflect.Type, fields []string) (reflect.Type, []int) {
+	var (
+		structFields []reflect.StructField
+		indexes      []int
+	)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		name, ok := jsonFieldName(f)
+		if f.Name != "XMLName" && (!ok || !validator.In(name, fields...)) {
+			continue
+		}
+
+		structFields = append(structFields, reflect.StructField{Name: f.Name, Type: f.Type, Tag: f.Tag})
+		indexes = append(indexes, i)
+	}
+
+	return reflect.StructOf(structFields), indexes
+}
+
+// copySparse() copies the fields of src at the indexes to the fields of dst, a value of a sparseType().
+func copySparse(dst, src reflect.Value, indexes []int) {
+	for i, index := range indexes {
+		dst.Field(i).Set(src.Field(index))
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// listGenresHandler() returns every genre with the number of movies which have it, most used first. For
+// administrators it also helps spot inconsistent spellings which should be merged.
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+	genres, err := app.models.Genres.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"genres": genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// renameGenreHandler() renames a genre on every movie, and in users' favorite genres and saved searches. If the
+// new name is already in use the genres must be merged instead.
+func (app *application) renameGenreHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	app.changeGenres(w, r, &data.GenreChange{Kind: data.GenreRename, Sources: []string{input.From}, Target: input.To})
+}
+
+// mergeGenresHandler() replaces each of the source genres with the target genre everywhere they are used, for
+// example to merge "Sci-Fi" into "Science Fiction".
+func (app *application) mergeGenresHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Sources []string `json:"sources"`
+		Target  string   `json:"target"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	app.changeGenres(w, r, &data.GenreChange{Kind: data.GenreMerge, Sources: input.Sources, Target: input.Target})
+}
+
+// changeGenres() validates and applies a rename or merge of genres, logs it, and sends the audit record.
+func (app *application) changeGenres(w http.ResponseWriter, r *http.Request, change *data.GenreChange) {
+	change.RequestedBy = app.contextGetUser(r).ID
+
+	v := validator.New()
+
+	if data.ValidateGenreChange(v, change); !v.Valid() {
+		// A rename's request body has from and to fields, rather than sources and target.
+		if change.Kind == data.GenreRename {
+			errs := make(map[string]string)
+			for key, message := range v.Errors {
+				switch key {
+				case "sources":
+					key = "from"
+				case "target":
+					key = "to"
+				}
+				errs[key] = message
+			}
+			v.Errors = errs
+		}
+
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Genres.Change(r.Context(), change)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrGenreExists):
+			v.AddError("to", "is already in use, merge the genres instead")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("from", "must be an existing genre")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logGenreChange(change)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"genre_change": change}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// logGenreChange() logs a completed rename or merge of genres.
+func (app *application) logGenreChange(change *data.GenreChange) {
+	app.logger.PrintInfo("genres changed", map[string]string{
+		"kind":           change.Kind,
+		"sources":        strings.Join(change.Sources, ","),
+		"target":         change.Target,
+		"requested_by":   strconv.FormatInt(change.RequestedBy, 10),
+		"movies_updated": strconv.FormatInt(change.MoviesUpdated, 10),
+	})
+}
+
+// createGenreHandler() adds a genre which movies can then be given.
+func (app *application) createGenreHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	genre := &data.Genre{Name: input.Name}
+
+	v := validator.New()
+
+	if data.ValidateGenre(v, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Genres.Insert(r.Context(), genre)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrGenreExists):
+			v.AddError("name", "a genre with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditEntityGenre, genre.ID, data.AuditCreate, nil, genre)
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/genres/%d", genre.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"genre": genre}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showGenreHandler() returns the genre with the ID in the URL, with the number of movies which have it.
+func (app *application) showGenreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	genre, err := app.models.Genres.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"genre": genre}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateGenreHandler() renames the genre with the ID in the URL. Like renameGenreHandler(), the new name also
+// replaces the old one in users' favorite genres and saved searches.
+func (app *application) updateGenreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	genre, err := app.models.Genres.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name *string `json:"name"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	before := *genre
+
+	if input.Name != nil {
+		genre.Name = *input.Name
+	}
+
+	v := validator.New()
+
+	if data.ValidateGenre(v, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if genre.Name != before.Name {
+		change := &data.GenreChange{
+			Kind:        data.GenreRename,
+			Sources:     []string{before.Name},
+			Target:      genre.Name,
+			RequestedBy: app.contextGetUser(r).ID,
+		}
+
+		err = app.models.Genres.Change(r.Context(), change)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrGenreExists):
+				v.AddError("name", "is already in use, merge the genres instead")
+				app.failedValidationResponse(w, r, v.Errors)
+			case errors.Is(err, data.ErrRecordNotFound):
+				// The genre was renamed or merged since it was read.
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.logGenreChange(change)
+
+		genre.Version++
+		app.audit(r, data.AuditEntityGenre, genre.ID, data.AuditUpdate, &before, genre)
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"genre": genre}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteGenreHandler() deletes the genre with the ID in the URL, which no movie can have. A genre in use should
+// be merged into another instead.
+func (app *application) deleteGenreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	genre, err := app.models.Genres.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Genres.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrGenreInUse):
+			v := validator.New()
+			v.AddError("genre", "is still used by some movies, merge it into another genre instead")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditEntityGenre, genre.ID, data.AuditDelete, genre, nil)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "genre successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
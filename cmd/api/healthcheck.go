@@ -1,22 +1,145 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"time"
 )
 
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	// Create an envelope instance which holds the information that we want to send in the response.
+	now := time.Now()
+
 	env := envelope{
 		"status": "available",
 		"system_info": map[string]string{
 			"environment": app.config.env,
 			"version":     version,
 		},
+		"uptime":    now.Sub(app.startedAt).Round(time.Second).String(),
+		"timestamp": now.UTC().Format(time.RFC3339),
 	}
 
+	// Tell clients and any intermediaries not to cache the response, so a stale status is never served.
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	headers.Set("Pragma", "no-cache")
+	headers.Set("Expires", "0")
+
 	// Pass the map to the json.Marshal() function. This returns a []byte slice containing the encoded JSON.
-	err := app.writeJSON(w, http.StatusOK, env, nil)
+	// For HEAD requests, the http.Server discards the body and just sends the status and headers.
+	err := app.writeResponse(w, r, http.StatusOK, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// deepHealthcheckHandler() reports whether the server and its dependencies are available, for load balancers and
+// container probes. It responds with 503 Service Unavailable in the same cases as the verbose healthcheck, but
+// leaves out the details of the dependencies, such as connection errors, which are only served by the debug
+// server.
+func (app *application) deepHealthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	status, env := app.deepHealthcheck(r)
+	delete(env, "database")
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	err := app.writeResponse(w, r, status, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verboseHealthcheckHandler() is the deep healthcheck with the details of each dependency, served by the debug
+// server.
+func (app *application) verboseHealthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	status, env := app.deepHealthcheck(r)
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	err := app.writeResponse(w, r, status, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deepHealthcheck() checks the status of the dependencies as well as the server itself: whether the primary
+// database and the movie shards answer a ping, and the read replica's replication lag. The status is 503 Service
+// Unavailable if the primary or a shard can't be reached. A lagging replica doesn't make the server unavailable,
+// as reads fall back to the primary.
+func (app *application) deepHealthcheck(r *http.Request) (int, envelope) {
+	status := http.StatusOK
+	database := map[string]interface{}{}
+
+	if app.db == nil {
+		database["status"] = "in-memory"
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		start := time.Now()
+
+		err := app.db.PingContext(ctx)
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			database["status"] = "unavailable"
+			database["error"] = err.Error()
+		} else {
+			database["status"] = "available"
+			database["latency"] = time.Since(start).String()
+		}
+	}
+
+	if app.replica != nil {
+		rs := app.replica.Status()
+
+		replica := map[string]interface{}{
+			"in_use":     rs.InUse,
+			"lag":        rs.Lag.String(),
+			"max_lag":    app.replica.MaxLag.String(),
+			"checked_at": rs.CheckedAt.UTC().Format(time.RFC3339),
+		}
+		if rs.Err != nil {
+			replica["error"] = rs.Err.Error()
+		}
+
+		database["replica"] = replica
+	}
+
+	if len(app.shards) > 0 {
+		shards := []map[string]interface{}{}
+
+		for _, shard := range app.shards {
+			ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+			err := shard.DB.PingContext(ctx)
+			cancel()
+
+			s := map[string]interface{}{"min_id": shard.MinID, "max_id": shard.MaxID, "status": "available"}
+			if err != nil {
+				status = http.StatusServiceUnavailable
+				s["status"] = "unavailable"
+				s["error"] = err.Error()
+			}
+
+			shards = append(shards, s)
+		}
+
+		database["shards"] = shards
+	}
+
+	env := envelope{
+		"status":   "available",
+		"database": database,
+		"system_info": map[string]string{
+			"environment": app.config.env,
+			"version":     version,
+		},
+	}
+	if status != http.StatusOK {
+		env["status"] = "unavailable"
+	}
+
+	return status, env
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/micypac/flick-info/internal/data"
 	"github.com/micypac/flick-info/internal/validator"
+	"github.com/tomasen/realip"
 )
 
 // Define an envelope type.
@@ -36,16 +42,11 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 // Helper method for sending JSON responses. It takes the destination ResponseWriter, HTTP status code to send,
 // the data to encode to JSON, and header map containing HTTP headers to set.
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	// Encode the data to JSON by passing to the json.Marshal() function. This returns a []byte slice containing the encoded JSON.
-	// Use MarshalIndent() so that whitespace is added to the encoded JSON.
-	js, err := json.MarshalIndent(data, "", "\t")
+	js, err := marshalJSON(data)
 	if err != nil {
 		return err
 	}
 
-	// Append newline to the JSON to make it easier to view in terminal apps.
-	js = append(js, '\n')
-
 	// Loop through the headers map and add each to the response header.
 	for key, value := range headers {
 		w.Header()[key] = value
@@ -61,6 +62,21 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
+// marshalJSON() encodes the envelope as indented JSON.
+func marshalJSON(data envelope) ([]byte, error) {
+	// Encode the data to JSON by passing to the json.Marshal() function. This returns a []byte slice containing the encoded JSON.
+	// Use MarshalIndent() so that whitespace is added to the encoded JSON.
+	js, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	// Append newline to the JSON to make it easier to view in terminal apps.
+	js = append(js, '\n')
+
+	return js, nil
+}
+
 // Helper method for reading JSON request. Decode the JSON from the request body then triage the errors and
 // replace them with custom message if necessary.
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
@@ -68,13 +84,28 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	maxBytes := 1_048_576
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
+	// Read the whole body up front, so it can be checked for maliciously shaped JSON before it is decoded.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		// Request body exceeds 1MB in size.
+		if err.Error() == "http: request body too large" {
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		}
+		return err
+	}
+
+	err = checkJSONShape(body, app.config.json.maxDepth, app.config.json.maxArrayLength)
+	if err != nil {
+		return err
+	}
+
 	// Initialize a new json.Decoder that reads from the request body and call the DisallowUnknownFields() before decoding.
 	// If the JSON request have fields that cannot be mapped to the target destination, it will error.
-	dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(bytes.NewReader(body))
 	dec.DisallowUnknownFields()
 
 	// Use the Decode() method to decode the body contents into the pointer input struct.
-	err := dec.Decode(dst)
+	err = dec.Decode(dst)
 	if err != nil {
 		var syntaxError *json.SyntaxError
 		var unmarshalTypeError *json.UnmarshalTypeError
@@ -101,10 +132,6 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
 			return fmt.Errorf("body contains unknown key %s", fieldName)
 
-		// Request body exceeds 1MB in size.
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
-
 		case errors.As(err, &invalidUnmarshalError):
 			panic(err)
 
@@ -124,6 +151,95 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// checkJSONShape() walks the tokens of a JSON body and returns an error if it nests objects and arrays more than
+// maxDepth deep, contains an array with more than maxArrayLength elements, or repeats a key within an object.
+// json.Decoder would quietly keep the last of the duplicate keys, so a body could otherwise pass a proxy or
+// audit log with one value and reach the handler with another. Syntax errors are left for Decode() to report.
+func checkJSONShape(body []byte, maxDepth, maxArrayLength int) error {
+	// frame tracks an object or array which is currently open.
+	type frame struct {
+		array     bool
+		length    int
+		keys      map[string]bool
+		expectKey bool
+	}
+
+	var stack []*frame
+
+	// value() records that a value has started inside the innermost open object or array, if there is one.
+	value := func() error {
+		if len(stack) == 0 {
+			return nil
+		}
+
+		top := stack[len(stack)-1]
+
+		if top.array {
+			top.length++
+			if top.length > maxArrayLength {
+				return fmt.Errorf("body must not contain arrays with more than %d elements", maxArrayLength)
+			}
+			return nil
+		}
+
+		// In an object, the next token after a value is always a key.
+		top.expectKey = true
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				err = value()
+				if err != nil {
+					return err
+				}
+
+				if len(stack) >= maxDepth {
+					return fmt.Errorf("body must not be nested more than %d levels deep", maxDepth)
+				}
+
+				stack = append(stack, &frame{array: t == '[', keys: make(map[string]bool), expectKey: t == '{'})
+			default:
+				stack = stack[:len(stack)-1]
+			}
+
+		case string:
+			if len(stack) > 0 && stack[len(stack)-1].expectKey {
+				top := stack[len(stack)-1]
+
+				if top.keys[t] {
+					return fmt.Errorf("body contains duplicate key %q", t)
+				}
+
+				top.keys[t] = true
+				top.expectKey = false
+				continue
+			}
+
+			err = value()
+			if err != nil {
+				return err
+			}
+
+		default:
+			err = value()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // readString() helper returns a string value from the query string, or provided default value
 // if no matching key could be found.
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -165,14 +281,93 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-// background helper method accepts an arbitrary function as a parameter.
-func (app *application) background(fn func()) {
+// readBool() reads a boolean value, such as "true" or "false", from the query string. If the key doesn't exist
+// the default value is returned, and if the value can't be parsed an error is added to the validator.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// signURL() returns a shareable, read-only URL for the given path which stays valid until ttl from now.
+func (app *application) signURL(path string, ttl time.Duration) (string, time.Time) {
+	expires := time.Now().Add(ttl)
+	return app.signer.Sign(path, expires), expires
+}
+
+// tokenMetadata() returns the details of the client making the request, to be stored alongside a new token.
+// The user agent is truncated so that a client can't fill the tokens table with arbitrarily large values.
+func (app *application) tokenMetadata(r *http.Request, deviceName string) data.TokenMetadata {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	return data.TokenMetadata{
+		ClientIP:   realip.FromRequest(r),
+		UserAgent:  userAgent,
+		DeviceName: deviceName,
+	}
+}
+
+// paginationHeaders() returns the response headers for a paginated list. It sets a Link header (RFC 8288,
+// formerly RFC 5988) with "first", "prev", "next" and "last" links built from the request URL and pagination
+// metadata, so generic HTTP clients can page through results without parsing the response body.
+func (app *application) paginationHeaders(r *http.Request, metadata data.Metadata) http.Header {
+	headers := make(http.Header)
+
+	// An empty metadata struct means there were no records, so there is nothing to link to.
+	if metadata.LastPage == 0 {
+		return headers
+	}
+
+	link := func(page int, rel string) string {
+		qs := r.URL.Query()
+		qs.Set("page", strconv.Itoa(page))
+
+		u := url.URL{Path: r.URL.Path, RawQuery: qs.Encode()}
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+
+	links := []string{link(metadata.FirstPage, "first")}
+
+	if metadata.CurrentPage > metadata.FirstPage {
+		links = append(links, link(metadata.CurrentPage-1, "prev"))
+	}
+
+	if metadata.CurrentPage < metadata.LastPage {
+		links = append(links, link(metadata.CurrentPage+1, "next"))
+	}
+
+	links = append(links, link(metadata.LastPage, "last"))
+
+	headers.Set("Link", strings.Join(links, ", "))
+
+	return headers
+}
+
+// background helper method accepts an arbitrary function as a parameter, along with a name which identifies the
+// task in the shutdown logs if it is still running when the shutdown deadline passes.
+func (app *application) background(name string, fn func()) {
 	// Increment the wait group counter.
 	app.wg.Add(1)
 
+	id := app.tasks.add(name, app.clock.Now())
+
 	go func() {
 		// Use defer to decrement the wait group counter when the goroutine completes.
 		defer app.wg.Done()
+		defer app.tasks.remove(id)
 
 		// Recover any panic
 		defer func() {
@@ -185,3 +380,93 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// taskSet keeps track of the running background tasks, so that any which are still running when the shutdown
+// deadline passes can be logged.
+type taskSet struct {
+	mu      sync.Mutex
+	nextID  uint64
+	running map[uint64]runningTask
+}
+
+type runningTask struct {
+	name    string
+	started time.Time
+}
+
+func (ts *taskSet) add(name string, started time.Time) uint64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.running == nil {
+		ts.running = make(map[uint64]runningTask)
+	}
+
+	ts.nextID++
+	ts.running[ts.nextID] = runningTask{name: name, started: started}
+
+	return ts.nextID
+}
+
+func (ts *taskSet) remove(id uint64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	delete(ts.running, id)
+}
+
+// snapshot() returns the running tasks, oldest first.
+func (ts *taskSet) snapshot() []runningTask {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tasks := make([]runningTask, 0, len(ts.running))
+	for _, t := range ts.running {
+		tasks = append(tasks, t)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].started.Before(tasks[j].started) })
+
+	return tasks
+}
+
+// waitForBackground() waits for the background tasks to complete, for at most timeout. If any are still running
+// after that, they are logged and abandoned, and the number of them is returned. They carry on running until the
+// process exits, but no longer hold up the shutdown.
+func (app *application) waitForBackground(timeout time.Duration) int {
+	done := make(chan struct{})
+
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-time.After(timeout):
+	}
+
+	now := app.clock.Now()
+	tasks := app.tasks.snapshot()
+
+	for _, t := range tasks {
+		app.logger.PrintError(errors.New("abandoned background task at shutdown"), map[string]string{
+			"task":    t.name,
+			"running": now.Sub(t.started).Round(time.Millisecond).String(),
+		})
+	}
+
+	return len(tasks)
+}
+
+// attachUserState() adds the authenticated user's watched, watchlist and rating state to the movies. It does
+// nothing for anonymous requests.
+func (app *application) attachUserState(r *http.Request, movies ...*data.Movie) error {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return nil
+	}
+
+	return app.models.UserStates.Attach(r.Context(), user.ID, movies...)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/importer"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// importResult is the outcome of importing a single row of a CSV export.
+type importResult struct {
+	Line    int    `json:"line" xml:"line"`
+	Title   string `json:"title" xml:"title"`
+	Year    int32  `json:"year,omitempty" xml:"year,omitempty"`
+	Status  string `json:"status" xml:"status"` // imported, unmatched or skipped.
+	MovieID int64  `json:"movie_id,omitempty" xml:"movie_id,omitempty"`
+	Message string `json:"message,omitempty" xml:"message,omitempty"`
+}
+
+// importDataHandler() imports the authenticated user's watch history, ratings and watchlist from a Letterboxd
+// or IMDb CSV export, sent as the request body. Each row is matched to a catalog movie by its title and year.
+// The response reports the outcome of every row, so the user can see which movies couldn't be matched.
+//
+// Letterboxd's watched.csv and watchlist.csv exports have the same columns, so a watchlist must be sent with
+// ?type=watchlist.
+func (app *application) importDataHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	kind := app.readString(r.URL.Query(), "type", "watched")
+	v.Check(validator.In(kind, "watched", "watchlist"), "type", "must be watched or watchlist")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Limit the size of the request body to 5MB, which is plenty for the maximum number of rows.
+	r.Body = http.MaxBytesReader(w, r.Body, 5_242_880)
+
+	source, rows, err := importer.Parse(r.Body, kind == "watchlist")
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.badRequestResponse(w, r, errors.New("body must not be larger than 5MB"))
+		case errors.Is(err, importer.ErrUnrecognizedFormat):
+			app.badRequestResponse(w, r, errors.New("body must be a Letterboxd or IMDb CSV export"))
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	keys := make([]data.TitleYear, 0, len(rows))
+	for _, row := range rows {
+		if row.Skip == "" {
+			keys = append(keys, data.TitleYear{Title: row.Title, Year: row.Year})
+		}
+	}
+
+	matches, err := app.models.Imports.MatchTitles(r.Context(), keys)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	results := make([]importResult, len(rows))
+	entries := []data.ImportEntry{}
+	summary := map[string]int{"imported": 0, "unmatched": 0, "skipped": 0}
+
+	for i, row := range rows {
+		results[i] = importResult{Line: row.Line, Title: row.Title, Year: row.Year}
+
+		movieID, matched := matches[data.TitleYear{Title: row.Title, Year: row.Year}]
+
+		switch {
+		case row.Skip != "":
+			results[i].Status = "skipped"
+			results[i].Message = row.Skip
+		case !matched:
+			results[i].Status = "unmatched"
+			results[i].Message = "no movie with this title and year in the catalog"
+		default:
+			results[i].Status = "imported"
+			results[i].MovieID = movieID
+
+			entries = append(entries, data.ImportEntry{
+				MovieID:   movieID,
+				WatchedOn: row.WatchedOn,
+				Rating:    row.Rating,
+				Watchlist: row.Watchlist,
+			})
+		}
+
+		summary[results[i].Status]++
+	}
+
+	err = app.models.Imports.Apply(r.Context(), app.contextGetUser(r).ID, entries)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"import": envelope{"source": source, "summary": summary, "rows": results}}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/mailer"
+)
+
+// schedule() runs fn every interval in a background goroutine until the application starts shutting down.
+// A panic in fn is recovered and logged, and the job carries on at the next interval. The context passed to fn
+// is cancelled when the shutdown starts, so that a run in progress doesn't hold up the shutdown.
+func (app *application) schedule(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	app.background("job:"+name, func() {
+		ticker := app.clock.NewTicker(interval)
+		defer ticker.Stop()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() {
+			select {
+			case <-app.shutdown:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		for {
+			select {
+			case <-app.shutdown:
+				return
+			case <-ticker.C():
+				app.runJob(ctx, name, fn)
+			}
+		}
+	})
+}
+
+// runJob() executes a single run of a scheduled job, logging any error or panic.
+func (app *application) runJob(ctx context.Context, name string, fn func(ctx context.Context) error) {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.PrintError(fmt.Errorf("%s", err), map[string]string{"job": name})
+		}
+	}()
+
+	err := fn(ctx)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"job": name})
+	}
+}
+
+// startJobs() registers all the scheduled background jobs.
+func (app *application) startJobs() {
+	// Publish the number of expired tokens deleted in total, and during the most recent run.
+	tokensPurged := expvar.NewInt("tokens_purged_total")
+	tokensPurgedLastRun := expvar.NewInt("tokens_purged_last_run")
+
+	app.schedule("purge_expired_tokens", app.config.tokens.purgeInterval, func(ctx context.Context) error {
+		start := app.clock.Now()
+
+		n, err := app.models.Tokens.DeleteExpired(ctx, app.config.tokens.purgeBatchSize)
+
+		// Record whatever was deleted before any error occurred.
+		tokensPurged.Add(n)
+		tokensPurgedLastRun.Set(n)
+
+		if err != nil {
+			return err
+		}
+
+		app.logger.PrintInfo("purged expired tokens", map[string]string{
+			"rows":     strconv.FormatInt(n, 10),
+			"duration": app.clock.Now().Sub(start).String(),
+		})
+
+		return nil
+	})
+
+	if app.replica != nil {
+		app.scheduleReplicaCheck()
+	}
+
+	// The remaining jobs need PostgreSQL, so they don't run with in-memory storage.
+	if app.config.db.backend == "memory" {
+		return
+	}
+
+	// Send the emails queued in the outbox, including any left over from before the last restart.
+	app.startOutboxWorkers()
+
+	digestsSent := expvar.NewInt("digest_emails_sent_total")
+
+	app.schedule("send_weekly_digests", app.config.digest.checkInterval, func(ctx context.Context) error {
+		n, err := app.sendDigests(ctx)
+
+		digestsSent.Add(int64(n))
+
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			app.logger.PrintInfo("sent weekly digests", map[string]string{"emails": strconv.Itoa(n)})
+		}
+
+		return nil
+	})
+
+	app.schedule("flush_analytics", app.config.analytics.flushInterval, app.flushAnalytics)
+
+	searchNotifications := expvar.NewInt("saved_search_notifications_total")
+
+	app.schedule("check_saved_searches", app.config.savedSearches.checkInterval, func(ctx context.Context) error {
+		n, err := app.checkSavedSearches(ctx)
+
+		searchNotifications.Add(int64(n))
+
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			app.logger.PrintInfo("notified saved search matches", map[string]string{"notifications": strconv.Itoa(n)})
+		}
+
+		return nil
+	})
+}
+
+// checkSavedSearches() checks each saved search which is due against the movies added since its last check,
+// and returns the number of notifications created. Where there are new matches, the owner gets an in-app
+// notification and, if the search asks for one, an email. If the email can't be sent the search is skipped, and
+// retried with the same matches on the next run.
+func (app *application) checkSavedSearches(ctx context.Context) (int, error) {
+	checks, err := app.models.SavedSearches.Due(ctx, app.config.savedSearches.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	notified := 0
+
+	for _, check := range checks {
+		search := check.Search
+
+		movies, total, err := app.models.SavedSearches.NewMatches(ctx, search, check.UpTo, 10)
+		if err != nil {
+			return notified, err
+		}
+
+		var notification *data.Notification
+
+		if total > 0 {
+			notification = &data.Notification{
+				UserID:  search.UserID,
+				Kind:    data.NotificationSavedSearchMatches,
+				Message: fmt.Sprintf("%d new movies match your saved search %q", total, search.Name),
+				Data:    data.NotificationData{SavedSearchID: search.ID},
+			}
+
+			if total == 1 {
+				notification.Message = fmt.Sprintf("A new movie matches your saved search %q", search.Name)
+			}
+
+			for _, movie := range movies {
+				notification.Data.MovieIDs = append(notification.Data.MovieIDs, movie.ID)
+			}
+
+			if search.NotifyEmail {
+				emailData := map[string]interface{}{
+					"name":   check.Name,
+					"search": search.Name,
+					"movies": movies,
+					"total":  total,
+					"more":   total - len(movies),
+				}
+
+				err = app.mailer.Send(check.Email, mailer.Localize("saved_search.tmpl.html", check.Locale), emailData)
+				if err != nil {
+					app.logger.PrintError(err, map[string]string{"job": "check_saved_searches", "saved_search_id": strconv.FormatInt(search.ID, 10)})
+					continue
+				}
+			}
+		}
+
+		err = app.models.SavedSearches.MarkChecked(ctx, search.ID, check.UpTo, notification)
+		if err != nil {
+			return notified, err
+		}
+
+		if notification != nil && notification.ID != 0 {
+			notified++
+		}
+	}
+
+	return notified, nil
+}
+
+// sendDigests() emails a digest of the movies added since the last digest to each user who is due one, and
+// returns the number of emails sent. Users for whom there are no new movies are skipped until the next
+// interval. A failure to send to one user is logged and doesn't stop the others; they'll be retried on the
+// next check.
+func (app *application) sendDigests(ctx context.Context) (int, error) {
+	since := app.clock.Now().Add(-app.config.digest.interval)
+
+	recipients, err := app.models.Digests.Due(ctx, since, app.config.digest.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+
+	for _, recipient := range recipients {
+		movies, err := app.models.Digests.NewMovies(ctx, since, recipient.FavoriteGenres, 10)
+		if err != nil {
+			return sent, err
+		}
+
+		if len(movies) > 0 {
+			data := map[string]interface{}{
+				"name":   recipient.Name,
+				"genres": recipient.FavoriteGenres,
+				"movies": movies,
+			}
+
+			err = app.mailer.Send(recipient.Email, mailer.Localize("weekly_digest.tmpl.html", recipient.Locale), data)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"job": "send_weekly_digests", "user_id": strconv.FormatInt(recipient.UserID, 10)})
+				continue
+			}
+
+			sent++
+		}
+
+		err = app.models.Digests.MarkSent(ctx, recipient.UserID)
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
+// scheduleReplicaCheck() measures the read replica's replication lag at a regular interval. Reads fall back to the
+// primary whenever the lag is above the configured maximum, or the check fails. The lag, and whether the replica
+// is in use, are published as replication_lag_seconds and replica_in_use.
+func (app *application) scheduleReplicaCheck() {
+	lagSeconds := expvar.NewFloat("replication_lag_seconds")
+	inUse := expvar.NewInt("replica_in_use")
+
+	record := func() {
+		status := app.replica.Status()
+
+		lagSeconds.Set(status.Lag.Seconds())
+
+		if status.InUse {
+			inUse.Set(1)
+		} else {
+			inUse.Set(0)
+		}
+	}
+
+	// Publish the result of the check made at startup.
+	record()
+
+	app.schedule("check_replication_lag", app.config.db.replica.checkInterval, func(ctx context.Context) error {
+		wasInUse := app.replica.Status().InUse
+
+		lag, err := app.replica.Check(ctx)
+		record()
+
+		if err != nil {
+			return err
+		}
+
+		// Log when reads switch between the replica and the primary, rather than on every check.
+		if inUse := app.replica.Status().InUse; inUse != wasInUse {
+			target := "primary"
+			if inUse {
+				target = "replica"
+			}
+
+			app.logger.PrintInfo("switched reads to "+target, map[string]string{
+				"lag":     lag.String(),
+				"max_lag": app.config.db.replica.maxLag.String(),
+			})
+		}
+
+		return nil
+	})
+}
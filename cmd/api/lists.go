@@ -0,0 +1,663 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// readList() fetches the list with the ID in the URL, and checks that the authenticated user has the requested
+// capability on it, either as its owner or as one of its members. Lists the user can't view are reported as not
+// found, so as not to reveal that another user's private list exists, while lists the user can view but lacks
+// the capability for get a 403 response. In either case a response has already been sent when ok is false.
+func (app *application) readList(w http.ResponseWriter, r *http.Request, capability data.ListCapability) (list *data.List, ok bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	list, err = app.models.Lists.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	user := app.listViewer(r)
+
+	// Only look up the member role when it could make a difference.
+	var role string
+	if !user.IsAnonymous() && !list.OwnedBy(user) {
+		role, err = app.models.ListMembers.Role(r.Context(), list.ID, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil, false
+		}
+	}
+
+	switch {
+	case !list.Permits(user, role, data.ListView):
+		app.notFoundResponse(w, r)
+		return nil, false
+	case !list.Permits(user, role, capability):
+		app.notPermittedResponse(w, r)
+		return nil, false
+	}
+
+	return list, true
+}
+
+// listViewer() returns the user whose access to lists is checked. Some list routes can be viewed without
+// authenticating, so requirePermission() doesn't check the scopes of the personal access token or API key the
+// request was made with. A credential with neither lists scope sees lists as an anonymous user would.
+func (app *application) listViewer(r *http.Request) *data.User {
+	if !app.credentialPermits(r, "lists:read") && !app.credentialPermits(r, "lists:write") {
+		return data.AnonymousUser
+	}
+
+	return app.contextGetUser(r)
+}
+
+// readSharedList() fetches the list with the share slug in the URL, as long as it isn't private.
+func (app *application) readSharedList(w http.ResponseWriter, r *http.Request) (list *data.List, ok bool) {
+	slug := httprouter.ParamsFromContext(r.Context()).ByName("slug")
+
+	list, err := app.models.Lists.GetBySlug(r.Context(), slug)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !list.VisibleBySlug(app.listViewer(r)) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return list, true
+}
+
+func (app *application) createListHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Visibility  string `json:"visibility"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	list := &data.List{
+		UserID:      app.contextGetUser(r).ID,
+		Name:        input.Name,
+		Description: input.Description,
+		Visibility:  input.Visibility,
+	}
+
+	// New lists are private unless the client says otherwise.
+	if list.Visibility == "" {
+		list.Visibility = data.ListPrivate
+	}
+
+	v := validator.New()
+
+	if data.ValidateList(v, list); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = list.EnsureSlug()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Lists.Insert(r.Context(), list)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/lists/%d", list.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"list": list}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listListsHandler() returns a page of the authenticated user's lists.
+func (app *application) listListsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "id")
+
+	input.Filters.SortSafeList = []string{"id", "name", "-id", "-name"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	lists, metadata, err := app.models.Lists.GetAllForUser(r.Context(), app.contextGetUser(r).ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"lists": lists, "metadata": metadata}, app.paginationHeaders(r, metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listPopularListsHandler() returns a page of the public lists, by default the most viewed first.
+func (app *application) listPopularListsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-view_count")
+
+	input.Filters.SortSafeList = []string{"id", "name", "view_count", "-id", "-name", "-view_count"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	lists, metadata, err := app.models.Lists.GetPublic(r.Context(), input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"lists": lists, "metadata": metadata}, app.paginationHeaders(r, metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListView)
+	if !ok {
+		return
+	}
+
+	app.writeList(w, r, list)
+}
+
+// showSharedListHandler() returns the list with the share slug in the URL.
+func (app *application) showSharedListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readSharedList(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeList(w, r, list)
+}
+
+// writeList() sends the list in the response, counting the view towards its popularity unless it was made by
+// the list's owner.
+func (app *application) writeList(w http.ResponseWriter, r *http.Request, list *data.List) {
+	if !list.OwnedBy(app.contextGetUser(r)) {
+		err := app.models.Lists.RecordView(r.Context(), list.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		list.Views++
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"list": list}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListManage)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		Visibility  *string `json:"visibility"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		list.Name = *input.Name
+	}
+
+	if input.Description != nil {
+		list.Description = *input.Description
+	}
+
+	if input.Visibility != nil {
+		list.Visibility = *input.Visibility
+	}
+
+	v := validator.New()
+
+	if data.ValidateList(v, list); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = list.EnsureSlug()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Lists.Update(r.Context(), list)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"list": list}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListManage)
+	if !ok {
+		return
+	}
+
+	err := app.models.Lists.Delete(r.Context(), list.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "list successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listListEntriesHandler() returns a page of the movies in a list, in list order.
+func (app *application) listListEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListView)
+	if !ok {
+		return
+	}
+
+	app.writeListEntries(w, r, list)
+}
+
+// listSharedListEntriesHandler() returns a page of the movies in the list with the share slug in the URL.
+func (app *application) listSharedListEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readSharedList(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeListEntries(w, r, list)
+}
+
+// writeListEntries() sends a page of the list's movies in the response, using the pagination parameters in the
+// query string.
+func (app *application) writeListEntries(w http.ResponseWriter, r *http.Request, list *data.List) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// Entries are always returned in list order, so the only valid sort is by position.
+	input.Sort = "position"
+	input.Filters.SortSafeList = []string{"position"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, metadata, err := app.models.Lists.Entries(r.Context(), list.ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"entries": entries, "metadata": metadata}, app.paginationHeaders(r, metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addListEntryHandler() adds a movie to a list. The optional position is 1-based; if it is omitted the movie is
+// added to the end of the list.
+func (app *application) addListEntryHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListEditEntries)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		MovieID  int64 `json:"movie_id"`
+		Position int   `json:"position"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.MovieID > 0, "movie_id", "must be provided")
+	v.Check(input.Position >= 0, "position", "must not be negative")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Movies.Get(r.Context(), input.MovieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("movie_id", "must be an existing movie")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Lists.AddEntry(r.Context(), list.ID, input.MovieID, app.contextGetUser(r).ID, input.Position)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateListEntry):
+			v.AddError("movie_id", "is already in this list")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrListFull):
+			v.AddError("movie_id", fmt.Sprintf("cannot be added, lists can hold at most %d movies", data.MaxListEntries))
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"message": "movie successfully added to list"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) removeListEntryHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListEditEntries)
+	if !ok {
+		return
+	}
+
+	movieID, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("movie_id"), 10, 64)
+	if err != nil || movieID < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Lists.RemoveEntry(r.Context(), list.ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "movie successfully removed from list"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// reorderListEntriesHandler() rearranges a list. The request body holds the IDs of every movie in the list, in
+// the new order.
+func (app *application) reorderListEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListEditEntries)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		MovieIDs []int64 `json:"movie_ids"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.MovieIDs != nil, "movie_ids", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Lists.Reorder(r.Context(), list.ID, input.MovieIDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrListOrderMismatch):
+			v.AddError("movie_ids", "must contain each movie in the list exactly once")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "list successfully reordered"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listListMembersHandler() returns the members of a list. Anyone who can view the list can see its members.
+func (app *application) listListMembersHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListView)
+	if !ok {
+		return
+	}
+
+	members, err := app.models.ListMembers.GetAllForList(r.Context(), list.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"members": members}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addListMemberHandler() gives a user access to a list as a viewer or an editor. The user is identified by
+// either their ID or their email address. If they are already a member, their role is changed.
+func (app *application) addListMemberHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListManage)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		UserID int64  `json:"user_id"`
+		Email  string `json:"email"`
+		Role   string `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.UserID > 0 || input.Email != "", "user_id", "either user_id or email must be provided")
+	v.Check(input.UserID == 0 || input.Email == "", "user_id", "must not be provided along with email")
+
+	if input.Email != "" {
+		data.ValidateEmail(v, input.Email)
+	}
+
+	data.ValidateListRole(v, input.Role)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Resolve the email address to a user ID. An unknown address is reported in the same way as an unknown ID.
+	if input.Email != "" {
+		user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("email", "no matching activated user found")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		input.UserID = user.ID
+	}
+
+	if input.UserID == list.UserID {
+		v.AddError("user_id", "must not be the list's owner")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	member, err := app.models.ListMembers.Upsert(r.Context(), list.ID, input.UserID, input.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			if input.Email != "" {
+				v.AddError("email", "no matching activated user found")
+			} else {
+				v.AddError("user_id", "no matching activated user found")
+			}
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"member": member}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// removeListMemberHandler() removes a user's access to a list. The owner can remove any member, and members can
+// remove themselves.
+func (app *application) removeListMemberHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := app.readList(w, r, data.ListView)
+	if !ok {
+		return
+	}
+
+	userID, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("user_id"), 10, 64)
+	if err != nil || userID < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if !list.OwnedBy(user) && user.ID != userID {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	err = app.models.ListMembers.Delete(r.Context(), list.ID, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "member successfully removed from list"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
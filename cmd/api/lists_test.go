@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micypac/flick-info/internal/data"
+)
+
+// insertTestList() inserts a list with the given visibility, owned by the user. Every list gets a share slug,
+// as one made unlisted and then private or public keeps it, so that each visibility can be requested by slug.
+func insertTestList(t *testing.T, app *application, owner *data.User, visibility string) *data.List {
+	t.Helper()
+
+	list := &data.List{
+		UserID:     owner.ID,
+		Name:       visibility + " list",
+		Visibility: data.ListUnlisted,
+	}
+
+	err := list.EnsureSlug()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list.Visibility = visibility
+
+	err = app.models.Lists.Insert(context.Background(), list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return list
+}
+
+func TestListVisibility(t *testing.T) {
+	app := newTestApplication(t)
+	routes := app.routes()
+
+	owner, ownerToken := insertTestUser(t, app, "owner")
+	_, otherToken := insertTestUser(t, app, "other")
+
+	callers := []struct {
+		name  string
+		token string
+	}{
+		{"owner", ownerToken},
+		{"other user", otherToken},
+		{"anonymous", ""},
+	}
+
+	// The status each caller gets for a list of each visibility, requested by ID and by share slug. Lists which
+	// can't be viewed are reported as not found.
+	tests := []struct {
+		visibility string
+		byID       map[string]int
+		bySlug     map[string]int
+	}{
+		{
+			visibility: data.ListPrivate,
+			byID:       map[string]int{"owner": http.StatusOK, "other user": http.StatusNotFound, "anonymous": http.StatusNotFound},
+			bySlug:     map[string]int{"owner": http.StatusOK, "other user": http.StatusNotFound, "anonymous": http.StatusNotFound},
+		},
+		{
+			visibility: data.ListUnlisted,
+			byID:       map[string]int{"owner": http.StatusOK, "other user": http.StatusNotFound, "anonymous": http.StatusNotFound},
+			bySlug:     map[string]int{"owner": http.StatusOK, "other user": http.StatusOK, "anonymous": http.StatusOK},
+		},
+		{
+			visibility: data.ListPublic,
+			byID:       map[string]int{"owner": http.StatusOK, "other user": http.StatusOK, "anonymous": http.StatusOK},
+			bySlug:     map[string]int{"owner": http.StatusOK, "other user": http.StatusOK, "anonymous": http.StatusOK},
+		},
+	}
+
+	for _, tt := range tests {
+		list := insertTestList(t, app, owner, tt.visibility)
+
+		paths := map[string]string{
+			"by ID":   fmt.Sprintf("/v1/lists/%d", list.ID),
+			"by slug": "/v1/shared/lists/" + list.Slug,
+		}
+
+		for _, caller := range callers {
+			for via, path := range paths {
+				want := tt.byID[caller.name]
+				if via == "by slug" {
+					want = tt.bySlug[caller.name]
+				}
+
+				t.Run(fmt.Sprintf("%s list %s as %s", tt.visibility, via, caller.name), func(t *testing.T) {
+					r := httptest.NewRequest(http.MethodGet, path, nil)
+					if caller.token != "" {
+						r.Header.Set("Authorization", "Bearer "+caller.token)
+					}
+
+					rr := httptest.NewRecorder()
+					routes.ServeHTTP(rr, r)
+
+					if rr.Code != want {
+						t.Errorf("got status %d; want %d: %s", rr.Code, want, rr.Body)
+					}
+				})
+			}
+		}
+	}
+}
@@ -2,25 +2,36 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/clock"
 	"github.com/micypac/flick-info/internal/data"
 	"github.com/micypac/flick-info/internal/jsonlog"
+	"github.com/micypac/flick-info/internal/jwt"
 	"github.com/micypac/flick-info/internal/mailer"
-
-	_ "github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/redis"
+	"github.com/micypac/flick-info/internal/storage"
+	"github.com/micypac/flick-info/internal/tracing"
+	"github.com/micypac/flick-info/internal/urlsign"
+	"github.com/micypac/flick-info/internal/validator"
+	"golang.org/x/crypto/bcrypt"
 )
 
-
-
 var (
 	buildTime string
 	version   string
@@ -30,77 +41,398 @@ var (
 // Read the config settings from command-line flags when the app starts.
 // port - the network port the server is listening on
 // env - current operating env for the app(dev, staging, prod, etc.)
-// db - hold the config setting for the db connection pool.
+// dev - bootstrap a local development setup (migrations, sample data, log mailer, localhost CORS) on startup.
+// db - hold the storage backend (postgres or memory) and the config setting for the db connection pool.
 // limiter - hold the config setting for the rate limiter containing the request per second, burst and switch flag.
 type config struct {
 	port int
 	env  string
+	dev  bool
 	db   struct {
-		dsn          string
+		backend     string
+		dsn         string
+		migrate     bool
+		schemaCheck string
+		replica     struct {
+			dsn           string
+			maxLag        time.Duration
+			checkInterval time.Duration
+		}
+		shards       []data.ShardSpec
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
 	}
 	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		rps      float64
+		burst    int
+		enabled  bool
+		store    string
+		redisURL string
 	}
 	smtp struct {
 		host     string
 		port     int
 		username string
 		password string
-		sender   string
+	}
+	mail struct {
+		transport string
+		sender    string
+		ses       struct {
+			region    string
+			accessKey string
+			secretKey string
+			endpoint  string
+		}
+		sendGrid struct {
+			apiKey string
+		}
+		mailgun struct {
+			domain   string
+			apiKey   string
+			endpoint string
+		}
+		attempts         int
+		backoff          time.Duration
+		alertThreshold   float64
+		alertWindow      time.Duration
+		breakerThreshold int
+		breakerCooldown  time.Duration
+	}
+	outbox struct {
+		workers  int
+		attempts int
+		backoff  time.Duration
+	}
+	alerts struct {
+		webhookURL string
+	}
+	shutdown struct {
+		taskTimeout time.Duration
+	}
+	requestTimeout struct {
+		max time.Duration
+	}
+	bcrypt struct {
+		cost int
+	}
+	startup struct {
+		maxWait   time.Duration
+		backoff   time.Duration
+		checkSMTP bool
 	}
 	cors struct {
 		trustedOrigins []string
 	}
+	router struct {
+		tolerant bool
+	}
+	requestLog struct {
+		enabled bool
+	}
+	xml struct {
+		enabled bool
+	}
+	json struct {
+		maxDepth       int
+		maxArrayLength int
+	}
+	urlSigning struct {
+		key    string
+		maxTTL time.Duration
+	}
+	digest struct {
+		interval      time.Duration
+		checkInterval time.Duration
+		batchSize     int
+	}
+	savedSearches struct {
+		checkInterval time.Duration
+		batchSize     int
+	}
+	emailThrottle struct {
+		limit  int
+		window time.Duration
+	}
+	chaos struct {
+		rules []chaosRule
+	}
+	analytics struct {
+		flushInterval time.Duration
+		cacheTTL      time.Duration
+	}
+	capture struct {
+		size      int
+		bodyBytes int
+	}
+	tokens struct {
+		activationTTL     time.Duration
+		authenticationTTL time.Duration
+		passwordResetTTL  time.Duration
+		refreshTTL        time.Duration
+		purgeInterval     time.Duration
+		purgeBatchSize    int
+		hmacKey           string
+		sliding           struct {
+			enabled     bool
+			maxLifetime time.Duration
+			interval    time.Duration
+		}
+	}
+	auth struct {
+		mode string
+	}
+	jwt struct {
+		secret string
+		issuer string
+		ttl    time.Duration
+	}
+	storage struct {
+		backend   string
+		dir       string
+		publicURL string
+		s3        struct {
+			endpoint  string
+			region    string
+			bucket    string
+			accessKey string
+			secretKey string
+			pathStyle bool
+		}
+	}
+	posters struct {
+		maxBytes int
+	}
+	movieCache struct {
+		store      string
+		ttl        time.Duration
+		maxEntries int
+		redisURL   string
+	}
+	debug struct {
+		addr string
+	}
+	tracing struct {
+		endpoint    string
+		serviceName string
+		sampleRatio float64
+	}
 }
 
 // App struct holds the dependencies for HTTP handlers, helpers, and middleware.
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config         config
+	clock          clock.Clock
+	startedAt      time.Time
+	logger         *jsonlog.Logger
+	models         data.Models
+	mailer         mailer.Sender
+	signer         *urlsign.Signer
+	jwt            *jwt.Signer
+	storage        storage.Store
+	db             *sql.DB
+	replica        *data.Replica
+	shards         []data.Shard
+	captures       *captureBuffer
+	limiter        *clientLimiter
+	analytics      *analyticsRecorder
+	analyticsCache analyticsCache
+	faultsInjected *expvar.Map
+	outboxWake     chan struct{}
+	tracer         *tracing.Tracer
+	wg             sync.WaitGroup
+	tasks          taskSet
+	shutdown       chan struct{}
 }
 
 func main() {
+	// Run a subcommand, such as "version" or "healthcheck", instead of the server if one is given.
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
 	var cfg config
 
 	// Read the value of command-line flags into the config struct.
 	// Port# 4000 and "dev" environment default if no corresponding flags are provided.
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.BoolVar(&cfg.dev, "dev", false, "Development mode: migrate and seed the database, log emails, and allow localhost CORS origins")
+	flag.StringVar(&cfg.db.backend, "db", "postgres", "Storage backend (postgres|memory)")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
+	flag.BoolVar(&cfg.db.migrate, "db-migrate", false, "Apply any pending migrations on startup")
+	flag.StringVar(&cfg.db.schemaCheck, "db-schema-check", "strict", "Check the schema version on startup (strict|warn|off): strict refuses to start if the schema is behind")
+	flag.StringVar(&cfg.db.replica.dsn, "db-replica-dsn", "", "PostgreSQL DSN of a read replica for movie listings (none if empty)")
+	flag.DurationVar(&cfg.db.replica.maxLag, "db-replica-max-lag", 10*time.Second, "Replication lag above which reads go to the primary instead of the replica")
+	flag.DurationVar(&cfg.db.replica.checkInterval, "db-replica-check-interval", 5*time.Second, "Interval between replication lag checks")
+	flag.Func("db-movie-shard", "Database holding a range of movie IDs above those in the main database, as MIN-MAX=DSN, or MIN-=DSN for the last shard (repeatable, in ascending order)", func(val string) error {
+		spec, err := data.ParseShardSpec(val)
+		if err != nil {
+			return err
+		}
+
+		cfg.db.shards = append(cfg.db.shards, spec)
+		return nil
+	})
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.limiter.store, "limiter-store", "memory", "Where the rate limiter keeps each client's token bucket (memory|redis): redis shares them between instances")
+	flag.StringVar(&cfg.limiter.redisURL, "limiter-redis-url", "", "Redis URL for limiter-store=redis, as redis://[:password@]host[:port][/db]")
+
+	flag.StringVar(&cfg.mail.transport, "mail-transport", "smtp", "How emails are sent (smtp|ses|sendgrid|mailgun|log)")
+	flag.StringVar(&cfg.mail.sender, "mail-sender", "Flickinfo <no-reply@flickinfo.micypac.io>", "Sender address of emails, optionally with a display name")
+	flag.StringVar(&cfg.mail.sender, "smtp-sender", "Flickinfo <no-reply@flickinfo.micypac.io>", "Deprecated: use mail-sender")
 
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "72cbe46f2dea79", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "91509898e93d7d", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Flickinfo <no-reply@flickinfo.micypac.io>", "SMTP sender")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+
+	flag.StringVar(&cfg.mail.ses.region, "mail-ses-region", "us-east-1", "AWS region for mail-transport=ses")
+	flag.StringVar(&cfg.mail.ses.accessKey, "mail-ses-access-key", "", "AWS access key ID for mail-transport=ses")
+	flag.StringVar(&cfg.mail.ses.secretKey, "mail-ses-secret-key", "", "AWS secret access key for mail-transport=ses")
+	flag.StringVar(&cfg.mail.ses.endpoint, "mail-ses-endpoint", "", "SES API URL for mail-transport=ses (the region's endpoint if empty)")
+	flag.StringVar(&cfg.mail.sendGrid.apiKey, "mail-sendgrid-api-key", "", "SendGrid API key for mail-transport=sendgrid")
+	flag.StringVar(&cfg.mail.mailgun.domain, "mail-mailgun-domain", "", "Mailgun sending domain for mail-transport=mailgun")
+	flag.StringVar(&cfg.mail.mailgun.apiKey, "mail-mailgun-api-key", "", "Mailgun API key for mail-transport=mailgun")
+	flag.StringVar(&cfg.mail.mailgun.endpoint, "mail-mailgun-endpoint", "https://api.mailgun.net", "Mailgun API URL for mail-transport=mailgun, https://api.eu.mailgun.net for EU domains")
+
+	flag.IntVar(&cfg.mail.attempts, "mail-attempts", 3, "Total attempts to send each email, including the first")
+	flag.DurationVar(&cfg.mail.backoff, "mail-retry-backoff", 500*time.Millisecond, "Delay before the first email retry, doubled for each following retry")
+	flag.Float64Var(&cfg.mail.alertThreshold, "mail-alert-threshold", 0.5, "Fraction of failed emails for a template which triggers an alert (0 disables)")
+	flag.DurationVar(&cfg.mail.alertWindow, "mail-alert-window", 15*time.Minute, "Window over which the email failure rate is measured")
+	flag.IntVar(&cfg.mail.breakerThreshold, "mail-breaker-threshold", 5, "Consecutive failed email attempts which stop sending until mail-breaker-cooldown has passed (0 disables)")
+	flag.DurationVar(&cfg.mail.breakerCooldown, "mail-breaker-cooldown", 30*time.Second, "Time to stop sending emails for once the circuit breaker opens")
+
+	flag.DurationVar(&cfg.startup.maxWait, "startup-max-wait", time.Minute, "Maximum time to wait for the database (and SMTP server) to become available on startup")
+	flag.DurationVar(&cfg.startup.backoff, "startup-retry-backoff", 500*time.Millisecond, "Delay before the first startup retry, doubled for each following retry")
+	flag.BoolVar(&cfg.startup.checkSMTP, "smtp-check", false, "Wait for the SMTP server to accept a connection on startup")
+	flag.DurationVar(&cfg.shutdown.taskTimeout, "shutdown-task-timeout", 20*time.Second, "Maximum time to wait for background tasks to complete on shutdown")
+
+	flag.IntVar(&cfg.outbox.workers, "mail-outbox-workers", 2, "Number of workers sending the emails queued in the outbox")
+	flag.IntVar(&cfg.outbox.attempts, "mail-outbox-attempts", 5, "Total attempts to send each queued email before marking it as failed")
+	flag.DurationVar(&cfg.outbox.backoff, "mail-outbox-backoff", 30*time.Second, "Delay before retrying a queued email, doubled for each following retry")
+
+	flag.StringVar(&cfg.alerts.webhookURL, "alert-webhook-url", "", "URL to POST alerts to as JSON (alerts are only logged if empty)")
+
+	flag.StringVar(&cfg.urlSigning.key, "url-signing-key", "", "Secret key for signing shareable URLs (random per process if empty)")
+	flag.DurationVar(&cfg.urlSigning.maxTTL, "url-signing-max-ttl", 7*24*time.Hour, "Maximum lifetime of a signed shareable URL")
+
+	flag.DurationVar(&cfg.digest.interval, "digest-interval", 7*24*time.Hour, "Interval between digest emails to each user")
+	flag.DurationVar(&cfg.digest.checkInterval, "digest-check-interval", time.Hour, "Interval between checks for users due a digest email")
+	flag.IntVar(&cfg.digest.batchSize, "digest-batch-size", 100, "Maximum digest emails sent per check")
+
+	flag.DurationVar(&cfg.savedSearches.checkInterval, "saved-search-check-interval", 15*time.Minute, "Interval between checks of saved searches for new matching movies")
+	flag.IntVar(&cfg.savedSearches.batchSize, "saved-search-batch-size", 100, "Maximum saved searches checked per run")
+
+	flag.IntVar(&cfg.emailThrottle.limit, "email-throttle-limit", 3, "Maximum emails of each kind sent to an account per window")
+	flag.DurationVar(&cfg.emailThrottle.window, "email-throttle-window", time.Hour, "Window for the per-account email limit")
+
+	flag.IntVar(&cfg.json.maxDepth, "json-max-depth", 20, "Maximum nesting depth of JSON request bodies")
+	flag.IntVar(&cfg.json.maxArrayLength, "json-max-array-length", 1000, "Maximum number of elements in each array in JSON request bodies")
+
+	flag.BoolVar(&cfg.xml.enabled, "xml-enabled", false, "Serve XML responses to clients which send Accept: application/xml")
+	flag.Func("chaos-rule", "Inject a fault into a percentage of requests, e.g. \"GET /v1/movies/:id error=503 10%\" (repeatable; not allowed in production)", func(val string) error {
+		rule, err := parseChaosRule(val)
+		if err != nil {
+			return err
+		}
+
+		cfg.chaos.rules = append(cfg.chaos.rules, rule)
+		return nil
+	})
+
+	flag.DurationVar(&cfg.analytics.flushInterval, "analytics-flush-interval", time.Minute, "Interval between saves of the request and movie view counts for GET /v1/admin/analytics")
+	flag.DurationVar(&cfg.analytics.cacheTTL, "analytics-cache-ttl", 5*time.Minute, "How long analytics reports are cached")
+
+	flag.IntVar(&cfg.capture.size, "debug-capture-size", 0, "Number of recent requests and responses to keep for GET /v1/admin/debug/requests (0 disables capturing)")
+	flag.IntVar(&cfg.capture.bodyBytes, "debug-capture-body-bytes", 2048, "Maximum bytes of each captured request and response body")
+
+	flag.BoolVar(&cfg.router.tolerant, "router-tolerant", false, "Redirect non-canonical paths (trailing slash, wrong case) with 308")
+
+	flag.BoolVar(&cfg.requestLog.enabled, "request-log-enabled", true, "Log each request with its status, duration, client IP, request ID and user ID")
 
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
 
+	flag.DurationVar(&cfg.tokens.activationTTL, "token-activation-ttl", 3*24*time.Hour, "Activation token lifetime")
+	flag.DurationVar(&cfg.tokens.authenticationTTL, "token-auth-ttl", 24*time.Hour, "Authentication token lifetime")
+	flag.DurationVar(&cfg.tokens.passwordResetTTL, "token-password-reset-ttl", 45*time.Minute, "Password reset token lifetime")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "token-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime, renewed each time the token is exchanged")
+	flag.DurationVar(&cfg.tokens.purgeInterval, "token-purge-interval", time.Hour, "Interval between expired token purges")
+	flag.IntVar(&cfg.tokens.purgeBatchSize, "token-purge-batch-size", 1000, "Maximum expired tokens deleted per batch")
+	flag.StringVar(&cfg.tokens.hmacKey, "token-hmac-key", "", "Secret key for HMAC-SHA-256 token hashing (SHA-256 if empty)")
+	flag.BoolVar(&cfg.tokens.sliding.enabled, "token-auth-sliding", false, "Extend authentication token expiry on use")
+	flag.DurationVar(&cfg.tokens.sliding.maxLifetime, "token-auth-max-lifetime", 30*24*time.Hour, "Absolute maximum lifetime of a sliding authentication token")
+	flag.DurationVar(&cfg.tokens.sliding.interval, "token-auth-sliding-interval", 5*time.Minute, "Minimum expiry extension before a sliding token is updated")
+
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "stateful", "Authentication mode (stateful|jwt): jwt also issues signed JWTs from POST /v1/tokens/jwt, which are accepted without a token lookup")
+	flag.StringVar(&cfg.jwt.secret, "jwt-secret", "", "Secret key for signing JWTs, at least 32 bytes long (required in jwt auth mode)")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "flickinfo", "Issuer (iss claim) of JWTs, which must match for a JWT to be accepted")
+	flag.DurationVar(&cfg.jwt.ttl, "jwt-ttl", 15*time.Minute, "JWT lifetime: JWTs can't be revoked before they expire")
+
+	flag.StringVar(&cfg.storage.backend, "storage", "disk", "Where uploaded files such as posters are kept (disk|s3)")
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "./uploads", "Directory for uploaded files with storage=disk")
+	flag.StringVar(&cfg.storage.publicURL, "storage-public-url", "", "Base URL uploaded files are served from directly, such as a CDN or public bucket (served by the API at /v1/posters if empty)")
+	flag.StringVar(&cfg.storage.s3.endpoint, "storage-s3-endpoint", "https://s3.amazonaws.com", "S3 endpoint URL for storage=s3")
+	flag.StringVar(&cfg.storage.s3.region, "storage-s3-region", "us-east-1", "S3 region for storage=s3")
+	flag.StringVar(&cfg.storage.s3.bucket, "storage-s3-bucket", "", "S3 bucket for storage=s3")
+	flag.StringVar(&cfg.storage.s3.accessKey, "storage-s3-access-key", "", "S3 access key ID for storage=s3")
+	flag.StringVar(&cfg.storage.s3.secretKey, "storage-s3-secret-key", "", "S3 secret access key for storage=s3")
+	flag.BoolVar(&cfg.storage.s3.pathStyle, "storage-s3-path-style", false, "Address the S3 bucket in the URL path rather than the host name, as MinIO and most other S3-compatible services need")
+	flag.IntVar(&cfg.posters.maxBytes, "poster-max-bytes", 5_242_880, "Maximum size of an uploaded poster image")
+
+	flag.StringVar(&cfg.movieCache.store, "movie-cache", "none", "Where movies and movie list pages are cached (none|memory|redis): redis shares them, and their invalidation, between instances")
+	flag.IntVar(&cfg.movieCache.maxEntries, "movie-cache-max-entries", 10_000, "Number of movies and movie list pages to cache with movie-cache=memory")
+	flag.DurationVar(&cfg.movieCache.ttl, "movie-cache-ttl", 30*time.Second, "How long movies and movie list pages are cached, and so how stale changes made elsewhere can be")
+	flag.StringVar(&cfg.movieCache.redisURL, "movie-cache-redis-url", "", "Redis URL for movie-cache=redis, as redis://[:password@]host[:port][/db]")
+
+	flag.StringVar(&cfg.debug.addr, "debug-addr", "localhost:4001", "Address of the debug server, which serves the expvar metrics, pprof profiles and verbose healthcheck without authentication (off if empty)")
+
+	flag.StringVar(&cfg.tracing.endpoint, "otel-endpoint", "", "OTLP/HTTP collector URL to export OpenTelemetry trace spans to, such as http://localhost:4318 (tracing is off if empty)")
+	flag.StringVar(&cfg.tracing.serviceName, "otel-service-name", "flickinfo-api", "Service name reported in the exported trace spans")
+	flag.Float64Var(&cfg.tracing.sampleRatio, "otel-sample-ratio", 1, "Fraction (0-1) of requests to trace, unless the caller's traceparent header says whether to")
+
+	flag.DurationVar(&cfg.requestTimeout.max, "request-timeout-max", 30*time.Second, "Maximum deadline clients can request with the X-Request-Timeout header (0 ignores the header)")
+
+	flag.IntVar(&cfg.bcrypt.cost, "bcrypt-cost", 12, "bcrypt cost for hashing passwords (10-31, at least 12 in production)")
+
+	configFile := flag.String("config", "", "Config file of name = value settings named after the flags, in a subset of TOML (defaults to $FLICKINFO_CONFIG)")
+
 	// Create a new version boolean flag with the default value false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
+	benchmarkBcrypt := flag.Bool("bcrypt-benchmark", false, "Display how long hashing a password takes at each bcrypt cost from 10 to 15 and exit")
 
 	flag.Parse()
 
+	// Fill in the settings which weren't given as flags from FLICKINFO_* environment variables and the config file.
+	err := applyConfigSources(flag.CommandLine, *configFile, os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	if *displayVersion {
-		fmt.Printf("Version:\t%s\n", version)
-		fmt.Printf("Build time:\t%s\n", buildTime)
+		printVersion(os.Stdout)
+		os.Exit(0)
+	}
+
+	if *benchmarkBcrypt {
+		for cost := 10; cost <= 15; cost++ {
+			d, err := data.BenchmarkPasswordCost(cost)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Cost %d:\t%s\n", cost, d.Round(time.Millisecond))
+		}
 		os.Exit(0)
 	}
 
@@ -108,15 +440,213 @@ func main() {
 	// to the standard out stream.
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	// Create a DB connection pool passing in the config struct.
-	db, err := openDB(cfg)
+	// Check the config settings before opening any connections, so a bad flag fails fast.
+	err = cfg.validate()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Hash passwords with the configured cost, and log how long that takes on this machine, as every login and
+	// registration takes about as long.
+	data.PasswordCost = cfg.bcrypt.cost
+
+	hashDuration, err := data.BenchmarkPasswordCost(cfg.bcrypt.cost)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 
-	defer db.Close()
+	logger.PrintInfo("password hashing benchmarked", map[string]string{
+		"bcrypt_cost": strconv.Itoa(cfg.bcrypt.cost),
+		"duration":    hashDuration.Round(time.Millisecond).String(),
+	})
+
+	// Use the system clock. Time-dependent logic, like token expiry and the scheduled jobs, reads the time through
+	// this rather than calling time.Now() directly, so that it can be swapped for a fake clock in tests.
+	clk := clock.Real{}
+
+	opts := data.ModelOptions{
+		Hashing: tokenHashing(cfg),
+		Sliding: data.SlidingExpiry{
+			Enabled:     cfg.tokens.sliding.enabled,
+			TTL:         cfg.tokens.authenticationTTL,
+			MaxLifetime: cfg.tokens.sliding.maxLifetime,
+			Interval:    cfg.tokens.sliding.interval,
+		},
+		Clock: clk,
+	}
 
-	logger.PrintInfo("database connection pool established", nil)
+	// Trace requests, along with their database queries, and email sends, if there is a collector to export the
+	// spans to.
+	var tracer *tracing.Tracer
+
+	if cfg.tracing.endpoint != "" {
+		tracer = tracing.New(tracing.Config{
+			Endpoint:    cfg.tracing.endpoint,
+			ServiceName: cfg.tracing.serviceName,
+			SampleRatio: cfg.tracing.sampleRatio,
+		})
+
+		expvar.Publish("tracing", expvar.Func(func() interface{} {
+			return tracer.Stats()
+		}))
+
+		logger.PrintInfo("tracing enabled", map[string]string{"endpoint": cfg.tracing.endpoint})
+	}
+
+	var models data.Models
+	var sender mailer.Sender
+	var db *sql.DB
+	var replica *data.Replica
+
+	if cfg.db.backend == "memory" {
+		// Keep everything in memory and log emails rather than sending them, so the API runs without any external
+		// services. Users are granted movies:write as well, so that the movie endpoints can all be tried out.
+		models = data.NewMemoryModels(opts, "movies:write")
+		sender = mailer.New(mailer.Log{Logger: logger}, cfg.mail.sender)
+
+		logger.PrintInfo("using in-memory storage, all data will be lost on exit", nil)
+	} else {
+		// Create a DB connection pool passing in the config struct, waiting for the database to start if it
+		// isn't ready yet.
+		err = waitFor("database", cfg, logger, func() error {
+			db, err = openDB(cfg, cfg.db.dsn, tracer)
+			return err
+		})
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		defer db.Close()
+
+		logger.PrintInfo("database connection pool established", nil)
+
+		if cfg.dev {
+			err = bootstrapDev(db, logger)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+		} else if cfg.db.migrate {
+			err = migrateDB(db, logger)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+		}
+
+		err = checkSchema(db, cfg.db.schemaCheck, logger)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		// Publish the db connection pool stats.
+		expvar.Publish("database", expvar.Func(func() interface{} {
+			return db.Stats()
+		}))
+
+		// Open a connection pool for the read replica, if there is one, and measure its lag straight away so
+		// that it can be used from the first request.
+		if cfg.db.replica.dsn != "" {
+			replicaDB, err := openDB(cfg, cfg.db.replica.dsn, tracer)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+
+			defer replicaDB.Close()
+
+			replica = &data.Replica{DB: replicaDB, MaxLag: cfg.db.replica.maxLag}
+
+			lag, err := replica.Check(context.Background())
+			if err != nil {
+				logger.PrintError(err, map[string]string{"replica": "initial lag check failed"})
+			} else {
+				logger.PrintInfo("read replica connection pool established", map[string]string{"lag": lag.String()})
+			}
+
+			opts.Replica = replica
+		}
+
+		// Open a connection pool for each movie shard, and make sure it is on the same schema version.
+		for _, spec := range cfg.db.shards {
+			shardDB, err := openShard(cfg, spec, tracer, logger)
+			if err != nil {
+				logger.PrintFatal(err, map[string]string{"shard_min_id": strconv.FormatInt(spec.MinID, 10)})
+			}
+
+			defer shardDB.Close()
+
+			opts.Shards = append(opts.Shards, data.Shard{DB: shardDB, MinID: spec.MinID, MaxID: spec.MaxID})
+		}
+
+		// New movies go into the last shard, so its IDs must start in its range.
+		if len(opts.Shards) > 0 {
+			last := opts.Shards[len(opts.Shards)-1]
+
+			moved, err := data.PrepareShardSequence(context.Background(), last)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+
+			if moved {
+				logger.PrintInfo("moved movie ID sequence to the start of the last shard", map[string]string{"min_id": strconv.FormatInt(last.MinID, 10)})
+			}
+		}
+
+		models = data.NewModels(db, opts)
+
+		// In dev mode, log emails rather than sending them, so no email service is needed. The transport settings
+		// were checked by cfg.validate().
+		transport, _ := mailTransport(cfg, logger)
+		if cfg.dev {
+			transport = mailer.Log{Logger: logger}
+		}
+
+		m := mailer.New(transport, cfg.mail.sender)
+
+		if cfg.startup.checkSMTP && !cfg.dev && cfg.mail.transport == "smtp" {
+			err = waitFor("smtp", cfg, logger, m.Check)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+		}
+
+		sender = m
+	}
+
+	// Cache the most read movies and movie list pages in front of the store, with hit and miss counts published
+	// as the movie_cache variable.
+	if cfg.movieCache.store != "none" {
+		var cache data.MovieCache = data.NewMemoryMovieCache(cfg.movieCache.ttl, cfg.movieCache.maxEntries, clk)
+
+		if cfg.movieCache.store == "redis" {
+			client, err := openRedis(cfg, cfg.movieCache.redisURL, logger)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+
+			cache = &redisMovieCache{client: client, ttl: cfg.movieCache.ttl}
+		}
+
+		cached := data.NewCachedMovieStore(models.Movies, cache)
+		models.Movies = cached
+
+		// The models which change movies behind the store's back invalidate the movies they change.
+		models.Duplicates.Cache = cached
+		models.Genres.Cache = cached
+		models.Ratings.Cache = cached
+
+		expvar.Publish("movie_cache", expvar.Func(func() interface{} {
+			return cached.Stats()
+		}))
+	}
+
+	// Count, retry and alert on failures for every email, whichever sender is used.
+	instrumented := mailer.NewInstrumented(sender)
+	instrumented.Attempts = cfg.mail.attempts
+	instrumented.Backoff = cfg.mail.backoff
+	instrumented.AlertThreshold = cfg.mail.alertThreshold
+	instrumented.AlertWindow = cfg.mail.alertWindow
+	instrumented.BreakerThreshold = cfg.mail.breakerThreshold
+	instrumented.BreakerCooldown = cfg.mail.breakerCooldown
+	instrumented.Tracer = tracer
 
 	// Publish a new "version" variable in the expvar handler containing the app version number.
 	expvar.NewString("version").Set(version)
@@ -126,24 +656,97 @@ func main() {
 		return runtime.NumGoroutine()
 	}))
 
-	// Publish the db connection pool stats.
-	expvar.Publish("database", expvar.Func(func() interface{} {
-		return db.Stats()
-	}))
-
 	// Publish the current Unix timestamp.
 	expvar.Publish("timestamp", expvar.Func(func() interface{} {
 		return time.Now().Unix()
 	}))
 
+	// Use the configured URL signing key. Without one, generate a random key, which means signed URLs stop
+	// working when the process restarts and aren't shared between instances.
+	signingKey := []byte(cfg.urlSigning.key)
+	if len(signingKey) == 0 {
+		signingKey = make([]byte, 32)
+
+		_, err = rand.Read(signingKey)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		logger.PrintInfo("no url signing key configured, using a random key", nil)
+	}
+
+	// With Redis, the clients' token buckets are shared by every instance of the API.
+	var limiterStore rateLimitStore = newMemoryRateLimitStore(cfg.limiter.rps, cfg.limiter.burst)
+
+	if cfg.limiter.store == "redis" {
+		client, err := openRedis(cfg, cfg.limiter.redisURL, logger)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		limiterStore = &redisRateLimitStore{client: client, rps: cfg.limiter.rps, burst: cfg.limiter.burst}
+	}
+
+	// In jwt auth mode, signed JWTs are issued from POST /v1/tokens/jwt as well as the stored tokens.
+	var jwtSigner *jwt.Signer
+	if cfg.auth.mode == "jwt" {
+		jwtSigner = jwt.New([]byte(cfg.jwt.secret), cfg.jwt.issuer)
+	}
+
+	// The S3 settings were checked by cfg.validate().
+	var fileStore storage.Store = storage.NewDisk(cfg.storage.dir)
+
+	if cfg.storage.backend == "s3" {
+		fileStore, _ = storage.NewS3(s3Options(cfg))
+	}
+
 	// Declare an instance of the application struct, containing the config struct,logger, and models.
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:     cfg,
+		clock:      clk,
+		startedAt:  clk.Now(),
+		logger:     logger,
+		models:     models,
+		db:         db,
+		replica:    replica,
+		shards:     opts.Shards,
+		mailer:     instrumented,
+		signer:     urlsign.New(signingKey),
+		jwt:        jwtSigner,
+		storage:    fileStore,
+		limiter:    newClientLimiter(cfg.limiter.rps, cfg.limiter.burst, limiterStore, cfg.limiter.store, clk.Now),
+		tracer:     tracer,
+		outboxWake: make(chan struct{}, 1),
+		shutdown:   make(chan struct{}),
+	}
+
+	instrumented.Alert = func(templateFile string, failed, total int) {
+		app.alert("high email failure rate", map[string]string{
+			"template": templateFile,
+			"failed":   strconv.Itoa(failed),
+			"total":    strconv.Itoa(total),
+			"window":   cfg.mail.alertWindow.String(),
+		})
+	}
+
+	if len(cfg.chaos.rules) > 0 {
+		app.faultsInjected = expvar.NewMap("faults_injected")
+		logger.PrintInfo("fault injection enabled", map[string]string{"rules": strconv.Itoa(len(cfg.chaos.rules))})
+	}
+
+	// Request and movie view counts are saved to PostgreSQL, so they aren't recorded with in-memory storage.
+	if cfg.db.backend != "memory" {
+		app.analytics = newAnalyticsRecorder()
+	}
+
+	if cfg.capture.size > 0 {
+		app.captures = newCaptureBuffer(cfg.capture.size)
+		logger.PrintInfo("capturing requests for debugging", map[string]string{"size": strconv.Itoa(cfg.capture.size)})
 	}
 
+	// Start the scheduled background jobs, such as purging expired tokens.
+	app.startJobs()
+
 	// HTTP server with timeout settings w/c listens to config port and uses the app.routes() as the handler.
 	err = app.serve()
 	if err != nil {
@@ -151,14 +754,422 @@ func main() {
 	}
 }
 
-// openDB() helper function returns a sql.DB connection pool.
-func openDB(cfg config) (*sql.DB, error) {
-	// Use sql.Open() to create empty connection pool, using the DSN from the config struct.
-	db, err := sql.Open("postgres", cfg.db.dsn)
+// validate() checks the config settings which can't be validated by the flag package alone.
+func (cfg config) validate() error {
+	if cfg.db.backend != "postgres" && cfg.db.backend != "memory" {
+		return errors.New("db must be either postgres or memory")
+	}
+
+	if cfg.db.schemaCheck != "strict" && cfg.db.schemaCheck != "warn" && cfg.db.schemaCheck != "off" {
+		return errors.New("db-schema-check must be strict, warn or off")
+	}
+
+	if cfg.db.migrate && cfg.db.backend == "memory" {
+		return errors.New("db-migrate can't be used with db=memory")
+	}
+
+	if cfg.db.replica.dsn != "" && cfg.db.backend == "memory" {
+		return errors.New("db-replica-dsn can't be used with db=memory")
+	}
+
+	if len(cfg.db.shards) > 0 && cfg.db.backend == "memory" {
+		return errors.New("db-movie-shard can't be used with db=memory")
+	}
+
+	if err := data.ValidateShardSpecs(cfg.db.shards); err != nil {
+		return fmt.Errorf("db-movie-shard: %w", err)
+	}
+
+	if cfg.db.replica.maxLag < 0 {
+		return errors.New("db-replica-max-lag must not be negative")
+	}
+
+	if cfg.db.replica.checkInterval <= 0 {
+		return errors.New("db-replica-check-interval must be positive")
+	}
+
+	// In-memory storage needs no setup, so there's nothing for dev mode to do.
+	if cfg.dev && cfg.db.backend == "memory" {
+		return errors.New("dev can't be used with db=memory")
+	}
+
+	if cfg.limiter.store != "memory" && cfg.limiter.store != "redis" {
+		return errors.New("limiter-store must be either memory or redis")
+	}
+
+	if cfg.limiter.store == "redis" {
+		if _, err := redis.ParseURL(cfg.limiter.redisURL); err != nil {
+			return fmt.Errorf("limiter-redis-url: %w", err)
+		}
+	}
+
+	if _, err := mail.ParseAddress(cfg.mail.sender); err != nil {
+		return fmt.Errorf("mail-sender: %w", err)
+	}
+
+	if _, err := mailTransport(cfg, nil); err != nil {
+		return err
+	}
+
+	if cfg.storage.backend != "disk" && cfg.storage.backend != "s3" {
+		return errors.New("storage must be either disk or s3")
+	}
+
+	if cfg.storage.backend == "s3" {
+		if _, err := storage.NewS3(s3Options(cfg)); err != nil {
+			return fmt.Errorf("storage-s3: %w", err)
+		}
+	}
+
+	if cfg.storage.publicURL != "" {
+		if u, err := url.Parse(cfg.storage.publicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("storage-public-url must be an http or https URL")
+		}
+	}
+
+	if cfg.posters.maxBytes < 1 {
+		return errors.New("poster-max-bytes must be positive")
+	}
+
+	if cfg.movieCache.store != "none" && cfg.movieCache.store != "memory" && cfg.movieCache.store != "redis" {
+		return errors.New("movie-cache must be none, memory or redis")
+	}
+
+	if cfg.movieCache.maxEntries < 1 {
+		return errors.New("movie-cache-max-entries must be positive")
+	}
+
+	if cfg.movieCache.ttl <= 0 {
+		return errors.New("movie-cache-ttl must be positive")
+	}
+
+	if cfg.movieCache.store == "redis" {
+		if _, err := redis.ParseURL(cfg.movieCache.redisURL); err != nil {
+			return fmt.Errorf("movie-cache-redis-url: %w", err)
+		}
+	}
+
+	if cfg.debug.addr != "" {
+		if _, _, err := net.SplitHostPort(cfg.debug.addr); err != nil {
+			return errors.New("debug-addr must be a host:port address, such as localhost:4001")
+		}
+	}
+
+	if cfg.tracing.endpoint != "" {
+		u, err := url.Parse(cfg.tracing.endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("otel-endpoint must be an absolute http or https URL")
+		}
+	}
+
+	if cfg.tracing.serviceName == "" {
+		return errors.New("otel-service-name must not be empty")
+	}
+
+	if cfg.tracing.sampleRatio < 0 || cfg.tracing.sampleRatio > 1 {
+		return errors.New("otel-sample-ratio must be between 0 and 1")
+	}
+
+	if cfg.urlSigning.key != "" && len(cfg.urlSigning.key) < 32 {
+		return errors.New("url-signing-key must be at least 32 bytes long")
+	}
+
+	if cfg.urlSigning.maxTTL <= 0 {
+		return errors.New("url-signing-max-ttl must be positive")
+	}
+
+	// Fault injection is for exercising clients in development and staging, never for real traffic.
+	if len(cfg.chaos.rules) > 0 && cfg.env == "production" {
+		return errors.New("chaos-rule can't be used in production")
+	}
+
+	if cfg.analytics.flushInterval <= 0 {
+		return errors.New("analytics-flush-interval must be positive")
+	}
+
+	if cfg.analytics.cacheTTL < 0 {
+		return errors.New("analytics-cache-ttl must not be negative")
+	}
+
+	if cfg.capture.size < 0 {
+		return errors.New("debug-capture-size must not be negative")
+	}
+
+	if cfg.capture.bodyBytes < 0 {
+		return errors.New("debug-capture-body-bytes must not be negative")
+	}
+
+	if cfg.json.maxDepth < 1 {
+		return errors.New("json-max-depth must be at least 1")
+	}
+
+	// Reordering a list sends the IDs of every entry in a single array.
+	if cfg.json.maxArrayLength < data.MaxListEntries {
+		return fmt.Errorf("json-max-array-length must be at least %d", data.MaxListEntries)
+	}
+
+	// Below 10, a stolen password hash can be brute forced too quickly. 31 is the most bcrypt supports.
+	if cfg.bcrypt.cost < 10 || cfg.bcrypt.cost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt-cost must be between 10 and %d", bcrypt.MaxCost)
+	}
+
+	if cfg.bcrypt.cost < 12 && cfg.env == "production" {
+		return errors.New("bcrypt-cost must be at least 12 in production")
+	}
+
+	if cfg.requestTimeout.max < 0 {
+		return errors.New("request-timeout-max must not be negative")
+	}
+
+	if cfg.startup.maxWait < 0 {
+		return errors.New("startup-max-wait must not be negative")
+	}
+
+	if cfg.startup.backoff <= 0 {
+		return errors.New("startup-retry-backoff must be positive")
+	}
+
+	if cfg.shutdown.taskTimeout <= 0 {
+		return errors.New("shutdown-task-timeout must be positive")
+	}
+
+	if cfg.outbox.workers < 1 {
+		return errors.New("mail-outbox-workers must be at least 1")
+	}
+
+	if cfg.outbox.attempts < 1 {
+		return errors.New("mail-outbox-attempts must be at least 1")
+	}
+
+	if cfg.outbox.backoff <= 0 {
+		return errors.New("mail-outbox-backoff must be positive")
+	}
+
+	if cfg.mail.attempts < 1 {
+		return errors.New("mail-attempts must be at least 1")
+	}
+
+	if cfg.mail.backoff < 0 {
+		return errors.New("mail-retry-backoff must not be negative")
+	}
+
+	if cfg.mail.alertThreshold < 0 || cfg.mail.alertThreshold > 1 {
+		return errors.New("mail-alert-threshold must be between 0 and 1")
+	}
+
+	if cfg.mail.alertWindow <= 0 {
+		return errors.New("mail-alert-window must be positive")
+	}
+
+	if cfg.mail.breakerThreshold < 0 {
+		return errors.New("mail-breaker-threshold must not be negative")
+	}
+
+	if cfg.mail.breakerThreshold > 0 && cfg.mail.breakerCooldown <= 0 {
+		return errors.New("mail-breaker-cooldown must be positive")
+	}
+
+	if cfg.alerts.webhookURL != "" {
+		u, err := url.Parse(cfg.alerts.webhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("alert-webhook-url must be an absolute http or https URL")
+		}
+	}
+
+	if cfg.digest.interval <= 0 {
+		return errors.New("digest-interval must be positive")
+	}
+
+	if cfg.digest.checkInterval <= 0 {
+		return errors.New("digest-check-interval must be positive")
+	}
+
+	if cfg.digest.batchSize < 1 {
+		return errors.New("digest-batch-size must be at least 1")
+	}
+
+	if cfg.savedSearches.checkInterval <= 0 {
+		return errors.New("saved-search-check-interval must be positive")
+	}
+
+	if cfg.savedSearches.batchSize < 1 {
+		return errors.New("saved-search-batch-size must be at least 1")
+	}
+
+	if cfg.emailThrottle.limit < 1 {
+		return errors.New("email-throttle-limit must be at least 1")
+	}
+
+	if cfg.emailThrottle.window <= 0 {
+		return errors.New("email-throttle-window must be positive")
+	}
+
+	if cfg.tokens.activationTTL < time.Minute {
+		return errors.New("token-activation-ttl must be at least 1 minute")
+	}
+
+	if cfg.tokens.passwordResetTTL < time.Minute || cfg.tokens.passwordResetTTL > 24*time.Hour {
+		return errors.New("token-password-reset-ttl must be between 1 minute and 24 hours")
+	}
+
+	if cfg.tokens.authenticationTTL < time.Minute {
+		return errors.New("token-auth-ttl must be at least 1 minute")
+	}
+
+	if cfg.tokens.authenticationTTL > 90*24*time.Hour {
+		return errors.New("token-auth-ttl must not be more than 90 days")
+	}
+
+	if cfg.tokens.refreshTTL < cfg.tokens.authenticationTTL {
+		return errors.New("token-refresh-ttl must not be less than token-auth-ttl")
+	}
+
+	if cfg.tokens.refreshTTL > 365*24*time.Hour {
+		return errors.New("token-refresh-ttl must not be more than 365 days")
+	}
+
+	if cfg.tokens.purgeInterval <= 0 {
+		return errors.New("token-purge-interval must be positive")
+	}
+
+	if cfg.tokens.purgeBatchSize < 1 {
+		return errors.New("token-purge-batch-size must be at least 1")
+	}
+
+	if cfg.tokens.sliding.enabled && cfg.tokens.sliding.maxLifetime < cfg.tokens.authenticationTTL {
+		return errors.New("token-auth-max-lifetime must not be less than token-auth-ttl")
+	}
+
+	if cfg.tokens.sliding.interval < 0 {
+		return errors.New("token-auth-sliding-interval must not be negative")
+	}
+
+	if cfg.tokens.hmacKey != "" && len(cfg.tokens.hmacKey) < 32 {
+		return errors.New("token-hmac-key must be at least 32 bytes long")
+	}
+
+	if !validator.In(cfg.auth.mode, "stateful", "jwt") {
+		return errors.New("auth-mode must be stateful or jwt")
+	}
+
+	if cfg.auth.mode == "jwt" {
+		if len(cfg.jwt.secret) < 32 {
+			return errors.New("jwt-secret must be at least 32 bytes long in jwt auth mode")
+		}
+
+		if cfg.jwt.issuer == "" {
+			return errors.New("jwt-issuer must not be empty")
+		}
+
+		if cfg.jwt.ttl < time.Minute || cfg.jwt.ttl > 24*time.Hour {
+			return errors.New("jwt-ttl must be between 1 minute and 24 hours")
+		}
+	}
+
+	return nil
+}
+
+// mailTransport() returns the transport emails are sent with, or an error if its settings are invalid.
+func mailTransport(cfg config, logger *jsonlog.Logger) (mailer.Transport, error) {
+	var transport mailer.Transport
+	var err error
+
+	switch cfg.mail.transport {
+	case "smtp":
+		transport = mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password)
+	case "ses":
+		transport, err = mailer.NewSES(mailer.SESOptions{
+			Region:    cfg.mail.ses.region,
+			AccessKey: cfg.mail.ses.accessKey,
+			SecretKey: cfg.mail.ses.secretKey,
+			Endpoint:  cfg.mail.ses.endpoint,
+		})
+	case "sendgrid":
+		transport, err = mailer.NewSendGrid(cfg.mail.sendGrid.apiKey)
+	case "mailgun":
+		transport, err = mailer.NewMailgun(mailer.MailgunOptions{
+			Domain:   cfg.mail.mailgun.domain,
+			APIKey:   cfg.mail.mailgun.apiKey,
+			Endpoint: cfg.mail.mailgun.endpoint,
+		})
+	case "log":
+		transport = mailer.Log{Logger: logger}
+	default:
+		return nil, errors.New("mail-transport must be smtp, ses, sendgrid, mailgun or log")
+	}
+
 	if err != nil {
+		return nil, fmt.Errorf("mail-%s: %w", cfg.mail.transport, err)
+	}
+
+	return transport, nil
+}
+
+// s3Options() returns the settings for storing uploaded files in S3.
+func s3Options(cfg config) storage.S3Options {
+	return storage.S3Options{
+		Endpoint:  cfg.storage.s3.endpoint,
+		Region:    cfg.storage.s3.region,
+		Bucket:    cfg.storage.s3.bucket,
+		AccessKey: cfg.storage.s3.accessKey,
+		SecretKey: cfg.storage.s3.secretKey,
+		PathStyle: cfg.storage.s3.pathStyle,
+	}
+}
+
+// tokenHashing() returns the token hashing settings for the config. When an HMAC key is configured, new tokens
+// are hashed with HMAC-SHA-256, while tokens issued before the key was introduced are still accepted.
+func tokenHashing(cfg config) data.TokenHashing {
+	if cfg.tokens.hmacKey == "" {
+		return data.TokenHashing{Current: data.SHA256Hasher{}}
+	}
+
+	return data.TokenHashing{
+		Current: data.HMACHasher{Key: []byte(cfg.tokens.hmacKey)},
+		Legacy:  []data.TokenHasher{data.SHA256Hasher{}},
+	}
+}
+
+// openShard() opens a connection pool for a movie shard, migrating it if -db-migrate is set and checking its
+// schema version in the same way as the main database's.
+func openShard(cfg config, spec data.ShardSpec, tracer *tracing.Tracer, logger *jsonlog.Logger) (*sql.DB, error) {
+	db, err := openDB(cfg, spec.DSN, tracer)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.db.migrate {
+		err = migrateDB(db, logger)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	err = checkSchema(db, cfg.db.schemaCheck, logger)
+	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
+	logger.PrintInfo("movie shard connection pool established", map[string]string{
+		"min_id": strconv.FormatInt(spec.MinID, 10),
+		"max_id": strconv.FormatInt(spec.MaxID, 10),
+	})
+
+	return db, nil
+}
+
+// openDB() helper function returns a sql.DB connection pool for the DSN, using the pool settings in the config.
+func openDB(cfg config, dsn string, tracer *tracing.Tracer) (*sql.DB, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create an empty connection pool for the DSN, recording a span for each query if tracing is enabled.
+	db := sql.OpenDB(tracing.WrapConnector(connector, tracer, "postgresql"))
+
 	db.SetMaxOpenConns(cfg.db.maxOpenConns)
 	db.SetMaxIdleConns(cfg.db.maxIdleConns)
 
@@ -177,6 +1188,7 @@ func openDB(cfg config) (*sql.DB, error) {
 	// If the connection is not established successfully within 5sec deadline, this will return an error.
 	err = db.PingContext(ctx)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -1,26 +1,39 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/felixge/httpsnoop"
+	"github.com/julienschmidt/httprouter"
 	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/jwt"
+	"github.com/micypac/flick-info/internal/metrics"
+	"github.com/micypac/flick-info/internal/tracing"
+	"github.com/micypac/flick-info/internal/urlsign"
 	"github.com/micypac/flick-info/internal/validator"
 	"github.com/tomasen/realip"
-	"golang.org/x/time/rate"
 )
 
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				// http.ErrAbortHandler cuts off a response which has already been started, so pass it on to the
+				// server rather than trying to send an error response.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
 				w.Header().Set("Connection", "close")
 
 				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
@@ -32,78 +45,101 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 }
 
 func (app *application) rateLimit(next http.Handler) http.Handler {
-	// Client struct to hold the rate limiter and last seen time for each client(IP address).
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-
-	// Declare a mutex and a map to hold the clients' struct.
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-
-	// Launch a background goroutine to remove old entries from the clients map once every minute.
+	// Launch a background goroutine to stop tracking idle clients, and remove expired exemptions, once every
+	// minute.
 	go func() {
-		for {
-			time.Sleep(time.Minute)
-
-			// Lock the mutex to prevent any rate limiter checks from happening while the cleanup is taking place.
-			mu.Lock()
-
-			// Loop through the map and remove any entries where the last seen time is older than 3 minutes.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
+		ticker := app.clock.NewTicker(time.Minute)
+		defer ticker.Stop()
 
-			// Unlock the mutex.
-			mu.Unlock()
+		for range ticker.C() {
+			app.limiter.cleanup(app.clock.Now())
 		}
 	}()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Carry out the rate limiting checks if the limiter is enabled.
 		if app.config.limiter.enabled {
-
-			// Extract the clients IP address from the request.
-			ip := realip.FromRequest(r)
-
-			// Lock the mutex to ensure that the map access is safe.
-			mu.Lock()
-
-			// Check if the IP address already exists in the map.
-			// If it doesnt, create a new client instance with rate limiter to the map.
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
-				}
+			// Extract the clients IP address from the request, and send a 429 Too Many Requests response if
+			// it has used up its allowance.
+			allowed, err := app.limiter.allow(r.Context(), realip.FromRequest(r), app.clock.Now())
+			if err != nil && app.limiter.shouldLogStoreError(app.clock.Now()) {
+				app.logError(r, fmt.Errorf("rate limit store: %w", err))
 			}
 
-			// Update the last seen time for the client.
-			clients[ip].lastSeen = time.Now()
-
-			// Call the Allow() method on the rate limiter for the current IP address.
-			// If the request is not allowed, unlock the mutex and send a 429 Too Many Requests response.
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
+			if !allowed {
 				app.rateLimitExceedResponse(w, r)
 				return
 			}
+		}
 
-			// Unlock the mutex before calling the next handler in the chain.
-			// DON'T use defer to unlock the mutex, as that would mean that the mutex isn't unlocked until all
-			// the handlers downstream of this middleware have also returned.
-			mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
 
+func (app *application) normalizePath(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only act in tolerant mode, and leave OPTIONS alone as preflight requests can't follow redirects.
+		if !app.config.router.tolerant || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		next.ServeHTTP(w, r)
+		// If the path already matches a route, or no canonical form of it does, carry on as normal.
+		if handle, _, _ := router.Lookup(r.Method, r.URL.Path); handle != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		canonical, ok := canonicalPath(router, r.Method, r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Redirect with 308 Permanent Redirect, so clients repeat the request with the same method and body.
+		u := *r.URL
+		u.Path = canonical
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
 	})
 }
 
+// canonicalPath() tries to find the registered route for a path that has a trailing slash or the wrong case,
+// e.g. "/V1/Movies/". The route is looked up with the path trimmed and lowercased, and then the original case
+// is restored for any parameter values, since things like share slugs are case-sensitive.
+func canonicalPath(router *httprouter.Router, method, path string) (string, bool) {
+	trimmed := path
+	if len(trimmed) > 1 {
+		trimmed = strings.TrimRight(trimmed, "/")
+	}
+
+	lowered := strings.ToLower(trimmed)
+
+	handle, params, _ := router.Lookup(method, lowered)
+	if handle == nil {
+		return "", false
+	}
+
+	original := strings.Split(trimmed, "/")
+	segments := strings.Split(lowered, "/")
+
+	i := 0
+	for j := range segments {
+		if i < len(params) && segments[j] == params[i].Value {
+			segments[j] = original[j]
+			i++
+		}
+	}
+
+	canonical := strings.Join(segments, "/")
+
+	// Check the path with the parameter values restored still matches the same route.
+	if handle, _, _ := router.Lookup(method, canonical); handle == nil || canonical == path {
+		return "", false
+	}
+
+	return canonical, true
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the 'Vary: Authorization' header to the response. This indicates to any caches that the response
@@ -132,6 +168,93 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
 
+		// Personal access tokens are told apart from session tokens by their prefix, and are looked up in their
+		// own table. The token is added to the request context so its permissions can be enforced later.
+		if data.IsPersonalAccessToken(token) {
+			v := validator.New()
+
+			if data.ValidatePersonalAccessTokenPlaintext(v, token); !v.Valid() {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			user, pat, err := app.models.PersonalAccessTokens.GetUserForToken(r.Context(), token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetPersonalAccessToken(r, pat)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// API keys are likewise told apart by their prefix, and are found by the lookup prefix which follows it.
+		if data.IsAPIKey(token) {
+			v := validator.New()
+
+			if data.ValidateAPIKeyPlaintext(v, token); !v.Valid() {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			user, key, err := app.models.APIKeys.GetUserForKey(r.Context(), token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetAPIKey(r, key)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// In jwt auth mode, JWTs are told apart by their dots, and are checked by their signature rather than
+		// looked up. The user is still loaded, so that deactivated and deleted users are turned away.
+		if app.jwt != nil && jwt.IsToken(token) {
+			claims, err := app.jwt.Verify(token, app.clock.Now())
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			id, err := strconv.ParseInt(claims.Subject, 10, 64)
+			if err != nil || id < 1 {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			user, err := app.models.Users.Get(r.Context(), id)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Validate the token.
 		v := validator.New()
 
@@ -141,7 +264,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		// Retrieve the details of the user associated with the authentication token.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -152,8 +275,10 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		// Call the contextSetUser() helper to add the user info to the request context.
+		// Call the contextSetUser() helper to add the user info to the request context, along with the token so
+		// that it can be revoked when the user logs out.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetSessionToken(r, token)
 
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
@@ -191,13 +316,87 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+func (app *application) requireSessionToken(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reject requests authenticated with a personal access token or API key, so that a leaked one can't be
+		// used to mint further credentials or otherwise manage the account.
+		if app.contextGetPersonalAccessToken(r) != nil || app.contextGetAPIKey(r) != nil {
+			app.sessionTokenRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
+// requestTimeout() lets clients shorten the time the server spends on a request, with an X-Request-Timeout header
+// holding either a duration like "500ms" or a number of milliseconds. The request context gets that deadline,
+// capped at the configured maximum, so database queries are cancelled when it passes and the client gets a 504
+// response from serverErrorResponse() instead of waiting for the server's own timeouts.
+func (app *application) requestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("X-Request-Timeout")
+		if header == "" || app.config.requestTimeout.max == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout, err := parseRequestTimeout(header)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		if timeout > app.config.requestTimeout.max {
+			timeout = app.config.requestTimeout.max
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// parseRequestTimeout() parses an X-Request-Timeout header value, which is either a Go duration string or a
+// whole number of milliseconds.
+func parseRequestTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		ms, convErr := strconv.ParseInt(value, 10, 64)
+		if convErr != nil {
+			return 0, errors.New("X-Request-Timeout header must be a duration (e.g. 500ms) or a number of milliseconds")
+		}
+
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	if timeout <= 0 {
+		return 0, errors.New("X-Request-Timeout header must be positive")
+	}
+
+	return timeout, nil
+}
+
+// requireDatabase() rejects requests for resources whose models have no in-memory implementation when the server
+// is running with in-memory storage. With PostgreSQL, next is returned unchanged.
+func (app *application) requireDatabase(next http.HandlerFunc) http.HandlerFunc {
+	if app.config.db.backend != "memory" {
+		return next
+	}
+
+	return app.databaseRequiredResponse
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		// Retrieve the user from the request context.
 		user := app.contextGetUser(r)
 
 		// Get the permissions slice for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -209,59 +408,158 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			return
 		}
 
+		// If the request was authenticated with a personal access token or API key, the permission must also
+		// be one of its scopes.
+		if !app.credentialPermits(r, code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	}
 
 	return app.requireActivatedUser(fn)
 }
 
-func (app *application) enableCORS(next http.Handler) http.Handler {
+// credentialPermits() reports whether the personal access token or API key the request was authenticated with,
+// if any, includes the permission. Requests authenticated with a session token aren't restricted.
+func (app *application) credentialPermits(r *http.Request, code string) bool {
+	if pat := app.contextGetPersonalAccessToken(r); pat != nil && !pat.Permissions.Include(code) {
+		return false
+	}
+
+	if key := app.contextGetAPIKey(r); key != nil && !key.Permissions.Include(code) {
+		return false
+	}
+
+	return true
+}
+
+func (app *application) requireSignedURL(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Add the "Vary: Origin" header.
-		w.Header().Set("Vary", "Origin")
+		// Check the signature and expiry in the query string. A valid signature stands in for authentication,
+		// so no user or permission checks are made for these requests.
+		err := app.signer.Verify(r.URL)
+		if err != nil {
+			switch {
+			case errors.Is(err, urlsign.ErrExpired):
+				app.signedURLExpiredResponse(w, r)
+			default:
+				app.invalidSignatureResponse(w, r)
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
 
-		// Add the "Vary: Access-Control-Request-Method" header.
-		w.Header().Set("Vary", "Access-Control-Request-Method")
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Add the "Vary: Origin" and "Vary: Access-Control-Request-Method" headers. Use Add() rather than Set(),
+		// so that both values are sent.
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
 
 		// Get the value of the request's Origin header.
 		origin := r.Header.Get("Origin")
 
 		// Check if Origin request header is not empty AND at least one trusted origin is configured.
-		if origin != "" && len(app.config.cors.trustedOrigins) != 0 {
+		// If the Origin header matches a trusted origin, add the Access-Control-Allow-Origin header to the response.
+		// Preflight requests are passed on to the router, which answers them in optionsHandler() with the
+		// methods actually registered for the path. In dev mode, every origin on the local machine is trusted.
+		if origin != "" && app.config.dev && isLocalOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		} else if origin != "" && len(app.config.cors.trustedOrigins) != 0 {
 			for i := range app.config.cors.trustedOrigins {
-				// If the Origin header matches a trusted origin, add the Access-Control-Allow-Origin header to the response.
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					break
 				}
+			}
+		}
 
-				// If request has the HTTP method OPTIONS and contains the 'Access-Control-Request-Method'
-				// header then it's a preflight request.
-				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-					// Add the 'Access-Control-Allow-Methods' header to the response.
-					w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-					// Add the 'Access-Control-Allow-Headers' header to the response.
-					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-
-					// Write the response with a 200 OK status and return from the middleware.
-					w.WriteHeader(http.StatusOK)
-					return
-				}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDRX matches the request IDs accepted from clients in the X-Request-ID header. Other values are
+// replaced, so that they can't be used to forge or garble log entries.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// logRequest() assigns each request an ID, which is sent back in the X-Request-ID header, and, if enabled, writes
+// an access log entry for it once it has been handled. A client, or a proxy in front of the API, can pass its
+// own ID in the X-Request-ID header to correlate the logs.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &requestLogEntry{id: r.Header.Get("X-Request-ID")}
+
+		if !requestIDRX.MatchString(entry.id) {
+			b := make([]byte, 8)
+
+			_, err := rand.Read(b)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
 			}
+
+			entry.id = hex.EncodeToString(b)
 		}
 
-		// w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("X-Request-ID", entry.id)
 
-		next.ServeHTTP(w, r)
+		r = app.contextSetRequestLogEntry(r, entry)
+
+		if !app.config.requestLog.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		props := map[string]string{
+			"request_id":     entry.id,
+			"request_method": r.Method,
+			"request_path":   r.URL.Path,
+			"status":         strconv.Itoa(metrics.Code),
+			"duration":       metrics.Duration.String(),
+			"client_ip":      realip.FromRequest(r),
+		}
+
+		if entry.userID != 0 {
+			props["user_id"] = strconv.FormatInt(entry.userID, 10)
+		}
+
+		// Include the trace ID, if the request is traced, so the log line can be matched up with the trace.
+		if traceID := tracing.SpanFromContext(r.Context()).TraceID(); traceID != "" {
+			props["trace_id"] = traceID
+		}
+
+		app.logger.PrintInfo("request", props)
 	})
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
+func (app *application) metrics(router *httprouter.Router, next http.Handler) http.Handler {
 	// Init the new expvar variables.
 	totalRequestsReceived := expvar.NewInt("total_requests_received")
 	totalResponsesSent := expvar.NewInt("total_responses_sent")
 	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
 	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
 
+	// Init the per-route histograms for the request latency (in seconds) and response size (in bytes).
+	requestDuration := metrics.NewHistogramVec("http_request_duration_seconds", "Request latency by route.",
+		[]string{"method", "route"}, metrics.LatencyBuckets)
+	responseSize := metrics.NewHistogramVec("http_response_size_bytes", "Response size by route.",
+		[]string{"method", "route"}, metrics.SizeBuckets)
+
+	// Publish a summary of the histograms (count, sum, p50, p95, p99) in the expvar handler.
+	expvar.Publish("http_request_duration_seconds", expvar.Func(func() interface{} {
+		return requestDuration.Summary()
+	}))
+	expvar.Publish("http_response_size_bytes", expvar.Func(func() interface{} {
+		return responseSize.Summary()
+	}))
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// Increment the totalRequestsReceived counter by 1.
@@ -280,5 +578,107 @@ func (app *application) metrics(next http.Handler) http.Handler {
 
 		// Increment the count for the given status code by 1.
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
+
+		// Record the latency and response size against the matched route pattern rather than the raw URL path,
+		// so that requests like /v1/movies/1 and /v1/movies/2 are grouped together.
+		route := routePattern(router, r)
+		requestDuration.WithLabelValues(r.Method, route).Observe(metrics.Duration.Seconds())
+		responseSize.WithLabelValues(r.Method, route).Observe(float64(metrics.Written))
+
+		// Count the request towards the daily request volume in the analytics.
+		if app.analytics != nil {
+			app.analytics.recordRequest(app.clock.Now(), r.Method, route)
+		}
 	})
 }
+
+// routePattern() returns the registered route pattern (e.g. "/v1/movies/:id") which matches the request.
+// Requests which don't match any route are grouped under "unmatched" to keep the number of labels bounded.
+func routePattern(router *httprouter.Router, r *http.Request) string {
+	handle, params, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+
+	// Swap the interpolated parameter values in the path back for their ":name" placeholders. The parameters
+	// are returned in the order they appear in the path, so walk the segments left to right.
+	segments := strings.Split(r.URL.Path, "/")
+	i := 0
+	for j := range segments {
+		if i < len(params) && segments[j] == params[i].Value {
+			segments[j] = ":" + params[i].Key
+			i++
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// trace() records a server span for each request, named after its method and route pattern, continuing the
+// caller's trace if the request has a valid traceparent header. The spans started while handling the request,
+// such as those of the middleware and the database queries, are its children. The handler is returned
+// unchanged if tracing isn't enabled.
+func (app *application) trace(router *httprouter.Router, next http.Handler) http.Handler {
+	if app.tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if parent, ok := tracing.ParseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = tracing.ContextWithRemoteParent(ctx, parent)
+		}
+
+		// Name the span after the route pattern, like the latency histograms, rather than the raw URL path.
+		name := r.Method
+		route := routePattern(router, r)
+		if route != "unmatched" {
+			name += " " + route
+		}
+
+		ctx, span := app.tracer.Start(ctx, name, tracing.KindServer)
+		defer span.End()
+
+		span.SetAttributes(
+			tracing.Attribute{Key: "http.request.method", Value: r.Method},
+			tracing.Attribute{Key: "http.route", Value: route},
+			tracing.Attribute{Key: "url.path", Value: r.URL.Path},
+			tracing.Attribute{Key: "user_agent.original", Value: r.UserAgent()},
+		)
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+
+		span.SetAttribute("http.response.status_code", metrics.Code)
+
+		if metrics.Code >= 500 {
+			span.SetError(http.StatusText(metrics.Code))
+		}
+	})
+}
+
+// traceMiddleware() returns the middleware, recording a span for the time spent in it, up to when it passes the
+// request on to the next handler or responds itself, so that slow middleware, such as authenticate() looking up
+// a token, stands out in a trace. The middleware is returned unchanged if tracing isn't enabled.
+func (app *application) traceMiddleware(name string, middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	if app.tracer == nil {
+		return middleware
+	}
+
+	return func(next http.Handler) http.Handler {
+		// End the middleware's span once it calls the next handler, which carries on under the span's parent.
+		wrapped := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span := tracing.SpanFromContext(r.Context())
+			span.End()
+
+			next.ServeHTTP(w, r.WithContext(tracing.ContextWithSpan(r.Context(), span.Parent())))
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := app.tracer.Start(r.Context(), "middleware "+name, tracing.KindInternal)
+			defer span.End()
+
+			wrapped.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/redis"
+)
+
+// Prefix of the Redis keys holding the cached movies and list pages.
+const redisMovieCacheKeyPrefix = "flickinfo:moviecache:"
+
+// redisMovieCache is a data.MovieCache in Redis, so that every instance of the API shares the cached results,
+// and a change made through any instance invalidates them for all of them. Results are gob encoded, rather than
+// JSON encoded, to keep the fields which aren't in the API's responses, such as the poster key, and expire after
+// ttl, leaving Redis to evict any others it hasn't room for.
+//
+// A movie is invalidated by deleting its key. The list pages can't be found without scanning the keys, so their
+// keys include a generation number instead, which Invalidate() increments; the old pages can no longer be
+// found, and expire.
+type redisMovieCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// redisMovieCacheGenerationKey holds the generation number of the list pages.
+const redisMovieCacheGenerationKey = redisMovieCacheKeyPrefix + "lists:generation"
+
+// key() returns the Redis key for the cache key. List keys are hashed, as they hold the whole query.
+func (c *redisMovieCache) key(ctx context.Context, key string) (string, error) {
+	if !strings.HasPrefix(key, data.MovieCacheListPrefix) {
+		return redisMovieCacheKeyPrefix + key, nil
+	}
+
+	reply, err := c.client.Do(ctx, "GET", redisMovieCacheGenerationKey)
+	if err != nil {
+		return "", err
+	}
+
+	generation, _ := reply.(string)
+	if generation == "" {
+		generation = "0"
+	}
+
+	sum := sha256.Sum256([]byte(key))
+
+	return redisMovieCacheKeyPrefix + data.MovieCacheListPrefix + generation + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+func (c *redisMovieCache) Get(ctx context.Context, key string) (*data.CachedMovies, bool, error) {
+	redisKey, err := c.key(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	reply, err := c.client.Do(ctx, "GET", redisKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	encoded, ok := reply.(string)
+	if !ok {
+		return nil, false, nil
+	}
+
+	var value data.CachedMovies
+
+	err = gob.NewDecoder(strings.NewReader(encoded)).Decode(&value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &value, true, nil
+}
+
+func (c *redisMovieCache) Set(ctx context.Context, key string, value *data.CachedMovies) error {
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(value)
+	if err != nil {
+		return err
+	}
+
+	redisKey, err := c.key(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.client.Do(ctx, "SET", redisKey, buf.String(), "PX", strconv.FormatInt(c.ttl.Milliseconds(), 10))
+	return err
+}
+
+func (c *redisMovieCache) Invalidate(ctx context.Context, ids ...int64) error {
+	if len(ids) > 0 {
+		args := []string{"DEL"}
+		for _, id := range ids {
+			args = append(args, redisMovieCacheKeyPrefix+data.MovieCacheKey(id))
+		}
+
+		_, err := c.client.Do(ctx, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := c.client.Do(ctx, "INCR", redisMovieCacheGenerationKey)
+	return err
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/micypac/flick-info/internal/data"
 	"github.com/micypac/flick-info/internal/validator"
@@ -12,10 +14,15 @@ import (
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Declare an anonymous struct to hold the info we expect to be in the request body.
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title    string       `json:"title"`
+		Year     int32        `json:"year"`
+		Runtime  data.Runtime `json:"runtime"`
+		Genres   []string     `json:"genres"`
+		Synopsis string       `json:"synopsis"`
+		Language string       `json:"language"`
+		Country  string       `json:"country"`
+		IMDbID   string       `json:"imdb_id"`
+		TMDbID   int64        `json:"tmdb_id"`
 	}
 
 	// Use the readJSON() helper method to decode the request body into the input struct.
@@ -27,10 +34,15 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Copy the values from input struct to new Movie struct.
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:    input.Title,
+		Year:     input.Year,
+		Runtime:  input.Runtime,
+		Genres:   input.Genres,
+		Synopsis: input.Synopsis,
+		Language: input.Language,
+		Country:  input.Country,
+		IMDbID:   input.IMDbID,
+		TMDbID:   input.TMDbID,
 	}
 
 	// Initialize a new Validator instance.
@@ -43,23 +55,100 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Call the Insert() method on our movies model, passing in a pointer to the validated movie struct.
 	// This will create a db record and update the movie struct with the system-generated info.
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(r.Context(), movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateIMDbID):
+			v.AddError("imdb_id", "a movie with this IMDb ID already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateTMDbID):
+			v.AddError("tmdb_id", "a movie with this TMDB ID already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownGenre):
+			v.AddError("genres", "must only contain existing genres")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
+	app.audit(r, data.AuditEntityMovie, movie.ID, data.AuditCreate, nil, movie)
+
+	env := envelope{"movie": movie}
+
+	// Warn about any existing movies which look like the same film, so that they can be merged. The movie has
+	// already been created, so a failure to check is only logged.
+	duplicates, err := app.models.Movies.PossibleDuplicates(r.Context(), movie)
+	if err != nil {
+		app.logError(r, err)
+	} else if len(duplicates) > 0 {
+		env["possible_duplicates"] = duplicates
+	}
+
 	// Include a Location header to let the client know which URL they can find the newly-created resource at.
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
 
+	// The movie has already been created, so a failure to work out its entity tag only leaves the header out.
+	if etag, err := app.movieETag(r, movie); err != nil {
+		app.logError(r, err)
+	} else {
+		headers.Set("ETag", etag)
+	}
+
 	// Write the JSON response with a 201 status code, movie data, and the location header.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	err = app.writeResponse(w, r, http.StatusCreated, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// attachIncludes() embeds the related resources named in include in the movie. People, ratings and reviews are
+// only kept in PostgreSQL, so with in-memory storage nothing is embedded.
+func (app *application) attachIncludes(r *http.Request, movie *data.Movie, include []string) error {
+	if app.config.db.backend == "memory" {
+		return nil
+	}
+
+	return app.models.MovieIncludes.Attach(r.Context(), movie, include)
+}
+
+// defaultMovieIncludes are the related resources embedded in a movie when the include parameter isn't given.
+var defaultMovieIncludes = []string{data.IncludeCast, data.IncludeCrew}
+
+// prepareMovie() attaches everything a movie's representation embeds: its poster URL, the user's state, and the
+// related resources named in include.
+func (app *application) prepareMovie(r *http.Request, movie *data.Movie, include []string) error {
+	app.attachPosterURLs(movie)
+
+	err := app.attachUserState(r, movie)
+	if err != nil {
+		return err
+	}
+
+	return app.attachIncludes(r, movie, include)
+}
+
+// movieETag() returns the entity tag of the movie as GET /v1/movies/:id returns it without any query parameters,
+// in the format requested by the client. This is the tag If-Match headers are compared with, and which is sent
+// with created and updated movies, so that clients can send it straight back. The movie itself isn't changed.
+func (app *application) movieETag(r *http.Request, movie *data.Movie) (string, error) {
+	current := *movie
+
+	err := app.prepareMovie(r, &current, defaultMovieIncludes)
+	if err != nil {
+		return "", err
+	}
+
+	contentType, body, err := app.encodeResponse(r, envelope{"movie": &current})
+	if err != nil {
+		return "", err
+	}
+
+	return representationETag(contentType, body), nil
+}
+
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Read "id" URL parameter.
 	id, err := app.readIDParam(r)
@@ -68,8 +157,29 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// The optional fields parameter limits the response to some of the movie's fields, such as fields=id,title,
+	// and the include parameter names the related resources to embed, from data.MovieIncludes. Without it, the
+	// cast and crew are embedded, as they always were.
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	fields := app.readFields(qs, data.Movie{}, v)
+	include := app.readCSV(qs, "include", defaultMovieIncludes)
+
+	for _, name := range include {
+		v.Check(validator.In(name, data.MovieIncludes...), "include", "must only contain cast, crew, ratings and reviews")
+	}
+
+	v.Check(validator.Unique(include), "include", "must not contain duplicate values")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Call the Get() method to fetch the data for a specific movie.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -80,8 +190,38 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Encode the struct to JSON and send it as the HTTP response. Enclose the Movie struct instance to 'envelope' type.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	// Count the view towards the most viewed movies in the analytics, even if the client's copy is up to date.
+	if app.analytics != nil {
+		app.analytics.recordMovieView(app.clock.Now(), movie.ID)
+	}
+
+	err = app.prepareMovie(r, movie, include)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The entity tag is a hash of the response body, so the response is encoded before checking whether the
+	// client's copy is up to date. Values which don't change the movie's version, such as its ratings, cast and
+	// the user's state, still change the tag.
+	w.Header().Add("Vary", "Accept")
+
+	contentType, body, err := app.encodeResponse(r, envelope{"movie": selectFields(movie, fields)})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	etag := representationETag(contentType, body)
+
+	if app.notModified(w, r, etag) {
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+
+	err = app.writeBody(w, http.StatusOK, contentType, body, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -95,7 +235,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Fetch the existing movie record from the db.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -106,12 +246,30 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// With an If-Match header, only update the movie if the client has the current version.
+	if r.Header.Get("If-Match") != "" {
+		etag, err := app.movieETag(r, movie)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if app.preconditionFailed(w, r, etag) {
+			return
+		}
+	}
+
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+		Title    *string       `json:"title"`
+		Year     *int32        `json:"year"`
+		Runtime  *data.Runtime `json:"runtime"`
+		Genres   []string      `json:"genres"`
+		Synopsis *string       `json:"synopsis"`
+		Language *string       `json:"language"`
+		Country  *string       `json:"country"`
+		IMDbID   *string       `json:"imdb_id"`
+		TMDbID   *int64        `json:"tmdb_id"`
 	}
 
 	// Read JSON request body into the input struct.
@@ -121,43 +279,107 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Keep a copy of the movie as it was, for the audit log. The fields are replaced rather than modified in
+	// place, so a shallow copy is enough.
+	before := *movie
+
+	// Only the fields present in the request are changed, and keep track of them so that only they are validated.
+	var supplied []string
+
 	if input.Title != nil {
 		movie.Title = *input.Title
+		supplied = append(supplied, "title")
 	}
 
 	if input.Year != nil {
 		movie.Year = *input.Year
+		supplied = append(supplied, "year")
 	}
 
 	if input.Runtime != nil {
 		movie.Runtime = *input.Runtime
+		supplied = append(supplied, "runtime")
 	}
 
 	if input.Genres != nil {
 		movie.Genres = input.Genres
+		supplied = append(supplied, "genres")
+	}
+
+	// The synopsis, language and country can be cleared by setting them to "".
+	if input.Synopsis != nil {
+		movie.Synopsis = *input.Synopsis
+		supplied = append(supplied, "synopsis")
+	}
+
+	if input.Language != nil {
+		movie.Language = *input.Language
+		supplied = append(supplied, "language")
 	}
 
-	// Validate the updated movie record.
+	if input.Country != nil {
+		movie.Country = *input.Country
+		supplied = append(supplied, "country")
+	}
+
+	// Likewise, the external IDs can be cleared by setting them to "" and 0.
+	if input.IMDbID != nil {
+		movie.IMDbID = *input.IMDbID
+		supplied = append(supplied, "imdb_id")
+	}
+
+	if input.TMDbID != nil {
+		movie.TMDbID = *input.TMDbID
+		supplied = append(supplied, "tmdb_id")
+	}
+
+	// Validate the supplied values. Problems with the fields left untouched, such as a movie imported before a
+	// rule was added, aren't the client's to fix here, so they don't stop the update.
 	v := validator.New()
 
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	data.ValidateMovie(v, movie)
+	v.Keep(supplied...)
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Pass the updated movie record to the Update() method.
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateIMDbID):
+			v.AddError("imdb_id", "a movie with this IMDb ID already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateTMDbID):
+			v.AddError("tmdb_id", "a movie with this TMDB ID already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownGenre):
+			v.AddError("genres", "must only contain existing genres")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	app.audit(r, data.AuditEntityMovie, movie.ID, data.AuditUpdate, &before, movie)
+
+	app.attachPosterURLs(movie)
+
+	headers := make(http.Header)
+
+	// As with a new movie, a failure to work out the entity tag only leaves the header out.
+	if etag, err := app.movieETag(r, movie); err != nil {
+		app.logError(r, err)
+	} else {
+		headers.Set("ETag", etag)
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -170,7 +392,8 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	// Fetch the movie first, to record what was deleted in the audit log.
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -181,7 +404,36 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+	// With an If-Match header, only delete the movie if the client has the current version. The movie could still
+	// be updated between this check and the delete.
+	if r.Header.Get("If-Match") != "" {
+		etag, err := app.movieETag(r, movie)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if app.preconditionFailed(w, r, etag) {
+			return
+		}
+	}
+
+	err = app.models.Movies.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditEntityMovie, id, data.AuditDelete, movie, nil)
+
+	app.deletePoster(r, movie.PosterKey)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -190,8 +442,19 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	// Define input struct to hold expected values from the request query string. Embed the separate Filters struct.
 	var input struct {
-		Title  string
-		Genres []string
+		Title       string
+		Genres      []string
+		Language    string
+		IMDbID      string
+		TMDbID      int64
+		YearMin     int
+		YearMax     int
+		RuntimeMin  int
+		RuntimeMax  int
+		Preferences bool
+		DirectorID  int64
+		Where       *data.MovieFilter
+		Fields      []string
 		data.Filters
 	}
 
@@ -203,25 +466,262 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Language = app.readString(qs, "language", "")
+	input.IMDbID = app.readString(qs, "imdb_id", "")
+	input.TMDbID = int64(app.readInt(qs, "tmdb_id", 0, v))
+	input.YearMin = app.readInt(qs, "year_min", 0, v)
+	input.YearMax = app.readInt(qs, "year_max", 0, v)
+	input.RuntimeMin = app.readInt(qs, "runtime_min", 0, v)
+	input.RuntimeMax = app.readInt(qs, "runtime_max", 0, v)
+	input.Preferences = app.readBool(qs, "preferences", false, v)
+	input.DirectorID = int64(app.readInt(qs, "director", 0, v))
 	input.Page = app.readInt(qs, "page", 1, v)
 	input.PageSize = app.readInt(qs, "page_size", 20, v)
 	input.Sort = app.readString(qs, "sort", "id")
+	input.Fields = app.readFields(qs, data.Movie{}, v)
+
+	// The advanced filter parameter holds an expression like year>=2000 AND genres@>["drama"], which is combined
+	// with the other filters. See data.MovieFilter for the syntax.
+	if expr := app.readString(qs, "filter", ""); expr != "" {
+		where, err := data.ParseMovieFilter(expr)
+		if err != nil {
+			v.AddError("filter", err.Error())
+		}
+		input.Where = where
+	}
 
 	input.Filters.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
 
+	// The director parameter holds the ID of a person credited as a director.
+	v.Check(input.DirectorID >= 0, "director", "must be a positive integer")
+
+	// The language parameter is shorthand for language="xx" in the filter expression.
+	if input.Language != "" {
+		v.Check(data.ValidLanguage(input.Language), "language", "must be a lower case ISO 639-1 language code, such as en")
+		input.Where = input.Where.AndEqual("language", input.Language)
+	}
+
+	// The imdb_id and tmdb_id parameters look up the movie with an external ID, so that clients can check
+	// whether a movie from another catalog is already here.
+	if input.IMDbID != "" {
+		v.Check(validator.Matches(input.IMDbID, data.IMDbIDRX), "imdb_id", "must be an IMDb title ID, such as tt0111161")
+		input.Where = input.Where.AndEqual("imdb_id", input.IMDbID)
+	}
+
+	if input.TMDbID != 0 {
+		v.Check(input.TMDbID > 0, "tmdb_id", "must be a positive integer")
+		input.Where = input.Where.AndEqualNumber("tmdb_id", input.TMDbID)
+	}
+
+	// The year and runtime ranges are inclusive, and either end can be left open, for faceted browsing.
+	ranges := []struct {
+		field, param string
+		value        int
+		op           string
+	}{
+		{"year", "year_min", input.YearMin, ">="},
+		{"year", "year_max", input.YearMax, "<="},
+		{"runtime", "runtime_min", input.RuntimeMin, ">="},
+		{"runtime", "runtime_max", input.RuntimeMax, "<="},
+	}
+
+	for _, rg := range ranges {
+		if rg.value != 0 {
+			v.Check(rg.value > 0, rg.param, "must be a positive integer")
+			input.Where = input.Where.AndCompareNumber(rg.field, rg.op, int64(rg.value))
+		}
+	}
+
+	v.Check(input.YearMax == 0 || input.YearMin <= input.YearMax, "year_max", "must not be less than year_min")
+	v.Check(input.RuntimeMax == 0 || input.RuntimeMin <= input.RuntimeMax, "runtime_max", "must not be less than runtime_min")
+
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	// In the opt-in preferences-aware mode, limit the movies to the user's favorite genres, unless the client
+	// asked for particular genres.
+	var anyGenres []string
+
+	if input.Preferences && len(input.Genres) == 0 {
+		prefs, err := app.models.Preferences.Get(r.Context(), app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		anyGenres = prefs.FavoriteGenres
+	}
+
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), input.Title, input.Genres, anyGenres, input.DirectorID, input.Where, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.attachPosterURLs(movies...)
+
+	err = app.attachUserState(r, movies...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	// Include the pagination links in a Link header, in addition to the metadata in the body.
+	headers := app.paginationHeaders(r, metadata)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movies": selectFields(movies, input.Fields), "metadata": metadata}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) shareMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Check the movie exists before handing out a link to it.
+	_, err = app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Read the optional link lifetime from the query string, in the time.ParseDuration() format (e.g. "24h").
+	v := validator.New()
+
+	ttl, err := time.ParseDuration(app.readString(r.URL.Query(), "expires_in", "24h"))
+	if err != nil {
+		v.AddError("expires_in", "must be a valid duration, such as 24h")
+	} else {
+		v.Check(ttl > 0, "expires_in", "must be positive")
+		v.Check(ttl <= app.config.urlSigning.maxTTL, "expires_in", "must not be more than "+app.config.urlSigning.maxTTL.String())
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	url, expires := app.signURL(fmt.Sprintf("/v1/shared/movies/%d", id), ttl)
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"share": envelope{"url": url, "expires": expires}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// streamMoviesHandler() sends every movie matching the title and genres filters as newline-delimited JSON
+// (one movie object per line), in ascending ID order. Unlike listMoviesHandler() there is no page limit; the
+// movies are read from the database in batches and flushed to the client as they're written, so even very
+// large result sets never have to be held in memory. If the stream is interrupted, the client can resume from
+// where it left off by passing the ID of the last movie it received in the after_id parameter.
+func (app *application) streamMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	title := app.readString(qs, "title", "")
+	genres := app.readCSV(qs, "genres", []string{})
+	afterID := app.readInt(qs, "after_id", 0, v)
+
+	v.Check(afterID >= 0, "after_id", "must not be negative")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	enc := json.NewEncoder(w)
+
+	lastID, err := app.streamMovies(w, r, title, genres, int64(afterID), func(movie *data.Movie) error {
+		return enc.Encode(movie)
+	}, nil)
+
+	// The status code has already been sent, so an error can't be reported in the usual way. Instead, write a
+	// final line describing the error and how to resume, unless the client has gone away.
+	if err != nil && r.Context().Err() == nil {
+		app.logError(r, err)
+		enc.Encode(envelope{"error": "the stream was interrupted", "resume_after_id": lastID})
+	}
+}
+
+// streamMovies() sends a 200 response and passes every movie matching the title and genres filters with an ID
+// greater than afterID to write, in ascending ID order, flushing the response to the client as it goes. If
+// write buffers its output, flush is called first to empty the buffer. It returns the ID of the last movie
+// written, so that the caller can tell the client where to resume from if there's an error.
+func (app *application) streamMovies(w http.ResponseWriter, r *http.Request, title string, genres []string, afterID int64, write func(*data.Movie) error, flush func() error) (int64, error) {
+	// The stream can take much longer than the server's write timeout, so try to lift the deadline. This isn't
+	// supported by every ResponseWriter wrapper; if it fails the stream is cut off at the write timeout, and the
+	// client can resume with after_id.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.WriteHeader(http.StatusOK)
+
+	const (
+		flushEvery    = 100
+		flushInterval = time.Second
+	)
+
+	lastID := afterID
+	pending := 0
+	lastFlush := time.Now()
+
+	// Flush the buffered movies to the client every flushEvery movies, or every flushInterval if the filters
+	// are selective and matching movies are slow to arrive.
+	flushPending := func() error {
+		if pending == 0 {
+			return nil
+		}
+
+		if flush != nil {
+			err := flush()
+			if err != nil {
+				return err
+			}
+		}
+
+		rc.Flush()
+		pending = 0
+		lastFlush = time.Now()
+
+		return nil
+	}
+
+	err := app.models.Movies.Stream(r.Context(), title, genres, lastID, 500, func(movie *data.Movie) error {
+		app.attachPosterURLs(movie)
+
+		err := write(movie)
+		if err != nil {
+			return err
+		}
+
+		lastID = movie.ID
+		pending++
+
+		if pending >= flushEvery || time.Since(lastFlush) >= flushInterval {
+			return flushPending()
+		}
+
+		return nil
+	})
+
+	// Send whatever is left, even after an error, so that the client has every movie up to lastID.
+	flushErr := flushPending()
+	if err == nil {
+		err = flushErr
+	}
+
+	return lastID, err
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/wire"
+)
+
+// Media types which responses can be encoded as.
+const (
+	mediaTypeJSON     = "application/json"
+	mediaTypeXML      = "application/xml"
+	mediaTypeMsgpack  = "application/msgpack"
+	mediaTypeProtobuf = "application/x-protobuf"
+)
+
+// negotiate() picks the offered media type which best matches the Accept header, taking the q-values into
+// account. Ties are broken by the order of the offers, so the first offer is the default. Wildcards such as
+// "*/*" and "application/*" match any offer.
+func negotiate(accept string, offers ...string) string {
+	if accept == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, offer := range offers {
+		q := 0.0
+
+		for _, part := range strings.Split(accept, ",") {
+			mediaRange, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+
+			if !mediaRangeMatches(mediaRange, offer) {
+				continue
+			}
+
+			partQ := 1.0
+			if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					partQ = f
+				}
+			}
+
+			if partQ > q {
+				q = partQ
+			}
+		}
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	// If nothing acceptable was found, fall back to the default rather than sending 406 Not Acceptable.
+	if best == "" {
+		return offers[0]
+	}
+
+	return best
+}
+
+func mediaRangeMatches(mediaRange, offer string) bool {
+	switch {
+	case mediaRange == "*/*":
+		return true
+	case strings.HasSuffix(mediaRange, "/*"):
+		return strings.HasPrefix(offer, strings.TrimSuffix(mediaRange, "*"))
+	default:
+		return mediaRange == offer
+	}
+}
+
+// writeResponse() sends the envelope in the format requested by the client's Accept header. JSON is always
+// available, XML is offered when enabled in the config, and MessagePack and Protocol Buffers are offered for
+// the compact binary encodings. Protocol Buffers are only available for the movie responses with a message
+// defined in proto/flickinfo/v1/movies.proto, and other responses (including errors) fall back to JSON.
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	// Tell caches that the response depends on the Accept header.
+	w.Header().Add("Vary", "Accept")
+
+	contentType, body, err := app.encodeResponse(r, data)
+	if err != nil {
+		return err
+	}
+
+	return app.writeBody(w, status, contentType, body, headers)
+}
+
+// encodeResponse() encodes the envelope as writeResponse() would send it, returning the content type along with
+// the body, so that handlers can derive an entity tag from the body before sending it.
+func (app *application) encodeResponse(r *http.Request, data envelope) (string, []byte, error) {
+	offers := []string{mediaTypeJSON, mediaTypeMsgpack, mediaTypeProtobuf}
+	if app.config.xml.enabled {
+		offers = append(offers, mediaTypeXML)
+	}
+
+	switch negotiate(r.Header.Get("Accept"), offers...) {
+	case mediaTypeXML:
+		body, err := marshalXML(data)
+		return "application/xml; charset=utf-8", body, err
+	case mediaTypeMsgpack:
+		body, err := wire.MarshalMsgpack(data)
+		return mediaTypeMsgpack, body, err
+	case mediaTypeProtobuf:
+		if body, ok := protobufMessage(data); ok {
+			return mediaTypeProtobuf, body, nil
+		}
+	}
+
+	body, err := marshalJSON(data)
+	return mediaTypeJSON, body, err
+}
+
+// protobufMessage() encodes the envelope as a protocol buffer message, if it has the shape of one of the
+// movie responses.
+func protobufMessage(env envelope) ([]byte, bool) {
+	switch {
+	case len(env) == 1 && env["movie"] != nil:
+		if movie, ok := env["movie"].(*data.Movie); ok {
+			return wire.MarshalMovieResponse(movie), true
+		}
+	case len(env) == 2 && env["movies"] != nil:
+		movies, ok1 := env["movies"].([]*data.Movie)
+		metadata, ok2 := env["metadata"].(data.Metadata)
+		if ok1 && ok2 {
+			return wire.MarshalMovieListResponse(movies, metadata), true
+		}
+	}
+
+	return nil, false
+}
+
+// writeBody() sends an already encoded response body with the given content type.
+func (app *application) writeBody(w http.ResponseWriter, status int, contentType string, body []byte, headers http.Header) error {
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+
+	return nil
+}
+
+// writeXML() is the XML counterpart of writeJSON(). The envelope is encoded as a <response> element with a
+// child element for each key.
+func (app *application) writeXML(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
+	xs, err := marshalXML(data)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(xs)
+
+	return nil
+}
+
+// marshalXML() encodes the envelope as an indented XML document.
+func marshalXML(data envelope) ([]byte, error) {
+	xs, err := xml.MarshalIndent(xmlEnvelope(data), "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	xs = append([]byte(xml.Header), xs...)
+	xs = append(xs, '\n')
+
+	return xs, nil
+}
+
+// xmlEnvelope wraps an envelope so it can be encoded as XML, which encoding/xml can't do for maps by itself.
+type xmlEnvelope envelope
+
+func (env xmlEnvelope) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "response"}
+	return encodeXMLMap(e, start, env)
+}
+
+// encodeXMLMap() writes a map as an element containing one child element per key, in sorted key order.
+func encodeXMLMap[V any](e *xml.Encoder, start xml.StartElement, m map[string]V) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := encodeXMLValue(e, xml.StartElement{Name: xml.Name{Local: key}}, m[key])
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// encodeXMLValue() writes a single envelope value. Nested envelopes and maps are written with encodeXMLMap(),
+// and slices as a wrapper element containing each item, named by the item type's XMLName (e.g. <movies>
+// containing <movie> elements). Everything else is left to encoding/xml and the struct tags.
+func encodeXMLValue(e *xml.Encoder, start xml.StartElement, value interface{}) error {
+	switch v := value.(type) {
+	case envelope:
+		return encodeXMLMap(e, start, v)
+	case map[string]interface{}:
+		return encodeXMLMap(e, start, v)
+	case map[string]string:
+		return encodeXMLMap(e, start, v)
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 {
+		err := e.EncodeToken(start)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < rv.Len(); i++ {
+			err := e.Encode(rv.Index(i).Interface())
+			if err != nil {
+				return err
+			}
+		}
+
+		return e.EncodeToken(start.End())
+	}
+
+	return e.EncodeElement(value, start)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+)
+
+// optionsHandler answers OPTIONS requests for any registered path. The router has already set the Allow header
+// to the methods registered for the path (including GET and POST), so it's reused for CORS preflight requests.
+func (app *application) optionsHandler(w http.ResponseWriter, r *http.Request) {
+	// If request has the HTTP method OPTIONS and contains the 'Access-Control-Request-Method' header, and the
+	// enableCORS() middleware has approved the origin, then it's a preflight request we should answer.
+	isPreflight := r.Header.Get("Access-Control-Request-Method") != "" && w.Header().Get("Access-Control-Allow-Origin") != ""
+
+	if isPreflight {
+		w.Header().Set("Access-Control-Allow-Methods", w.Header().Get("Allow"))
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match, X-Request-ID, X-Request-Timeout")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/storage"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// The image types accepted as posters, by the content type http.DetectContentType() sniffs from the file, with
+// the extension the poster is stored with.
+var posterTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// posterURL() returns the URL a poster can be fetched from: under the storage public URL if there is one, or
+// else from the API itself.
+func (app *application) posterURL(key string) string {
+	if app.config.storage.publicURL != "" {
+		return strings.TrimSuffix(app.config.storage.publicURL, "/") + "/" + key
+	}
+
+	return "/v1/posters/" + key
+}
+
+// attachPosterURLs() fills in the poster URL of the movies which have a poster.
+func (app *application) attachPosterURLs(movies ...*data.Movie) {
+	for _, movie := range movies {
+		if movie.PosterKey != "" {
+			movie.PosterURL = app.posterURL(movie.PosterKey)
+		}
+	}
+}
+
+// deletePoster() removes a poster which is no longer used from storage. A failure is only logged, as it just
+// leaves an unused file behind.
+func (app *application) deletePoster(r *http.Request, key string) {
+	if key == "" {
+		return
+	}
+
+	err := app.storage.Delete(r.Context(), key)
+	if err != nil {
+		app.logError(r, fmt.Errorf("deleting poster %s: %w", key, err))
+	}
+}
+
+// readPoster() reads the image in the "poster" field of the multipart/form-data request body, returning it with
+// its content type. Problems with the image itself are added to v.
+func (app *application) readPoster(w http.ResponseWriter, r *http.Request, v *validator.Validator) ([]byte, string, error) {
+	maxBytes := int64(app.config.posters.maxBytes)
+
+	// Allow a little more than the largest poster, for the multipart boundaries and headers.
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64*1024)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", errors.New("body must be multipart/form-data")
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		if part.FormName() != "poster" {
+			part.Close()
+			continue
+		}
+
+		// Read one byte more than the limit, to tell whether the image is too large.
+		image, err := io.ReadAll(io.LimitReader(part, maxBytes+1))
+		part.Close()
+		if err != nil {
+			return nil, "", err
+		}
+
+		contentType := http.DetectContentType(image)
+		_, allowed := posterTypes[contentType]
+
+		v.Check(len(image) > 0, "poster", "must be provided")
+		v.Check(int64(len(image)) <= maxBytes, "poster", fmt.Sprintf("must not be larger than %d bytes", maxBytes))
+		v.Check(len(image) == 0 || allowed, "poster", "must be a JPEG, PNG or WebP image")
+
+		return image, contentType, nil
+	}
+
+	v.AddError("poster", "must be provided")
+
+	return nil, "", nil
+}
+
+// uploadPosterHandler() sets the poster of the movie with the ID in the URL to the JPEG, PNG or WebP image in
+// the "poster" field of a multipart/form-data request. The image replaces any poster the movie already has,
+// which is deleted. Each upload is stored under a new key, so that caches of the old poster never need to be
+// invalidated.
+func (app *application) uploadPosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	image, contentType, err := app.readPoster(w, r, v)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit))
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	random := make([]byte, 8)
+
+	_, err = rand.Read(random)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	key := "movie-" + strconv.FormatInt(movie.ID, 10) + "-" + hex.EncodeToString(random) + posterTypes[contentType]
+
+	err = app.storage.Put(r.Context(), key, image, contentType)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	before := *movie
+	app.attachPosterURLs(&before)
+
+	movie.PosterKey = key
+
+	err = app.models.Movies.Update(r.Context(), movie)
+	if err != nil {
+		// The movie doesn't refer to the new poster, so it isn't needed.
+		app.deletePoster(r, key)
+
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.deletePoster(r, before.PosterKey)
+
+	app.attachPosterURLs(movie)
+	app.audit(r, data.AuditEntityMovie, movie.ID, data.AuditUpdate, &before, movie)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showPosterHandler() serves the poster image with the key in the URL from storage. Posters are public, as
+// they're loaded by browsers which can't send an Authorization header, and a key is never reused for a
+// different image, so they can be cached indefinitely.
+func (app *application) showPosterHandler(w http.ResponseWriter, r *http.Request) {
+	key := httprouter.ParamsFromContext(r.Context()).ByName("key")
+	if !storage.ValidKey(key) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	file, err := app.storage.Get(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Body.Close()
+
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	if file.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	}
+
+	// The status code has been sent once the copy starts, so an error can only be logged.
+	_, err = io.Copy(w, file.Body)
+	if err != nil && r.Context().Err() == nil {
+		app.logError(r, err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// showPreferencesHandler() returns the authenticated user's preferences.
+func (app *application) showPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	prefs, err := app.models.Preferences.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"preferences": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updatePreferencesHandler() updates the authenticated user's preferences. Fields missing from the request body
+// are left unchanged.
+func (app *application) updatePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	prefs, err := app.models.Preferences.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		FavoriteGenres     []string `json:"favorite_genres"`
+		PreferredLanguages []string `json:"preferred_languages"`
+		MaxContentRating   *string  `json:"max_content_rating"`
+		WeeklyDigest       *bool    `json:"weekly_digest"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.FavoriteGenres != nil {
+		prefs.FavoriteGenres = input.FavoriteGenres
+	}
+
+	if input.PreferredLanguages != nil {
+		prefs.PreferredLanguages = input.PreferredLanguages
+	}
+
+	if input.MaxContentRating != nil {
+		prefs.MaxContentRating = *input.MaxContentRating
+	}
+
+	if input.WeeklyDigest != nil {
+		prefs.WeeklyDigest = *input.WeeklyDigest
+	}
+
+	v := validator.New()
+
+	if data.ValidatePreferences(v, prefs); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Preferences.Update(r.Context(), user.ID, prefs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"preferences": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
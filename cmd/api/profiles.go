@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// The number of reviews and lists shown with a user's profile.
+const profileItems = 20
+
+// showUserProfileHandler() returns the public profile of the user with the given ID, along with their most recent
+// approved reviews and most viewed public lists. Private profiles are only shown to their owner; for everyone else
+// they are reported as not found, so that the response doesn't reveal whether the account exists. The owner sees
+// the same reviews and lists as everyone else, so that they can check what their profile shows.
+func (app *application) showUserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	profile, err := app.models.Profiles.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !profile.VisibleTo(app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	reviews, _, err := app.models.Reviews.GetApprovedForUser(r.Context(), id, data.Filters{
+		Page:         1,
+		PageSize:     profileItems,
+		Sort:         "-created_at",
+		SortSafeList: []string{"-created_at"},
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	lists, _, err := app.models.Lists.GetPublicForUser(r.Context(), id, data.Filters{
+		Page:         1,
+		PageSize:     profileItems,
+		Sort:         "-view_count",
+		SortSafeList: []string{"-view_count"},
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"profile": profile, "reviews": reviews, "lists": lists}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCurrentUserProfileHandler() returns the profile of the authenticated user, whatever its visibility.
+func (app *application) showCurrentUserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	profile, err := app.models.Profiles.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"profile": profile}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserProfileHandler() makes a partial update to the authenticated user's profile, including its
+// visibility setting.
+func (app *application) updateCurrentUserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	profile, err := app.models.Profiles.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Use pointers so that fields missing from the request body are left unchanged.
+	var input struct {
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		AvatarURL   *string `json:"avatar_url"`
+		Visibility  *string `json:"visibility"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.DisplayName != nil {
+		profile.DisplayName = *input.DisplayName
+	}
+
+	if input.Bio != nil {
+		profile.Bio = *input.Bio
+	}
+
+	if input.AvatarURL != nil {
+		profile.AvatarURL = *input.AvatarURL
+	}
+
+	if input.Visibility != nil {
+		profile.Visibility = *input.Visibility
+	}
+
+	v := validator.New()
+
+	if data.ValidateProfile(v, profile); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Profiles.Update(r.Context(), profile)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"profile": profile}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
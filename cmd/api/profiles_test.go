@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micypac/flick-info/internal/data"
+)
+
+// insertTestMovie() inserts a movie, deleting it along with its reviews when the test finishes.
+func insertTestMovie(t *testing.T, app *application, title string) *data.Movie {
+	t.Helper()
+
+	movie := &data.Movie{Title: title, Year: 2000, Runtime: 100, Genres: []string{}}
+
+	err := app.models.Movies.Insert(context.Background(), movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.db.Exec(`DELETE FROM movies WHERE id = $1`, movie.ID) })
+
+	return movie
+}
+
+// insertTestReview() inserts a review of the movie by the user, and gives it the moderation status.
+func insertTestReview(t *testing.T, app *application, user *data.User, movie *data.Movie, status string) *data.Review {
+	t.Helper()
+
+	ctx := context.Background()
+
+	review := &data.Review{UserID: user.ID, MovieID: movie.ID, Body: status + " review"}
+
+	err := app.models.Reviews.Insert(ctx, review)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != data.ReviewPending {
+		err = app.models.Reviews.Moderate(ctx, review, status, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return review
+}
+
+func TestUserProfile(t *testing.T) {
+	app := newTestApplication(t)
+	routes := app.routes()
+
+	ctx := context.Background()
+
+	public, publicToken := insertTestUser(t, app, "public")
+	private, privateToken := insertTestUser(t, app, "private")
+	_, otherToken := insertTestUser(t, app, "other")
+
+	profile, err := app.models.Profiles.Get(ctx, public.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile.Visibility = data.ProfilePublic
+
+	err = app.models.Profiles.Update(ctx, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the approved review and the public list belong on the profile.
+	var (
+		approved = insertTestReview(t, app, public, insertTestMovie(t, app, "Approved"), data.ReviewApproved)
+		_        = insertTestReview(t, app, public, insertTestMovie(t, app, "Pending"), data.ReviewPending)
+		_        = insertTestReview(t, app, public, insertTestMovie(t, app, "Rejected"), data.ReviewRejected)
+
+		publicList = insertTestList(t, app, public, data.ListPublic)
+		_          = insertTestList(t, app, public, data.ListUnlisted)
+		_          = insertTestList(t, app, public, data.ListPrivate)
+	)
+
+	tests := []struct {
+		name       string
+		userID     int64
+		token      string
+		wantStatus int
+	}{
+		{"public profile as anonymous", public.ID, "", http.StatusOK},
+		{"public profile as another user", public.ID, otherToken, http.StatusOK},
+		{"public profile as its owner", public.ID, publicToken, http.StatusOK},
+		{"private profile as anonymous", private.ID, "", http.StatusNotFound},
+		{"private profile as another user", private.ID, otherToken, http.StatusNotFound},
+		{"private profile as its owner", private.ID, privateToken, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v1/users/%d/profile", tt.userID), nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rr := httptest.NewRecorder()
+			routes.ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+
+			if tt.wantStatus != http.StatusOK || tt.userID != public.ID {
+				return
+			}
+
+			var resp struct {
+				Reviews []data.Review `json:"reviews"`
+				Lists   []data.List   `json:"lists"`
+			}
+
+			err := json.Unmarshal(rr.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(resp.Reviews) != 1 || resp.Reviews[0].ID != approved.ID {
+				t.Errorf("got reviews %+v; want only review %d", resp.Reviews, approved.ID)
+			}
+
+			if len(resp.Lists) != 1 || resp.Lists[0].ID != publicList.ID {
+				t.Errorf("got lists %+v; want only list %d", resp.Lists, publicList.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/micypac/flick-info/internal/redis"
+	"github.com/micypac/flick-info/internal/validator"
+	"golang.org/x/time/rate"
+)
+
+// The longest a client can be exempted from rate limiting in one go, so that a forgotten exemption runs out.
+const maxRateLimitExemption = 24 * time.Hour
+
+// Prefix of the Redis keys holding the clients' token buckets.
+const redisRateLimitKeyPrefix = "flickinfo:ratelimit:"
+
+// rateLimitStore holds a token bucket for each client IP address, which decides whether its requests may go
+// ahead.
+type rateLimitStore interface {
+	// take() takes a token from the client's bucket, reporting whether there was one.
+	take(ctx context.Context, ip string, now time.Time) (bool, error)
+	// reset() gives the client a full bucket again, reporting whether it had a bucket.
+	reset(ctx context.Context, ip string) (bool, error)
+	// cleanup() forgets the buckets of clients which haven't been seen since before the given time.
+	cleanup(before time.Time)
+}
+
+// memoryRateLimitStore keeps the token buckets in memory, so each instance of the API limits clients separately.
+type memoryRateLimitStore struct {
+	rps   rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newMemoryRateLimitStore(rps float64, burst int) *memoryRateLimitStore {
+	return &memoryRateLimitStore{rps: rate.Limit(rps), burst: burst, buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *memoryRateLimitStore) take(ctx context.Context, ip string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, found := s.buckets[ip]
+	if !found {
+		b = &memoryBucket{limiter: rate.NewLimiter(s.rps, s.burst)}
+		s.buckets[ip] = b
+	}
+
+	b.lastSeen = now
+
+	return b.limiter.AllowN(now, 1), nil
+}
+
+func (s *memoryRateLimitStore) reset(ctx context.Context, ip string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, found := s.buckets[ip]
+	delete(s.buckets, ip)
+
+	return found, nil
+}
+
+func (s *memoryRateLimitStore) cleanup(before time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ip, b := range s.buckets {
+		if b.lastSeen.Before(before) {
+			delete(s.buckets, ip)
+		}
+	}
+}
+
+// redisRateLimitStore keeps the token buckets in Redis, so that every instance of the API shares them and a
+// client is limited to the same rate however its requests are balanced across the instances. Each bucket is a
+// hash holding its tokens and when it was last refilled, which expires once it would be full again anyway.
+type redisRateLimitStore struct {
+	client *redis.Client
+	rps    float64
+	burst  int
+}
+
+// tokenBucketScript refills the bucket in KEYS[1] at ARGV[1] tokens per second, up to ARGV[2] tokens, and takes
+// a token if there is one, returning 1 if there was and 0 if not. It uses the Redis server's clock, so that the
+// instances' clocks don't need to agree.
+var tokenBucketScript = redis.NewScript(`
+local rps = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'refilled')
+local tokens = tonumber(bucket[1]) or burst
+local refilled = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - refilled) / 1000 * rps)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'refilled', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rps * 1000) + 1000)
+
+return allowed
+`)
+
+func (s *redisRateLimitStore) take(ctx context.Context, ip string, now time.Time) (bool, error) {
+	reply, err := tokenBucketScript.Run(ctx, s.client, []string{redisRateLimitKeyPrefix + ip},
+		strconv.FormatFloat(s.rps, 'f', -1, 64), strconv.Itoa(s.burst))
+	if err != nil {
+		return false, err
+	}
+
+	return reply == int64(1), nil
+}
+
+func (s *redisRateLimitStore) reset(ctx context.Context, ip string) (bool, error) {
+	reply, err := s.client.Do(ctx, "DEL", redisRateLimitKeyPrefix+ip)
+	if err != nil {
+		return false, err
+	}
+
+	return reply == int64(1), nil
+}
+
+// cleanup() does nothing, as the buckets expire in Redis.
+func (s *redisRateLimitStore) cleanup(before time.Time) {}
+
+// clientLimiter rate limits each client IP address with the token buckets in its store, and holds the temporary
+// exemptions an admin has made. The exemptions and the counts of rejected requests are kept in memory, so each
+// instance of the API has its own, even when the buckets are shared through Redis.
+type clientLimiter struct {
+	rps   float64
+	burst int
+	store rateLimitStore
+	kind  string // The kind of store, "memory" or "redis".
+
+	mu         sync.Mutex
+	clients    map[string]*limitedClient
+	exemptions map[string]time.Time // Keyed by IP address, holding when the exemption ends.
+
+	// Rejections in the current and the previous minute, for the rejects per minute.
+	minute          int64
+	rejects         int64
+	previousRejects int64
+
+	// When an error from the store was last logged, so that an outage doesn't log every request.
+	lastStoreErrorLogged time.Time
+
+	rejectedTotal *expvar.Int
+	storeErrors   *expvar.Int
+}
+
+// limitedClient is how many of a client's requests have been rejected since it was first tracked. A client is no
+// longer tracked once it has been idle for 3 minutes.
+type limitedClient struct {
+	lastSeen time.Time
+	rejected int64
+}
+
+// throttledClient describes a tracked client, for the admin endpoint.
+type throttledClient struct {
+	XMLName  xml.Name  `json:"-" xml:"client"`
+	IP       string    `json:"ip" xml:"ip"`
+	Rejected int64     `json:"rejected" xml:"rejected"`
+	LastSeen time.Time `json:"last_seen" xml:"last_seen"`
+}
+
+// rateLimitExemption is a client which isn't rate limited until the given time.
+type rateLimitExemption struct {
+	XMLName xml.Name  `json:"-" xml:"exemption"`
+	IP      string    `json:"ip" xml:"ip"`
+	Until   time.Time `json:"until" xml:"until"`
+}
+
+// rateLimitStatus is the limiter's state, for the admin endpoint.
+type rateLimitStatus struct {
+	XMLName          xml.Name             `json:"-" xml:"rate_limit"`
+	Enabled          bool                 `json:"enabled" xml:"enabled"`
+	Store            string               `json:"store" xml:"store"`
+	RPS              float64              `json:"rps" xml:"rps"`
+	Burst            int                  `json:"burst" xml:"burst"`
+	TrackedClients   int                  `json:"tracked_clients" xml:"tracked_clients"`
+	RejectsPerMinute int64                `json:"rejects_per_minute" xml:"rejects_per_minute"`
+	RejectedTotal    int64                `json:"rejected_total" xml:"rejected_total"`
+	TopThrottled     []throttledClient    `json:"top_throttled" xml:"top_throttled>client"`
+	Exemptions       []rateLimitExemption `json:"exemptions" xml:"exemptions>exemption"`
+}
+
+// newClientLimiter() returns a limiter allowing each client rps requests per second with the given burst, using
+// the token buckets in the store. The number of tracked clients, the rejects in the last full minute, the total
+// rejects and the number of errors from the store are published through expvar as rate_limiter_clients,
+// rate_limiter_rejects_per_minute, rate_limiter_rejected_total and rate_limiter_store_errors. Like
+// expvar.Publish(), this panics if it is called more than once.
+func newClientLimiter(rps float64, burst int, store rateLimitStore, kind string, now func() time.Time) *clientLimiter {
+	l := &clientLimiter{
+		rps:           rps,
+		burst:         burst,
+		store:         store,
+		kind:          kind,
+		clients:       make(map[string]*limitedClient),
+		exemptions:    make(map[string]time.Time),
+		rejectedTotal: expvar.NewInt("rate_limiter_rejected_total"),
+		storeErrors:   expvar.NewInt("rate_limiter_store_errors"),
+	}
+
+	expvar.Publish("rate_limiter_clients", expvar.Func(func() interface{} {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		return len(l.clients)
+	}))
+
+	expvar.Publish("rate_limiter_rejects_per_minute", expvar.Func(func() interface{} {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		return l.rejectsPerMinute(now())
+	}))
+
+	return l
+}
+
+// allow() reports whether a request from the client with the given IP address may go ahead. If the store fails,
+// the request is allowed, so that an outage of Redis doesn't take the API down with it, and the error is
+// returned for logging.
+func (l *clientLimiter) allow(ctx context.Context, ip string, now time.Time) (bool, error) {
+	l.mu.Lock()
+
+	if until, ok := l.exemptions[ip]; ok && now.Before(until) {
+		l.mu.Unlock()
+		return true, nil
+	}
+
+	c, found := l.clients[ip]
+	if !found {
+		c = &limitedClient{}
+		l.clients[ip] = c
+	}
+
+	c.lastSeen = now
+
+	// Don't hold the mutex while the store is consulted, as with Redis that is a network round trip.
+	l.mu.Unlock()
+
+	allowed, err := l.store.take(ctx, ip, now)
+	if err != nil {
+		l.storeErrors.Add(1)
+		return true, err
+	}
+
+	if allowed {
+		return true, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c.rejected++
+	l.rejectedTotal.Add(1)
+
+	// Move the per-minute counts on to this minute before counting the reject.
+	l.rejectsPerMinute(now)
+	l.rejects++
+
+	return false, nil
+}
+
+// shouldLogStoreError() reports whether an error from the store should be logged, which it is at most once a
+// minute.
+func (l *clientLimiter) shouldLogStoreError(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastStoreErrorLogged) < time.Minute {
+		return false
+	}
+
+	l.lastStoreErrorLogged = now
+	return true
+}
+
+// rejectsPerMinute() returns the number of requests rejected in the last full minute, first moving the counts
+// on to the current minute. The caller must hold the mutex.
+func (l *clientLimiter) rejectsPerMinute(now time.Time) int64 {
+	minute := now.Unix() / 60
+
+	switch {
+	case minute == l.minute+1:
+		l.previousRejects, l.rejects = l.rejects, 0
+	case minute > l.minute+1:
+		l.previousRejects, l.rejects = 0, 0
+	}
+
+	if minute > l.minute {
+		l.minute = minute
+	}
+
+	return l.previousRejects
+}
+
+// cleanup() stops tracking clients which haven't been seen for 3 minutes, and removes expired exemptions.
+func (l *clientLimiter) cleanup(now time.Time) {
+	l.store.cleanup(now.Add(-3 * time.Minute))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, client := range l.clients {
+		if now.Sub(client.lastSeen) > 3*time.Minute {
+			delete(l.clients, ip)
+		}
+	}
+
+	for ip, until := range l.exemptions {
+		if !now.Before(until) {
+			delete(l.exemptions, ip)
+		}
+	}
+}
+
+// reset() gives the client a full bucket again, and stops tracking it. It reports whether the client was being
+// tracked, or had a bucket in the store.
+func (l *clientLimiter) reset(ctx context.Context, ip string) (bool, error) {
+	hadBucket, err := l.store.reset(ctx, ip)
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, found := l.clients[ip]
+	delete(l.clients, ip)
+
+	return found || hadBucket, nil
+}
+
+// exempt() stops rate limiting the client until the given time.
+func (l *clientLimiter) exempt(ip string, until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.exemptions[ip] = until
+}
+
+// unexempt() removes the client's exemption, and reports whether it had one.
+func (l *clientLimiter) unexempt(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, found := l.exemptions[ip]
+	delete(l.exemptions, ip)
+
+	return found
+}
+
+// status() returns the limiter's state, with up to top of the tracked clients which have had the most requests
+// rejected.
+func (l *clientLimiter) status(now time.Time, top int) rateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := rateLimitStatus{
+		Store:            l.kind,
+		RPS:              l.rps,
+		Burst:            l.burst,
+		TrackedClients:   len(l.clients),
+		RejectsPerMinute: l.rejectsPerMinute(now),
+		RejectedTotal:    l.rejectedTotal.Value(),
+		TopThrottled:     []throttledClient{},
+		Exemptions:       []rateLimitExemption{},
+	}
+
+	for ip, client := range l.clients {
+		if client.rejected > 0 {
+			status.TopThrottled = append(status.TopThrottled, throttledClient{IP: ip, Rejected: client.rejected, LastSeen: client.lastSeen})
+		}
+	}
+
+	sort.Slice(status.TopThrottled, func(i, j int) bool {
+		a, b := status.TopThrottled[i], status.TopThrottled[j]
+		if a.Rejected != b.Rejected {
+			return a.Rejected > b.Rejected
+		}
+		return a.IP < b.IP
+	})
+
+	if len(status.TopThrottled) > top {
+		status.TopThrottled = status.TopThrottled[:top]
+	}
+
+	for ip, until := range l.exemptions {
+		if now.Before(until) {
+			status.Exemptions = append(status.Exemptions, rateLimitExemption{IP: ip, Until: until})
+		}
+	}
+
+	sort.Slice(status.Exemptions, func(i, j int) bool {
+		return status.Exemptions[i].IP < status.Exemptions[j].IP
+	})
+
+	return status
+}
+
+// readIPParam() reads the IP address in the "ip" URL parameter, in its canonical form.
+func (app *application) readIPParam(r *http.Request) (string, error) {
+	ip := net.ParseIP(httprouter.ParamsFromContext(r.Context()).ByName("ip"))
+	if ip == nil {
+		return "", errors.New("invalid ip parameter")
+	}
+
+	return ip.String(), nil
+}
+
+// showRateLimitHandler() returns the rate limiter's state: the number of clients being tracked, the rejects in
+// the last full minute, the 20 clients with the most rejected requests, and any exemptions.
+func (app *application) showRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	status := app.limiter.status(app.clock.Now(), 20)
+	status.Enabled = app.config.limiter.enabled
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"rate_limit": status}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resetRateLimitClientHandler() clears the rate limit state of the client with the IP address in the URL, so that
+// its next requests are allowed up to the full burst.
+func (app *application) resetRateLimitClientHandler(w http.ResponseWriter, r *http.Request) {
+	ip, err := app.readIPParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	found, err := app.limiter.reset(r.Context(), ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !found {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.logger.PrintInfo("rate limit reset", map[string]string{
+		"ip":       ip,
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "rate limit successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createRateLimitExemptionHandler() stops rate limiting a client for a while, for example to let a partner's
+// integration through during an incident. Exempting a client which is already exempt replaces its exemption.
+func (app *application) createRateLimitExemptionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IP       string `json:"ip"`
+		Duration string `json:"duration"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	ip := net.ParseIP(input.IP)
+	v.Check(input.IP != "", "ip", "must be provided")
+	v.Check(input.IP == "" || ip != nil, "ip", "must be a valid IP address")
+
+	duration, err := time.ParseDuration(input.Duration)
+	v.Check(input.Duration != "", "duration", "must be provided")
+	v.Check(input.Duration == "" || err == nil, "duration", "must be a duration such as 30m or 2h")
+	v.Check(err != nil || duration > 0, "duration", "must be positive")
+	v.Check(err != nil || duration <= maxRateLimitExemption, "duration", "must not be more than "+maxRateLimitExemption.String())
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	exemption := rateLimitExemption{IP: ip.String(), Until: app.clock.Now().Add(duration)}
+
+	app.limiter.exempt(exemption.IP, exemption.Until)
+
+	app.logger.PrintInfo("rate limit exemption added", map[string]string{
+		"ip":       exemption.IP,
+		"until":    exemption.Until.Format(time.RFC3339),
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"exemption": exemption}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteRateLimitExemptionHandler() ends the exemption of the client with the IP address in the URL early.
+func (app *application) deleteRateLimitExemptionHandler(w http.ResponseWriter, r *http.Request) {
+	ip, err := app.readIPParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if !app.limiter.unexempt(ip) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.logger.PrintInfo("rate limit exemption removed", map[string]string{
+		"ip":       ip,
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "rate limit exemption successfully removed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/micypac/flick-info/internal/metrics"
 )
 
 func (app *application) routes() http.Handler {
@@ -17,23 +18,210 @@ func (app *application) routes() http.Handler {
 	// Use the methodNotAllowedResponse() helper method for the router.
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
+	// Let the router answer OPTIONS requests for every path automatically, using the optionsHandler() to write
+	// the response. This also handles CORS preflight requests.
+	router.HandleOPTIONS = true
+	router.GlobalOPTIONS = http.HandlerFunc(app.optionsHandler)
+
+	// In tolerant mode, non-canonical paths are redirected by the normalizePath() middleware with a 308, which
+	// (unlike the router's own 301/307 redirects) keeps the method and body for every request. So turn off the
+	// router's built-in redirects to avoid both acting on the same request.
+	if app.config.router.tolerant {
+		router.RedirectTrailingSlash = false
+		router.RedirectFixedPath = false
+	}
+
 	// Register the relevant methods, URL patterns, and handler functions for the
 	// different endpoints using the HandlerFunc() method.
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodHead, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/deep", app.deepHealthcheckHandler)
 
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
+	// httprouter doesn't allow a static segment and a named parameter in the same position, so requests for
+	// /v1/movies/stream, /v1/movies/export and /v1/movies/duplicates are dispatched from the /v1/movies/:id route.
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.dispatchParam("id", map[string]http.HandlerFunc{
+		"duplicates": app.requireDatabase(app.requirePermission("movies:write", app.listMovieDuplicatesHandler)),
+		"export":     app.exportMoviesHandler,
+		"stream":     app.streamMoviesHandler,
+	}, app.showMovieHandler)))
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/merge", app.requireDatabase(app.requirePermission("movies:write", app.mergeMoviesHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/poster", app.requirePermission("movies:write", app.uploadPosterHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/share", app.requirePermission("movies:read", app.shareMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/search", app.requireDatabase(app.requirePermission("movies:read", app.searchHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/search/movies", app.requirePermission("movies:read", app.searchMoviesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/ratings", app.requireDatabase(app.requirePermission("movies:read", app.listMovieRatingsHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/ratings", app.requireDatabase(app.requirePermission("movies:read", app.rateMovieHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/ratings/:id", app.requireDatabase(app.requirePermission("movies:read", app.deleteRatingHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.requireDatabase(app.requirePermission("movies:read", app.listMovieReviewsHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requireDatabase(app.requirePermission("movies:read", app.createReviewHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/reviews/:id", app.requireDatabase(app.requirePermission("movies:read", app.showReviewHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/reviews/:id", app.requireDatabase(app.requirePermission("movies:read", app.updateReviewHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/reviews/:id", app.requireDatabase(app.requirePermission("movies:read", app.deleteReviewHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/cast", app.requireDatabase(app.requirePermission("movies:write", app.updateMovieCastHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/crew", app.requireDatabase(app.requirePermission("movies:read", app.listMovieCrewHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/crew", app.requireDatabase(app.requirePermission("movies:write", app.updateMovieCrewHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/genres", app.requireDatabase(app.requirePermission("movies:read", app.listGenresHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/genres/:id", app.requireDatabase(app.requirePermission("movies:read", app.showGenreHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/people", app.requireDatabase(app.requirePermission("movies:read", app.listPeopleHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/people", app.requireDatabase(app.requirePermission("movies:write", app.createPersonHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/people/:id", app.requireDatabase(app.requirePermission("movies:read", app.showPersonHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/people/:id", app.requireDatabase(app.requirePermission("movies:write", app.updatePersonHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/people/:id", app.requireDatabase(app.requirePermission("movies:write", app.deletePersonHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/people/:id/movies", app.requireDatabase(app.requirePermission("movies:read", app.listPersonMoviesHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/shared/movies/:id", app.requireSignedURL(app.showMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/posters/:key", app.showPosterHandler)
+	// The routes wrapped with requireDatabase() use models which are only implemented for PostgreSQL, so they
+	// respond with a 501 when the server is running with in-memory storage.
+	router.HandlerFunc(http.MethodGet, "/v1/shared/lists/:slug", app.requireDatabase(app.showSharedListHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/shared/lists/:slug/entries", app.requireDatabase(app.listSharedListEntriesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/lists", app.requireDatabase(app.requirePermission("lists:read", app.listListsHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/lists", app.requireDatabase(app.requirePermission("lists:write", app.createListHandler)))
+	// Lists can be viewed without authenticating, subject to their visibility.
+	router.HandlerFunc(http.MethodGet, "/v1/lists/:id", app.requireDatabase(app.dispatchParam("id", map[string]http.HandlerFunc{
+		"popular": app.listPopularListsHandler,
+	}, app.showListHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/lists/:id", app.requireDatabase(app.requirePermission("lists:write", app.updateListHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/lists/:id", app.requireDatabase(app.requirePermission("lists:write", app.deleteListHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/lists/:id/entries", app.requireDatabase(app.listListEntriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/lists/:id/entries", app.requireDatabase(app.requirePermission("lists:write", app.addListEntryHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/lists/:id/entries", app.requireDatabase(app.requirePermission("lists:write", app.reorderListEntriesHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/lists/:id/entries/:movie_id", app.requireDatabase(app.requirePermission("lists:write", app.removeListEntryHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/lists/:id/members", app.requireDatabase(app.listListMembersHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/lists/:id/members", app.requireDatabase(app.requirePermission("lists:write", app.addListMemberHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/lists/:id/members/:user_id", app.requireDatabase(app.requirePermission("lists:write", app.removeListMemberHandler)))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/pat", app.requireSessionToken(app.createPersonalAccessTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/pat/:id", app.requireSessionToken(app.deletePersonalAccessTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireSessionToken(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireSessionToken(app.deleteAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireSessionToken(app.deleteSessionHandler))
+
+	// As with the movie routes, httprouter can't register /v1/users/me/... alongside /v1/users/:id/..., so the
+	// GET requests for both are dispatched from a single route.
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id", app.dispatchParam("id", map[string]http.HandlerFunc{
+		"me": app.requireAuthenticatedUser(app.showCurrentUserHandler),
+	}, app.notFoundResponse))
+	router.HandlerFunc(http.MethodGet, "/v1/users/:id/:resource", app.dispatchParam("id", map[string]http.HandlerFunc{
+		"me": app.dispatchParam("resource", map[string]http.HandlerFunc{
+			"api-keys":      app.requireSessionToken(app.listAPIKeysHandler),
+			"notifications": app.requireDatabase(app.requirePermission("account:read", app.listNotificationsHandler)),
+			"pat":           app.requireSessionToken(app.listPersonalAccessTokensHandler),
+			"preferences":   app.requirePermission("account:read", app.showPreferencesHandler),
+			"profile":       app.requireDatabase(app.requirePermission("account:read", app.showCurrentUserProfileHandler)),
+			"reviews":       app.requireDatabase(app.requirePermission("account:read", app.listCurrentUserReviewsHandler)),
+			"searches":      app.requireDatabase(app.requirePermission("account:read", app.listSavedSearchesHandler)),
+			"sessions":      app.requireSessionToken(app.listSessionsHandler),
+			"watchlist":     app.requireDatabase(app.requirePermission("account:read", app.listWatchlistHandler)),
+		}, app.notFoundResponse),
+	}, app.dispatchParam("resource", map[string]http.HandlerFunc{
+		"profile": app.requireDatabase(app.showUserProfileHandler),
+	}, app.notFoundResponse)))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireSessionToken(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/profile", app.requireDatabase(app.requirePermission("account:write", app.updateCurrentUserProfileHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/preferences", app.requirePermission("account:write", app.updatePreferencesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/import", app.requireDatabase(app.requirePermission("account:write", app.importDataHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/searches", app.requireDatabase(app.requirePermission("account:write", app.createSavedSearchHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/searches/:id", app.requireDatabase(app.requirePermission("account:write", app.deleteSavedSearchHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/watchlist", app.requireDatabase(app.requirePermission("account:write", app.addToWatchlistHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/watchlist/:movie_id", app.requireDatabase(app.requirePermission("account:write", app.removeFromWatchlistHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/notifications/read", app.requireDatabase(app.requirePermission("account:write", app.markNotificationsReadHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/erasure", app.requireDatabase(app.requireSessionToken(app.eraseCurrentUserHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit", app.requirePermission("audit:read", app.listAuditLogHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requireDatabase(app.requirePermission("users:admin", app.listUsersHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requireDatabase(app.requirePermission("users:admin", app.showUserHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requireDatabase(app.requirePermission("users:admin", app.updateUserHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id", app.requireDatabase(app.requirePermission("users:admin", app.deleteUserHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/erasure", app.requireDatabase(app.requirePermission("users:erase", app.eraseUserHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/genres", app.requireDatabase(app.requirePermission("movies:write", app.listGenresHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/genres", app.requireDatabase(app.requirePermission("movies:write", app.createGenreHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/genres/:id", app.requireDatabase(app.requirePermission("movies:write", app.updateGenreHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/genres/:id", app.requireDatabase(app.requirePermission("movies:write", app.deleteGenreHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/genres/rename", app.requireDatabase(app.requirePermission("movies:write", app.renameGenreHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/genres/merge", app.requireDatabase(app.requirePermission("movies:write", app.mergeGenresHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/reviews", app.requireDatabase(app.requirePermission("reviews:moderate", app.listReviewsForModerationHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/reviews/:id/status", app.requireDatabase(app.requirePermission("reviews:moderate", app.moderateReviewHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/emails", app.requireDatabase(app.requirePermission("emails:manage", app.listOutboxEmailsHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/emails/:id/requeue", app.requireDatabase(app.requirePermission("emails:manage", app.requeueOutboxEmailHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/analytics", app.requireDatabase(app.requirePermission("analytics:read", app.showAnalyticsHandler)))
 
+	router.HandlerFunc(http.MethodGet, "/v1/admin/ratelimit", app.requirePermission("debug:read", app.showRateLimitHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/ratelimit/clients/:ip", app.requirePermission("ratelimit:manage", app.resetRateLimitClientHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/ratelimit/exemptions", app.requirePermission("ratelimit:manage", app.createRateLimitExemptionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/ratelimit/exemptions/:ip", app.requirePermission("ratelimit:manage", app.deleteRateLimitExemptionHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/debug/runtime", app.requirePermission("debug:read", app.showRuntimeDumpHandler))
+
+	// The debug capture endpoint only exists when capturing is enabled.
+	if app.captures != nil {
+		router.HandlerFunc(http.MethodGet, "/v1/admin/debug/requests", app.requirePermission("debug:read", app.listCapturedRequestsHandler))
+	}
+
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.createRefreshedTokensHandler)
+
+	if app.jwt != nil {
+		router.HandlerFunc(http.MethodPost, "/v1/tokens/jwt", app.createJWTHandler)
+	}
+
+	// The metrics are also served without authentication by the debug server, for scrapers which can reach it.
+	router.HandlerFunc(http.MethodGet, "/v1/metrics", app.requirePermission("debug:read", expvar.Handler().ServeHTTP))
+	router.HandlerFunc(http.MethodGet, "/v1/metrics/prometheus", app.requirePermission("debug:read", metrics.Handler().ServeHTTP))
+
+	handler := app.traceMiddleware("authenticate", app.authenticate)(app.deprecationHeaders(router, router))
 
-	router.Handler(http.MethodGet, "/v1/metrics", expvar.Handler())
+	// Record requests and responses for debugging, if enabled.
+	if app.captures != nil {
+		handler = app.captureRequests(handler)
+	}
 
 	// Wrap the router with the panic recover middleware.
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	rateLimit := app.traceMiddleware("rateLimit", app.rateLimit)
+	handler = app.recoverPanic(app.enableCORS(rateLimit(app.requestTimeout(app.normalizePath(router, handler)))))
+
+	// Inject faults, if configured, outside recoverPanic(), so that an aborted request isn't turned into a 500.
+	if len(app.config.chaos.rules) > 0 {
+		handler = app.injectFaults(router, handler)
+	}
+
+	// Trace each request, outside the other middleware so that its span covers all of them, and the request log
+	// has its trace ID.
+	return app.trace(router, app.metrics(router, app.logRequest(handler)))
+}
+
+// dispatchParam() returns a handler which calls the handler in static matching the value of the named route
+// parameter, or fallback if there isn't one. This lets a fixed path like /v1/movies/stream share a route with
+// a parameterized one like /v1/movies/:id.
+func (app *application) dispatchParam(name string, static map[string]http.HandlerFunc, fallback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+
+		if handler, ok := static[params.ByName(name)]; ok {
+			handler(w, r)
+			return
+		}
+
+		fallback(w, r)
+	}
 }
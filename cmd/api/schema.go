@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/micypac/flick-info/internal/dbmigrate"
+	"github.com/micypac/flick-info/internal/jsonlog"
+	"github.com/micypac/flick-info/migrations"
+)
+
+// migrateDB() applies any pending embedded migrations. dbmigrate.Up() holds an advisory lock while it runs, so
+// when several instances start at once, one migrates and the others wait and then find nothing left to do.
+func migrateDB(db *sql.DB, logger *jsonlog.Logger) error {
+	applied, err := dbmigrate.Up(db, migrations.FS)
+	for _, m := range applied {
+		logger.PrintInfo("applied migration", map[string]string{"version": strconv.FormatInt(m.Version, 10), "name": m.Name})
+	}
+
+	return err
+}
+
+// checkSchema() compares the database's schema version with the newest migration embedded in the binary.
+//
+// A database which is behind, or dirty, is missing tables or columns the code relies on, so with the "strict"
+// check it stops the API from serving. A database which is ahead is only logged, because during a rolling deploy
+// the new version's migrations are applied while the old version is still serving, and migrations are written
+// to be backward compatible. With the "warn" check every mismatch is logged instead.
+func checkSchema(db *sql.DB, mode string, logger *jsonlog.Logger) error {
+	if mode == "off" {
+		return nil
+	}
+
+	current, dirty, err := dbmigrate.Version(db)
+	if err != nil {
+		return err
+	}
+
+	expected, err := dbmigrate.Latest(migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	props := map[string]string{
+		"schema_version":   strconv.FormatInt(current, 10),
+		"expected_version": strconv.FormatInt(expected, 10),
+	}
+
+	var problem error
+
+	switch {
+	case dirty:
+		problem = fmt.Errorf("database schema is dirty at version %d, fix it and run the migrate force command", current)
+	case current < expected:
+		problem = fmt.Errorf("database schema version %d is behind the expected version %d, run the migrations with -db-migrate or the migrate command", current, expected)
+	case current > expected:
+		logger.PrintError(fmt.Errorf("database schema version %d is ahead of the expected version %d", current, expected), props)
+		return nil
+	default:
+		return nil
+	}
+
+	if mode == "strict" {
+		return problem
+	}
+
+	logger.PrintError(problem, props)
+
+	return nil
+}
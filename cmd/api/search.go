@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// The most results of each type GET /v1/search returns.
+const maxSearchGroupResults = 20
+
+// searchHandler() searches movies, people and users at once, for a single search box, returning a group of the
+// best matches of each type with its total number of matches. Each result has a rank, which can only be
+// compared within its group. Users are only searched for administrators with the users:admin permission. The
+// types parameter limits the search to some of the types, such as types=movies,people.
+func (app *application) searchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Query string
+		Types []string
+		Limit int
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Query = app.readString(qs, "q", "")
+	input.Types = app.readCSV(qs, "types", []string{})
+	input.Limit = app.readInt(qs, "limit", 5, v)
+
+	v.Check(input.Query != "", "q", "must be provided")
+	v.Check(len(input.Query) <= data.MaxSearchQueryLength, "q", fmt.Sprintf("must not be more than %d bytes long", data.MaxSearchQueryLength))
+	v.Check(input.Query == "" || len(data.SearchTerms(input.Query)) > 0, "q", "must contain a letter or digit")
+	v.Check(input.Limit > 0, "limit", "must be greater than zero")
+	v.Check(input.Limit <= maxSearchGroupResults, "limit", "must be a maximum of "+strconv.Itoa(maxSearchGroupResults))
+
+	for _, t := range input.Types {
+		v.Check(validator.In(t, "movies", "people", "users"), "types", "must only contain movies, people and users")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	isAdmin := permissions.Include("users:admin") && app.credentialPermits(r, "users:admin")
+
+	types := map[string]bool{"movies": true, "people": true, "users": isAdmin}
+
+	if len(input.Types) > 0 {
+		types = make(map[string]bool)
+		for _, t := range input.Types {
+			types[t] = true
+		}
+
+		if types["users"] && !isAdmin {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	// Each group is the first page of the search of its type.
+	filters := data.Filters{Page: 1, PageSize: input.Limit}
+
+	results := envelope{}
+
+	if types["movies"] {
+		movies, metadata, err := app.models.Movies.Search(r.Context(), input.Query, filters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		for _, result := range movies {
+			app.attachPosterURLs(result.Movie)
+		}
+
+		results["movies"] = envelope{"total": metadata.TotalRecords, "results": movies}
+	}
+
+	if types["people"] {
+		people, metadata, err := app.models.People.Search(r.Context(), input.Query, filters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		results["people"] = envelope{"total": metadata.TotalRecords, "results": people}
+	}
+
+	if types["users"] {
+		users, metadata, err := app.models.AdminUsers.Search(r.Context(), input.Query, filters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		results["users"] = envelope{"total": metadata.TotalRecords, "results": users}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// searchMoviesHandler() returns a page of the movies whose titles match the q parameter, most relevant first,
+// with each title highlighted. Unlike the title filter of the movies listing, which needs every word to match
+// exactly, a search matches words by their start and tolerates typos. See data.MovieModel.Search().
+func (app *application) searchMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Query string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Query = app.readString(qs, "q", "")
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// Results are always in order of relevance.
+	input.Sort = "-rank"
+	input.Filters.SortSafeList = []string{"-rank"}
+
+	v.Check(input.Query != "", "q", "must be provided")
+	v.Check(len(input.Query) <= data.MaxSearchQueryLength, "q", fmt.Sprintf("must not be more than %d bytes long", data.MaxSearchQueryLength))
+	v.Check(input.Query == "" || len(data.SearchTerms(input.Query)) > 0, "q", "must contain a letter or digit")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	results, metadata, err := app.models.Movies.Search(r.Context(), input.Query, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movies := make([]*data.Movie, len(results))
+	for i, result := range results {
+		movies[i] = result.Movie
+	}
+
+	app.attachPosterURLs(movies...)
+
+	err = app.attachUserState(r, movies...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"results": results, "metadata": metadata}, app.paginationHeaders(r, metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// createSavedSearchHandler() saves a named search for the authenticated user. The search is checked against
+// the movies added from now on, and the user is notified of new matches.
+func (app *application) createSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Title       string   `json:"title"`
+		Genres      []string `json:"genres"`
+		Filter      string   `json:"filter"`
+		NotifyEmail *bool    `json:"notify_email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	search := &data.SavedSearch{
+		UserID:      app.contextGetUser(r).ID,
+		Name:        input.Name,
+		Title:       input.Title,
+		Genres:      input.Genres,
+		Filter:      input.Filter,
+		NotifyEmail: true,
+	}
+
+	// Notification emails are sent unless the client opts out.
+	if input.NotifyEmail != nil {
+		search.NotifyEmail = *input.NotifyEmail
+	}
+
+	if search.Genres == nil {
+		search.Genres = []string{}
+	}
+
+	v := validator.New()
+
+	if data.ValidateSavedSearch(v, search); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.SavedSearches.Insert(r.Context(), search)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateSavedSearch):
+			v.AddError("name", "a saved search with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrTooManySavedSearches):
+			v.AddError("name", fmt.Sprintf("cannot be added, you can have at most %d saved searches", data.MaxSavedSearches))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"saved_search": search}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSavedSearchesHandler() returns all of the authenticated user's saved searches.
+func (app *application) listSavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	searches, err := app.models.SavedSearches.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"saved_searches": searches}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Only delete the search if it belongs to the current user. Otherwise respond as if it doesn't exist.
+	err = app.models.SavedSearches.Delete(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "saved search successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -22,6 +23,12 @@ func (app *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Start the debug server, if there is one, on its own address.
+	debugSrv, err := app.listenDebug()
+	if err != nil {
+		return err
+	}
+
 	// Create a shutdownError channel. Use this to receive any errors returned by the graceful Shutdown() function.
 	shutdownError := make(chan error)
 
@@ -55,17 +62,46 @@ func (app *application) serve() error {
 			shutdownError <- err
 		}
 
+		// Stop the debug server too. A profile which is still being taken is abandoned when the deadline passes.
+		if debugSrv != nil {
+			debugSrv.Shutdown(ctx)
+		}
+
+		// Close the shutdown channel to tell the scheduled background jobs to stop.
+		close(app.shutdown)
+
 		// Log a message to say that we're waiting for any background goroutines to complete.
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
 
-		// Call Wait() to block until WaitGroup counter is zero. Then return nil
-		// on the shutdownError channel, to inidicate the shutdown completed without any issues.
-		app.wg.Wait()
+		// Block until the WaitGroup counter is zero, or the deadline passes, so that a stuck task can't stop the
+		// process from exiting. Then return nil on the shutdownError channel, as abandoned tasks are only logged.
+		if abandoned := app.waitForBackground(app.config.shutdown.taskTimeout); abandoned > 0 {
+			props := map[string]string{
+				"deadline": app.config.shutdown.taskTimeout.String(),
+				"tasks":    strconv.Itoa(abandoned),
+			}
+
+			app.logger.PrintInfo("abandoned background tasks after deadline", props)
+		}
+
+		// Export the trace spans which are still queued, including those of the background tasks, with a deadline of
+		// its own, as waiting for the tasks may have used up the server's.
+		tracingCtx, cancelTracing := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelTracing()
+
+		err = app.tracer.Shutdown(tracingCtx)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"tracing": "spans not exported before shutdown"})
+		}
+
 		shutdownError <- nil
 	}()
 
+	// Log a dump of the goroutine stacks whenever SIGQUIT is received.
+	app.handleDumpSignal()
+
 	// Log the starting server message.
 	app.logger.PrintInfo("starting server", map[string]string{
 		"env":  app.config.env,
@@ -75,7 +111,7 @@ func (app *application) serve() error {
 	// Calling server Shutdown() will cause ListenAndServe() to immediately return a http.ErrServerClosed error.
 	// This is an indication that the graceful shutdown has been initiated. Check specifically for this error
 	// only returning it if it is not http.ErrServerClosed.
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/micypac/flick-info/internal/jsonlog"
+	"github.com/micypac/flick-info/internal/redis"
+)
+
+// The longest delay between startup retries, however many attempts have failed.
+const maxStartupBackoff = 10 * time.Second
+
+// waitFor() calls check until it succeeds, backing off exponentially between attempts, so that the API survives
+// its dependencies starting up at the same time as it does. If check is still failing after the configured
+// maximum wait, the last error is returned. A maximum wait of zero means check is only called once.
+func waitFor(name string, cfg config, logger *jsonlog.Logger, check func() error) error {
+	deadline := time.Now().Add(cfg.startup.maxWait)
+	backoff := cfg.startup.backoff
+
+	for attempt := 1; ; attempt++ {
+		err := check()
+		if err == nil {
+			if attempt > 1 {
+				logger.PrintInfo(name+" is available", map[string]string{"attempts": strconv.Itoa(attempt)})
+			}
+			return nil
+		}
+
+		// Give up if the next attempt would start after the deadline.
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		logger.PrintInfo("waiting for "+name, map[string]string{
+			"error":       err.Error(),
+			"attempt":     strconv.Itoa(attempt),
+			"retry_after": backoff.String(),
+		})
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+// openRedis() returns a client for the Redis server at the URL, which cfg.validate() has checked, waiting for
+// the server to start if it isn't ready yet.
+func openRedis(cfg config, rawURL string, logger *jsonlog.Logger) (*redis.Client, error) {
+	redisOpts, _ := redis.ParseURL(rawURL)
+	redisOpts.Timeout = 500 * time.Millisecond
+
+	client := redis.New(redisOpts)
+
+	err := waitFor("redis", cfg, logger, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		return client.Ping(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
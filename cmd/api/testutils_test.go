@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/micypac/flick-info/internal/clock"
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/jsonlog"
+)
+
+// testDSNEnv names the environment variable holding the DSN of a migrated PostgreSQL database to run the
+// database tests against. They're skipped if it isn't set.
+const testDSNEnv = "FLICKINFO_TEST_DB_DSN"
+
+// newTestApplication() returns an application backed by the test database, with just enough set up to serve
+// its routes.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s isn't set", testDSNEnv)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	var cfg config
+	cfg.db.backend = "postgres"
+
+	clk := clock.Real{}
+
+	app := newBareApplication(cfg, clk)
+	app.models = data.NewModels(db, data.ModelOptions{Clock: clk})
+	app.db = db
+
+	return app
+}
+
+// newMemoryTestApplication() returns an application using in-memory storage, with just enough set up to serve its
+// routes.
+func newMemoryTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	var cfg config
+	cfg.db.backend = "memory"
+
+	clk := clock.Real{}
+
+	app := newBareApplication(cfg, clk)
+	app.models = data.NewMemoryModels(data.ModelOptions{Clock: clk})
+
+	return app
+}
+
+// newBareApplication() returns an application without any storage, for the functions above to add it to. The
+// limits on JSON request bodies are set to the flags' defaults.
+func newBareApplication(cfg config, clk clock.Clock) *application {
+	cfg.json.maxDepth = 20
+	cfg.json.maxArrayLength = 1000
+
+	return &application{
+		config:   cfg,
+		clock:    clk,
+		logger:   jsonlog.New(io.Discard, jsonlog.LevelError),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// insertTestUser() inserts an activated user with the default permissions, and returns it with the plaintext of an
+// authentication token for it. A user inserted into the database is deleted, along with everything it owns, when
+// the test finishes.
+func insertTestUser(t *testing.T, app *application, name string) (*data.User, string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	user := &data.User{
+		Name:      name,
+		Email:     fmt.Sprintf("%s-%d@example.com", name, time.Now().UnixNano()),
+		Activated: true,
+		Locale:    data.DefaultLocale,
+	}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.db != nil {
+		t.Cleanup(func() { app.db.Exec(`DELETE FROM users WHERE id = $1`, user.ID) })
+	}
+
+	err = app.models.Permissions.AddForUser(ctx, user.ID, defaultPermissions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.models.Tokens.New(ctx, user.ID, time.Hour, data.ScopeAuthentication, data.TokenMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, token.Plaintext
+}
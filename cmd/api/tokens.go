@@ -1,19 +1,26 @@
 package main
 
 import (
+	"encoding/xml"
 	"errors"
+	"expvar"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/micypac/flick-info/internal/data"
 	"github.com/micypac/flick-info/internal/validator"
 )
 
+// Count of logins from a client IP address and user agent that the user hasn't authenticated from before.
+var unrecognizedDeviceLogins = expvar.NewInt("auth_unrecognized_device_logins")
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the email and password from the request body.
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		DeviceName string `json:"device_name"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -27,14 +34,63 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	data.ValidateEmail(v, input.Email)
 	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateDeviceName(v, input.DeviceName)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	user, ok := app.checkCredentials(w, r, input.Email, input.Password)
+	if !ok {
+		return
+	}
+
+	// Check whether the user has logged in from this client before. An unrecognized client isn't rejected,
+	// but it is logged and counted so unusual activity can be spotted.
+	metadata := app.tokenMetadata(r, input.DeviceName)
+
+	known, err := app.models.Tokens.IsKnownDevice(r.Context(), data.ScopeAuthentication, user.ID, metadata)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !known {
+		unrecognizedDeviceLogins.Add(1)
+		app.logger.PrintInfo("authentication from unrecognized device", map[string]string{
+			"user_id":    strconv.FormatInt(user.ID, 10),
+			"client_ip":  metadata.ClientIP,
+			"user_agent": metadata.UserAgent,
+		})
+	}
+
+	// If password is correct, generate a new token with the configured expiry time and scope of "authentication".
+	token, err := app.models.Tokens.New(r.Context(), user.ID, app.config.tokens.authenticationTTL, data.ScopeAuthentication, metadata)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Also issue a refresh token, so the client can get new authentication tokens without sending the password
+	// again.
+	refreshToken, err := app.models.Tokens.New(r.Context(), user.ID, app.config.tokens.refreshTTL, data.ScopeRefresh, metadata)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Encode the token to JSON and send in response along with status code 201.
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkCredentials() looks up the user with the email address and checks the password, sending a 401
+// response if either is wrong. It reports whether they were right.
+func (app *application) checkCredentials(w http.ResponseWriter, r *http.Request, email, password string) (*data.User, bool) {
 	// Lookup the user record based on the email address.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -42,29 +98,527 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
-		return
+		return nil, false
 	}
 
 	// Check if the provided password matches the actual password for the user.
-	match, err := user.Password.Matches(input.Password)
+	match, err := user.Password.Matches(password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+		return nil, false
 	}
 	if !match {
 		app.invalidCredentialsResponse(w, r)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// jwtToken is a JSON Web Token issued by createJWTHandler().
+type jwtToken struct {
+	XMLName xml.Name  `json:"-" xml:"token"`
+	Token   string    `json:"token" xml:"token"`
+	Expiry  time.Time `json:"expiry" xml:"expiry"`
+}
+
+// createJWTHandler() exchanges an email address and password for a signed JSON Web Token, in JWT auth mode. The
+// token is checked by its signature alone, so it isn't stored and can't be revoked before it expires: logging
+// out, or resetting the password, doesn't end it. Its lifetime is kept short for that reason.
+func (app *application) createJWTHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordPlaintext(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, ok := app.checkCredentials(w, r, input.Email, input.Password)
+	if !ok {
 		return
 	}
 
-	// If password is correct, generate a new token with 24hr expiry time and scope of "authentication".
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	now := app.clock.Now()
+
+	token, err := app.jwt.Sign(strconv.FormatInt(user.ID, 10), now, app.config.jwt.ttl)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send in response along with status code 201.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	expiry := time.Unix(now.Add(app.config.jwt.ttl).Unix(), 0).UTC()
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": jwtToken{Token: token, Expiry: expiry}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createRefreshedTokensHandler() exchanges a refresh token for a new authentication token and a new refresh
+// token. The refresh token is rotated: the one sent can't be used again, so the client must keep the new one.
+func (app *application) createRefreshedTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.RefreshToken != "", "refresh_token", "must be provided")
+	v.Check(len(input.RefreshToken) == 26, "refresh_token", "must be 26 bytes long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, refreshToken, err := app.models.Tokens.Refresh(r.Context(), input.RefreshToken, app.config.tokens.authenticationTTL, app.config.tokens.refreshTTL, app.tokenMetadata(r, ""))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAuthenticationTokenHandler() logs the user out by revoking the authentication token the request was made
+// with. Requests authenticated some other way have no session to end, so they're rejected.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.contextGetSessionToken(r)
+	if token == "" {
+		app.errorResponse(w, r, http.StatusForbidden, "only authentication tokens can be revoked")
+		return
+	}
+
+	err := app.models.Tokens.DeleteByHash(r.Context(), data.ScopeAuthentication, token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAllAuthenticationTokensHandler() logs the user out everywhere by revoking all of their authentication
+// and refresh tokens, including the one the request was made with. Personal access tokens and API keys are left
+// alone, as they're managed with their own endpoints.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	// Don't let a leaked personal access token or API key be used to lock the user out of their sessions.
+	if app.contextGetPersonalAccessToken(r) != nil || app.contextGetAPIKey(r) != nil {
+		app.sessionTokenRequiredResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.models.Tokens.DeleteAllForUser(r.Context(), scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"message": "all authentication tokens successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSessionsHandler() lists the user's unexpired authentication tokens, with the client details captured when
+// each was issued and when it was last used, marking the one the request was made with.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(r.Context(), user.ID, app.contextGetSessionToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteSessionHandler() revokes one of the user's authentication tokens by its session ID.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Only delete the session if it belongs to the current user. Otherwise respond as if it doesn't exist.
+	err = app.models.Tokens.DeleteSession(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the token name, optional expiry and permissions from the request body.
+	var input struct {
+		Name        string     `json:"name"`
+		Expiry      *time.Time `json:"expiry"`
+		Permissions []string   `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Get the user's permissions, so we can check the token doesn't ask for more than the user has.
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token := &data.PersonalAccessToken{
+		Name:        input.Name,
+		Expiry:      input.Expiry,
+		Permissions: input.Permissions,
+	}
+
+	v := validator.New()
+
+	if data.ValidatePersonalAccessToken(v, token, permissions); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err = app.models.PersonalAccessTokens.New(r.Context(), user.ID, token.Name, token.Permissions, token.Expiry)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The plaintext token is only ever included in this response, it can't be retrieved later.
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"personal_access_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listPersonalAccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	tokens, err := app.models.PersonalAccessTokens.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"personal_access_tokens": tokens}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deletePersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Only delete the token if it belongs to the current user. Otherwise respond as if it doesn't exist.
+	err = app.models.PersonalAccessTokens.Delete(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "personal access token successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createAPIKeyHandler() creates an API key for a server integration, restricted to a subset of the user's
+// permissions.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Get the user's permissions, so we can check the key doesn't ask for more than the user has.
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	key := &data.APIKey{
+		Name:        input.Name,
+		Permissions: input.Permissions,
+	}
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key, permissions); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	key, err = app.models.APIKeys.New(r.Context(), user.ID, key.Name, key.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The plaintext key is only ever included in this response, it can't be retrieved later.
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Only delete the key if it belongs to the current user. Otherwise respond as if it doesn't exist.
+	err = app.models.APIKeys.Delete(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "API key successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Try to retrieve the corresponding user record for the email address.
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Return an error if the user has already been activated.
+	if user.Activated {
+		v.AddError("email", "user has already been activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Limit the number of activation emails per account, so that the endpoint can't be used to flood
+	// someone's inbox, no matter how many IP addresses the requests come from.
+	allowed, err := app.models.EmailThrottles.Allow(r.Context(), user.ID, data.ScopeActivation, app.config.emailThrottle.limit, app.config.emailThrottle.window)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.emailRateLimitExceededResponse(w, r)
+		return
+	}
+
+	// Otherwise, create a new activation token.
+	token, err := app.models.Tokens.New(r.Context(), user.ID, app.config.tokens.activationTTL, data.ScopeActivation, app.tokenMetadata(r, ""))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Email the user with their additional activation token.
+	app.sendEmail("send_activation_email", user, "token_activation.tmpl.html", map[string]interface{}{
+		"activationToken":  token.Plaintext,
+		"activationExpiry": token.Expiry.Format(time.RFC1123),
+	})
+
+	// Send a 202 Accepted response and confirmation message to the client.
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPasswordResetTokenHandler() emails a password reset token to the user with the email address, provided
+// their account has been activated.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A password can only be reset for an activated account, as the reset email also proves the address works.
+	if !user.Activated {
+		v.AddError("email", "user account must be activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Password reset emails are limited per account in the same way as activation emails, but counted separately.
+	allowed, err := app.models.EmailThrottles.Allow(r.Context(), user.ID, data.ScopePasswordReset, app.config.emailThrottle.limit, app.config.emailThrottle.window)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.emailRateLimitExceededResponse(w, r)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, app.config.tokens.passwordResetTTL, data.ScopePasswordReset, app.tokenMetadata(r, ""))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail("send_password_reset_email", user, "token_password_reset.tmpl.html", map[string]interface{}{
+		"passwordResetToken":  token.Plaintext,
+		"passwordResetExpiry": token.Expiry.Format(time.RFC1123),
+	})
+
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -1,20 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/micypac/flick-info/internal/data"
 	"github.com/micypac/flick-info/internal/validator"
 )
 
+// defaultPermissions are granted to every new user: reading movies, and managing their own account and lists.
+// The account and lists permissions let personal access tokens and API keys be scoped to those routes.
+var defaultPermissions = data.Permissions{"movies:read", "account:read", "account:write", "lists:read", "lists:write"}
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Anonymous input struct to hold the expected data from the request body.
 	var input struct {
 		Name     string `json:"name"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Locale   string `json:"locale"`
 	}
 
 	// Parse the request body and store the result in the input struct.
@@ -24,11 +31,17 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// The locale is optional, defaulting to English.
+	if input.Locale == "" {
+		input.Locale = data.DefaultLocale
+	}
+
 	// Copy the values from the input struct to a new User struct.
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false,
+		Locale:    input.Locale,
 	}
 
 	// Use the Password Set() method to generate the hashed version of the password.
@@ -45,7 +58,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	err = app.models.Users.Insert(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -58,37 +71,41 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add 'read' permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	app.audit(r, data.AuditEntityUser, user.ID, data.AuditCreate, nil, user)
+
+	// Grant the new user the default permissions.
+	err = app.models.Permissions.AddForUser(r.Context(), user.ID, defaultPermissions...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// After a new user record has been created, generate a new activation token for the user.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	app.audit(r, data.AuditEntityUserPermissions, user.ID, data.AuditCreate, nil, auditPermissions(defaultPermissions))
+
+	// Record the welcome email against the account's email limit, so it counts towards the activation emails
+	// sent in the current window. A brand new account is always allowed.
+	_, err = app.models.EmailThrottles.Allow(r.Context(), user.ID, data.ScopeActivation, app.config.emailThrottle.limit, app.config.emailThrottle.window)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Use the background() helper to execute an anonymous function that sends the welcome email.
-	app.background(func() {
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-
-		// Call the Send() method on the Mailer, passing in the user's email address,
-		// name of the template file, and the User struct containing the dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl.html", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
+	// After a new user record has been created, generate a new activation token for the user.
+	token, err := app.models.Tokens.New(r.Context(), user.ID, app.config.tokens.activationTTL, data.ScopeActivation, app.tokenMetadata(r, ""))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
+	// Use the sendEmail() helper to send the welcome email in the background, passing in the user, name of the
+	// template file, and the dynamic data for the template.
+	app.sendEmail("send_welcome_email", user, "user_welcome.tmpl.html", map[string]interface{}{
+		"activationToken":  token.Plaintext,
+		"activationExpiry": token.Expiry.Format(time.RFC1123),
+		"userID":           user.ID,
 	})
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -114,9 +131,9 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Retrieve the details of the user associated with the token using the GetForToken() method.
-	// If no matching record is found, let the client know the token provided is invalid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	// Redeem the token and activate the associated user. This happens atomically in the data layer, so the
+	// token can't be used twice. If no matching token is found, let the client know the token provided is invalid.
+	user, err := app.models.Users.Activate(r.Context(), input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -128,30 +145,243 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Update the user's activated status to true.
-	user.Activated = true
+	before := *user
+	before.Activated = false
+
+	app.audit(r, data.AuditEntityUser, user.ID, data.AuditUpdate, &before, user)
+
+	// Send updated user details in the JSON response.
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateUserPasswordHandler() sets a new password for the user a password reset token was emailed to. The token
+// can only be used once, and the user's existing authentication and refresh tokens are revoked.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
-	// Save the updated user record in the db, checking for any edit conflicts.
-	err = app.models.Users.Update(user)
+	// Redeem the token and set the password atomically. A token belonging to a user who isn't activated is
+	// treated the same as an invalid one.
+	user, err := app.models.Users.ResetPassword(r.Context(), input.TokenPlaintext, input.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfo("password reset", map[string]string{"user_id": strconv.FormatInt(user.ID, 10)})
+
+	// The password hashes aren't recorded, only that the password changed.
+	redacted := json.RawMessage(`"[redacted]"`)
+
+	app.recordAudit(r, &data.AuditEntry{
+		Entity:   data.AuditEntityUser,
+		EntityID: user.ID,
+		Action:   data.AuditUpdate,
+		Changes:  []data.AuditChange{{Field: "password", Before: redacted, After: redacted}},
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCurrentUserHandler() returns the authenticated user's account details.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserHandler() makes a partial update to the authenticated user's name, email address and locale. A new
+// email address doesn't take effect straight away: it's recorded as pending, and a token is emailed to it, which
+// has to be sent to confirmEmailChangeHandler() before the address is swapped. The update is made against the
+// version of the user loaded when the request was authenticated, so concurrent updates get an edit conflict.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	before := *user
+
+	// Use pointers so that fields missing from the request body are left unchanged.
+	var input struct {
+		Name   *string `json:"name"`
+		Email  *string `json:"email"`
+		Locale *string `json:"locale"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Locale != nil {
+		user.Locale = *input.Locale
+	}
+
+	var pendingEmail string
+	if input.Email != nil && *input.Email != user.Email {
+		pendingEmail = *input.Email
+	}
+
+	v := validator.New()
+
+	data.ValidateUser(v, user)
+
+	if pendingEmail != "" {
+		data.ValidateEmail(v, pendingEmail)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if pendingEmail != "" {
+		// Confirming the new address takes an email, so it counts towards the account's email limit.
+		allowed, err := app.models.EmailThrottles.Allow(r.Context(), user.ID, data.ScopeEmailChange, app.config.emailThrottle.limit, app.config.emailThrottle.window)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !allowed {
+			app.emailRateLimitExceededResponse(w, r)
+			return
+		}
+
+		// The pending address is recorded along with the rest of the update, so neither is saved if the other
+		// fails.
+		err = app.models.Users.RequestEmailChange(r.Context(), user, pendingEmail)
+	} else {
+		err = app.models.Users.Update(r.Context(), user)
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	// Delete all activation tokens for the user if everything is successful.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	app.audit(r, data.AuditEntityUser, user.ID, data.AuditUpdate, &before, user)
+
+	env := envelope{"user": user}
+
+	if pendingEmail != "" {
+		// Revoke any tokens sent for an earlier change, so only the latest pending address can be confirmed.
+		err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeEmailChange, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(r.Context(), user.ID, app.config.tokens.activationTTL, data.ScopeEmailChange, app.tokenMetadata(r, ""))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// The token is sent to the new address, to prove that it belongs to the user.
+		recipient := *user
+		recipient.Email = pendingEmail
+
+		app.sendEmail("send_email_change_email", &recipient, "email_change.tmpl.html", map[string]interface{}{
+			"emailChangeToken":  token.Plaintext,
+			"emailChangeExpiry": token.Expiry.Format(time.RFC1123),
+		})
+
+		env["pending_email"] = pendingEmail
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler() redeems an email change token, replacing the user's email address with the pending
+// one it was sent to. The old address is told about the change, so that the owner can act if they didn't make it.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	// Send updated user details in the JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, oldEmail, err := app.models.Users.ConfirmEmailChange(r.Context(), input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	before := *user
+	before.Email = oldEmail
+
+	app.audit(r, data.AuditEntityUser, user.ID, data.AuditUpdate, &before, user)
+
+	app.sendEmail("send_email_changed_email", &before, "email_changed.tmpl.html", map[string]interface{}{
+		"newEmail": user.Email,
+	})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// The page logs in, then creates, updates and deletes a movie. Sending the Authorization header, a JSON body,
+// or a PATCH or DELETE request all make the browser send a preflight OPTIONS request first, so each step
+// exercises both the preflight and the actual request against enableCORS(). Check the browser's network tab
+// to see the preflight requests.
+var page = template.Must(template.New("page").Parse(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<style>
+		pre { background: #f4f4f4; padding: 0.5em; }
+		.ok { color: green; }
+		.failed { color: red; }
+	</style>
+</head>
+<body>
+	<h1>Authenticated CORS</h1>
+	<p>API: <code>{{.API}}</code>. Start it with <code>-cors-trusted-origins="http://localhost{{.Addr}}"</code>,
+	or in <code>-dev</code> mode, and use an account with the movies:write permission.</p>
+	<form id="login">
+		<input name="email" type="email" placeholder="Email" value="admin@example.com">
+		<input name="password" type="password" placeholder="Password" value="pa55word1234">
+		<button type="submit">Run</button>
+	</form>
+	<div id="output"></div>
+	<script>
+		const api = {{.API}};
+		const output = document.getElementById("output");
+
+		// step() sends a request and writes its outcome to the page. A CORS failure rejects the fetch() promise
+		// without any detail, so that is reported separately from an error response.
+		async function step(name, path, options) {
+			const el = document.createElement("div");
+			output.appendChild(el);
+
+			let response;
+			try {
+				response = await fetch(api + path, options);
+			} catch (err) {
+				el.innerHTML = "<h3 class='failed'>" + name + ": blocked (" + err + ")</h3>";
+				throw err;
+			}
+
+			const text = await response.text();
+			el.innerHTML = "<h3 class='" + (response.ok ? "ok" : "failed") + "'>" + name + ": " + response.status + "</h3>";
+
+			const pre = document.createElement("pre");
+			pre.textContent = text;
+			el.appendChild(pre);
+
+			if (!response.ok) {
+				throw new Error(name + " failed");
+			}
+
+			return text ? JSON.parse(text) : null;
+		}
+
+		document.getElementById("login").addEventListener("submit", async (event) => {
+			event.preventDefault();
+			output.innerHTML = "";
+
+			const form = new FormData(event.target);
+
+			try {
+				const login = await step("Log in (POST)", "/v1/tokens/authentication", {
+					method: "POST",
+					headers: { "Content-Type": "application/json" },
+					body: JSON.stringify({ email: form.get("email"), password: form.get("password") }),
+				});
+
+				const auth = { "Authorization": "Bearer " + login.authentication_token.token };
+				const json = Object.assign({ "Content-Type": "application/json" }, auth);
+
+				const created = await step("Create movie (POST)", "/v1/movies", {
+					method: "POST",
+					headers: json,
+					body: JSON.stringify({ title: "CORS Test", year: 2000, runtime: "90 mins", genres: ["test"] }),
+				});
+
+				const path = "/v1/movies/" + created.movie.id;
+
+				await step("Show movie (GET)", path, { headers: auth });
+				await step("Update movie (PATCH)", path, {
+					method: "PATCH",
+					headers: json,
+					body: JSON.stringify({ title: "CORS Test (updated)" }),
+				});
+				await step("Delete movie (DELETE)", path, { method: "DELETE", headers: auth });
+			} catch (err) {
+				// The failed step has already been reported.
+			}
+		});
+	</script>
+</body>
+</html>
+`))
+
+func main() {
+	addr := flag.String("addr", ":9000", "Server address")
+	api := flag.String("api", "http://localhost:4000", "Base URL of the API")
+	flag.Parse()
+
+	log.Printf("starting server on %s", *addr)
+
+	err := http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := page.Execute(w, map[string]string{"API": *api, "Addr": *addr})
+		if err != nil {
+			log.Print(err)
+		}
+	}))
+
+	log.Fatal(err)
+}
@@ -0,0 +1,82 @@
+// Command fixtures loads YAML or JSON fixture files into the database, replacing the users, movies and reviews
+// already there.
+//
+// Usage:
+//
+//	go run ./cmd/fixtures -db-dsn=$FLICKINFO_DB_DSN fixtures/development.json
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/micypac/flick-info/internal/fixtures"
+
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	dsn := flag.String("db-dsn", "", "PostgreSQL DSN")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: fixtures -db-dsn=DSN FILE...")
+		os.Exit(2)
+	}
+
+	err := run(*dsn, flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(dsn string, paths []string) error {
+	set, err := fixtures.Load(paths...)
+	if err != nil {
+		return err
+	}
+
+	// Report every invalid entity at once, rather than failing on the first.
+	if v := set.Validate(); !v.Valid() {
+		keys := make([]string, 0, len(v.Errors))
+		for key := range v.Errors {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", key, v.Errors[key])
+		}
+
+		return fmt.Errorf("invalid fixtures")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = set.Apply(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("loaded %d users, %d permission grants, %d movies and %d reviews\n", len(set.Users), len(set.Permissions), len(set.Movies), len(set.Reviews))
+
+	return nil
+}
@@ -0,0 +1,7 @@
+// Package fixtures embeds the sample fixture files, so that the API can seed an empty database in dev mode.
+package fixtures
+
+import "embed"
+
+//go:embed *.json
+var FS embed.FS
@@ -0,0 +1,162 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AdminUser is a user as an administrator sees them: their account, the permissions they hold, and when their
+// personal data was erased, if it has been.
+type AdminUser struct {
+	User
+	XMLName     xml.Name    `json:"-" xml:"user"`
+	Permissions Permissions `json:"permissions" xml:"permissions>permission"`
+	ErasedAt    *time.Time  `json:"erased_at,omitempty" xml:"erased_at,omitempty"`
+}
+
+// AdminUserFilter narrows a listing of users. Zero values don't filter.
+type AdminUserFilter struct {
+	Search     string // Part of the name or email address, ignoring case.
+	Activated  *bool
+	Permission string // A permission code the users must hold.
+}
+
+type AdminUserModel struct {
+	DB *sql.DB
+}
+
+// adminUserQuery selects users with their permissions, in alphabetical order. The query ends with the WHERE
+// keyword, for the caller to add its conditions, GROUP BY and ORDER BY clauses after.
+const adminUserQuery = `
+	SELECT count(*) OVER(), users.id, users.created_at, users.name, users.email, users.activated, users.locale, users.version, users.erased_at,
+		coalesce(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+	FROM users
+	LEFT JOIN users_permissions ON users_permissions.user_id = users.id
+	LEFT JOIN permissions ON permissions.id = users_permissions.permission_id
+	WHERE`
+
+// GetAll() returns a page of the users matching the filter.
+func (m AdminUserModel) GetAll(ctx context.Context, filter AdminUserFilter, filters Filters) ([]*AdminUser, Metadata, error) {
+	stmt := fmt.Sprintf(adminUserQuery+`
+		($1 = '' OR strpos(lower(users.name), lower($1)) > 0 OR strpos(lower(users.email::text), lower($1)) > 0)
+		AND ($2::boolean IS NULL OR users.activated = $2)
+		AND ($3 = '' OR EXISTS (
+			SELECT 1 FROM users_permissions up
+			INNER JOIN permissions p ON p.id = up.permission_id
+			WHERE up.user_id = users.id AND p.code = $3
+		))
+		GROUP BY users.id
+		ORDER BY %s, users.id ASC
+		LIMIT $4 OFFSET $5`, filters.orderBy("users."))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, filter.Search, filter.Activated, filter.Permission, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*AdminUser{}
+
+	for rows.Next() {
+		user, err := scanAdminUser(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return users, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Get() returns the user with the ID, including erased users.
+func (m AdminUserModel) Get(ctx context.Context, id int64) (*AdminUser, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	stmt := adminUserQuery + `
+		users.id = $1
+		GROUP BY users.id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var totalRecords int
+
+	user, err := scanAdminUser(m.DB.QueryRowContext(ctx, stmt, id), &totalRecords)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// scanAdminUser() scans a row of adminUserQuery.
+func scanAdminUser(row interface{ Scan(...interface{}) error }, totalRecords *int) (*AdminUser, error) {
+	var user AdminUser
+
+	err := row.Scan(
+		totalRecords,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.Locale,
+		&user.Version,
+		&user.ErasedAt,
+		pq.Array(&user.Permissions),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Delete() removes the user's account, along with everything which belongs to it, such as their tokens,
+// ratings and lists. Unlike an erasure, which keeps the account and the user's public lists, nothing is kept.
+func (m AdminUserModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
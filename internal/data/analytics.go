@@ -0,0 +1,249 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AnalyticsDayLayout is the format of the days in the analytics tables and reports. Days are in UTC.
+const AnalyticsDayLayout = "2006-01-02"
+
+// RequestCountKey identifies a count of requests to a route on a day.
+type RequestCountKey struct {
+	Day    string
+	Method string
+	Route  string
+}
+
+// MovieViewKey identifies a count of views of a movie on a day.
+type MovieViewKey struct {
+	Day     string
+	MovieID int64
+}
+
+// DailyCount is a count for a single day.
+type DailyCount struct {
+	XMLName xml.Name `json:"-" xml:"day"`
+	Day     string   `json:"day" xml:"date"`
+	Count   int64    `json:"count" xml:"count"`
+}
+
+// EndpointCount is the number of requests to a route.
+type EndpointCount struct {
+	XMLName xml.Name `json:"-" xml:"endpoint"`
+	Method  string   `json:"method" xml:"method"`
+	Route   string   `json:"route" xml:"route"`
+	Count   int64    `json:"count" xml:"count"`
+}
+
+// MovieViewCount is the number of times a movie was viewed.
+type MovieViewCount struct {
+	XMLName xml.Name `json:"-" xml:"movie_views"`
+	Movie   *Movie   `json:"movie" xml:"movie"`
+	Views   int64    `json:"views" xml:"views"`
+}
+
+// AnalyticsReport summarizes the activity between two days, inclusive.
+type AnalyticsReport struct {
+	XMLName     xml.Name         `json:"-" xml:"analytics"`
+	From        string           `json:"from" xml:"from"`
+	To          string           `json:"to" xml:"to"`
+	GeneratedAt time.Time        `json:"generated_at" xml:"generated_at"`
+	Signups     []DailyCount     `json:"signups_per_day" xml:"signups_per_day>day"`
+	ActiveUsers int64            `json:"active_users" xml:"active_users"`
+	Ratings     int64            `json:"ratings" xml:"ratings"`
+	Requests    []EndpointCount  `json:"requests_by_endpoint" xml:"requests_by_endpoint>endpoint"`
+	TopMovies   []MovieViewCount `json:"top_viewed_movies" xml:"top_viewed_movies>movie_views"`
+}
+
+type AnalyticsModel struct {
+	DB *sql.DB
+}
+
+// AddRequestCounts() adds the counts to the daily request counts.
+func (m AnalyticsModel) AddRequestCounts(ctx context.Context, counts map[RequestCountKey]int64) error {
+	if len(counts) == 0 {
+		return nil
+	}
+
+	var days, methods, routes []string
+	var values []int64
+
+	for key, count := range counts {
+		days = append(days, key.Day)
+		methods = append(methods, key.Method)
+		routes = append(routes, key.Route)
+		values = append(values, count)
+	}
+
+	stmt := `
+		INSERT INTO request_counts (day, method, route, count)
+		SELECT * FROM unnest($1::date[], $2::text[], $3::text[], $4::bigint[])
+		ON CONFLICT (day, method, route) DO UPDATE SET count = request_counts.count + EXCLUDED.count`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, pq.Array(days), pq.Array(methods), pq.Array(routes), pq.Array(values))
+	return err
+}
+
+// AddMovieViews() adds the counts to the daily movie view counts. Views of movies which have since been deleted
+// are dropped.
+func (m AnalyticsModel) AddMovieViews(ctx context.Context, views map[MovieViewKey]int64) error {
+	if len(views) == 0 {
+		return nil
+	}
+
+	var days []string
+	var movieIDs, values []int64
+
+	for key, count := range views {
+		days = append(days, key.Day)
+		movieIDs = append(movieIDs, key.MovieID)
+		values = append(values, count)
+	}
+
+	stmt := `
+		INSERT INTO movie_views (day, movie_id, count)
+		SELECT v.day, v.movie_id, v.count
+		FROM unnest($1::date[], $2::bigint[], $3::bigint[]) AS v(day, movie_id, count)
+		WHERE EXISTS (SELECT 1 FROM movies WHERE id = v.movie_id)
+		ON CONFLICT (day, movie_id) DO UPDATE SET count = movie_views.count + EXCLUDED.count`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, pq.Array(days), pq.Array(movieIDs), pq.Array(values))
+	return err
+}
+
+// Report() returns the analytics for the days from and to, inclusive, which are in AnalyticsDayLayout.
+//
+// A user counts as active if they logged in, rated, watched or added to their watchlist during the period.
+// Logins are only known from unexpired session tokens, as expired ones are purged, so older periods may
+// undercount users who only logged in.
+func (m AnalyticsModel) Report(ctx context.Context, from, to string) (*AnalyticsReport, error) {
+	// The report runs several aggregate queries over potentially large tables, so allow longer than usual.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	report := &AnalyticsReport{
+		From:      from,
+		To:        to,
+		Signups:   []DailyCount{},
+		Requests:  []EndpointCount{},
+		TopMovies: []MovieViewCount{},
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `
+		SELECT to_char(d, 'YYYY-MM-DD'), count(u.id)
+		FROM generate_series($1::date::timestamp, $2::date::timestamp, interval '1 day') d
+		LEFT JOIN users u ON u.created_at >= (d AT TIME ZONE 'UTC') AND u.created_at < ((d + interval '1 day') AT TIME ZONE 'UTC')
+		GROUP BY d
+		ORDER BY d`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day DailyCount
+
+		err := rows.Scan(&day.Day, &day.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		report.Signups = append(report.Signups, day)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// period() returns the condition that the timestamp column is within the days, in UTC.
+	period := func(column string) string {
+		return column + ` >= ($1::date::timestamp AT TIME ZONE 'UTC') AND ` + column + ` < (($2::date + 1)::timestamp AT TIME ZONE 'UTC')`
+	}
+
+	err = m.DB.QueryRowContext(ctx, `
+		SELECT count(DISTINCT user_id) FROM (
+			SELECT user_id FROM tokens WHERE scope = 'authentication' AND `+period(`created_at`)+`
+			UNION ALL
+			SELECT user_id FROM ratings WHERE `+period(`created_at`)+`
+			UNION ALL
+			SELECT user_id FROM watch_history WHERE `+period(`created_at`)+`
+			UNION ALL
+			SELECT user_id FROM watchlist WHERE `+period(`added_at`)+`
+		) active`, from, to).Scan(&report.ActiveUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.DB.QueryRowContext(ctx, `SELECT count(*) FROM ratings WHERE `+period(`created_at`), from, to).Scan(&report.Ratings)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+		SELECT method, route, sum(count)
+		FROM request_counts
+		WHERE day BETWEEN $1 AND $2
+		GROUP BY method, route
+		ORDER BY sum(count) DESC, route, method
+		LIMIT 50`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var endpoint EndpointCount
+
+		err := rows.Scan(&endpoint.Method, &endpoint.Route, &endpoint.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		report.Requests = append(report.Requests, endpoint)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.DB.QueryContext(ctx, `
+		SELECT sum(v.count), m.id, m.created_at, m.title, m.year, m.runtime, movie_genre_names(m.id), m.version
+		FROM movie_views v
+		INNER JOIN movies m ON m.id = v.movie_id
+		WHERE v.day BETWEEN $1 AND $2
+		GROUP BY m.id
+		ORDER BY sum(v.count) DESC, m.id
+		LIMIT 10`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		views := MovieViewCount{Movie: &Movie{}}
+
+		err := rows.Scan(&views.Views, &views.Movie.ID, &views.Movie.CreatedAt, &views.Movie.Title, &views.Movie.Year, &views.Movie.Runtime, pq.Array(&views.Movie.Genres), &views.Movie.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		report.TopMovies = append(report.TopMovies, views)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,281 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/clock"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Prefix for API keys, telling them apart from session tokens and personal access tokens in the Authorization
+// header.
+const APIKeyPrefix = "fikey_"
+
+// An API key is "fikey_", an 8 character lookup prefix, "_" and a 32 character secret.
+const apiKeyLength = len(APIKeyPrefix) + 8 + 1 + 32
+
+// How often an API key's last use is recorded. Recording every use would mean a write for every request made
+// with the key.
+const apiKeyLastUsedInterval = time.Minute
+
+// APIKey holds the data for a long-lived credential for a server integration which can't go through the login
+// flow. Unlike a personal access token it never expires, and is only revoked by deleting it. Its prefix is stored
+// in the clear, so that the key can be found without trying every hash, and so that users can tell their keys
+// apart; the rest of the key is only stored hashed.
+type APIKey struct {
+	XMLName     xml.Name    `json:"-" xml:"api_key"`
+	ID          int64       `json:"id" xml:"id"`
+	CreatedAt   time.Time   `json:"created_at" xml:"created_at"`
+	UserID      int64       `json:"-" xml:"-"`
+	Name        string      `json:"name" xml:"name"`
+	Prefix      string      `json:"prefix" xml:"prefix"`
+	Plaintext   string      `json:"key,omitempty" xml:"key,omitempty"` // Only populated when the key is first created.
+	Hash        []byte      `json:"-" xml:"-"`
+	HashVersion int16       `json:"-" xml:"-"`
+	Permissions Permissions `json:"permissions" xml:"permissions>permission"`
+	LastUsedAt  *time.Time  `json:"last_used_at" xml:"last_used_at,omitempty"` // Nil if the key has never been used.
+}
+
+// generateAPIKey() creates a new key with a random prefix and secret, and the hash of the whole key.
+func generateAPIKey(userID int64, name string, permissions Permissions, hasher TokenHasher) (*APIKey, error) {
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Permissions: permissions,
+	}
+
+	// 5 random bytes for the prefix, and 20 for the secret, which encode to 8 and 32 characters.
+	randomBytes := make([]byte, 25)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	key.Prefix = encoding.EncodeToString(randomBytes[:5])
+	key.Plaintext = APIKeyPrefix + key.Prefix + "_" + encoding.EncodeToString(randomBytes[5:])
+	key.Hash = hasher.Hash(key.Plaintext)
+	key.HashVersion = hasher.Version()
+
+	return key, nil
+}
+
+// IsAPIKey() reports whether the plaintext credential looks like an API key.
+func IsAPIKey(keyPlaintext string) bool {
+	return strings.HasPrefix(keyPlaintext, APIKeyPrefix)
+}
+
+// apiKeyLookupPrefix() returns the lookup prefix of the plaintext key, which must have been validated.
+func apiKeyLookupPrefix(keyPlaintext string) string {
+	return keyPlaintext[len(APIKeyPrefix) : len(APIKeyPrefix)+8]
+}
+
+// Check that the plaintext API key has the expected prefix, length and separator.
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "key", "must be provided")
+	v.Check(IsAPIKey(keyPlaintext), "key", "must be an API key")
+	v.Check(len(keyPlaintext) == apiKeyLength, "key", "must be 47 bytes long")
+
+	if v.Valid() {
+		v.Check(keyPlaintext[apiKeyLength-33] == '_', "key", "must be an API key")
+	}
+}
+
+// ValidateAPIKey() checks the key's name and permissions. As with personal access tokens, the permissions must
+// be a subset of those the user holds.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, userPermissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	for _, code := range key.Permissions {
+		v.Check(userPermissions.Include(code), "permissions", "must only contain permissions you hold")
+	}
+}
+
+// APIKeyModel type.
+type APIKeyModel struct {
+	DB      *sql.DB
+	Hashing TokenHashing
+	Clock   clock.Clock
+}
+
+// New() creates a new API key for the user and inserts it in the api_keys table.
+func (m APIKeyModel) New(ctx context.Context, userID int64, name string, permissions Permissions) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, permissions, m.Hashing.current())
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, hash_version, permissions)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash, key.HashVersion, pq.Array(key.Permissions)}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, stmt, args...).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// GetAllForUser() returns all of the user's API keys, newest first.
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	stmt := `
+		SELECT id, created_at, user_id, name, prefix, permissions, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetUserForKey() retrieves the user owning an API key, along with the key itself so that the caller can
+// restrict the request to the key's permissions. The key is found by its prefix, and then its hash is checked
+// in constant time. Its last use is recorded, at most once every apiKeyLastUsedInterval.
+func (m APIKeyModel) GetUserForKey(ctx context.Context, keyPlaintext string) (*User, *APIKey, error) {
+	stmt := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale, users.version,
+			api_keys.id, api_keys.created_at, api_keys.name, api_keys.prefix, api_keys.hash, api_keys.hash_version,
+			api_keys.permissions, api_keys.last_used_at
+		FROM users
+		INNER JOIN api_keys
+		ON users.id = api_keys.user_id
+		WHERE api_keys.prefix = $1`
+
+	var user User
+	var key APIKey
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, apiKeyLookupPrefix(keyPlaintext)).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
+		&user.Version,
+		&key.ID,
+		&key.CreatedAt,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		&key.HashVersion,
+		pq.Array(&key.Permissions),
+		&key.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	hasher := m.Hashing.hasher(key.HashVersion)
+	if hasher == nil || !VerifyTokenHash(hasher, keyPlaintext, key.Hash) {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	key.UserID = user.ID
+
+	now := m.Clock.Now()
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyLastUsedInterval {
+		_, err = m.DB.ExecContext(ctx, `UPDATE api_keys SET last_used_at = $1 WHERE id = $2`, now, key.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key.LastUsedAt = &now
+	}
+
+	return &user, &key, nil
+}
+
+// Delete() removes an API key, provided it belongs to the given user.
+func (m APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	stmt := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
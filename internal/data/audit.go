@@ -0,0 +1,228 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Actions recorded in the audit log. An erasure of a user's personal data records the erasure report's fields as
+// its changes.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+	AuditErase  = "erase"
+)
+
+// Kinds of entity recorded in the audit log. The entity ID of user permissions is the user's ID.
+const (
+	AuditEntityGenre           = "genre"
+	AuditEntityMovie           = "movie"
+	AuditEntityUser            = "user"
+	AuditEntityUserPermissions = "user_permissions"
+)
+
+// AuditChange is the change to a single field of an entity. Before and After are JSON values, null where the
+// field was absent, such as every Before of a create.
+type AuditChange struct {
+	XMLName xml.Name        `json:"-" xml:"change"`
+	Field   string          `json:"field" xml:"field"`
+	Before  json.RawMessage `json:"before" xml:"before"`
+	After   json.RawMessage `json:"after" xml:"after"`
+}
+
+// AuditEntry records a change to an entity: who made it, when, and what changed. UserID is nil for changes
+// made without logging in, such as registering or activating an account.
+type AuditEntry struct {
+	XMLName   xml.Name      `json:"-" xml:"audit_entry"`
+	ID        int64         `json:"id" xml:"id"`
+	CreatedAt time.Time     `json:"created_at" xml:"created_at"`
+	UserID    *int64        `json:"user_id" xml:"user_id,omitempty"`
+	RequestID string        `json:"request_id,omitempty" xml:"request_id,omitempty"`
+	Entity    string        `json:"entity" xml:"entity"`
+	EntityID  int64         `json:"entity_id" xml:"entity_id"`
+	Action    string        `json:"action" xml:"action"`
+	Changes   []AuditChange `json:"changes" xml:"changes>change"`
+}
+
+// AuditFilter narrows a listing of the audit log. Zero values don't filter.
+type AuditFilter struct {
+	Entity   string
+	EntityID int64
+	UserID   int64
+	Action   string
+}
+
+// ValidateAuditFilter() checks that the entity and action, if given, are ones which are recorded.
+func ValidateAuditFilter(v *validator.Validator, filter AuditFilter) {
+	if filter.Entity != "" {
+		v.Check(validator.In(filter.Entity, AuditEntityGenre, AuditEntityMovie, AuditEntityUser, AuditEntityUserPermissions), "entity", "must be genre, movie, user or user_permissions")
+	}
+
+	if filter.Action != "" {
+		v.Check(validator.In(filter.Action, AuditCreate, AuditUpdate, AuditDelete, AuditErase), "action", "must be create, update, delete or erase")
+	}
+
+	v.Check(filter.EntityID >= 0, "entity_id", "must not be negative")
+	v.Check(filter.UserID >= 0, "user_id", "must not be negative")
+}
+
+// AuditDiff() returns the fields which differ between the JSON encodings of before and after, in field name
+// order. Either may be nil, for a create or a delete. Only top-level fields are compared, so a change within a
+// nested value, such as a movie's genres, is recorded as the whole old and new value.
+func AuditDiff(before, after interface{}) ([]AuditChange, error) {
+	b, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, 0, len(b)+len(a))
+	for field := range b {
+		fields = append(fields, field)
+	}
+	for field := range a {
+		if _, ok := b[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []AuditChange{}
+
+	for _, field := range fields {
+		before, after := auditValue(b[field]), auditValue(a[field])
+
+		// A missing field is the same as a null one, as fields are often left out when empty.
+		if bytes.Equal(before, after) {
+			continue
+		}
+
+		changes = append(changes, AuditChange{Field: field, Before: before, After: after})
+	}
+
+	return changes, nil
+}
+
+// auditFields() returns the top-level fields of the value's JSON encoding, which must be an object, or none if
+// the value is nil.
+func auditFields(value interface{}) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+
+	if value == nil {
+		return fields, nil
+	}
+
+	js, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(js, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("audit value must encode to a JSON object: %w", err)
+	}
+
+	return fields, nil
+}
+
+// auditValue() returns the JSON value, or null for a missing one.
+func auditValue(value json.RawMessage) json.RawMessage {
+	if value == nil {
+		return json.RawMessage("null")
+	}
+
+	return value
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// Insert() adds the entry to the audit log, setting its ID and time.
+func (m AuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+
+	stmt := `
+		INSERT INTO audit_log (user_id, request_id, entity, entity_id, action, changes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, stmt, entry.UserID, entry.RequestID, entry.Entity, entry.EntityID, entry.Action, changes).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// GetAll() returns a page of the audit log entries matching the filter.
+func (m AuditModel) GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEntry, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, user_id, request_id, entity, entity_id, action, changes
+		FROM audit_log
+		WHERE ($1 = '' OR entity = $1)
+		AND ($2 = 0 OR entity_id = $2)
+		AND ($3 = 0 OR user_id = $3)
+		AND ($4 = '' OR action = $4)
+		ORDER BY %s, id DESC
+		LIMIT $5 OFFSET $6`, filters.orderBy(""))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, filter.Entity, filter.EntityID, filter.UserID, filter.Action, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+		var changes []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.UserID,
+			&entry.RequestID,
+			&entry.Entity,
+			&entry.EntityID,
+			&entry.Action,
+			&changes,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(changes, &entry.Changes)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return entries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
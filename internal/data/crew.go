@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// The jobs a person can have in a movie's crew.
+var CrewJobs = []string{"director", "writer", "producer", "composer", "cinematographer", "editor"}
+
+// The most credits a movie's crew can have.
+const MaxCrewMembers = 200
+
+// CrewMember is a credit in a movie's crew: the person and their job.
+type CrewMember struct {
+	XMLName  xml.Name `json:"-" xml:"member"`
+	PersonID int64    `json:"person_id" xml:"person_id"`
+	Name     string   `json:"name" xml:"name"`
+	Job      string   `json:"job" xml:"job"`
+}
+
+// ValidateCrew() checks a movie's crew, in billing order. Each person can only be credited once for each job.
+func ValidateCrew(v *validator.Validator, crew []*CrewMember) {
+	v.Check(len(crew) <= MaxCrewMembers, "crew", fmt.Sprintf("must not contain more than %d members", MaxCrewMembers))
+
+	seen := make(map[string]bool, len(crew))
+
+	for _, member := range crew {
+		v.Check(member.PersonID > 0, "crew", "must only contain members with a person_id")
+		v.Check(validator.In(member.Job, CrewJobs...), "crew", "must only contain jobs of "+strings.Join(CrewJobs, ", "))
+
+		key := fmt.Sprintf("%d %s", member.PersonID, member.Job)
+		v.Check(!seen[key], "crew", "must not credit a person for the same job more than once")
+		seen[key] = true
+	}
+}
+
+type CrewModel struct {
+	DB *sql.DB
+}
+
+// GetForMovie() returns the movie's crew in billing order.
+func (m CrewModel) GetForMovie(ctx context.Context, movieID int64) ([]*CrewMember, error) {
+	stmt := `
+		SELECT c.person_id, p.name, c.job
+		FROM movie_crew c
+		INNER JOIN people p ON p.id = c.person_id
+		WHERE c.movie_id = $1
+		ORDER BY c.position`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	crew := []*CrewMember{}
+
+	for rows.Next() {
+		var member CrewMember
+
+		err := rows.Scan(&member.PersonID, &member.Name, &member.Job)
+		if err != nil {
+			return nil, err
+		}
+
+		crew = append(crew, &member)
+	}
+
+	return crew, rows.Err()
+}
+
+// SetForMovie() replaces the movie's crew, in a single transaction, with the members in billing order, and fills
+// in their names. ErrRecordNotFound is returned if any of the people don't exist.
+func (m CrewModel) SetForMovie(ctx context.Context, movieID int64, crew []*CrewMember) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM movie_crew WHERE movie_id = $1`, movieID)
+	if err != nil {
+		return err
+	}
+
+	personIDs := make([]int64, len(crew))
+	jobs := make([]string, len(crew))
+
+	for i, member := range crew {
+		personIDs[i] = member.PersonID
+		jobs[i] = member.Job
+	}
+
+	stmt := `
+		INSERT INTO movie_crew (movie_id, person_id, job, position)
+		SELECT $1, c.person_id, c.job, c.position
+		FROM unnest($2::bigint[], $3::text[]) WITH ORDINALITY AS c(person_id, job, position)`
+
+	_, err = tx.ExecContext(ctx, stmt, movieID, pq.Array(personIDs), pq.Array(jobs))
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "movie_crew" violates foreign key constraint "movie_crew_person_id_fkey"`:
+			return ErrRecordNotFound
+		case err.Error() == `pq: insert or update on table "movie_crew" violates foreign key constraint "movie_crew_movie_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	names, err := personNames(ctx, tx, personIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range crew {
+		member.Name = names[member.PersonID]
+	}
+
+	return tx.Commit()
+}
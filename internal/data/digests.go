@@ -0,0 +1,122 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DigestRecipient is a user who is due a weekly digest email.
+type DigestRecipient struct {
+	UserID         int64
+	Name           string
+	Email          string
+	Locale         string
+	FavoriteGenres []string
+}
+
+// DigestModel selects the recipients and contents of the weekly digest emails.
+type DigestModel struct {
+	DB *sql.DB
+}
+
+// Due() returns up to limit activated users who have opted in to the digest and haven't been sent one since
+// the given time. Users who have never been sent a digest come first.
+func (m DigestModel) Due(ctx context.Context, since time.Time, limit int) ([]*DigestRecipient, error) {
+	stmt := `
+		SELECT id, name, email, locale, favorite_genres
+		FROM users
+		WHERE weekly_digest AND activated
+		AND (digest_sent_at IS NULL OR digest_sent_at < $1)
+		ORDER BY digest_sent_at ASC NULLS FIRST, id ASC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := []*DigestRecipient{}
+
+	for rows.Next() {
+		var recipient DigestRecipient
+
+		err := rows.Scan(&recipient.UserID, &recipient.Name, &recipient.Email, &recipient.Locale, pq.Array(&recipient.FavoriteGenres))
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, &recipient)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+// NewMovies() returns up to limit of the most recently added movies created after since, which have at least
+// one of the given genres. If genres is empty, movies of any genre are returned.
+func (m DigestModel) NewMovies(ctx context.Context, since time.Time, genres []string, limit int) ([]*Movie, error) {
+	stmt := `
+		SELECT id, created_at, title, year, runtime, movie_genre_names(id), version
+		FROM movies
+		WHERE created_at > $1
+		AND (` + genreFilterSQL("$2", true) + ` OR $2 = '{}')
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, since, pq.Array(genres), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
+
+// MarkSent() records that a digest has just been sent to the user.
+func (m DigestModel) MarkSent(ctx context.Context, userID int64) error {
+	stmt := `UPDATE users SET digest_sent_at = now() WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID)
+	return err
+}
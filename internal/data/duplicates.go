@@ -0,0 +1,371 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// DuplicateSimilarity is the trigram similarity (0-1) of two lower-cased titles, from the same year, above which
+// the movies are reported as likely duplicates. Movies whose normalized titles are equal always are.
+const DuplicateSimilarity = 0.6
+
+// MovieDuplicate is a pair of movies which are likely to be the same film.
+type MovieDuplicate struct {
+	XMLName    xml.Name `json:"-" xml:"duplicate"`
+	Movie      *Movie   `json:"movie" xml:"movie"`
+	Duplicate  *Movie   `json:"duplicate" xml:"duplicate_movie"`
+	Similarity float64  `json:"similarity" xml:"similarity"`
+	// Whether the titles are the same once normalized, as opposed to just similar.
+	SameTitle bool `json:"same_title" xml:"same_title"`
+}
+
+// MergeReport describes what was moved onto the surviving movie when duplicates were merged into it.
+type MergeReport struct {
+	XMLName        xml.Name `json:"-" xml:"merge"`
+	MovieID        int64    `json:"movie_id" xml:"movie_id"`
+	MergedIDs      []int64  `json:"merged_ids" xml:"merged_ids>id"`
+	RatingsMoved   int64    `json:"ratings_moved" xml:"ratings_moved"`
+	ReviewsMoved   int64    `json:"reviews_moved" xml:"reviews_moved"`
+	CastMoved      int64    `json:"cast_moved" xml:"cast_moved"`
+	CrewMoved      int64    `json:"crew_moved" xml:"crew_moved"`
+	WatchesMoved   int64    `json:"watches_moved" xml:"watches_moved"`
+	WatchlistMoved int64    `json:"watchlist_moved" xml:"watchlist_moved"`
+	ListsUpdated   int64    `json:"lists_updated" xml:"lists_updated"`
+}
+
+// NormalizeTitle() returns the form of a title compared when looking for duplicates: lower case, with each run
+// of characters other than letters and digits replaced by a single space, and any leading "the", "a" or "an"
+// removed. It matches the normalize_title() SQL function.
+func NormalizeTitle(title string) string {
+	fields := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if len(fields) > 1 && (fields[0] == "the" || fields[0] == "a" || fields[0] == "an") {
+		fields = fields[1:]
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// trigramSimilarity() approximates the pg_trgm similarity() function: the number of trigrams the two strings
+// share divided by the number of distinct trigrams in either. The strings are split into words of letters and
+// digits, and each word is padded with two spaces in front and one behind, as pg_trgm does.
+func trigramSimilarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for t := range ta {
+		if tb[t] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+func trigrams(s string) map[string]bool {
+	set := make(map[string]bool)
+
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+
+	return set
+}
+
+// PossibleDuplicates() returns up to 5 existing movies which are likely duplicates of the given movie, most
+// similar first. The movie itself is excluded if it has already been inserted.
+func (m MovieModel) PossibleDuplicates(ctx context.Context, movie *Movie) ([]*Movie, error) {
+	stmt := `
+		SELECT id, created_at, title, year, runtime, movie_genre_names(id), version
+		FROM movies
+		WHERE id <> $1 AND year = $2
+		AND (normalize_title(title) = normalize_title($3) OR similarity(lower(title), lower($3)) >= $4)
+		ORDER BY similarity(lower(title), lower($3)) DESC, id ASC
+		LIMIT 5`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, movie.ID, movie.Year, movie.Title, DuplicateSimilarity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(&movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	return movies, rows.Err()
+}
+
+type DuplicateModel struct {
+	DB *sql.DB
+
+	// Cache, if not nil, is told which movies merges change.
+	Cache MovieInvalidator
+}
+
+// GetAll() returns a page of the pairs of movies in the catalog which are likely duplicates: movies from the
+// same year whose titles are the same once normalized, or have a trigram similarity of at least
+// DuplicateSimilarity. Each pair is returned once, with the older movie first. Filters can sort by similarity.
+func (m DuplicateModel) GetAll(ctx context.Context, filters Filters) ([]*MovieDuplicate, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), similarity, same_title,
+			a.id, a.created_at, a.title, a.year, a.runtime, movie_genre_names(a.id), a.version,
+			b.id, b.created_at, b.title, b.year, b.runtime, movie_genre_names(b.id), b.version
+		FROM movies a
+		JOIN movies b ON b.year = a.year AND b.id > a.id,
+		LATERAL (SELECT
+			similarity(lower(a.title), lower(b.title)) AS similarity,
+			normalize_title(a.title) = normalize_title(b.title) AS same_title) s
+		WHERE same_title OR similarity >= $1
+		ORDER BY %s, a.id ASC, b.id ASC
+		LIMIT $2 OFFSET $3`, filters.orderBy(""))
+
+	// Comparing every pair of movies from each year is slow for a big catalog, so allow longer than usual.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, DuplicateSimilarity, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	duplicates := []*MovieDuplicate{}
+
+	for rows.Next() {
+		d := MovieDuplicate{Movie: &Movie{}, Duplicate: &Movie{}}
+
+		err := rows.Scan(
+			&totalRecords,
+			&d.Similarity,
+			&d.SameTitle,
+			&d.Movie.ID, &d.Movie.CreatedAt, &d.Movie.Title, &d.Movie.Year, &d.Movie.Runtime, pq.Array(&d.Movie.Genres), &d.Movie.Version,
+			&d.Duplicate.ID, &d.Duplicate.CreatedAt, &d.Duplicate.Title, &d.Duplicate.Year, &d.Duplicate.Runtime, pq.Array(&d.Duplicate.Genres), &d.Duplicate.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		duplicates = append(duplicates, &d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return duplicates, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Merge() consolidates the duplicate movies into the surviving movie, in a single transaction, and then deletes
+// the duplicates:
+//
+//   - Ratings, reviews, watch history and watchlist entries are moved onto the survivor. Where a user already has
+//     one for the survivor, theirs is kept; where they rated or reviewed several of the duplicates, the latest
+//     rating or review is kept.
+//   - Cast and crew credits the survivor doesn't already have are added after its own.
+//   - In each list holding any of the movies, the survivor takes the place of the first of them, and the others
+//     are removed.
+//
+// ErrRecordNotFound is returned if any of the movies doesn't exist.
+func (m DuplicateModel) Merge(ctx context.Context, survivorID int64, duplicateIDs []int64) (*MergeReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the movies, in ID order to avoid deadlocks with a concurrent merge, and check they all exist.
+	var found int
+
+	err = tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM (
+			SELECT id FROM movies WHERE id = $1 OR id = ANY($2) ORDER BY id FOR UPDATE
+		) locked`, survivorID, pq.Array(duplicateIDs)).Scan(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	if found != len(duplicateIDs)+1 {
+		return nil, ErrRecordNotFound
+	}
+
+	report := &MergeReport{MovieID: survivorID, MergedIDs: duplicateIDs}
+
+	moves := []struct {
+		stmt  string
+		count *int64
+	}{
+		{`
+			INSERT INTO ratings (user_id, movie_id, rating, created_at)
+			SELECT DISTINCT ON (user_id) user_id, $1, rating, created_at
+			FROM ratings
+			WHERE movie_id = ANY($2)
+			ORDER BY user_id, created_at DESC, id DESC
+			ON CONFLICT (user_id, movie_id) DO NOTHING`, &report.RatingsMoved},
+		{`
+			INSERT INTO reviews (user_id, movie_id, created_at, updated_at, body, status, moderated_by, moderated_at)
+			SELECT DISTINCT ON (coalesce(user_id, -id)) user_id, $1, created_at, updated_at, body, status, moderated_by, moderated_at
+			FROM reviews
+			WHERE movie_id = ANY($2)
+			ORDER BY coalesce(user_id, -id), updated_at DESC, id DESC
+			ON CONFLICT (user_id, movie_id) DO NOTHING`, &report.ReviewsMoved},
+		{`
+			INSERT INTO movie_cast (movie_id, person_id, role, character, position)
+			SELECT $1, person_id, role, max(character),
+				(SELECT coalesce(max(position), 0) FROM movie_cast WHERE movie_id = $1) + row_number() OVER (ORDER BY min(position))
+			FROM movie_cast
+			WHERE movie_id = ANY($2)
+			GROUP BY person_id, role
+			ON CONFLICT (movie_id, person_id, role) DO NOTHING`, &report.CastMoved},
+		{`
+			INSERT INTO movie_crew (movie_id, person_id, job, position)
+			SELECT $1, person_id, job,
+				(SELECT coalesce(max(position), 0) FROM movie_crew WHERE movie_id = $1) + row_number() OVER (ORDER BY min(position))
+			FROM movie_crew
+			WHERE movie_id = ANY($2)
+			GROUP BY person_id, job
+			ON CONFLICT (movie_id, person_id, job) DO NOTHING`, &report.CrewMoved},
+		{`
+			INSERT INTO watch_history (user_id, movie_id, watched_on, created_at)
+			SELECT user_id, $1, watched_on, min(created_at)
+			FROM watch_history
+			WHERE movie_id = ANY($2)
+			GROUP BY user_id, watched_on
+			ON CONFLICT (user_id, movie_id, watched_on) DO NOTHING`, &report.WatchesMoved},
+		{`
+			INSERT INTO watchlist (user_id, movie_id, added_at)
+			SELECT user_id, $1, min(added_at)
+			FROM watchlist
+			WHERE movie_id = ANY($2)
+			GROUP BY user_id
+			ON CONFLICT (user_id, movie_id) DO NOTHING`, &report.WatchlistMoved},
+	}
+
+	for _, move := range moves {
+		result, err := tx.ExecContext(ctx, move.stmt, survivorID, pq.Array(duplicateIDs))
+		if err != nil {
+			return nil, err
+		}
+
+		*move.count, err = result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var listIDs []int64
+
+	err = tx.QueryRowContext(ctx, `
+		SELECT coalesce(array_agg(DISTINCT list_id ORDER BY list_id), '{}')
+		FROM list_entries
+		WHERE movie_id = ANY($1)`, pq.Array(duplicateIDs)).Scan(pq.Array(&listIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, listID := range listIDs {
+		err = mergeListEntries(ctx, tx, listID, survivorID, duplicateIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report.ListsUpdated = int64(len(listIDs))
+
+	// Deleting the duplicates cascades to whatever of theirs wasn't moved.
+	_, err = tx.ExecContext(ctx, `DELETE FROM movies WHERE id = ANY($1)`, pq.Array(duplicateIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	invalidateMovies(ctx, m.Cache, append([]int64{survivorID}, duplicateIDs...)...)
+
+	return report, nil
+}
+
+// mergeListEntries() puts the survivor in place of the first of the survivor and duplicates in the list, and
+// removes the rest.
+func mergeListEntries(ctx context.Context, tx *sql.Tx, listID, survivorID int64, duplicateIDs []int64) error {
+	order, err := lockListOrder(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+
+	merging := map[int64]bool{survivorID: true}
+	for _, id := range duplicateIDs {
+		merging[id] = true
+	}
+
+	var first int64
+	newOrder := make([]int64, 0, len(order))
+
+	for _, id := range order {
+		if !merging[id] {
+			newOrder = append(newOrder, id)
+			continue
+		}
+
+		if first == 0 {
+			first = id
+			newOrder = append(newOrder, survivorID)
+		}
+	}
+
+	// Delete the duplicates' entries, except the first if it's taking the survivor's place, and then point that
+	// one at the survivor.
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM list_entries
+		WHERE list_id = $1 AND movie_id = ANY($2) AND movie_id <> $3`, listID, pq.Array(duplicateIDs), first)
+	if err != nil {
+		return err
+	}
+
+	if first != survivorID {
+		_, err = tx.ExecContext(ctx, `UPDATE list_entries SET movie_id = $1 WHERE list_id = $2 AND movie_id = $3`, survivorID, listID, first)
+		if err != nil {
+			return err
+		}
+	}
+
+	return setListOrder(ctx, tx, listID, newOrder)
+}
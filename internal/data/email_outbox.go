@@ -0,0 +1,235 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Statuses of an email in the outbox. Sent emails are deleted rather than given a status of their own.
+const (
+	OutboxPending = "pending"
+	OutboxFailed  = "failed"
+)
+
+// OutboxEmail is an email queued in the outbox, waiting to be sent by an outbox worker, or which failed to send
+// after every attempt.
+type OutboxEmail struct {
+	XMLName       xml.Name               `json:"-" xml:"email"`
+	ID            int64                  `json:"id" xml:"id"`
+	CreatedAt     time.Time              `json:"created_at" xml:"created_at"`
+	Task          string                 `json:"task" xml:"task"` // What queued it, such as send_welcome_email.
+	Recipient     string                 `json:"recipient" xml:"recipient"`
+	Template      string                 `json:"template" xml:"template"`
+	Data          map[string]interface{} `json:"-" xml:"-"` // Hidden, as it may hold one-time tokens.
+	Status        string                 `json:"status" xml:"status"`
+	Attempts      int                    `json:"attempts" xml:"attempts"`
+	NextAttemptAt time.Time              `json:"next_attempt_at" xml:"next_attempt_at"`
+	LastError     string                 `json:"last_error,omitempty" xml:"last_error,omitempty"`
+}
+
+// ValidateOutboxStatus() checks the status an admin is listing the emails with.
+func ValidateOutboxStatus(v *validator.Validator, status string) {
+	v.Check(validator.In(status, OutboxPending, OutboxFailed), "status", "must be pending or failed")
+}
+
+type EmailOutboxModel struct {
+	DB *sql.DB
+}
+
+const outboxColumns = `id, created_at, task, recipient, template, data, status, attempts, next_attempt_at, last_error`
+
+// scanOutboxEmail() scans a row of the outboxColumns, with any extra destinations before them. The numbers in
+// the template data are decoded as json.Number, which templates print just as they would the original integers.
+func scanOutboxEmail(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*OutboxEmail, error) {
+	var email OutboxEmail
+	var js []byte
+
+	dest := append(extra, &email.ID, &email.CreatedAt, &email.Task, &email.Recipient, &email.Template, &js,
+		&email.Status, &email.Attempts, &email.NextAttemptAt, &email.LastError)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	err = dec.Decode(&email.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email, nil
+}
+
+// Insert() queues the email to be sent straight away. Its template data is stored as JSON, so it must only hold
+// values which survive being encoded and decoded, such as strings and numbers.
+func (m EmailOutboxModel) Insert(ctx context.Context, email *OutboxEmail) error {
+	js, err := json.Marshal(email.Data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO email_outbox (task, recipient, template, data)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, status, next_attempt_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, email.Task, email.Recipient, email.Template, js).Scan(
+		&email.ID, &email.CreatedAt, &email.Status, &email.NextAttemptAt)
+}
+
+// Claim() returns up to limit of the pending emails which are due, oldest first, for the caller to send. Their
+// attempts are counted, and their next attempts put off by lease, so that no other worker claims them in the
+// meantime, but a worker which dies while sending them doesn't stop them being retried after the lease. Rows
+// which another worker is claiming at the same time are skipped.
+func (m EmailOutboxModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*OutboxEmail, error) {
+	query := `
+		UPDATE email_outbox
+		SET attempts = attempts + 1, next_attempt_at = now() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + outboxColumns
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []*OutboxEmail{}
+
+	for rows.Next() {
+		email, err := scanOutboxEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING doesn't keep the order of the subquery.
+	sort.Slice(emails, func(i, j int) bool { return emails[i].ID < emails[j].ID })
+
+	return emails, nil
+}
+
+// Sent() deletes the email once it has been sent.
+func (m EmailOutboxModel) Sent(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM email_outbox WHERE id = $1`, id)
+	return err
+}
+
+// Retry() records the error of a failed attempt, and puts the next attempt off by delay.
+func (m EmailOutboxModel) Retry(ctx context.Context, id int64, delay time.Duration, lastError string) error {
+	query := `
+		UPDATE email_outbox
+		SET next_attempt_at = now() + make_interval(secs => $2), last_error = $3
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, delay.Seconds(), lastError)
+	return err
+}
+
+// Fail() marks the email as failed with the error of its last attempt. It stays in the outbox, without being
+// retried, until an admin requeues it.
+func (m EmailOutboxModel) Fail(ctx context.Context, id int64, lastError string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE email_outbox SET status = 'failed', last_error = $2 WHERE id = $1`, id, lastError)
+	return err
+}
+
+// Requeue() puts a failed email back in the queue, to be sent straight away with a fresh set of attempts.
+// ErrRecordNotFound is returned if there's no failed email with the ID.
+func (m EmailOutboxModel) Requeue(ctx context.Context, id int64) (*OutboxEmail, error) {
+	query := `
+		UPDATE email_outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = now()
+		WHERE id = $1 AND status = 'failed'
+		RETURNING ` + outboxColumns
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	email, err := scanOutboxEmail(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return email, nil
+}
+
+// GetAll() returns a page of the emails with the status, or all emails if status is empty, for admins.
+func (m EmailOutboxModel) GetAll(ctx context.Context, status string, filters Filters) ([]*OutboxEmail, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM email_outbox
+		WHERE (status = $1 OR $1 = '')
+		ORDER BY %s, id ASC
+		LIMIT $2 OFFSET $3`, outboxColumns, filters.orderBy(""))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	emails := []*OutboxEmail{}
+
+	for rows.Next() {
+		email, err := scanOutboxEmail(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		emails = append(emails, email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return emails, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// EmailThrottleModel tracks the emails sent to each account, so that the number of emails of a given scope
+// (e.g. activation) can be limited per account, independently of the per-IP rate limiter.
+type EmailThrottleModel struct {
+	DB *sql.DB
+}
+
+// Allow() reports whether another email of the given scope may be sent to the user, given that at most limit
+// emails may be sent within window. If it is allowed, the send is recorded straight away. The user's row is
+// locked for the duration of the check, so concurrent requests for the same account can't both slip through.
+func (m EmailThrottleModel) Allow(ctx context.Context, userID int64, scope string, limit int, window time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		return false, err
+	}
+
+	since := time.Now().Add(-window)
+
+	// Remove the user's records which have fallen outside the window, so the table doesn't grow forever.
+	_, err = tx.ExecContext(ctx, `DELETE FROM email_throttles WHERE user_id = $1 AND sent_at <= $2`, userID, since)
+	if err != nil {
+		return false, err
+	}
+
+	var sent int
+
+	err = tx.QueryRowContext(ctx, `
+		SELECT count(*)
+		FROM email_throttles
+		WHERE user_id = $1 AND scope = $2 AND sent_at > $3`, userID, scope, since).Scan(&sent)
+	if err != nil {
+		return false, err
+	}
+
+	if sent >= limit {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO email_throttles (user_id, scope) VALUES ($1, $2)`, userID, scope)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"time"
+)
+
+// ErasedUserName is the name given to a user's account when their personal data is erased, so that any content
+// of theirs which is kept is attributed to a "deleted user".
+const ErasedUserName = "deleted user"
+
+// ErasureReport describes what was removed when a user's personal data was erased.
+type ErasureReport struct {
+	XMLName                     xml.Name  `json:"-" xml:"erasure"`
+	ID                          int64     `json:"id" xml:"id"`
+	UserID                      int64     `json:"user_id" xml:"user_id"`
+	RequestedBy                 int64     `json:"requested_by" xml:"requested_by"`
+	CompletedAt                 time.Time `json:"completed_at" xml:"completed_at"`
+	TokensRevoked               int64     `json:"tokens_revoked" xml:"tokens_revoked"`
+	PersonalAccessTokensRevoked int64     `json:"personal_access_tokens_revoked" xml:"personal_access_tokens_revoked"`
+	APIKeysRevoked              int64     `json:"api_keys_revoked" xml:"api_keys_revoked"`
+	ListsDeleted                int64     `json:"lists_deleted" xml:"lists_deleted"`
+	ListsAnonymized             int64     `json:"lists_anonymized" xml:"lists_anonymized"`
+	ListMembershipsDeleted      int64     `json:"list_memberships_deleted" xml:"list_memberships_deleted"`
+	RatingsDeleted              int64     `json:"ratings_deleted" xml:"ratings_deleted"`
+	ReviewsAnonymized           int64     `json:"reviews_anonymized" xml:"reviews_anonymized"`
+	WatchHistoryDeleted         int64     `json:"watch_history_deleted" xml:"watch_history_deleted"`
+	WatchlistDeleted            int64     `json:"watchlist_deleted" xml:"watchlist_deleted"`
+}
+
+type ErasureModel struct {
+	DB *sql.DB
+}
+
+// Erase() removes a user's personal data, in a single transaction:
+//
+//   - Their tokens, personal access tokens, API keys and permissions are revoked.
+//   - Their ratings, watch history, watchlist and list memberships are deleted, along with their private and
+//     unlisted lists.
+//   - Their public lists are kept, but are attributed to a "deleted user".
+//   - Their reviews are kept, but unlinked from the account, so they can't be traced back to it.
+//   - The changes recorded in the audit log for their account are cleared, as they hold the old name and email
+//     address. The entries themselves are kept.
+//   - Their account is kept so that its ID stays reserved, but the name, email address, password, profile and
+//     preferences are wiped and it is deactivated, so it can't be logged in to.
+//
+// The erasure is recorded in the erasures table along with the report, which is also returned. requestedBy is
+// the ID of the user who asked for the erasure: the user themselves, or an administrator. ErrRecordNotFound is
+// returned if the user doesn't exist or has already been erased.
+func (m ErasureModel) Erase(ctx context.Context, userID, requestedBy int64) (*ErasureReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 AND erased_at IS NULL FOR UPDATE`, userID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	report := &ErasureReport{UserID: userID, RequestedBy: requestedBy}
+
+	deletions := []struct {
+		stmt  string
+		count *int64
+	}{
+		{`DELETE FROM tokens WHERE user_id = $1`, &report.TokensRevoked},
+		{`DELETE FROM personal_access_tokens WHERE user_id = $1`, &report.PersonalAccessTokensRevoked},
+		{`DELETE FROM api_keys WHERE user_id = $1`, &report.APIKeysRevoked},
+		{`DELETE FROM lists WHERE user_id = $1 AND visibility <> 'public'`, &report.ListsDeleted},
+		{`DELETE FROM list_members WHERE user_id = $1`, &report.ListMembershipsDeleted},
+		{`DELETE FROM ratings WHERE user_id = $1`, &report.RatingsDeleted},
+		{`UPDATE reviews SET user_id = NULL WHERE user_id = $1`, &report.ReviewsAnonymized},
+		{`DELETE FROM watch_history WHERE user_id = $1`, &report.WatchHistoryDeleted},
+		{`DELETE FROM watchlist WHERE user_id = $1`, &report.WatchlistDeleted},
+		{`DELETE FROM saved_searches WHERE user_id = $1`, nil},
+		{`DELETE FROM notifications WHERE user_id = $1`, nil},
+		{`DELETE FROM users_permissions WHERE user_id = $1`, nil},
+		{`DELETE FROM email_throttles WHERE user_id = $1`, nil},
+		{`UPDATE audit_log SET changes = '[]' WHERE entity = 'user' AND entity_id = $1`, nil},
+	}
+
+	for _, d := range deletions {
+		result, err := tx.ExecContext(ctx, d.stmt, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		if d.count != nil {
+			*d.count, err = result.RowsAffected()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM lists WHERE user_id = $1`, userID).Scan(&report.ListsAnonymized)
+	if err != nil {
+		return nil, err
+	}
+
+	// The email address has a unique constraint, so replace it with one that's unique to the account but can
+	// never be delivered to.
+	stmt := `
+		UPDATE users
+		SET name = $2, email = 'deleted-' || id || '@erased.invalid', password_hash = '\x', activated = false,
+			display_name = '', bio = '', avatar_url = '', profile_visibility = 'private',
+			favorite_genres = '{}', preferred_languages = '{}', max_content_rating = '', weekly_digest = false, locale = 'en',
+			pending_email = NULL, digest_sent_at = NULL, erased_at = now(), version = version + 1
+		WHERE id = $1`
+
+	_, err = tx.ExecContext(ctx, stmt, userID, ErasedUserName)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+		INSERT INTO erasures (user_id, requested_by, report)
+		VALUES ($1, $2, '{}')
+		RETURNING id, completed_at`
+
+	err = tx.QueryRowContext(ctx, stmt, userID, requestedBy).Scan(&report.ID, &report.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store the complete report, now that its ID and completion time are known.
+	js, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE erasures SET report = $2 WHERE id = $1`, report.ID, js)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
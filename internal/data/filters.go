@@ -20,30 +20,69 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 
-	v.Check(validator.In(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+	// Sort holds one or more comma-separated keys, such as -year,title, each of which must be in the safelist.
+	// Sorting on the same column twice would be pointless, so it's rejected rather than silently ignored.
+	seen := make(map[string]bool)
+
+	for _, key := range strings.Split(f.Sort, ",") {
+		column := strings.TrimPrefix(key, "-")
+
+		v.Check(validator.In(key, f.SortSafeList...), "sort", "invalid sort value")
+		v.Check(!seen[column], "sort", "must not contain the same field more than once")
+
+		seen[column] = true
+	}
 }
 
-// Check that the client provided Sort field matches any one of the entries in our safelist.
-// If it does, return the column name by stripping the leading '-' character if it has one.
-func (f Filters) sortColumn() string {
-	for _, safeValue := range f.SortSafeList {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+// sortKey is one column of the sort order.
+type sortKey struct {
+	column     string
+	descending bool
+}
+
+// Check that each of the comma-separated keys in the client provided Sort field matches one of the entries in
+// our safelist, and return them in order, with the column name stripped of the leading '-' character if it
+// has one.
+func (f Filters) sortKeys() []sortKey {
+	var keys []sortKey
+
+	for _, key := range strings.Split(f.Sort, ",") {
+		if !validator.In(key, f.SortSafeList...) {
+			panic("unsafe sort parameter:" + f.Sort)
 		}
+
+		keys = append(keys, sortKey{column: strings.TrimPrefix(key, "-"), descending: strings.HasPrefix(key, "-")})
 	}
 
-	panic("unsafe sort parameter:" + f.Sort)
+	return keys
 }
 
-// Return the sort direction depending on the prefix of the Sort field.
+// Return the direction of the first sort key.
 func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
+	if f.sortKeys()[0].descending {
 		return "DESC"
 	}
 
 	return "ASC"
 }
 
+// Return the ORDER BY list for the sort keys, such as "year DESC, title ASC", with each column qualified by the
+// prefix, such as "m.", if it isn't empty.
+func (f Filters) orderBy(prefix string) string {
+	var terms []string
+
+	for _, key := range f.sortKeys() {
+		direction := "ASC"
+		if key.descending {
+			direction = "DESC"
+		}
+
+		terms = append(terms, prefix+key.column+" "+direction)
+	}
+
+	return strings.Join(terms, ", ")
+}
+
 // Return the number of records in a query.
 func (f Filters) limit() int {
 	return f.PageSize
@@ -56,11 +95,11 @@ func (f Filters) offset() int {
 
 // Metadata struct for holding the pagination metadata.
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int `json:"current_page,omitempty" xml:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty" xml:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty" xml:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty" xml:"last_page,omitempty"`
+	TotalRecords int `json:"total_records,omitempty" xml:"total_records,omitempty"`
 }
 
 // Calculates the appropriate pagination metadata values given the total number of records,
@@ -0,0 +1,405 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Kinds of genre change.
+const (
+	GenreRename = "rename"
+	GenreMerge  = "merge"
+)
+
+// The most genres which can be merged into another in one change.
+const maxGenreMergeSources = 20
+
+var (
+	// ErrGenreExists is returned when a genre is created or renamed with the name of another genre.
+	ErrGenreExists = errors.New("genre exists")
+	// ErrGenreInUse is returned when deleting a genre which some movies still have.
+	ErrGenreInUse = errors.New("genre in use")
+	// ErrUnknownGenre is returned when a movie is given a genre which isn't in the genres table.
+	ErrUnknownGenre = errors.New("unknown genre")
+)
+
+// Genre is one of the genres movies can have. Movies refer to genres by ID, but the API shows and accepts their
+// names, so that renaming a genre updates every movie which has it.
+type Genre struct {
+	XMLName xml.Name `json:"-" xml:"genre"`
+	ID      int64    `json:"id" xml:"id"`
+	Name    string   `json:"name" xml:"name"`
+	Movies  int64    `json:"movies" xml:"movies"` // The number of movies which have the genre.
+	Version int32    `json:"version" xml:"version"`
+}
+
+func ValidateGenre(v *validator.Validator, genre *Genre) {
+	v.Check(genre.Name != "", "name", "must be provided")
+	v.Check(len(genre.Name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+// GenreChange records a rename or merge of genres: every occurrence of the source genres was replaced with the
+// target genre.
+type GenreChange struct {
+	XMLName              xml.Name  `json:"-" xml:"genre_change"`
+	ID                   int64     `json:"id" xml:"id"`
+	Kind                 string    `json:"kind" xml:"kind"`
+	Sources              []string  `json:"sources" xml:"sources>genre"`
+	Target               string    `json:"target" xml:"target"`
+	RequestedBy          int64     `json:"requested_by" xml:"requested_by"`
+	CompletedAt          time.Time `json:"completed_at" xml:"completed_at"`
+	MoviesUpdated        int64     `json:"movies_updated" xml:"movies_updated"`
+	UsersUpdated         int64     `json:"users_updated" xml:"users_updated"`
+	SavedSearchesUpdated int64     `json:"saved_searches_updated" xml:"saved_searches_updated"`
+}
+
+// ValidateGenreChange() checks the source and target genres. A rename has a single source.
+func ValidateGenreChange(v *validator.Validator, change *GenreChange) {
+	v.Check(len(change.Sources) >= 1, "sources", "must contain at least 1 genre")
+	v.Check(len(change.Sources) <= maxGenreMergeSources, "sources", "must not contain more than 20 genres")
+	v.Check(validator.Unique(change.Sources), "sources", "must not contain duplicate values")
+
+	for _, source := range change.Sources {
+		v.Check(source != "", "sources", "must not contain empty genres")
+		v.Check(source != change.Target, "sources", "must not contain the target genre")
+	}
+
+	if change.Kind == GenreRename {
+		v.Check(len(change.Sources) == 1, "sources", "must contain exactly 1 genre")
+	}
+
+	v.Check(change.Target != "", "target", "must be provided")
+	v.Check(len(change.Target) <= 100, "target", "must not be more than 100 bytes long")
+}
+
+type GenreModel struct {
+	DB *sql.DB
+
+	// Cache, if not nil, is told which movies genre changes change.
+	Cache MovieInvalidator
+}
+
+// GetAll() returns every genre, with the number of movies which have it, most used first.
+func (m GenreModel) GetAll(ctx context.Context) ([]*Genre, error) {
+	stmt := `
+		SELECT g.id, g.name, g.version, count(mg.movie_id)
+		FROM genres g
+		LEFT JOIN movies_genres mg ON mg.genre_id = g.id
+		GROUP BY g.id
+		ORDER BY count(mg.movie_id) DESC, g.name`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(&genre.ID, &genre.Name, &genre.Version, &genre.Movies)
+		if err != nil {
+			return nil, err
+		}
+
+		genres = append(genres, &genre)
+	}
+
+	return genres, rows.Err()
+}
+
+// Get() returns the genre with the ID, with the number of movies which have it.
+func (m GenreModel) Get(ctx context.Context, id int64) (*Genre, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	stmt := `
+		SELECT id, name, version, (SELECT count(*) FROM movies_genres WHERE genre_id = genres.id)
+		FROM genres
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var genre Genre
+
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(&genre.ID, &genre.Name, &genre.Version, &genre.Movies)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &genre, nil
+}
+
+// Insert() adds a new genre, returning ErrGenreExists if there is already one with the name.
+func (m GenreModel) Insert(ctx context.Context, genre *Genre) error {
+	stmt := `
+		INSERT INTO genres (name)
+		VALUES ($1)
+		RETURNING id, version`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, genre.Name).Scan(&genre.ID, &genre.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "genres_name_key"`:
+			return ErrGenreExists
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete() removes the genre with the ID. ErrGenreInUse is returned if any movie still has it; the genre should
+// be merged into another instead.
+func (m GenreModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM genres WHERE id = $1`, id)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: update or delete on table "genres" violates foreign key constraint "movies_genres_genre_id_fkey" on table "movies_genres"`:
+			return ErrGenreInUse
+		default:
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// setMovieGenres() replaces the movie's genres with the named genres, in order, as part of the transaction.
+// ErrUnknownGenre is returned if any of them isn't in the genres table.
+func setMovieGenres(ctx context.Context, tx *sql.Tx, movieID int64, genres []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM movies_genres WHERE movie_id = $1`, movieID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO movies_genres (movie_id, genre_id, position)
+		SELECT $1, g.id, t.position
+		FROM unnest($2::text[]) WITH ORDINALITY AS t(name, position)
+		INNER JOIN genres g ON g.name = t.name`, movieID, pq.Array(genres))
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if int(n) != len(genres) {
+		return ErrUnknownGenre
+	}
+
+	return nil
+}
+
+// Change() replaces the source genres with the target genre, in a single transaction, on every movie, and in
+// users' favorite genres and saved searches' genres. A rename renames the source genre in the genres table. A
+// merge moves the source genres' movies onto the target genre, which is created if it doesn't exist, and then
+// deletes the source genres. Where a movie or an array already has the target, or several of the sources, they
+// are collapsed into one entry at the position of the first. Movies and saved searches have their version
+// incremented, so that a concurrent edit based on the old genres gets an edit conflict.
+//
+// For a rename, ErrRecordNotFound is returned if there is no source genre, and ErrGenreExists if the target genre
+// already exists; the genres should be merged instead. The change is recorded in the genre_changes table, and its
+// ID and counts are set on change. Genres are matched exactly, including case. Saved searches' filter
+// expressions aren't rewritten.
+func (m GenreModel) Change(ctx context.Context, change *GenreChange) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the source genres, so that movies can't be given them while they're changed.
+	var sourceIDs []int64
+
+	err = tx.QueryRowContext(ctx, `
+		SELECT coalesce(array_agg(id), '{}') FROM (
+			SELECT id FROM genres WHERE name = ANY($1) ORDER BY id FOR UPDATE
+		) locked`, pq.Array(change.Sources)).Scan(pq.Array(&sourceIDs))
+	if err != nil {
+		return err
+	}
+
+	// Bump the version of every movie whose genres are changing.
+	var movieIDs []int64
+
+	err = tx.QueryRowContext(ctx, `
+		WITH updated AS (
+			UPDATE movies SET version = version + 1
+			WHERE id IN (SELECT movie_id FROM movies_genres WHERE genre_id = ANY($1))
+			RETURNING id
+		)
+		SELECT coalesce(array_agg(id), '{}') FROM updated`, pq.Array(sourceIDs)).Scan(pq.Array(&movieIDs))
+	if err != nil {
+		return err
+	}
+
+	change.MoviesUpdated = int64(len(movieIDs))
+
+	switch change.Kind {
+	case GenreRename:
+		if len(sourceIDs) == 0 {
+			return ErrRecordNotFound
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE genres SET name = $1, version = version + 1 WHERE id = $2`, change.Target, sourceIDs[0])
+		if err != nil {
+			switch {
+			case err.Error() == `pq: duplicate key value violates unique constraint "genres_name_key"`:
+				return ErrGenreExists
+			default:
+				return err
+			}
+		}
+
+	default:
+		var targetID int64
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO genres (name) VALUES ($1)
+			ON CONFLICT (name) DO UPDATE SET version = genres.version + 1
+			RETURNING id`, change.Target).Scan(&targetID)
+		if err != nil {
+			return err
+		}
+
+		// Give the target genre to the movies with any of the sources, at the position of the first of them
+		// or the target, whichever comes first.
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO movies_genres (movie_id, genre_id, position)
+			SELECT movie_id, $2, min(position)
+			FROM movies_genres
+			WHERE genre_id = ANY($1)
+			GROUP BY movie_id
+			ON CONFLICT (movie_id, genre_id) DO UPDATE SET position = least(movies_genres.position, excluded.position)`,
+			pq.Array(sourceIDs), targetID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM movies_genres WHERE genre_id = ANY($1)`, pq.Array(sourceIDs))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM genres WHERE id = ANY($1)`, pq.Array(sourceIDs))
+		if err != nil {
+			return err
+		}
+	}
+
+	// replaced() returns the SQL expression for the column with the sources replaced by the target, keeping the
+	// order of the genres, and without duplicates.
+	replaced := func(column string) string {
+		return `(
+			SELECT array_agg(genre ORDER BY position)
+			FROM (
+				SELECT CASE WHEN g = ANY($1) THEN $2 ELSE g END AS genre, min(position) AS position
+				FROM unnest(` + column + `) WITH ORDINALITY AS t(g, position)
+				GROUP BY 1
+			) s
+		)`
+	}
+
+	updates := []struct {
+		stmt  string
+		count *int64
+	}{
+		{`UPDATE users SET favorite_genres = ` + replaced(`favorite_genres`) + ` WHERE favorite_genres && $1`, &change.UsersUpdated},
+		{`UPDATE saved_searches SET genres = ` + replaced(`genres`) + `, version = version + 1 WHERE genres && $1`, &change.SavedSearchesUpdated},
+	}
+
+	for _, u := range updates {
+		result, err := tx.ExecContext(ctx, u.stmt, pq.Array(change.Sources), change.Target)
+		if err != nil {
+			return err
+		}
+
+		*u.count, err = result.RowsAffected()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO genre_changes (kind, sources, target, requested_by, movies_updated, users_updated, saved_searches_updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, completed_at`,
+		change.Kind, pq.Array(change.Sources), change.Target, change.RequestedBy,
+		change.MoviesUpdated, change.UsersUpdated, change.SavedSearchesUpdated,
+	).Scan(&change.ID, &change.CompletedAt)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	invalidateMovies(ctx, m.Cache, movieIDs...)
+
+	return nil
+}
+
+// genreFilterSQL() returns an SQL condition matching the rows of the movies table which have all of the genres in
+// the text array parameter param, such as "$2", or at least one of them if any is true. The genres are looked up
+// in movies_genres, where the index on (genre_id, movie_id) finds the matching movies, rather than by calling
+// movie_genre_names() for every movie. Callers must handle an empty array themselves.
+func genreFilterSQL(param string, any bool) string {
+	if any {
+		return `EXISTS (
+			SELECT 1 FROM movies_genres mg INNER JOIN genres g ON g.id = mg.genre_id
+			WHERE mg.movie_id = movies.id AND g.name = ANY(` + param + `))`
+	}
+
+	return `movies.id IN (
+			SELECT mg.movie_id FROM movies_genres mg INNER JOIN genres g ON g.id = mg.genre_id
+			WHERE g.name = ANY(` + param + `)
+			GROUP BY mg.movie_id
+			HAVING count(*) = (SELECT count(DISTINCT name) FROM unnest(` + param + `::text[]) AS name))`
+}
@@ -0,0 +1,181 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TitleYear identifies a movie by its title and release year, for matching movies from other services against
+// the catalog. A Year of 0 means the year isn't known.
+type TitleYear struct {
+	Title string
+	Year  int32
+}
+
+// ImportEntry is what to record for a single movie when importing a user's data from another service.
+type ImportEntry struct {
+	MovieID   int64
+	WatchedOn time.Time // The zero time if the movie wasn't watched.
+	Rating    int       // 0 if the movie wasn't rated.
+	Watchlist bool
+}
+
+// ImportModel records imported watch history, ratings and watchlist entries.
+type ImportModel struct {
+	DB *sql.DB
+}
+
+// MatchTitles() looks up the catalog movies matching each title and year, ignoring case. If there is more than
+// one movie with the same title and year, the oldest is used. When the year isn't known, a title is only matched
+// if exactly one movie has it. Unmatched keys are missing from the returned map.
+func (m ImportModel) MatchTitles(ctx context.Context, keys []TitleYear) (map[TitleYear]int64, error) {
+	titles := make([]string, len(keys))
+	years := make([]int32, len(keys))
+
+	for i, key := range keys {
+		titles[i] = strings.ToLower(key.Title)
+		years[i] = key.Year
+	}
+
+	stmt := `
+		SELECT k.title, k.year, min(m.id), count(*)
+		FROM unnest($1::text[], $2::int[]) AS k(title, year)
+		INNER JOIN movies m ON lower(m.title) = k.title AND (m.year = k.year OR k.year = 0)
+		GROUP BY k.title, k.year`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, pq.Array(titles), pq.Array(years))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := make(map[TitleYear]int64)
+
+	for rows.Next() {
+		var key TitleYear
+		var id int64
+		var count int
+
+		err := rows.Scan(&key.Title, &key.Year, &id, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		if key.Year == 0 && count > 1 {
+			continue
+		}
+
+		matches[key] = id
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Map the results back to the keys as given, rather than lower case.
+	result := make(map[TitleYear]int64, len(matches))
+	for _, key := range keys {
+		if id, ok := matches[TitleYear{strings.ToLower(key.Title), key.Year}]; ok {
+			result[key] = id
+		}
+	}
+
+	return result, nil
+}
+
+// Apply() records the entries for the user in a single transaction, so an import is either applied in full or
+// not at all. Importing the same data again has no further effect: watches are only recorded once per movie and
+// day, watchlist entries once per movie, and ratings replace any earlier rating of the same movie.
+func (m ImportModel) Apply(ctx context.Context, userID int64, entries []ImportEntry) error {
+	var watchedMovies, ratedMovies, watchlistMovies []int64
+	var watchedOn []time.Time
+	var ratingValues []int64
+
+	// The last rating of a movie in the import wins. Collect them in a map first, as a single INSERT ... ON
+	// CONFLICT statement can't update the same row twice.
+	ratings := make(map[int64]int)
+
+	for _, entry := range entries {
+		if !entry.WatchedOn.IsZero() {
+			watchedMovies = append(watchedMovies, entry.MovieID)
+			watchedOn = append(watchedOn, entry.WatchedOn)
+		}
+
+		if entry.Rating > 0 {
+			if _, seen := ratings[entry.MovieID]; !seen {
+				ratedMovies = append(ratedMovies, entry.MovieID)
+			}
+			ratings[entry.MovieID] = entry.Rating
+		}
+
+		if entry.Watchlist {
+			watchlistMovies = append(watchlistMovies, entry.MovieID)
+		}
+	}
+
+	for _, id := range ratedMovies {
+		ratingValues = append(ratingValues, int64(ratings[id]))
+	}
+
+	// An import can hold thousands of rows, so allow longer than the usual 3 seconds. Each table is still written
+	// with a single statement.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(watchedMovies) > 0 {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO watch_history (user_id, movie_id, watched_on)
+			SELECT $1, w.movie_id, w.watched_on
+			FROM unnest($2::bigint[], $3::date[]) AS w(movie_id, watched_on)
+			ON CONFLICT DO NOTHING`, userID, pq.Array(watchedMovies), pq.Array(dates(watchedOn)))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(ratedMovies) > 0 {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO ratings (user_id, movie_id, rating)
+			SELECT $1, r.movie_id, r.rating
+			FROM unnest($2::bigint[], $3::smallint[]) AS r(movie_id, rating)
+			ON CONFLICT (user_id, movie_id) DO UPDATE SET rating = EXCLUDED.rating`, userID, pq.Array(ratedMovies), pq.Array(ratingValues))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(watchlistMovies) > 0 {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO watchlist (user_id, movie_id)
+			SELECT $1, movie_id
+			FROM unnest($2::bigint[]) AS movie_id
+			ON CONFLICT DO NOTHING`, userID, pq.Array(watchlistMovies))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// dates() formats the times as YYYY-MM-DD strings, for passing to Postgres as a date array.
+func dates(times []time.Time) []string {
+	s := make([]string, len(times))
+	for i, t := range times {
+		s[i] = t.Format("2006-01-02")
+	}
+	return s
+}
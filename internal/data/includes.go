@@ -0,0 +1,126 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The related resources which can be embedded in a movie with the include parameter of GET /v1/movies/:id.
+const (
+	IncludeCast    = "cast"
+	IncludeCrew    = "crew"
+	IncludeRatings = "ratings"
+	IncludeReviews = "reviews"
+)
+
+// MovieIncludes lists the related resources which can be embedded in a movie.
+var MovieIncludes = []string{IncludeCast, IncludeCrew, IncludeRatings, IncludeReviews}
+
+// MaxIncludedItems is the most ratings or reviews embedded in a movie, the most recent first. The rest can be
+// paged through at /v1/movies/:id/ratings and /v1/movies/:id/reviews.
+const MaxIncludedItems = 20
+
+// movieIncludeQueries holds, for each related resource, a subquery aggregating it into a JSON array in the shape
+// of its struct's JSON encoding. $1 is the movie's ID, and $2, which only the ratings and reviews use, is
+// MaxIncludedItems.
+var movieIncludeQueries = map[string]string{
+	IncludeCast: `(
+		SELECT coalesce(json_agg(json_build_object(
+			'person_id', c.person_id, 'name', p.name, 'role', c.role, 'character', c.character
+		) ORDER BY c.position), '[]')
+		FROM movie_cast c
+		INNER JOIN people p ON p.id = c.person_id
+		WHERE c.movie_id = $1)`,
+	IncludeCrew: `(
+		SELECT coalesce(json_agg(json_build_object(
+			'person_id', c.person_id, 'name', p.name, 'job', c.job
+		) ORDER BY c.position), '[]')
+		FROM movie_crew c
+		INNER JOIN people p ON p.id = c.person_id
+		WHERE c.movie_id = $1)`,
+	IncludeRatings: `(
+		SELECT coalesce(json_agg(json_build_object(
+			'id', r.id, 'user_id', r.user_id, 'movie_id', r.movie_id, 'rating', r.rating, 'created_at', r.created_at
+		) ORDER BY r.created_at DESC, r.id DESC), '[]')
+		FROM (
+			SELECT * FROM ratings WHERE movie_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2
+		) r)`,
+	IncludeReviews: `(
+		SELECT coalesce(json_agg(json_build_object(
+			'id', r.id, 'user_id', r.user_id, 'author', CASE WHEN r.user_id IS NULL THEN '` + ErasedUserName + `' END,
+			'movie_id', r.movie_id, 'created_at', r.created_at,
+			'updated_at', r.updated_at, 'body', r.body, 'status', r.status, 'moderated_at', r.moderated_at,
+			'version', r.version
+		) ORDER BY r.created_at DESC, r.id DESC), '[]')
+		FROM (
+			SELECT * FROM reviews WHERE movie_id = $1 AND status = 'approved' ORDER BY created_at DESC, id DESC LIMIT $2
+		) r)`,
+}
+
+type MovieIncludeModel struct {
+	DB *sql.DB
+}
+
+// Attach() fills in the related resources named in include, from MovieIncludes, on the movie. They're fetched in
+// a single query, with a subquery for each, rather than one round trip per resource. Only approved reviews are
+// included, and no more than MaxIncludedItems ratings and reviews.
+func (m MovieIncludeModel) Attach(ctx context.Context, movie *Movie, include []string) error {
+	if len(include) == 0 {
+		return nil
+	}
+
+	columns := make([]string, len(include))
+	values := make([][]byte, len(include))
+	dest := make([]interface{}, len(include))
+	args := []interface{}{movie.ID}
+
+	for i, name := range include {
+		query, ok := movieIncludeQueries[name]
+		if !ok {
+			return fmt.Errorf("unknown movie include %q", name)
+		}
+
+		columns[i] = query
+		dest[i] = &values[i]
+
+		if strings.Contains(query, "$2") && len(args) == 1 {
+			args = append(args, MaxIncludedItems)
+		}
+	}
+
+	stmt := `SELECT ` + strings.Join(columns, ", ")
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(dest...)
+	if err != nil {
+		return err
+	}
+
+	for i, name := range include {
+		var target interface{}
+
+		switch name {
+		case IncludeCast:
+			target = &movie.Cast
+		case IncludeCrew:
+			target = &movie.Crew
+		case IncludeRatings:
+			target = &movie.Ratings
+		case IncludeReviews:
+			target = &movie.Reviews
+		}
+
+		err := json.Unmarshal(values[i], target)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
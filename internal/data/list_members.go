@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"time"
+
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Roles a collaborator can have on a list. Viewers can see the list whatever its visibility, and editors can
+// also add, remove and reorder its movies. Only the owner can change the list's details, delete it, or manage
+// its members.
+const (
+	ListRoleViewer = "viewer"
+	ListRoleEditor = "editor"
+)
+
+// ListMember is a user who has been given access to someone else's list.
+type ListMember struct {
+	XMLName xml.Name  `json:"-" xml:"member"`
+	UserID  int64     `json:"user_id" xml:"user_id"`
+	Name    string    `json:"name" xml:"name"`
+	Role    string    `json:"role" xml:"role"`
+	AddedAt time.Time `json:"added_at" xml:"added_at"`
+}
+
+func ValidateListRole(v *validator.Validator, role string) {
+	v.Check(validator.In(role, ListRoleViewer, ListRoleEditor), "role", "must be viewer or editor")
+}
+
+type ListMemberModel struct {
+	DB *sql.DB
+}
+
+// Role() returns the user's role on the list, or an empty string if they aren't a member.
+func (m ListMemberModel) Role(ctx context.Context, listID, userID int64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var role string
+
+	err := m.DB.QueryRowContext(ctx, `SELECT role FROM list_members WHERE list_id = $1 AND user_id = $2`, listID, userID).Scan(&role)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", nil
+		default:
+			return "", err
+		}
+	}
+
+	return role, nil
+}
+
+// GetAllForList() returns the members of a list, in the order they were added.
+func (m ListMemberModel) GetAllForList(ctx context.Context, listID int64) ([]*ListMember, error) {
+	stmt := `
+		SELECT m.user_id, u.name, m.role, m.added_at
+		FROM list_members m
+		INNER JOIN users u ON u.id = m.user_id
+		WHERE m.list_id = $1
+		ORDER BY m.added_at, m.user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*ListMember{}
+
+	for rows.Next() {
+		var member ListMember
+
+		err := rows.Scan(&member.UserID, &member.Name, &member.Role, &member.AddedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, &member)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// Upsert() adds the user to the list with the given role, or changes their role if they are already a member.
+// ErrRecordNotFound is returned if there is no activated user with the given ID.
+func (m ListMemberModel) Upsert(ctx context.Context, listID, userID int64, role string) (*ListMember, error) {
+	stmt := `
+		INSERT INTO list_members (list_id, user_id, role)
+		SELECT $1, id, $3 FROM users WHERE id = $2 AND activated
+		ON CONFLICT (list_id, user_id) DO UPDATE SET role = EXCLUDED.role
+		RETURNING user_id, (SELECT name FROM users WHERE id = $2), role, added_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var member ListMember
+
+	err := m.DB.QueryRowContext(ctx, stmt, listID, userID, role).Scan(&member.UserID, &member.Name, &member.Role, &member.AddedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &member, nil
+}
+
+// Delete() removes the user from the list's members.
+func (m ListMemberModel) Delete(ctx context.Context, listID, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM list_members WHERE list_id = $1 AND user_id = $2`, listID, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
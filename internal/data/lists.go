@@ -0,0 +1,527 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// MaxListEntries is the maximum number of movies a single list can hold.
+const MaxListEntries = 500
+
+// List visibility settings:
+//   - A private list can only be seen by its owner.
+//   - An unlisted list can be seen by anyone who has its share link, which contains an unguessable slug, but
+//     isn't included in public browsing and can't be fetched by its (guessable) ID.
+//   - A public list can be seen by anyone, and is included in public browsing.
+const (
+	ListPrivate  = "private"
+	ListUnlisted = "unlisted"
+	ListPublic   = "public"
+)
+
+var (
+	ErrDuplicateListEntry = errors.New("duplicate list entry")
+	ErrListFull           = errors.New("list full")
+	ErrListOrderMismatch  = errors.New("list order mismatch")
+)
+
+// List is a user-curated, ordered collection of movies, like "Top 10 heist movies".
+type List struct {
+	XMLName     xml.Name  `json:"-" xml:"list"`
+	ID          int64     `json:"id" xml:"id"`
+	UserID      int64     `json:"user_id" xml:"user_id"`
+	CreatedAt   time.Time `json:"created_at" xml:"created_at"`
+	Name        string    `json:"name" xml:"name"`
+	Description string    `json:"description" xml:"description"`
+	Visibility  string    `json:"visibility" xml:"visibility"`
+	Slug        string    `json:"slug,omitempty" xml:"slug,omitempty"`
+	Views       int64     `json:"views" xml:"views"`
+	EntryCount  int       `json:"entry_count" xml:"entry_count"`
+	Version     int32     `json:"version" xml:"version"`
+}
+
+// ListEntry is a movie in a list, along with its 1-based position in the list and the ID of the user who added
+// it (which is omitted if that user's account has since been deleted).
+type ListEntry struct {
+	XMLName  xml.Name  `json:"-" xml:"entry"`
+	Position int       `json:"position" xml:"position"`
+	AddedAt  time.Time `json:"added_at" xml:"added_at"`
+	AddedBy  int64     `json:"added_by,omitempty" xml:"added_by,omitempty"`
+	Movie    *Movie    `json:"movie" xml:"movie"`
+}
+
+func ValidateList(v *validator.Validator, list *List) {
+	v.Check(list.Name != "", "name", "must be provided")
+	v.Check(utf8.RuneCountInString(list.Name) <= 100, "name", "must not be more than 100 characters long")
+
+	v.Check(utf8.RuneCountInString(list.Description) <= 1000, "description", "must not be more than 1000 characters long")
+
+	v.Check(validator.In(list.Visibility, ListPrivate, ListUnlisted, ListPublic), "visibility", "must be private, unlisted or public")
+}
+
+// VisibleTo() reports whether the list can be viewed by the given user when it is requested by its ID. Unlisted
+// lists aren't visible this way, except to their owner, as list IDs are easy to guess.
+func (l *List) VisibleTo(user *User) bool {
+	return l.Visibility == ListPublic || l.OwnedBy(user)
+}
+
+// ListCapability is something a user may be allowed to do with a list.
+type ListCapability int
+
+const (
+	ListView        ListCapability = iota // See the list and its movies.
+	ListEditEntries                       // Add, remove and reorder the list's movies.
+	ListManage                            // Change the list's details, delete it, and manage its members.
+)
+
+// Permits() reports whether the given user, who has the given member role on the list (or an empty string if
+// they aren't a member), has the capability.
+func (l *List) Permits(user *User, role string, capability ListCapability) bool {
+	switch capability {
+	case ListView:
+		return l.VisibleTo(user) || role != ""
+	case ListEditEntries:
+		return l.OwnedBy(user) || role == ListRoleEditor
+	default:
+		return l.OwnedBy(user)
+	}
+}
+
+// VisibleBySlug() reports whether the list can be viewed by the given user when it is requested by its share
+// slug.
+func (l *List) VisibleBySlug(user *User) bool {
+	return l.Visibility != ListPrivate || l.OwnedBy(user)
+}
+
+// OwnedBy() reports whether the list belongs to the given user.
+func (l *List) OwnedBy(user *User) bool {
+	return !user.IsAnonymous() && l.UserID == user.ID
+}
+
+// EnsureSlug() gives an unlisted list a random share slug, if it doesn't already have one. The slug is kept if
+// the list's visibility later changes, so that existing share links work again if the list is made unlisted
+// again.
+func (l *List) EnsureSlug() error {
+	if l.Visibility != ListUnlisted || l.Slug != "" {
+		return nil
+	}
+
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	l.Slug = strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+
+	return nil
+}
+
+type ListModel struct {
+	DB *sql.DB
+}
+
+func (m ListModel) Insert(ctx context.Context, list *List) error {
+	stmt := `
+		INSERT INTO lists (user_id, name, description, visibility, slug)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		RETURNING id, created_at, version`
+
+	args := []interface{}{list.UserID, list.Name, list.Description, list.Visibility, list.Slug}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, stmt, args...).Scan(&list.ID, &list.CreatedAt, &list.Version)
+}
+
+func (m ListModel) Get(ctx context.Context, id int64) (*List, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	return m.getWhere(ctx, `l.id = $1`, id)
+}
+
+// GetBySlug() returns the list with the given share slug.
+func (m ListModel) GetBySlug(ctx context.Context, slug string) (*List, error) {
+	return m.getWhere(ctx, `l.slug = $1`, slug)
+}
+
+// getWhere() returns the single list matching the where clause.
+func (m ListModel) getWhere(ctx context.Context, where string, args ...interface{}) (*List, error) {
+	stmt := `
+		SELECT ` + listColumns + `
+		FROM lists l
+		WHERE ` + where
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var list List
+
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(list.scanDest()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &list, nil
+}
+
+// The columns selected for a list, in the order expected by scanDest().
+const listColumns = `l.id, l.user_id, l.created_at, l.name, l.description, l.visibility, coalesce(l.slug, ''),
+	l.view_count, (SELECT count(*) FROM list_entries e WHERE e.list_id = l.id), l.version`
+
+// scanDest() returns the scan destinations for the listColumns.
+func (l *List) scanDest() []interface{} {
+	return []interface{}{
+		&l.ID,
+		&l.UserID,
+		&l.CreatedAt,
+		&l.Name,
+		&l.Description,
+		&l.Visibility,
+		&l.Slug,
+		&l.Views,
+		&l.EntryCount,
+		&l.Version,
+	}
+}
+
+// GetAllForUser() returns a page of the lists created by the given user.
+func (m ListModel) GetAllForUser(ctx context.Context, userID int64, filters Filters) ([]*List, Metadata, error) {
+	return m.getPage(ctx, `l.user_id = $1`, userID, filters)
+}
+
+// GetPublic() returns a page of the public lists.
+func (m ListModel) GetPublic(ctx context.Context, filters Filters) ([]*List, Metadata, error) {
+	return m.getPage(ctx, `l.visibility = $1`, ListPublic, filters)
+}
+
+// GetPublicForUser() returns a page of the public lists created by the given user, which are shown on their
+// profile.
+func (m ListModel) GetPublicForUser(ctx context.Context, userID int64, filters Filters) ([]*List, Metadata, error) {
+	return m.getPage(ctx, `l.user_id = $1 AND l.visibility = '`+ListPublic+`'`, userID, filters)
+}
+
+// getPage() returns a page of the lists matching the where clause, which must use a single $1 placeholder.
+func (m ListModel) getPage(ctx context.Context, where string, arg interface{}, filters Filters) ([]*List, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM lists l
+		WHERE %s
+		ORDER BY %s, l.id ASC
+		LIMIT $2 OFFSET $3`, listColumns, where, filters.orderBy("l."))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, arg, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	lists := []*List{}
+
+	for rows.Next() {
+		var list List
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, list.scanDest()...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		lists = append(lists, &list)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return lists, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// RecordView() increments the list's view count, which is used to rank the public lists by popularity.
+func (m ListModel) RecordView(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE lists SET view_count = view_count + 1 WHERE id = $1`, id)
+	return err
+}
+
+// Update() saves the list's details, using the version number for optimistic locking.
+func (m ListModel) Update(ctx context.Context, list *List) error {
+	stmt := `
+		UPDATE lists
+		SET name = $1, description = $2, visibility = $3, slug = NULLIF($4, ''), version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+
+	args := []interface{}{list.Name, list.Description, list.Visibility, list.Slug, list.ID, list.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&list.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete() removes a list along with all of its entries.
+func (m ListModel) Delete(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM lists WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Entries() returns a page of the movies in a list, in list order.
+//
+// The stored positions are only used as sort keys, and may have gaps (for example after a movie is removed),
+// so the reported positions are calculated with row_number() instead.
+func (m ListModel) Entries(ctx context.Context, listID int64, filters Filters) ([]*ListEntry, Metadata, error) {
+	stmt := `
+		SELECT count(*) OVER(), row_number() OVER (ORDER BY e.position, e.movie_id), e.added_at, coalesce(e.added_by, 0),
+			m.id, m.created_at, m.title, m.year, m.runtime, movie_genre_names(m.id), m.version
+		FROM list_entries e
+		INNER JOIN movies m ON m.id = e.movie_id
+		WHERE e.list_id = $1
+		ORDER BY e.position, e.movie_id
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, listID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*ListEntry{}
+
+	for rows.Next() {
+		var entry ListEntry
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.Position,
+			&entry.AddedAt,
+			&entry.AddedBy,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entry.Movie = &movie
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return entries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// AddEntry() adds a movie to a list at the given 1-based position, moving the movies at and after that position
+// down by one. A position of 0, or past the end of the list, appends the movie. The addedBy user is recorded
+// against the entry.
+func (m ListModel) AddEntry(ctx context.Context, listID, movieID, addedBy int64, position int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order, err := lockListOrder(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range order {
+		if id == movieID {
+			return ErrDuplicateListEntry
+		}
+	}
+
+	if len(order) >= MaxListEntries {
+		return ErrListFull
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO list_entries (list_id, movie_id, position, added_by) VALUES ($1, $2, 0, $3)`, listID, movieID, addedBy)
+	if err != nil {
+		return err
+	}
+
+	if position < 1 || position > len(order) {
+		order = append(order, movieID)
+	} else {
+		order = append(order[:position-1], append([]int64{movieID}, order[position-1:]...)...)
+	}
+
+	err = setListOrder(ctx, tx, listID, order)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveEntry() removes a movie from a list.
+func (m ListModel) RemoveEntry(ctx context.Context, listID, movieID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM list_entries WHERE list_id = $1 AND movie_id = $2`, listID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Reorder() rearranges the movies in a list into the given order. The movie IDs must be exactly the movies
+// currently in the list, or ErrListOrderMismatch is returned.
+func (m ListModel) Reorder(ctx context.Context, listID int64, movieIDs []int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order, err := lockListOrder(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+
+	if len(order) != len(movieIDs) {
+		return ErrListOrderMismatch
+	}
+
+	current := make(map[int64]bool, len(order))
+	for _, id := range order {
+		current[id] = true
+	}
+
+	for _, id := range movieIDs {
+		if !current[id] {
+			return ErrListOrderMismatch
+		}
+		// Remove each ID as it is seen, so that duplicates are caught too.
+		delete(current, id)
+	}
+
+	err = setListOrder(ctx, tx, listID, movieIDs)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockListOrder() locks the list's row for the rest of the transaction, so that concurrent changes to the same
+// list are serialized, and returns the IDs of the movies in the list in order.
+func lockListOrder(ctx context.Context, tx *sql.Tx, listID int64) ([]int64, error) {
+	var id int64
+
+	err := tx.QueryRowContext(ctx, `SELECT id FROM lists WHERE id = $1 FOR UPDATE`, listID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	var order []int64
+
+	err = tx.QueryRowContext(ctx, `
+		SELECT coalesce(array_agg(movie_id ORDER BY position, movie_id), '{}')
+		FROM list_entries
+		WHERE list_id = $1`, listID).Scan(pq.Array(&order))
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// setListOrder() renumbers the list's entries to match the order of the given movie IDs.
+func setListOrder(ctx context.Context, tx *sql.Tx, listID int64, movieIDs []int64) error {
+	stmt := `
+		UPDATE list_entries e
+		SET position = o.position
+		FROM unnest($2::bigint[]) WITH ORDINALITY AS o(movie_id, position)
+		WHERE e.list_id = $1 AND e.movie_id = o.movie_id`
+
+	_, err := tx.ExecContext(ctx, stmt, listID, pq.Array(movieIDs))
+	return err
+}
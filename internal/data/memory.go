@@ -0,0 +1,1162 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/micypac/flick-info/internal/clock"
+)
+
+// memoryStore holds all the data for the in-memory models. Every model returned by NewMemoryModels() shares a
+// single store, so that, for example, a token issued by the token model can be looked up by the user model.
+// Records are copied on the way in and out, so that callers can't change stored data without going through a
+// model, just like with the database.
+type memoryStore struct {
+	mu      sync.Mutex
+	hashing TokenHashing
+	sliding SlidingExpiry
+	clock   clock.Clock
+	grants  Permissions
+
+	movies      map[int64]*Movie
+	lastMovieID int64
+
+	users      map[int64]*memoryUser
+	lastUserID int64
+
+	tokens      []*memoryToken
+	lastTokenID int64
+
+	pats      []*PersonalAccessToken
+	lastPATID int64
+
+	apiKeys      []*APIKey
+	lastAPIKeyID int64
+
+	audit []*AuditEntry
+
+	permissions map[int64]Permissions
+	emails      []memoryEmail
+}
+
+type memoryUser struct {
+	user         User
+	prefs        Preferences
+	pendingEmail string
+}
+
+type memoryToken struct {
+	id         int64
+	token      Token
+	createdAt  time.Time
+	lastUsedAt *time.Time
+}
+
+type memoryEmail struct {
+	userID int64
+	scope  string
+	sentAt time.Time
+}
+
+// NewMemoryModels() returns a Models struct whose movie, user, token, permission and preferences models keep
+// their data in memory instead of PostgreSQL. Nothing is persisted, so the data is lost when the process exits.
+// Every user is granted the permission codes in grants on top of any added with AddForUser(), as there's no way
+// to grant permissions by hand without a database.
+//
+// The remaining models, such as lists and profiles, have no in-memory implementation and mustn't be used.
+func NewMemoryModels(opts ModelOptions, grants ...string) Models {
+	store := &memoryStore{
+		hashing:     opts.Hashing,
+		sliding:     opts.Sliding,
+		clock:       opts.Clock,
+		grants:      grants,
+		movies:      make(map[int64]*Movie),
+		users:       make(map[int64]*memoryUser),
+		permissions: make(map[int64]Permissions),
+	}
+
+	return Models{
+		APIKeys:              memoryAPIKeyModel{store},
+		Audit:                memoryAuditModel{store},
+		EmailThrottles:       memoryEmailThrottleModel{store},
+		Movies:               memoryMovieModel{store},
+		PersonalAccessTokens: memoryPersonalAccessTokenModel{store},
+		Permissions:          memoryPermissionModel{store},
+		Preferences:          memoryPreferencesModel{store},
+		Tokens:               memoryTokenModel{store},
+		UserStates:           memoryUserStateModel{store},
+		Users:                memoryUserModel{store},
+	}
+}
+
+// copyMovie() returns a copy of the movie which doesn't share its genres slice with the original.
+func copyMovie(movie *Movie) *Movie {
+	c := *movie
+	c.Genres = append([]string(nil), movie.Genres...)
+	return &c
+}
+
+// userByEmail() returns the stored user with the email address, ignoring case like the citext column does.
+// The caller must hold the lock.
+func (s *memoryStore) userByEmail(email string) *memoryUser {
+	for _, u := range s.users {
+		if strings.EqualFold(u.user.Email, email) {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// findToken() returns the stored token of the given scope matching the plaintext under any accepted hasher,
+// provided it hasn't expired. The caller must hold the lock.
+func (s *memoryStore) findToken(scope, tokenPlaintext string) (int, *memoryToken) {
+	now := s.clock.Now()
+
+	for _, hash := range s.hashing.candidates(tokenPlaintext) {
+		for i, t := range s.tokens {
+			if t.token.Scope == scope && bytes.Equal(t.token.Hash, hash) && t.token.Expiry.After(now) {
+				return i, t
+			}
+		}
+	}
+
+	return -1, nil
+}
+
+type memoryMovieModel struct {
+	s *memoryStore
+}
+
+// matchesMovie() reports whether the movie matches the title and genre filters in the same way as the SQL
+// queries: every word of the title filter must appear as a word in the title, the movie must have all of the
+// genres, and at least one of anyGenres.
+func matchesMovie(movie *Movie, title string, genres, anyGenres []string) bool {
+	words := func(s string) []string {
+		return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+	}
+
+	titleWords := words(movie.Title)
+
+	for _, word := range words(title) {
+		if !contains(titleWords, word) {
+			return false
+		}
+	}
+
+	for _, genre := range genres {
+		if !contains(movie.Genres, genre) {
+			return false
+		}
+	}
+
+	if len(anyGenres) == 0 {
+		return true
+	}
+
+	for _, genre := range anyGenres {
+		if contains(movie.Genres, genre) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m memoryMovieModel) GetAll(ctx context.Context, title string, genres, anyGenres []string, directorID int64, where *MovieFilter, filters Filters) ([]*Movie, Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	matches := []*Movie{}
+	for _, movie := range m.s.movies {
+		// Nobody is credited in movies kept in memory, so filtering by director matches none of them.
+		if directorID == 0 && matchesMovie(movie, title, genres, anyGenres) && where.Matches(movie) {
+			matches = append(matches, movie)
+		}
+	}
+
+	keys := filters.sortKeys()
+
+	// Sort by the requested columns, then by ID, as the SQL query does.
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+
+		if c := compareMovies(a, b, keys); c != 0 {
+			return c < 0
+		}
+
+		return a.ID < b.ID
+	})
+
+	total := len(matches)
+
+	start := filters.offset()
+	if start > total {
+		start = total
+	}
+	end := start + filters.limit()
+	if end > total {
+		end = total
+	}
+
+	movies := make([]*Movie, 0, end-start)
+	for _, movie := range matches[start:end] {
+		movies = append(movies, copyMovie(movie))
+	}
+
+	return movies, calculateMetadata(total, filters.Page, filters.PageSize), nil
+}
+
+func (m memoryMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if err := m.checkExternalIDs(movie); err != nil {
+		return err
+	}
+
+	m.s.lastMovieID++
+
+	movie.ID = m.s.lastMovieID
+	movie.CreatedAt = m.s.clock.Now()
+	movie.Version = 1
+
+	m.s.movies[movie.ID] = copyMovie(movie)
+
+	return nil
+}
+
+func (m memoryMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	movie, ok := m.s.movies[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyMovie(movie), nil
+}
+
+func (m memoryMovieModel) Update(ctx context.Context, movie *Movie) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.movies[movie.ID]
+	if !ok || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	if err := m.checkExternalIDs(movie); err != nil {
+		return err
+	}
+
+	movie.Version++
+	m.s.movies[movie.ID] = copyMovie(movie)
+
+	return nil
+}
+
+// checkExternalIDs() enforces the uniqueness of the external IDs, like the movies table's constraints. It must
+// be called with the lock held.
+func (m memoryMovieModel) checkExternalIDs(movie *Movie) error {
+	for _, other := range m.s.movies {
+		if other.ID == movie.ID {
+			continue
+		}
+
+		switch {
+		case movie.IMDbID != "" && other.IMDbID == movie.IMDbID:
+			return ErrDuplicateIMDbID
+		case movie.TMDbID != 0 && other.TMDbID == movie.TMDbID:
+			return ErrDuplicateTMDbID
+		}
+	}
+
+	return nil
+}
+
+func (m memoryMovieModel) Delete(ctx context.Context, id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.movies[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	delete(m.s.movies, id)
+
+	return nil
+}
+
+// PossibleDuplicates() applies the same rules as the PostgreSQL implementation, with an approximation of
+// pg_trgm's similarity().
+func (m memoryMovieModel) PossibleDuplicates(ctx context.Context, movie *Movie) ([]*Movie, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	normalized := NormalizeTitle(movie.Title)
+	similarity := make(map[int64]float64)
+	movies := []*Movie{}
+
+	for _, stored := range m.s.movies {
+		if stored.ID == movie.ID || stored.Year != movie.Year {
+			continue
+		}
+
+		s := trigramSimilarity(strings.ToLower(stored.Title), strings.ToLower(movie.Title))
+		if NormalizeTitle(stored.Title) != normalized && s < DuplicateSimilarity {
+			continue
+		}
+
+		similarity[stored.ID] = s
+		movies = append(movies, copyMovie(stored))
+	}
+
+	sort.Slice(movies, func(i, j int) bool {
+		if similarity[movies[i].ID] != similarity[movies[j].ID] {
+			return similarity[movies[i].ID] > similarity[movies[j].ID]
+		}
+		return movies[i].ID < movies[j].ID
+	})
+
+	if len(movies) > 5 {
+		movies = movies[:5]
+	}
+
+	return movies, nil
+}
+
+// Stream() takes a copy of the matching movies up front, so that the lock isn't held while fn runs.
+func (m memoryMovieModel) Stream(ctx context.Context, title string, genres []string, afterID int64, batchSize int, fn func(*Movie) error) error {
+	m.s.mu.Lock()
+
+	movies := []*Movie{}
+	for _, movie := range m.s.movies {
+		if movie.ID > afterID && matchesMovie(movie, title, genres, nil) {
+			movies = append(movies, copyMovie(movie))
+		}
+	}
+
+	m.s.mu.Unlock()
+
+	sort.Slice(movies, func(i, j int) bool { return movies[i].ID < movies[j].ID })
+
+	for _, movie := range movies {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := fn(movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type memoryUserModel struct {
+	s *memoryStore
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if m.s.userByEmail(user.Email) != nil {
+		return ErrDuplicateEmail
+	}
+
+	m.s.lastUserID++
+
+	user.ID = m.s.lastUserID
+	user.CreatedAt = m.s.clock.Now()
+	user.Version = 1
+
+	m.s.users[user.ID] = &memoryUser{
+		user:  *user,
+		prefs: Preferences{FavoriteGenres: []string{}, PreferredLanguages: []string{}},
+	}
+
+	return nil
+}
+
+func (m memoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	u, ok := m.s.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	user := u.user
+	return &user, nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	u := m.s.userByEmail(email)
+	if u == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	user := u.user
+	return &user, nil
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	u, ok := m.s.users[user.ID]
+	if !ok || u.user.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	if other := m.s.userByEmail(user.Email); other != nil && other != u {
+		return ErrDuplicateEmail
+	}
+
+	user.Version++
+	u.user = *user
+
+	return nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	_, t := m.s.findToken(tokenScope, tokenPlaintext)
+	if t == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	u, ok := m.s.users[t.token.UserID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	if tokenScope == ScopeAuthentication {
+		now := m.s.clock.Now()
+		t.lastUsedAt = &now
+
+		if m.s.sliding.Enabled {
+			newExpiry, ok := m.s.sliding.next(now, t.token.Expiry, t.createdAt)
+			if ok {
+				t.token.Expiry = newExpiry
+			}
+		}
+	}
+
+	user := u.user
+	return &user, nil
+}
+
+func (m memoryUserModel) Activate(ctx context.Context, tokenPlaintext string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	_, t := m.s.findToken(ScopeActivation, tokenPlaintext)
+	if t == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	u, ok := m.s.users[t.token.UserID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	u.user.Activated = true
+	u.user.Version++
+
+	// Delete the redeemed token along with any other outstanding activation tokens for the user.
+	m.s.deleteTokens(func(t *memoryToken) bool {
+		return t.token.Scope == ScopeActivation && t.token.UserID == u.user.ID
+	})
+
+	user := u.user
+	return &user, nil
+}
+
+func (m memoryUserModel) RequestEmailChange(ctx context.Context, user *User, email string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	u, ok := m.s.users[user.ID]
+	if !ok || u.user.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	if other := m.s.userByEmail(email); other != nil && other != u {
+		return ErrDuplicateEmail
+	}
+
+	user.Version++
+	u.user = *user
+	u.pendingEmail = email
+
+	return nil
+}
+
+func (m memoryUserModel) ConfirmEmailChange(ctx context.Context, tokenPlaintext string) (*User, string, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	_, t := m.s.findToken(ScopeEmailChange, tokenPlaintext)
+	if t == nil {
+		return nil, "", ErrRecordNotFound
+	}
+
+	u, ok := m.s.users[t.token.UserID]
+	if !ok || u.pendingEmail == "" {
+		return nil, "", ErrRecordNotFound
+	}
+
+	if other := m.s.userByEmail(u.pendingEmail); other != nil && other != u {
+		return nil, "", ErrDuplicateEmail
+	}
+
+	oldEmail := u.user.Email
+	u.user.Email = u.pendingEmail
+	u.user.Version++
+	u.pendingEmail = ""
+
+	m.s.deleteTokens(func(t *memoryToken) bool {
+		return t.token.Scope == ScopeEmailChange && t.token.UserID == u.user.ID
+	})
+
+	user := u.user
+	return &user, oldEmail, nil
+}
+
+func (m memoryUserModel) ResetPassword(ctx context.Context, tokenPlaintext, plaintextPassword string) (*User, error) {
+	var pw password
+
+	err := pw.Set(plaintextPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	_, t := m.s.findToken(ScopePasswordReset, tokenPlaintext)
+	if t == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	u, ok := m.s.users[t.token.UserID]
+	if !ok || !u.user.Activated {
+		return nil, ErrRecordNotFound
+	}
+
+	u.user.Password = pw
+	u.user.Version++
+
+	// Delete the redeemed token along with the user's other password reset tokens, and log out their sessions,
+	// including any refresh tokens.
+	m.s.deleteTokens(func(t *memoryToken) bool {
+		return (t.token.Scope == ScopePasswordReset || t.token.Scope == ScopeAuthentication || t.token.Scope == ScopeRefresh) && t.token.UserID == u.user.ID
+	})
+
+	user := u.user
+	return &user, nil
+}
+
+// deleteTokens() removes every stored token for which match returns true, and returns the number removed.
+// The caller must hold the lock.
+func (s *memoryStore) deleteTokens(match func(*memoryToken) bool) int64 {
+	kept := s.tokens[:0]
+
+	for _, t := range s.tokens {
+		if !match(t) {
+			kept = append(kept, t)
+		}
+	}
+
+	deleted := int64(len(s.tokens) - len(kept))
+	s.tokens = kept
+
+	return deleted
+}
+
+// storeToken() saves a copy of the token, without its plaintext, with the next ID. The caller must hold the lock.
+func (s *memoryStore) storeToken(token *Token, createdAt time.Time) {
+	stored := *token
+	stored.Plaintext = ""
+
+	s.lastTokenID++
+	s.tokens = append(s.tokens, &memoryToken{id: s.lastTokenID, token: stored, createdAt: createdAt})
+}
+
+type memoryTokenModel struct {
+	s *memoryStore
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string, metadata TokenMetadata) (*Token, error) {
+	token, err := generateToken(userID, m.s.clock.Now().Add(ttl), scope, m.s.hashing.current(), metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.storeToken(token, m.s.clock.Now())
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.deleteTokens(func(t *memoryToken) bool {
+		return t.token.Scope == scope && t.token.UserID == userID
+	})
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteByHash(ctx context.Context, scope, tokenPlaintext string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	_, t := m.s.findToken(scope, tokenPlaintext)
+	if t != nil {
+		m.s.deleteTokens(func(other *memoryToken) bool { return other == t })
+	}
+
+	return nil
+}
+
+func (m memoryTokenModel) GetSessionsForUser(ctx context.Context, userID int64, currentPlaintext string) ([]*Session, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	_, current := m.s.findToken(ScopeAuthentication, currentPlaintext)
+	now := m.s.clock.Now()
+
+	sessions := []*Session{}
+
+	// Tokens are stored in the order they were created, so walk backwards to return the newest first.
+	for i := len(m.s.tokens) - 1; i >= 0; i-- {
+		t := m.s.tokens[i]
+		if t.token.Scope != ScopeAuthentication || t.token.UserID != userID || !t.token.Expiry.After(now) {
+			continue
+		}
+
+		session := &Session{
+			ID:            t.id,
+			CreatedAt:     t.createdAt,
+			Expiry:        t.token.Expiry,
+			TokenMetadata: t.token.Metadata,
+			Current:       t == current,
+		}
+		if t.lastUsedAt != nil {
+			lastUsedAt := *t.lastUsedAt
+			session.LastUsedAt = &lastUsedAt
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func (m memoryTokenModel) DeleteSession(ctx context.Context, id, userID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	deleted := m.s.deleteTokens(func(t *memoryToken) bool {
+		return t.id == id && t.token.UserID == userID && t.token.Scope == ScopeAuthentication
+	})
+	if deleted == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m memoryTokenModel) IsKnownDevice(ctx context.Context, scope string, userID int64, metadata TokenMetadata) (bool, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var total, matching int
+
+	for _, t := range m.s.tokens {
+		if t.token.Scope != scope || t.token.UserID != userID {
+			continue
+		}
+
+		total++
+
+		if t.token.Metadata.ClientIP == metadata.ClientIP || t.token.Metadata.UserAgent == metadata.UserAgent {
+			matching++
+		}
+	}
+
+	return total == 0 || matching > 0, nil
+}
+
+// DeleteExpired() deletes all the expired tokens at once. There are no locks on other rows to worry about, so
+// the batch size is ignored.
+func (m memoryTokenModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	now := m.s.clock.Now()
+
+	return m.s.deleteTokens(func(t *memoryToken) bool {
+		return t.token.Expiry.Before(now)
+	}), nil
+}
+
+func (m memoryTokenModel) Refresh(ctx context.Context, refreshPlaintext string, authTTL, refreshTTL time.Duration, metadata TokenMetadata) (*Token, *Token, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	_, t := m.s.findToken(ScopeRefresh, refreshPlaintext)
+	if t == nil {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	m.s.deleteTokens(func(other *memoryToken) bool { return other == t })
+
+	userID := t.token.UserID
+	metadata.DeviceName = t.token.Metadata.DeviceName
+	now := m.s.clock.Now()
+
+	authToken, err := generateToken(userID, now.Add(authTTL), ScopeAuthentication, m.s.hashing.current(), metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := generateToken(userID, now.Add(refreshTTL), ScopeRefresh, m.s.hashing.current(), metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, token := range []*Token{authToken, refreshToken} {
+		m.s.storeToken(token, now)
+	}
+
+	return authToken, refreshToken, nil
+}
+
+type memoryPermissionModel struct {
+	s *memoryStore
+}
+
+func (m memoryPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var permissions Permissions
+
+	for _, code := range append(m.s.permissions[userID], m.s.grants...) {
+		if !permissions.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions, nil
+}
+
+func (m memoryPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, code := range codes {
+		if !m.s.permissions[userID].Include(code) {
+			m.s.permissions[userID] = append(m.s.permissions[userID], code)
+		}
+	}
+
+	return nil
+}
+
+func (m memoryPermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var kept Permissions
+
+	for _, code := range m.s.permissions[userID] {
+		if !Permissions(codes).Include(code) {
+			kept = append(kept, code)
+		}
+	}
+
+	m.s.permissions[userID] = kept
+
+	return nil
+}
+
+// GetAll() returns the codes granted to every user, and any added to a user, as there is no permissions table.
+func (m memoryPermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	permissions := append(Permissions(nil), m.s.grants...)
+
+	for _, codes := range m.s.permissions {
+		for _, code := range codes {
+			if !permissions.Include(code) {
+				permissions = append(permissions, code)
+			}
+		}
+	}
+
+	sort.Strings(permissions)
+
+	return permissions, nil
+}
+
+type memoryPersonalAccessTokenModel struct {
+	s *memoryStore
+}
+
+// copyPersonalAccessToken() returns a copy of the token without its plaintext, which is never stored.
+func copyPersonalAccessToken(token *PersonalAccessToken) *PersonalAccessToken {
+	c := *token
+	c.Plaintext = ""
+	c.Permissions = append(Permissions(nil), token.Permissions...)
+	return &c
+}
+
+func (m memoryPersonalAccessTokenModel) New(ctx context.Context, userID int64, name string, permissions Permissions, expiry *time.Time) (*PersonalAccessToken, error) {
+	token, err := generatePersonalAccessToken(userID, name, permissions, expiry, m.s.hashing.current())
+	if err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.lastPATID++
+
+	token.ID = m.s.lastPATID
+	token.CreatedAt = m.s.clock.Now()
+
+	m.s.pats = append(m.s.pats, copyPersonalAccessToken(token))
+
+	return token, nil
+}
+
+func (m memoryPersonalAccessTokenModel) GetAllForUser(ctx context.Context, userID int64) ([]*PersonalAccessToken, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	tokens := []*PersonalAccessToken{}
+
+	// Tokens are stored in the order they were created, so walk backwards to return the newest first.
+	for i := len(m.s.pats) - 1; i >= 0; i-- {
+		if m.s.pats[i].UserID == userID {
+			tokens = append(tokens, copyPersonalAccessToken(m.s.pats[i]))
+		}
+	}
+
+	return tokens, nil
+}
+
+func (m memoryPersonalAccessTokenModel) GetUserForToken(ctx context.Context, tokenPlaintext string) (*User, *PersonalAccessToken, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	now := m.s.clock.Now()
+
+	for _, hash := range m.s.hashing.candidates(tokenPlaintext) {
+		for _, token := range m.s.pats {
+			if !bytes.Equal(token.Hash, hash) || (token.Expiry != nil && !token.Expiry.After(now)) {
+				continue
+			}
+
+			u, ok := m.s.users[token.UserID]
+			if !ok {
+				return nil, nil, ErrRecordNotFound
+			}
+
+			user := u.user
+			return &user, copyPersonalAccessToken(token), nil
+		}
+	}
+
+	return nil, nil, ErrRecordNotFound
+}
+
+func (m memoryPersonalAccessTokenModel) Delete(ctx context.Context, id, userID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for i, token := range m.s.pats {
+		if token.ID == id && token.UserID == userID {
+			m.s.pats = append(m.s.pats[:i], m.s.pats[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrRecordNotFound
+}
+
+type memoryAPIKeyModel struct {
+	s *memoryStore
+}
+
+// copyAPIKey() returns a copy of the key without its plaintext, which is never stored.
+func copyAPIKey(key *APIKey) *APIKey {
+	c := *key
+	c.Plaintext = ""
+	c.Permissions = append(Permissions(nil), key.Permissions...)
+	if key.LastUsedAt != nil {
+		lastUsedAt := *key.LastUsedAt
+		c.LastUsedAt = &lastUsedAt
+	}
+	return &c
+}
+
+func (m memoryAPIKeyModel) New(ctx context.Context, userID int64, name string, permissions Permissions) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, permissions, m.s.hashing.current())
+	if err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.lastAPIKeyID++
+
+	key.ID = m.s.lastAPIKeyID
+	key.CreatedAt = m.s.clock.Now()
+
+	m.s.apiKeys = append(m.s.apiKeys, copyAPIKey(key))
+
+	return key, nil
+}
+
+func (m memoryAPIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	keys := []*APIKey{}
+
+	// Keys are stored in the order they were created, so walk backwards to return the newest first.
+	for i := len(m.s.apiKeys) - 1; i >= 0; i-- {
+		if m.s.apiKeys[i].UserID == userID {
+			keys = append(keys, copyAPIKey(m.s.apiKeys[i]))
+		}
+	}
+
+	return keys, nil
+}
+
+func (m memoryAPIKeyModel) GetUserForKey(ctx context.Context, keyPlaintext string) (*User, *APIKey, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	prefix := apiKeyLookupPrefix(keyPlaintext)
+
+	for _, key := range m.s.apiKeys {
+		if key.Prefix != prefix {
+			continue
+		}
+
+		hasher := m.s.hashing.hasher(key.HashVersion)
+		if hasher == nil || !VerifyTokenHash(hasher, keyPlaintext, key.Hash) {
+			return nil, nil, ErrRecordNotFound
+		}
+
+		u, ok := m.s.users[key.UserID]
+		if !ok {
+			return nil, nil, ErrRecordNotFound
+		}
+
+		now := m.s.clock.Now()
+		key.LastUsedAt = &now
+
+		user := u.user
+		return &user, copyAPIKey(key), nil
+	}
+
+	return nil, nil, ErrRecordNotFound
+}
+
+func (m memoryAPIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for i, key := range m.s.apiKeys {
+		if key.ID == id && key.UserID == userID {
+			m.s.apiKeys = append(m.s.apiKeys[:i], m.s.apiKeys[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrRecordNotFound
+}
+
+type memoryAuditModel struct {
+	s *memoryStore
+}
+
+func (m memoryAuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	entry.ID = int64(len(m.s.audit)) + 1
+	entry.CreatedAt = m.s.clock.Now()
+
+	c := *entry
+	c.Changes = append([]AuditChange(nil), entry.Changes...)
+	m.s.audit = append(m.s.audit, &c)
+
+	return nil
+}
+
+// GetAll() returns a page of the matching entries. Entries are never removed, so their order by ID is also their
+// order by time, whichever the sort column.
+func (m memoryAuditModel) GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEntry, Metadata, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	matches := []*AuditEntry{}
+	for _, entry := range m.s.audit {
+		switch {
+		case filter.Entity != "" && entry.Entity != filter.Entity,
+			filter.EntityID != 0 && entry.EntityID != filter.EntityID,
+			filter.UserID != 0 && (entry.UserID == nil || *entry.UserID != filter.UserID),
+			filter.Action != "" && entry.Action != filter.Action:
+			continue
+		}
+
+		c := *entry
+		matches = append(matches, &c)
+	}
+
+	if filters.sortDirection() == "DESC" {
+		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+			matches[i], matches[j] = matches[j], matches[i]
+		}
+	}
+
+	total := len(matches)
+	start := min(filters.offset(), total)
+	end := min(start+filters.limit(), total)
+
+	return matches[start:end], calculateMetadata(total, filters.Page, filters.PageSize), nil
+}
+
+type memoryEmailThrottleModel struct {
+	s *memoryStore
+}
+
+func (m memoryEmailThrottleModel) Allow(ctx context.Context, userID int64, scope string, limit int, window time.Duration) (bool, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	now := m.s.clock.Now()
+	since := now.Add(-window)
+
+	// Drop the sends which have fallen outside the window, and count the user's remaining ones of this scope.
+	kept := m.s.emails[:0]
+	sent := 0
+
+	for _, e := range m.s.emails {
+		if !e.sentAt.After(since) {
+			continue
+		}
+
+		kept = append(kept, e)
+
+		if e.userID == userID && e.scope == scope {
+			sent++
+		}
+	}
+
+	m.s.emails = kept
+
+	if sent >= limit {
+		return false, nil
+	}
+
+	m.s.emails = append(m.s.emails, memoryEmail{userID: userID, scope: scope, sentAt: now})
+
+	return true, nil
+}
+
+type memoryUserStateModel struct {
+	s *memoryStore
+}
+
+// Attach() gives every movie an empty state, since watch history, watchlists and ratings aren't kept in memory.
+func (m memoryUserStateModel) Attach(ctx context.Context, userID int64, movies ...*Movie) error {
+	for _, movie := range movies {
+		movie.UserState = &UserState{}
+	}
+
+	return nil
+}
+
+type memoryPreferencesModel struct {
+	s *memoryStore
+}
+
+func (m memoryPreferencesModel) Get(ctx context.Context, userID int64) (*Preferences, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	u, ok := m.s.users[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	prefs := u.prefs
+	prefs.FavoriteGenres = append([]string{}, u.prefs.FavoriteGenres...)
+	prefs.PreferredLanguages = append([]string{}, u.prefs.PreferredLanguages...)
+
+	return &prefs, nil
+}
+
+func (m memoryPreferencesModel) Update(ctx context.Context, userID int64, prefs *Preferences) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	u, ok := m.s.users[userID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	u.prefs = *prefs
+	u.prefs.FavoriteGenres = append([]string{}, prefs.FavoriteGenres...)
+	u.prefs.PreferredLanguages = append([]string{}, prefs.PreferredLanguages...)
+	u.user.Version++
+
+	return nil
+}
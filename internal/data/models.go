@@ -1,8 +1,12 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/micypac/flick-info/internal/clock"
 )
 
 var (
@@ -10,18 +14,167 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// The models needed to register, log in and work with movies are declared as interfaces, so that they can be
+// backed either by PostgreSQL or by the in-memory implementations returned by NewMemoryModels().
+type (
+	MovieStore interface {
+		GetAll(ctx context.Context, title string, genres, anyGenres []string, directorID int64, where *MovieFilter, filters Filters) ([]*Movie, Metadata, error)
+		Insert(ctx context.Context, movie *Movie) error
+		Get(ctx context.Context, id int64) (*Movie, error)
+		Update(ctx context.Context, movie *Movie) error
+		Delete(ctx context.Context, id int64) error
+		PossibleDuplicates(ctx context.Context, movie *Movie) ([]*Movie, error)
+		Stream(ctx context.Context, title string, genres []string, afterID int64, batchSize int, fn func(*Movie) error) error
+		Search(ctx context.Context, query string, filters Filters) ([]*MovieSearchResult, Metadata, error)
+	}
+
+	UserStore interface {
+		Insert(ctx context.Context, user *User) error
+		Get(ctx context.Context, id int64) (*User, error)
+		GetByEmail(ctx context.Context, email string) (*User, error)
+		Update(ctx context.Context, user *User) error
+		GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+		Activate(ctx context.Context, tokenPlaintext string) (*User, error)
+		ResetPassword(ctx context.Context, tokenPlaintext, plaintextPassword string) (*User, error)
+		RequestEmailChange(ctx context.Context, user *User, email string) error
+		ConfirmEmailChange(ctx context.Context, tokenPlaintext string) (*User, string, error)
+	}
+
+	TokenStore interface {
+		New(ctx context.Context, userID int64, ttl time.Duration, scope string, metadata TokenMetadata) (*Token, error)
+		Insert(ctx context.Context, token *Token) error
+		DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+		DeleteByHash(ctx context.Context, scope, tokenPlaintext string) error
+		GetSessionsForUser(ctx context.Context, userID int64, currentPlaintext string) ([]*Session, error)
+		DeleteSession(ctx context.Context, id, userID int64) error
+		IsKnownDevice(ctx context.Context, scope string, userID int64, metadata TokenMetadata) (bool, error)
+		DeleteExpired(ctx context.Context, batchSize int) (int64, error)
+		Refresh(ctx context.Context, refreshPlaintext string, authTTL, refreshTTL time.Duration, metadata TokenMetadata) (*Token, *Token, error)
+	}
+
+	PermissionStore interface {
+		GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+		AddForUser(ctx context.Context, userID int64, codes ...string) error
+		RemoveForUser(ctx context.Context, userID int64, codes ...string) error
+		GetAll(ctx context.Context) (Permissions, error)
+	}
+
+	PersonalAccessTokenStore interface {
+		New(ctx context.Context, userID int64, name string, permissions Permissions, expiry *time.Time) (*PersonalAccessToken, error)
+		GetAllForUser(ctx context.Context, userID int64) ([]*PersonalAccessToken, error)
+		GetUserForToken(ctx context.Context, tokenPlaintext string) (*User, *PersonalAccessToken, error)
+		Delete(ctx context.Context, id, userID int64) error
+	}
+
+	APIKeyStore interface {
+		New(ctx context.Context, userID int64, name string, permissions Permissions) (*APIKey, error)
+		GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error)
+		GetUserForKey(ctx context.Context, keyPlaintext string) (*User, *APIKey, error)
+		Delete(ctx context.Context, id, userID int64) error
+	}
+
+	AuditStore interface {
+		Insert(ctx context.Context, entry *AuditEntry) error
+		GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEntry, Metadata, error)
+	}
+
+	EmailThrottleStore interface {
+		Allow(ctx context.Context, userID int64, scope string, limit int, window time.Duration) (bool, error)
+	}
+
+	UserStateStore interface {
+		Attach(ctx context.Context, userID int64, movies ...*Movie) error
+	}
+
+	PreferencesStore interface {
+		Get(ctx context.Context, userID int64) (*Preferences, error)
+		Update(ctx context.Context, userID int64, prefs *Preferences) error
+	}
+)
+
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	AdminUsers           AdminUserModel
+	Analytics            AnalyticsModel
+	APIKeys              APIKeyStore
+	Audit                AuditStore
+	Crew                 CrewModel
+	Digests              DigestModel
+	Duplicates           DuplicateModel
+	EmailOutbox          EmailOutboxModel
+	EmailThrottles       EmailThrottleStore
+	Erasures             ErasureModel
+	Genres               GenreModel
+	Imports              ImportModel
+	ListMembers          ListMemberModel
+	Lists                ListModel
+	MovieIncludes        MovieIncludeModel
+	Movies               MovieStore
+	Notifications        NotificationModel
+	People               PeopleModel
+	PersonalAccessTokens PersonalAccessTokenStore
+	Permissions          PermissionStore
+	Preferences          PreferencesStore
+	Profiles             ProfileModel
+	Ratings              RatingModel
+	Reviews              ReviewModel
+	SavedSearches        SavedSearchModel
+	Tokens               TokenStore
+	UserStates           UserStateStore
+	Users                UserStore
+	Watchlist            WatchlistModel
+}
+
+// ModelOptions holds the settings shared by the models which deal with tokens. The token hashing settings are
+// needed to look up tokens by their hash, and the clock decides whether tokens have expired. Replica, if not nil,
+// is a read replica which some read-heavy queries use. Shards, if not empty, are further databases holding
+// ranges of movie IDs above those in the main database, in ascending order; see ShardedMovieModel.
+type ModelOptions struct {
+	Hashing TokenHashing
+	Sliding SlidingExpiry
+	Clock   clock.Clock
+	Replica *Replica
+	Shards  []Shard
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels() returns a Models struct containing the initialized models, all backed by the db connection pool.
+func NewModels(db *sql.DB, opts ModelOptions) Models {
+	var movies MovieStore = MovieModel{DB: db, Replica: opts.Replica}
+
+	// With shards, the main database holds the movies with IDs below the first shard's.
+	if len(opts.Shards) > 0 {
+		main := Shard{DB: db, Replica: opts.Replica, MinID: 1, MaxID: opts.Shards[0].MinID - 1}
+		movies = ShardedMovieModel{Shards: append([]Shard{main}, opts.Shards...)}
+	}
+
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		AdminUsers:           AdminUserModel{DB: db},
+		Analytics:            AnalyticsModel{DB: db},
+		APIKeys:              APIKeyModel{DB: db, Hashing: opts.Hashing, Clock: opts.Clock},
+		Audit:                AuditModel{DB: db},
+		Crew:                 CrewModel{DB: db},
+		Digests:              DigestModel{DB: db},
+		Duplicates:           DuplicateModel{DB: db},
+		EmailOutbox:          EmailOutboxModel{DB: db},
+		EmailThrottles:       EmailThrottleModel{DB: db},
+		Erasures:             ErasureModel{DB: db},
+		Genres:               GenreModel{DB: db},
+		Imports:              ImportModel{DB: db},
+		ListMembers:          ListMemberModel{DB: db},
+		Lists:                ListModel{DB: db},
+		MovieIncludes:        MovieIncludeModel{DB: db},
+		Movies:               movies,
+		Notifications:        NotificationModel{DB: db},
+		People:               PeopleModel{DB: db},
+		PersonalAccessTokens: PersonalAccessTokenModel{DB: db, Hashing: opts.Hashing, Clock: opts.Clock},
+		Permissions:          PermissionModel{DB: db},
+		Preferences:          PreferencesModel{DB: db},
+		Profiles:             ProfileModel{DB: db},
+		Ratings:              RatingModel{DB: db},
+		Reviews:              ReviewModel{DB: db},
+		SavedSearches:        SavedSearchModel{DB: db},
+		Tokens:               TokenModel{DB: db, Hashing: opts.Hashing, Clock: opts.Clock},
+		UserStates:           UserStateModel{DB: db},
+		Users:                UserModel{DB: db, Hashing: opts.Hashing, Sliding: opts.Sliding, Clock: opts.Clock},
+		Watchlist:            WatchlistModel{DB: db},
 	}
 }
@@ -0,0 +1,302 @@
+package data
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/micypac/flick-info/internal/clock"
+)
+
+// MovieCache holds the results cached by a CachedMovieStore, under keys made by MovieCacheKey() for a movie and
+// starting with MovieCacheListPrefix for a page of a list. MemoryMovieCache keeps them in the process, and a
+// shared cache, such as one in Redis, lets every instance of the API see the others' results and invalidations.
+type MovieCache interface {
+	// Get() returns the unexpired result cached under the key, and false if there isn't one.
+	Get(ctx context.Context, key string) (*CachedMovies, bool, error)
+	Set(ctx context.Context, key string, value *CachedMovies) error
+
+	// Invalidate() removes the movies with the IDs, and every page of every list.
+	Invalidate(ctx context.Context, ids ...int64) error
+}
+
+// MovieInvalidator is told about changes to movies made without going through the MovieStore, such as by the
+// DuplicateModel, GenreModel and RatingModel, so that it can drop any cached copies of them.
+type MovieInvalidator interface {
+	InvalidateMovies(ctx context.Context, ids ...int64)
+}
+
+// invalidateMovies() tells the invalidator, if there is one, that the movies with the IDs have changed.
+func invalidateMovies(ctx context.Context, invalidator MovieInvalidator, ids ...int64) {
+	if invalidator != nil && len(ids) > 0 {
+		invalidator.InvalidateMovies(ctx, ids...)
+	}
+}
+
+// CachedMovies is a cached result: either a single movie, or a page of a list with its metadata.
+type CachedMovies struct {
+	Movie    *Movie
+	Movies   []*Movie
+	Metadata Metadata
+}
+
+// MovieCacheListPrefix starts the keys of the cached pages of lists.
+const MovieCacheListPrefix = "list:"
+
+// MovieCacheKey() returns the key of the movie with the ID.
+func MovieCacheKey(id int64) string {
+	return "movie:" + strconv.FormatInt(id, 10)
+}
+
+// CachedMovieStore is a read-through cache in front of another MovieStore, holding the results of Get() and
+// GetAll() in its MovieCache. Any Insert(), Update() or Delete() made through it removes the changed movie and
+// every cached list, as the change may affect any of them.
+//
+// Genre changes, movie merges and ratings, which change a movie's average rating, are made by other models. They
+// invalidate the movies they change through InvalidateMovies(), once they are given the store as their Cache.
+// Changes made by another instance of the API with its own MemoryMovieCache are only seen once the cached results
+// expire, so the cache's TTL bounds how stale a read can be. A movie updated elsewhere can't be overwritten with a
+// stale copy, as Update() checks the version, and the stale copy is dropped when it fails with ErrEditConflict.
+//
+// The cache is best effort: a failure to read or write it is counted, and the store is used as if the result
+// wasn't cached. Callers get copies of the cached movies, which they can change, as the handlers do when they add
+// poster URLs and the user's state, without affecting the cache. The other methods aren't cached.
+type CachedMovieStore struct {
+	MovieStore
+	Cache MovieCache
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	errors atomic.Int64
+}
+
+// MovieCacheStats counts the cache's lookups since it was created, for the movie_cache expvar variable.
+type MovieCacheStats struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	Errors  int64   `json:"errors"`
+}
+
+// NewCachedMovieStore() returns a store which caches the results of the store in the cache.
+func NewCachedMovieStore(store MovieStore, cache MovieCache) *CachedMovieStore {
+	return &CachedMovieStore{MovieStore: store, Cache: cache}
+}
+
+// Stats() returns the numbers of hits and misses, the fraction of lookups which were hits, and the number of
+// failed cache reads and writes.
+func (c *CachedMovieStore) Stats() MovieCacheStats {
+	stats := MovieCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Errors: c.errors.Load()}
+
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+
+	return stats
+}
+
+// lookup() returns the result cached under the key, counting the hit or miss. A failed read is a miss.
+func (c *CachedMovieStore) lookup(ctx context.Context, key string) (*CachedMovies, bool) {
+	value, ok, err := c.Cache.Get(ctx, key)
+	if err != nil {
+		c.errors.Add(1)
+	}
+
+	if err != nil || !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	return value, true
+}
+
+func (c *CachedMovieStore) store(ctx context.Context, key string, value *CachedMovies) {
+	if err := c.Cache.Set(ctx, key, value); err != nil {
+		c.errors.Add(1)
+	}
+}
+
+// InvalidateMovies() removes the movies with the IDs, and every cached list. A failure is counted as an error.
+func (c *CachedMovieStore) InvalidateMovies(ctx context.Context, ids ...int64) {
+	if err := c.Cache.Invalidate(ctx, ids...); err != nil {
+		c.errors.Add(1)
+	}
+}
+
+// copyMovies() returns copies of the movies, from copyMovie().
+func copyMovies(movies []*Movie) []*Movie {
+	copies := make([]*Movie, len(movies))
+	for i, movie := range movies {
+		copies[i] = copyMovie(movie)
+	}
+	return copies
+}
+
+func (c *CachedMovieStore) Get(ctx context.Context, id int64) (*Movie, error) {
+	key := MovieCacheKey(id)
+
+	if value, ok := c.lookup(ctx, key); ok && value.Movie != nil {
+		return copyMovie(value.Movie), nil
+	}
+
+	movie, err := c.MovieStore.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store(ctx, key, &CachedMovies{Movie: copyMovie(movie)})
+
+	return movie, nil
+}
+
+func (c *CachedMovieStore) GetAll(ctx context.Context, title string, genres, anyGenres []string, directorID int64, where *MovieFilter, filters Filters) ([]*Movie, Metadata, error) {
+	condition, args := where.SQL(0)
+
+	// The filter's condition and arguments identify it, whichever way it was written.
+	js, err := json.Marshal([]interface{}{
+		title, genres, anyGenres, directorID, condition, args, filters.Page, filters.PageSize, filters.Sort,
+	})
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	key := MovieCacheListPrefix + string(js)
+
+	if value, ok := c.lookup(ctx, key); ok {
+		return copyMovies(value.Movies), value.Metadata, nil
+	}
+
+	movies, metadata, err := c.MovieStore.GetAll(ctx, title, genres, anyGenres, directorID, where, filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	c.store(ctx, key, &CachedMovies{Movies: copyMovies(movies), Metadata: metadata})
+
+	return movies, metadata, nil
+}
+
+func (c *CachedMovieStore) Insert(ctx context.Context, movie *Movie) error {
+	err := c.MovieStore.Insert(ctx, movie)
+	if err == nil {
+		c.InvalidateMovies(ctx, movie.ID)
+	}
+
+	return err
+}
+
+func (c *CachedMovieStore) Update(ctx context.Context, movie *Movie) error {
+	err := c.MovieStore.Update(ctx, movie)
+	if err == nil || errors.Is(err, ErrEditConflict) {
+		c.InvalidateMovies(ctx, movie.ID)
+	}
+
+	return err
+}
+
+func (c *CachedMovieStore) Delete(ctx context.Context, id int64) error {
+	err := c.MovieStore.Delete(ctx, id)
+	if err == nil || errors.Is(err, ErrRecordNotFound) {
+		c.InvalidateMovies(ctx, id)
+	}
+
+	return err
+}
+
+// MemoryMovieCache is a MovieCache in the process's memory, holding each result for up to TTL, and only the
+// MaxEntries most recently used of them. Each instance of the API has its own, so it only sees the changes made
+// through that instance before the results expire.
+type MemoryMovieCache struct {
+	TTL        time.Duration
+	MaxEntries int
+	Clock      clock.Clock
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	recency *list.List // Of *memoryMovieCacheEntry, most recently used first.
+}
+
+type memoryMovieCacheEntry struct {
+	key     string
+	expires time.Time
+	value   *CachedMovies
+}
+
+// NewMemoryMovieCache() returns an empty cache.
+func NewMemoryMovieCache(ttl time.Duration, maxEntries int, clk clock.Clock) *MemoryMovieCache {
+	return &MemoryMovieCache{
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		Clock:      clk,
+		entries:    make(map[string]*list.Element),
+		recency:    list.New(),
+	}
+}
+
+func (c *MemoryMovieCache) Get(ctx context.Context, key string) (*CachedMovies, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	entry := elem.Value.(*memoryMovieCacheEntry)
+
+	if !c.Clock.Now().Before(entry.expires) {
+		c.recency.Remove(elem)
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+
+	c.recency.MoveToFront(elem)
+
+	return entry.value, true, nil
+}
+
+// Set() caches the value, evicting the least recently used entries beyond MaxEntries.
+func (c *MemoryMovieCache) Set(ctx context.Context, key string, value *CachedMovies) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.recency.Remove(elem)
+	}
+
+	c.entries[key] = c.recency.PushFront(&memoryMovieCacheEntry{key: key, expires: c.Clock.Now().Add(c.TTL), value: value})
+
+	for c.recency.Len() > c.MaxEntries {
+		oldest := c.recency.Back()
+		c.recency.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryMovieCacheEntry).key)
+	}
+
+	return nil
+}
+
+func (c *MemoryMovieCache) Invalidate(ctx context.Context, ids ...int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	movieKeys := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		movieKeys[MovieCacheKey(id)] = true
+	}
+
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, MovieCacheListPrefix) || movieKeys[key] {
+			c.recency.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/micypac/flick-info/internal/clock"
+)
+
+func TestCachedMovieStoreInvalidateMovies(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemoryModels(ModelOptions{Clock: clock.Real{}}).Movies
+	cached := NewCachedMovieStore(store, NewMemoryMovieCache(time.Hour, 100, clock.Real{}))
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{}}
+
+	err := cached.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the movie and a list holding it, then change it behind the cache's back, as the other models do.
+	_, err = cached.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = cached.GetAll(ctx, "", nil, nil, 0, nil, Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := copyMovie(movie)
+	changed.Title = "Moana 2"
+
+	err = store.Update(ctx, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cached.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Moana" {
+		t.Fatalf("got title %q before invalidating; want the cached %q", got.Title, "Moana")
+	}
+
+	cached.InvalidateMovies(ctx, movie.ID)
+
+	got, err = cached.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Moana 2" {
+		t.Errorf("got title %q after invalidating; want %q", got.Title, "Moana 2")
+	}
+
+	movies, _, err := cached.GetAll(ctx, "", nil, nil, 0, nil, Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 1 || movies[0].Title != "Moana 2" {
+		t.Errorf("got list %+v after invalidating; want the changed movie", movies)
+	}
+}
+
+func TestMergeAndRatingsInvalidateCachedMovies(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s isn't set", testDSNEnv)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+
+	models := NewModels(db, ModelOptions{Clock: clock.Real{}})
+	cached := NewCachedMovieStore(models.Movies, NewMemoryMovieCache(time.Hour, 100, clock.Real{}))
+	models.Movies = cached
+	models.Duplicates.Cache = cached
+	models.Ratings.Cache = cached
+
+	survivor := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{}}
+	duplicate := &Movie{Title: "Moana!", Year: 2016, Runtime: 107, Genres: []string{}}
+
+	for _, movie := range []*Movie{survivor, duplicate} {
+		err := models.Movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := movie.ID
+		t.Cleanup(func() { db.Exec(`DELETE FROM movies WHERE id = $1`, id) })
+	}
+
+	user := insertTestUser(t, models, true)
+
+	rating := &Rating{UserID: user.ID, MovieID: duplicate.ID, Rating: 8}
+
+	_, err = models.Ratings.Upsert(ctx, rating)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache both movies before the merge.
+	for _, id := range []int64{survivor.ID, duplicate.ID} {
+		_, err := models.Movies.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = models.Duplicates.Merge(ctx, survivor.ID, []int64{duplicate.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := models.Movies.Get(ctx, survivor.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RatingsCount != 1 {
+		t.Errorf("got %d ratings of the survivor after the merge; want the merged 1", got.RatingsCount)
+	}
+
+	_, err = models.Movies.Get(ctx, duplicate.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v reading the merged duplicate; want ErrRecordNotFound", err)
+	}
+
+	// The moved rating is the user's rating of the survivor, and deleting it must be seen at once.
+	ratings, _, err := models.Ratings.GetAllForMovie(ctx, survivor.ID, Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ratings) != 1 {
+		t.Fatalf("got %d ratings of the survivor; want 1", len(ratings))
+	}
+
+	err = models.Ratings.Delete(ctx, ratings[0].ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = models.Movies.Get(ctx, survivor.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RatingsCount != 0 {
+		t.Errorf("got %d ratings of the survivor after deleting the rating; want 0", got.RatingsCount)
+	}
+}
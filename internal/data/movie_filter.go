@@ -0,0 +1,559 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// Limits on the size of a filter expression, so that a client can't make the server parse, or the database run,
+// something huge.
+const (
+	MaxMovieFilterLength      = 1000
+	maxMovieFilterComparisons = 32
+	maxMovieFilterDepth       = 8
+)
+
+// MovieFilter is a parsed filter expression for the movies listing, such as
+//
+//	year>=2000 AND genres@>["drama"] AND (runtime<150 OR title~"director's cut")
+//
+// Comparisons can be combined with AND, OR and NOT (in increasing order of precedence) and grouped with
+// parentheses. The fields and operators are:
+//
+//   - id, year, runtime, version: =, !=, <, <=, >, >= with a whole number.
+//   - tmdb_id: = and != with a whole number, where 0 matches the movies without one.
+//   - title: = and != with a string, and ~ for a case-insensitive substring match.
+//   - language, country: = and != with a string, such as language="fr" or country!="US".
+//   - imdb_id: = and != with a string, where "" matches the movies without one.
+//   - genres: @> (has all of) and && (has any of) with an array of strings.
+//
+// Strings are double-quoted, with \" and \\ escapes. A MovieFilter is converted into SQL with placeholders for
+// all of the values, so it is safe to use in a query.
+type MovieFilter struct {
+	root filterNode
+}
+
+type filterNode interface {
+	// sql() returns the SQL condition for the node, appending the values it uses to args. Placeholders are
+	// numbered from offset+1.
+	sql(args *[]interface{}, offset int) string
+	matches(movie *Movie) bool
+}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ operand filterNode }
+
+type filterComparison struct {
+	field  string
+	op     string
+	number int64
+	text   string
+	list   []string
+}
+
+// The operators allowed for each field, keyed by field name.
+var movieFilterFields = map[string][]string{
+	"id":       {"=", "!=", "<", "<=", ">", ">="},
+	"year":     {"=", "!=", "<", "<=", ">", ">="},
+	"runtime":  {"=", "!=", "<", "<=", ">", ">="},
+	"version":  {"=", "!=", "<", "<=", ">", ">="},
+	"title":    {"=", "!=", "~"},
+	"language": {"=", "!="},
+	"country":  {"=", "!="},
+	"imdb_id":  {"=", "!="},
+	"tmdb_id":  {"=", "!="},
+	"genres":   {"@>", "&&"},
+}
+
+// ParseMovieFilter() parses and validates a filter expression. The error describes the first problem found, and
+// where it is, in a form suitable for showing to the client.
+func ParseMovieFilter(expr string) (*MovieFilter, error) {
+	if len(expr) > MaxMovieFilterLength {
+		return nil, fmt.Errorf("must not be more than %d bytes long", MaxMovieFilterLength)
+	}
+
+	tokens, err := lexMovieFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+
+	root, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+	}
+
+	return &MovieFilter{root: root}, nil
+}
+
+// SQL() returns the filter as an SQL condition, and the values for its placeholders, which are numbered from
+// offset+1. A nil filter matches every movie.
+func (f *MovieFilter) SQL(offset int) (string, []interface{}) {
+	if f == nil {
+		return "TRUE", nil
+	}
+
+	args := []interface{}{}
+
+	return f.root.sql(&args, offset), args
+}
+
+// AndEqual() returns a filter matching the movies which match f and whose text field, such as language, is the
+// value. f may be nil, to match on the field alone.
+func (f *MovieFilter) AndEqual(field, value string) *MovieFilter {
+	return f.and(filterComparison{field: field, op: "=", text: value})
+}
+
+// AndEqualNumber() is like AndEqual(), for a numeric field such as tmdb_id.
+func (f *MovieFilter) AndEqualNumber(field string, value int64) *MovieFilter {
+	return f.and(filterComparison{field: field, op: "=", number: value})
+}
+
+// AndCompareNumber() returns a filter matching the movies which match f and whose numeric field compares to the
+// value with the operator, such as year >= 2000.
+func (f *MovieFilter) AndCompareNumber(field, op string, value int64) *MovieFilter {
+	return f.and(filterComparison{field: field, op: op, number: value})
+}
+
+func (f *MovieFilter) and(c filterComparison) *MovieFilter {
+	if f == nil {
+		return &MovieFilter{root: c}
+	}
+
+	return &MovieFilter{root: filterAnd{f.root, c}}
+}
+
+// Matches() reports whether the movie matches the filter. A nil filter matches every movie.
+func (f *MovieFilter) Matches(movie *Movie) bool {
+	return f == nil || f.root.matches(movie)
+}
+
+func (n filterAnd) sql(args *[]interface{}, offset int) string {
+	return "(" + n.left.sql(args, offset) + " AND " + n.right.sql(args, offset) + ")"
+}
+
+func (n filterAnd) matches(movie *Movie) bool {
+	return n.left.matches(movie) && n.right.matches(movie)
+}
+
+func (n filterOr) sql(args *[]interface{}, offset int) string {
+	return "(" + n.left.sql(args, offset) + " OR " + n.right.sql(args, offset) + ")"
+}
+
+func (n filterOr) matches(movie *Movie) bool {
+	return n.left.matches(movie) || n.right.matches(movie)
+}
+
+func (n filterNot) sql(args *[]interface{}, offset int) string {
+	return "NOT " + n.operand.sql(args, offset)
+}
+
+func (n filterNot) matches(movie *Movie) bool {
+	return !n.operand.matches(movie)
+}
+
+func (n filterComparison) sql(args *[]interface{}, offset int) string {
+	// The field names and operators have been checked against movieFilterFields, so only the values need to be
+	// passed as parameters.
+	placeholder := func(value interface{}) string {
+		*args = append(*args, value)
+		return "$" + strconv.Itoa(offset+len(*args))
+	}
+
+	op := n.op
+	if op == "!=" {
+		op = "<>"
+	}
+
+	switch n.field {
+	case "title", "language", "country":
+		if n.op == "~" {
+			// Escape the LIKE wildcards, so that the value is matched literally.
+			escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(n.text)
+			return "title ILIKE " + placeholder("%"+escaped+"%")
+		}
+		return n.field + " " + op + " " + placeholder(n.text)
+	case "imdb_id":
+		// Movies without an external ID have NULL, which needs to compare like the "" or 0 they have in the API.
+		// A lookup by ID compares the column itself, so that it can use the unique index.
+		if n.op == "=" && n.text != "" {
+			return "imdb_id = " + placeholder(n.text)
+		}
+		return "coalesce(imdb_id, '') " + op + " " + placeholder(n.text)
+	case "tmdb_id":
+		if n.op == "=" && n.number != 0 {
+			return "tmdb_id = " + placeholder(n.number)
+		}
+		return "coalesce(tmdb_id, 0) " + op + " " + placeholder(n.number)
+	case "genres":
+		// Every movie has all of no genres, and none has any of them.
+		if len(n.list) == 0 {
+			if n.op == "@>" {
+				return "true"
+			}
+			return "false"
+		}
+		return "(" + genreFilterSQL(placeholder(pq.Array(n.list)), n.op == "&&") + ")"
+	default:
+		return n.field + " " + op + " " + placeholder(n.number)
+	}
+}
+
+func (n filterComparison) matches(movie *Movie) bool {
+	switch n.field {
+	case "title", "language", "country", "imdb_id":
+		text := movie.Title
+		switch n.field {
+		case "language":
+			text = movie.Language
+		case "country":
+			text = movie.Country
+		case "imdb_id":
+			text = movie.IMDbID
+		}
+
+		switch n.op {
+		case "=":
+			return text == n.text
+		case "!=":
+			return text != n.text
+		default:
+			return strings.Contains(strings.ToLower(text), strings.ToLower(n.text))
+		}
+	case "genres":
+		if n.op == "@>" {
+			for _, g := range n.list {
+				if !contains(movie.Genres, g) {
+					return false
+				}
+			}
+			return true
+		}
+		for _, g := range n.list {
+			if contains(movie.Genres, g) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var value int64
+	switch n.field {
+	case "id":
+		value = movie.ID
+	case "year":
+		value = int64(movie.Year)
+	case "runtime":
+		value = int64(movie.Runtime)
+	case "version":
+		value = int64(movie.Version)
+	case "tmdb_id":
+		value = movie.TMDbID
+	}
+
+	switch n.op {
+	case "=":
+		return value == n.number
+	case "!=":
+		return value != n.number
+	case "<":
+		return value < n.number
+	case "<=":
+		return value <= n.number
+	case ">":
+		return value > n.number
+	default:
+		return value >= n.number
+	}
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+	tokenPunct
+)
+
+type filterToken struct {
+	kind  tokenKind
+	value string
+	pos   int // 1-based byte offset, for error messages.
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of filter"
+	case tokenString:
+		return strconv.Quote(t.value)
+	default:
+		return fmt.Sprintf("%q", t.value)
+	}
+}
+
+// lexMovieFilter() splits a filter expression into tokens.
+func lexMovieFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		pos := i + 1
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '(' || c == ')' || c == '[' || c == ']' || c == ',':
+			tokens = append(tokens, filterToken{tokenPunct, string(c), pos})
+			i++
+
+		case strings.ContainsRune("=!<>~@&", rune(c)):
+			op := ""
+			for _, candidate := range []string{"<=", ">=", "!=", "@>", "&&", "=", "<", ">", "~"} {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unknown operator at position %d", pos)
+			}
+			tokens = append(tokens, filterToken{tokenOperator, op, pos})
+			i += len(op)
+
+		case c == '"':
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(expr) {
+					return nil, fmt.Errorf("unterminated string starting at position %d", pos)
+				}
+				if expr[i] == '\\' && i+1 < len(expr) && (expr[i+1] == '"' || expr[i+1] == '\\') {
+					sb.WriteByte(expr[i+1])
+					i += 2
+					continue
+				}
+				if expr[i] == '"' {
+					i++
+					break
+				}
+				sb.WriteByte(expr[i])
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenString, sb.String(), pos})
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(expr) && expr[i] >= '0' && expr[i] <= '9' {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenNumber, expr[start:i], pos})
+
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(expr) && (expr[i] == '_' || unicode.IsLetter(rune(expr[i])) || (expr[i] >= '0' && expr[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenIdent, expr[start:i], pos})
+
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, pos)
+		}
+	}
+
+	return append(tokens, filterToken{kind: tokenEOF, pos: len(expr) + 1}), nil
+}
+
+// filterParser is a recursive descent parser for filter expressions:
+//
+//	or         = and { "OR" and }
+//	and        = not { "AND" not }
+//	not        = "NOT" not | "(" or ")" | comparison
+//	comparison = field operator value
+type filterParser struct {
+	tokens      []filterToken
+	next        int
+	comparisons int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+// keyword() consumes the next token if it is the given keyword, in any case.
+func (p *filterParser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokenIdent && strings.EqualFold(t.value, word) {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr(depth int) (filterNode, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("OR") {
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd(depth int) (filterNode, error) {
+	left, err := p.parseNot(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("AND") {
+		right, err := p.parseNot(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseNot(depth int) (filterNode, error) {
+	if depth > maxMovieFilterDepth {
+		return nil, fmt.Errorf("must not be nested more than %d levels deep", maxMovieFilterDepth)
+	}
+
+	if p.keyword("NOT") {
+		operand, err := p.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{operand}, nil
+	}
+
+	if t := p.peek(); t.kind == tokenPunct && t.value == "(" {
+		p.take()
+
+		inner, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if t := p.take(); t.kind != tokenPunct || t.value != ")" {
+			return nil, fmt.Errorf("expected \")\" at position %d, found %s", t.pos, t)
+		}
+
+		return inner, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	p.comparisons++
+	if p.comparisons > maxMovieFilterComparisons {
+		return nil, fmt.Errorf("must not have more than %d comparisons", maxMovieFilterComparisons)
+	}
+
+	field := p.take()
+	if field.kind != tokenIdent {
+		return nil, fmt.Errorf("expected a field name at position %d, found %s", field.pos, field)
+	}
+
+	name := strings.ToLower(field.value)
+
+	ops, ok := movieFilterFields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q at position %d", field.value, field.pos)
+	}
+
+	op := p.take()
+	if op.kind != tokenOperator {
+		return nil, fmt.Errorf("expected an operator after %q at position %d, found %s", field.value, op.pos, op)
+	}
+
+	allowed := false
+	for _, candidate := range ops {
+		if op.value == candidate {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("operator %s can't be used with %s at position %d (use one of %s)", op.value, name, op.pos, strings.Join(ops, " "))
+	}
+
+	c := filterComparison{field: name, op: op.value}
+
+	value := p.take()
+
+	switch name {
+	case "title", "language", "country", "imdb_id":
+		if value.kind != tokenString {
+			return nil, fmt.Errorf("expected a string at position %d, found %s", value.pos, value)
+		}
+		c.text = value.value
+
+	case "genres":
+		if value.kind != tokenPunct || value.value != "[" {
+			return nil, fmt.Errorf("expected an array of strings at position %d, found %s", value.pos, value)
+		}
+
+		for {
+			item := p.take()
+			if item.kind != tokenString {
+				return nil, fmt.Errorf("expected a string at position %d, found %s", item.pos, item)
+			}
+			c.list = append(c.list, item.value)
+
+			sep := p.take()
+			if sep.kind == tokenPunct && sep.value == "]" {
+				break
+			}
+			if sep.kind != tokenPunct || sep.value != "," {
+				return nil, fmt.Errorf("expected \",\" or \"]\" at position %d, found %s", sep.pos, sep)
+			}
+		}
+
+	default:
+		if value.kind != tokenNumber {
+			return nil, fmt.Errorf("expected a whole number at position %d, found %s", value.pos, value)
+		}
+
+		n, err := strconv.ParseInt(value.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at position %d", value.pos)
+		}
+		c.number = n
+	}
+
+	return c, nil
+}
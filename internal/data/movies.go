@@ -3,8 +3,10 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/micypac/flick-info/internal/validator"
@@ -12,14 +14,49 @@ import (
 	"github.com/lib/pq"
 )
 
+// Errors for a violation of the "movies_imdb_id_key" and "movies_tmdb_id_key" constraints, when another movie
+// already has the external ID.
+var (
+	ErrDuplicateIMDbID = errors.New("duplicate imdb id")
+	ErrDuplicateTMDbID = errors.New("duplicate tmdb id")
+)
+
+// IMDbIDRX matches IMDb title IDs, such as tt0111161.
+var IMDbIDRX = regexp.MustCompile(`^tt[0-9]{7,10}$`)
+
 type Movie struct {
-	ID        int64     `json:"id"` // Unique integer id for the movie.
-	CreatedAt time.Time `json:"-"`  // Timestamp when the movie is added to the db. '-' struct tag directive to hide in the output.
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`    // Release year. 'omitempty' struct directive to hide field in the output if the it is zero value.
-	Runtime   Runtime   `json:"runtime,omitempty"` // Runtime (in minutes).
-	Genres    []string  `json:"genres,omitempty"`  // Genres of the movie.
-	Version   int32     `json:"version"`           // Version starts at 1 and incremented when movie info is updated.
+	XMLName   xml.Name  `json:"-" xml:"movie"`
+	ID        int64     `json:"id" xml:"id"` // Unique integer id for the movie.
+	CreatedAt time.Time `json:"-" xml:"-"`   // Timestamp when the movie is added to the db. '-' struct tag directive to hide in the output.
+	Title     string    `json:"title" xml:"title"`
+	Year      int32     `json:"year,omitempty" xml:"year,omitempty"`           // Release year. 'omitempty' struct directive to hide field in the output if the it is zero value.
+	Runtime   Runtime   `json:"runtime,omitempty" xml:"runtime,omitempty"`     // Runtime (in minutes).
+	Genres    []string  `json:"genres,omitempty" xml:"genres>genre,omitempty"` // Genres of the movie.
+	Version   int32     `json:"version" xml:"version"`                         // Version starts at 1 and incremented when movie info is updated.
+	Synopsis  string    `json:"synopsis,omitempty" xml:"synopsis,omitempty"`   // Plot summary.
+	Language  string    `json:"language,omitempty" xml:"language,omitempty"`   // Original language, as an ISO 639-1 code such as "en".
+	Country   string    `json:"country,omitempty" xml:"country,omitempty"`     // Country of origin, as an ISO 3166-1 alpha-2 code such as "US".
+	IMDbID    string    `json:"imdb_id,omitempty" xml:"imdb_id,omitempty"`     // The movie's ID on IMDb, such as "tt0111161".
+	TMDbID    int64     `json:"tmdb_id,omitempty" xml:"tmdb_id,omitempty"`     // The movie's ID on The Movie Database.
+
+	// The storage key of the movie's poster image, empty if it hasn't got one, and the URL the poster can be
+	// fetched from, which the handlers fill in from the key.
+	PosterKey string `json:"-" xml:"-"`
+	PosterURL string `json:"poster_url,omitempty" xml:"poster_url,omitempty"`
+
+	// The mean of the movie's ratings to 1 decimal place, nil if it hasn't been rated, and the number of ratings.
+	// These are only filled in by MovieModel's Get() and GetAll().
+	AverageRating *float64 `json:"average_rating" xml:"average_rating,omitempty"`
+	RatingsCount  int64    `json:"ratings_count" xml:"ratings_count"`
+
+	UserState *UserState    `json:"user_state,omitempty" xml:"user_state,omitempty"` // The authenticated user's state for the movie, if there is one.
+	Cast      []*CastMember `json:"cast,omitempty" xml:"cast>member,omitempty"`      // Only filled in when a single movie is shown.
+	Crew      []*CrewMember `json:"crew,omitempty" xml:"crew>member,omitempty"`      // Only filled in when a single movie is shown.
+
+	// The most recent ratings and approved reviews, only filled in when a single movie is shown with them in
+	// the include parameter. See MovieIncludeModel.
+	Ratings []*Rating `json:"ratings,omitempty" xml:"ratings>rating,omitempty"`
+	Reviews []*Review `json:"reviews,omitempty" xml:"reviews>review,omitempty"`
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -38,27 +75,68 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
 
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+
+	// The synopsis, language and country are optional.
+	v.Check(len(movie.Synopsis) <= 5000, "synopsis", "must not be more than 5000 bytes long")
+	v.Check(movie.Language == "" || ValidLanguage(movie.Language), "language", "must be a lower case ISO 639-1 language code, such as en")
+	v.Check(movie.Country == "" || ValidCountry(movie.Country), "country", "must be an upper case ISO 3166-1 alpha-2 country code, such as US")
+
+	// The external IDs are optional too, but no two movies can have the same one.
+	v.Check(movie.IMDbID == "" || validator.Matches(movie.IMDbID, IMDbIDRX), "imdb_id", "must be an IMDb title ID, such as tt0111161")
+	v.Check(movie.TMDbID >= 0, "tmdb_id", "must be a positive integer")
 }
 
+// movieConstraintError() returns the error for a violation of one of the movies table's unique constraints on
+// the external IDs, or err itself if it isn't one.
+func movieConstraintError(err error) error {
+	switch {
+	case err.Error() == `pq: duplicate key value violates unique constraint "movies_imdb_id_key"`:
+		return ErrDuplicateIMDbID
+	case err.Error() == `pq: duplicate key value violates unique constraint "movies_tmdb_id_key"`:
+		return ErrDuplicateTMDbID
+	default:
+		return err
+	}
+}
+
+// movieRatingsSubquery is joined laterally to movies to get each movie's average rating and number of ratings.
+const movieRatingsSubquery = `SELECT round(avg(rating), 1)::float8 AS average_rating, count(*) AS ratings_count FROM ratings WHERE movie_id = movies.id`
+
+// MovieModel queries the movies table. The listing queries, GetAll() and Stream(), read from Replica when it is
+// usable. Get() always reads from the primary, as it is used to read a movie before updating it, and an
+// out-of-date version from the replica would cause a spurious edit conflict.
 type MovieModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Replica *Replica
 }
 
-// GetAll() return a slice of movies.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// GetAll() return a slice of movies. Movies must have all of the genres, and at least one of the anyGenres.
+// Either can be empty to leave it out of the filter. If directorID isn't zero, only the movies that person is
+// credited as directing are returned. Movies must also match the where filter expression, if it isn't nil.
+func (m MovieModel) GetAll(ctx context.Context, title string, genres, anyGenres []string, directorID int64, where *MovieFilter, filters Filters) ([]*Movie, Metadata, error) {
+	// The filter expression's placeholders are numbered after the six used here.
+	condition, whereArgs := where.SQL(6)
+
 	stmt := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, movie_genre_names(id), version, synopsis, language, country,
+			coalesce(imdb_id, ''), coalesce(tmdb_id, 0), poster_key, r.average_rating, r.ratings_count
 		FROM movies
+		LEFT JOIN LATERAL (%s) r ON true
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 OR $2 = '{}')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4
-	`, filters.sortColumn(), filters.sortDirection())
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		AND (%s OR $2 = '{}')
+		AND (%s OR $3 = '{}')
+		AND (EXISTS (SELECT 1 FROM movie_crew WHERE movie_id = movies.id AND job = 'director' AND person_id = $6) OR $6 = 0)
+		AND %s
+		ORDER BY %s, id ASC
+		LIMIT $4 OFFSET $5
+	`, movieRatingsSubquery, genreFilterSQL("$2", false), genreFilterSQL("$3", true), condition, filters.orderBy(""))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, stmt, title, pq.Array(genres), filters.limit(), filters.offset())
+	args := append([]interface{}{title, pq.Array(genres), pq.Array(anyGenres), filters.limit(), filters.offset(), directorID}, whereArgs...)
+
+	rows, err := m.Replica.Reader(m.DB).QueryContext(ctx, stmt, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -83,6 +161,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.Synopsis,
+			&movie.Language,
+			&movie.Country,
+			&movie.IMDbID,
+			&movie.TMDbID,
+			&movie.PosterKey,
+			&movie.AverageRating,
+			&movie.RatingsCount,
 		)
 
 		if err != nil {
@@ -107,42 +193,66 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 }
 
-// Insert method accepts a pointer to a Movie struct which contain data for the new record.
-func (m MovieModel) Insert(movie *Movie) error {
+// Insert method accepts a pointer to a Movie struct which contain data for the new record. The movie and its
+// genres are inserted in a single transaction, and ErrUnknownGenre is returned if any of the genres isn't in the
+// genres table.
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	stmt := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, year, runtime, synopsis, language, country, imdb_id, tmdb_id)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, 0))
 		RETURNING id, created_at, version
 	`
 
-	// Create a slice containing the values for the placeholder parameters from the Movie struct.
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	// Create a slice containing the values for the placeholder parameters from the Movie struct. The genres are
+	// inserted into movies_genres separately.
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, movie.Synopsis, movie.Language, movie.Country,
+		movie.IMDbID, movie.TMDbID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	defer cancel()
 
-	// Use the QueryRow() method to execute the SQL statement on the connection pool, passing in the args
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Use the QueryRow() method to execute the SQL statement in the transaction, passing in the args
 	// as a variadic parameter and scanning the system-generated values into the movie struct.
-	return m.DB.QueryRowContext(ctx, stmt, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err = tx.QueryRowContext(ctx, stmt, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	if err != nil {
+		return movieConstraintError(err)
+	}
+
+	err = setMovieGenres(ctx, tx, movie.ID, movie.Genres)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	// The PostgreSQL bigserial type for the movie ID starts auto-incrementing at 1 by default.
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	stmt := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, title, year, runtime, movie_genre_names(id), version, synopsis, language, country,
+			coalesce(imdb_id, ''), coalesce(tmdb_id, 0), poster_key, r.average_rating, r.ratings_count
 		FROM movies
+		LEFT JOIN LATERAL (` + movieRatingsSubquery + `) r ON true
 		WHERE id = $1
 	`
 	// Declare a Movie struct that will hold the returned data.
 	var movie Movie
 
-	// Use context.WithTimeout() function to create a context w/c carries a 3sec timeout deadline.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Use context.WithTimeout() function to layer a 3sec timeout deadline on top of the caller's context. The query
+	// is cancelled when either the deadline passes or the caller's context is done, e.g. because the client
+	// went away.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	// Use defer to make sure we cancel the context before the Get() method returns.
 	defer cancel()
@@ -156,6 +266,14 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.Synopsis,
+		&movie.Language,
+		&movie.Country,
+		&movie.IMDbID,
+		&movie.TMDbID,
+		&movie.PosterKey,
+		&movie.AverageRating,
+		&movie.RatingsCount,
 	)
 
 	if err != nil {
@@ -170,11 +288,15 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+// Update() saves the movie and replaces its genres, in a single transaction. ErrEditConflict is returned if the
+// movie has been changed or deleted since it was read, and ErrUnknownGenre if any of the genres isn't in the
+// genres table.
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	stmt := `
 		UPDATE movies 
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET title = $1, year = $2, runtime = $3, synopsis = $4, language = $5, country = $6, poster_key = $7,
+			imdb_id = NULLIF($8, ''), tmdb_id = NULLIF($9, 0), version = version + 1
+		WHERE id = $10 AND version = $11
 		RETURNING version
 	`
 
@@ -182,28 +304,54 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Title,
 		movie.Year,
 		movie.Runtime,
-		pq.Array(movie.Genres),
+		movie.Synopsis,
+		movie.Language,
+		movie.Country,
+		movie.PosterKey,
+		movie.IMDbID,
+		movie.TMDbID,
 		movie.ID,
 		movie.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&movie.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int32
+
+	err = tx.QueryRowContext(ctx, stmt, args...).Scan(&version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return movieConstraintError(err)
 		}
 	}
 
+	err = setMovieGenres(ctx, tx, movie.ID, movie.Genres)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// Only move the movie on to the new version once it has been saved, so that a failed update can be retried.
+	movie.Version = version
+
 	return nil
 }
 
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -213,7 +361,7 @@ func (m MovieModel) Delete(id int64) error {
 		WHERE id = $1	
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	result, err := m.DB.ExecContext(ctx, stmt, id)
@@ -233,3 +381,86 @@ func (m MovieModel) Delete(id int64) error {
 
 	return nil
 }
+
+// Stream() calls fn for every movie matching the title and genres filters with an ID greater than afterID,
+// in ascending ID order. Rather than loading the whole result set into memory, the movies are fetched in
+// batches of batchSize using keyset pagination on the ID, so each batch is a cheap index range scan no matter
+// how deep into the result set it is. Iteration stops at the first error returned by fn, or when ctx is done.
+func (m MovieModel) Stream(ctx context.Context, title string, genres []string, afterID int64, batchSize int, fn func(*Movie) error) error {
+	stmt := `
+		SELECT id, created_at, title, year, runtime, movie_genre_names(id), version, synopsis, language, country,
+			coalesce(imdb_id, ''), coalesce(tmdb_id, 0), poster_key
+		FROM movies
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND (` + genreFilterSQL("$2", false) + ` OR $2 = '{}')
+		AND id > $3
+		ORDER BY id ASC
+		LIMIT $4`
+
+	for {
+		movies, err := m.streamBatch(ctx, stmt, title, genres, afterID, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, movie := range movies {
+			err = fn(movie)
+			if err != nil {
+				return err
+			}
+		}
+
+		// A short batch means there are no more matching movies.
+		if len(movies) < batchSize {
+			return nil
+		}
+
+		afterID = movies[len(movies)-1].ID
+	}
+}
+
+// streamBatch() fetches a single batch of movies for Stream(). Each batch gets its own 3-second timeout, so
+// the total duration of the stream isn't limited, but a single slow query is.
+func (m MovieModel) streamBatch(ctx context.Context, stmt, title string, genres []string, afterID int64, batchSize int) ([]*Movie, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.Replica.Reader(m.DB).QueryContext(ctx, stmt, title, pq.Array(genres), afterID, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := make([]*Movie, 0, batchSize)
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.Synopsis,
+			&movie.Language,
+			&movie.Country,
+			&movie.IMDbID,
+			&movie.TMDbID,
+			&movie.PosterKey,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
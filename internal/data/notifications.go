@@ -0,0 +1,104 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Kinds of notification.
+const (
+	NotificationSavedSearchMatches = "saved_search_matches"
+)
+
+// Notification is an in-app notification for a user, such as new movies matching one of their saved searches.
+type Notification struct {
+	XMLName   xml.Name         `json:"-" xml:"notification"`
+	ID        int64            `json:"id" xml:"id"`
+	UserID    int64            `json:"-" xml:"-"`
+	CreatedAt time.Time        `json:"created_at" xml:"created_at"`
+	Kind      string           `json:"kind" xml:"kind"`
+	Message   string           `json:"message" xml:"message"`
+	Data      NotificationData `json:"data" xml:"data"`
+	ReadAt    *time.Time       `json:"read_at" xml:"read_at,omitempty"` // Nil until the notification is read.
+}
+
+// NotificationData holds the details of a notification, depending on its kind. It is stored as JSON.
+type NotificationData struct {
+	SavedSearchID int64   `json:"saved_search_id,omitempty" xml:"saved_search_id,omitempty"`
+	MovieIDs      []int64 `json:"movie_ids,omitempty" xml:"movie_ids>id,omitempty"`
+}
+
+type NotificationModel struct {
+	DB *sql.DB
+}
+
+// GetAllForUser() returns a page of the user's notifications, optionally only the unread ones.
+func (m NotificationModel) GetAllForUser(ctx context.Context, userID int64, unreadOnly bool, filters Filters) ([]*Notification, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, kind, message, data, read_at
+		FROM notifications
+		WHERE user_id = $1 AND (read_at IS NULL OR NOT $2)
+		ORDER BY %s, id DESC
+		LIMIT $3 OFFSET $4`, filters.orderBy(""))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID, unreadOnly, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	notifications := []*Notification{}
+
+	for rows.Next() {
+		notification := Notification{UserID: userID}
+		var js []byte
+
+		err := rows.Scan(&totalRecords, &notification.ID, &notification.CreatedAt, &notification.Kind, &notification.Message, &js, &notification.ReadAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(js, &notification.Data)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		notifications = append(notifications, &notification)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return notifications, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// MarkRead() marks the user's notifications with the given IDs as read, or all of them if ids is empty, and
+// returns the number which were unread. IDs of other users' notifications are ignored.
+func (m NotificationModel) MarkRead(ctx context.Context, userID int64, ids []int64) (int64, error) {
+	stmt := `
+		UPDATE notifications
+		SET read_at = now()
+		WHERE user_id = $1 AND read_at IS NULL
+		AND (id = ANY($2) OR cardinality($2::bigint[]) = 0)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, userID, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
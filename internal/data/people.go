@@ -0,0 +1,378 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// The roles a person can have in a movie's cast. Jobs behind the camera are crew credits; see CrewJobs.
+var CastRoles = []string{"actor", "voice"}
+
+// The most credits a movie's cast can have.
+const MaxCastMembers = 200
+
+// Person is someone who worked on movies, such as an actor or a director.
+type Person struct {
+	XMLName   xml.Name  `json:"-" xml:"person"`
+	ID        int64     `json:"id" xml:"id"`
+	CreatedAt time.Time `json:"-" xml:"-"`
+	Name      string    `json:"name" xml:"name"`
+	BirthYear int32     `json:"birth_year,omitempty" xml:"birth_year,omitempty"`
+	Bio       string    `json:"bio,omitempty" xml:"bio,omitempty"`
+	Version   int32     `json:"version" xml:"version"`
+}
+
+// CastMember is a credit in a movie's cast: the person, their role, and the character they played, if any.
+type CastMember struct {
+	XMLName   xml.Name `json:"-" xml:"member"`
+	PersonID  int64    `json:"person_id" xml:"person_id"`
+	Name      string   `json:"name" xml:"name"`
+	Role      string   `json:"role" xml:"role"`
+	Character string   `json:"character,omitempty" xml:"character,omitempty"`
+}
+
+// Credit is a movie in a person's filmography, with their role in the cast or their job in the crew.
+type Credit struct {
+	XMLName   xml.Name `json:"-" xml:"credit"`
+	Movie     *Movie   `json:"movie" xml:"movie"`
+	Role      string   `json:"role" xml:"role"`
+	Character string   `json:"character,omitempty" xml:"character,omitempty"`
+}
+
+func ValidatePerson(v *validator.Validator, person *Person) {
+	v.Check(person.Name != "", "name", "must be provided")
+	v.Check(len(person.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	v.Check(person.BirthYear == 0 || person.BirthYear >= 1800, "birth_year", "must be greater than 1800")
+	v.Check(person.BirthYear <= int32(time.Now().Year()), "birth_year", "must not be in the future")
+
+	v.Check(len(person.Bio) <= 5000, "bio", "must not be more than 5000 bytes long")
+}
+
+// ValidateCast() checks a movie's cast, in billing order. Each person can only be credited once in each role.
+func ValidateCast(v *validator.Validator, cast []*CastMember) {
+	v.Check(len(cast) <= MaxCastMembers, "cast", fmt.Sprintf("must not contain more than %d members", MaxCastMembers))
+
+	seen := make(map[string]bool, len(cast))
+
+	for _, member := range cast {
+		v.Check(member.PersonID > 0, "cast", "must only contain members with a person_id")
+		v.Check(validator.In(member.Role, CastRoles...), "cast", "must only contain roles of "+strings.Join(CastRoles, ", "))
+		v.Check(len(member.Character) <= 500, "cast", "must not contain characters more than 500 bytes long")
+
+		key := fmt.Sprintf("%d %s", member.PersonID, member.Role)
+		v.Check(!seen[key], "cast", "must not credit a person in the same role more than once")
+		seen[key] = true
+	}
+}
+
+type PeopleModel struct {
+	DB *sql.DB
+}
+
+func (m PeopleModel) Insert(ctx context.Context, person *Person) error {
+	stmt := `
+		INSERT INTO people (name, birth_year, bio)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, stmt, person.Name, person.BirthYear, person.Bio).Scan(&person.ID, &person.CreatedAt, &person.Version)
+}
+
+func (m PeopleModel) Get(ctx context.Context, id int64) (*Person, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	stmt := `
+		SELECT id, created_at, name, birth_year, bio, version
+		FROM people
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var person Person
+
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(&person.ID, &person.CreatedAt, &person.Name, &person.BirthYear, &person.Bio, &person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &person, nil
+}
+
+// GetAll() returns a page of people, optionally only those with every word of name in their name.
+func (m PeopleModel) GetAll(ctx context.Context, name string, filters Filters) ([]*Person, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, birth_year, bio, version
+		FROM people
+		WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		ORDER BY %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.orderBy(""))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, name, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	people := []*Person{}
+
+	for rows.Next() {
+		var person Person
+
+		err := rows.Scan(&totalRecords, &person.ID, &person.CreatedAt, &person.Name, &person.BirthYear, &person.Bio, &person.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		people = append(people, &person)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return people, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m PeopleModel) Update(ctx context.Context, person *Person) error {
+	stmt := `
+		UPDATE people
+		SET name = $1, birth_year = $2, bio = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, person.Name, person.BirthYear, person.Bio, person.ID, person.Version).Scan(&person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete() deletes the person, and with them their credits in every movie's cast.
+func (m PeopleModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM people WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetCast() returns the movie's cast in billing order.
+func (m PeopleModel) GetCast(ctx context.Context, movieID int64) ([]*CastMember, error) {
+	stmt := `
+		SELECT c.person_id, p.name, c.role, c.character
+		FROM movie_cast c
+		INNER JOIN people p ON p.id = c.person_id
+		WHERE c.movie_id = $1
+		ORDER BY c.position`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cast := []*CastMember{}
+
+	for rows.Next() {
+		var member CastMember
+
+		err := rows.Scan(&member.PersonID, &member.Name, &member.Role, &member.Character)
+		if err != nil {
+			return nil, err
+		}
+
+		cast = append(cast, &member)
+	}
+
+	return cast, rows.Err()
+}
+
+// SetCast() replaces the movie's cast, in a single transaction, with the members in billing order, and fills in
+// their names. ErrRecordNotFound is returned if any of the people don't exist.
+func (m PeopleModel) SetCast(ctx context.Context, movieID int64, cast []*CastMember) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM movie_cast WHERE movie_id = $1`, movieID)
+	if err != nil {
+		return err
+	}
+
+	personIDs := make([]int64, len(cast))
+	roles := make([]string, len(cast))
+	characters := make([]string, len(cast))
+
+	for i, member := range cast {
+		personIDs[i] = member.PersonID
+		roles[i] = member.Role
+		characters[i] = member.Character
+	}
+
+	stmt := `
+		INSERT INTO movie_cast (movie_id, person_id, role, character, position)
+		SELECT $1, c.person_id, c.role, c.character, c.position
+		FROM unnest($2::bigint[], $3::text[], $4::text[]) WITH ORDINALITY AS c(person_id, role, character, position)`
+
+	_, err = tx.ExecContext(ctx, stmt, movieID, pq.Array(personIDs), pq.Array(roles), pq.Array(characters))
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "movie_cast" violates foreign key constraint "movie_cast_person_id_fkey"`:
+			return ErrRecordNotFound
+		case err.Error() == `pq: insert or update on table "movie_cast" violates foreign key constraint "movie_cast_movie_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	names, err := personNames(ctx, tx, personIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range cast {
+		member.Name = names[member.PersonID]
+	}
+
+	return tx.Commit()
+}
+
+// personNames() returns the names of the people with the IDs, keyed by ID.
+func personNames(ctx context.Context, tx *sql.Tx, ids []int64) (map[int64]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, name FROM people WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[int64]string, len(ids))
+
+	for rows.Next() {
+		var id int64
+		var name string
+
+		err := rows.Scan(&id, &name)
+		if err != nil {
+			return nil, err
+		}
+
+		names[id] = name
+	}
+
+	return names, rows.Err()
+}
+
+// GetFilmography() returns a page of the movies the person is credited in, in the cast or the crew, with their
+// role or job in each. A person credited in several roles in a movie has an entry for each role.
+func (m PeopleModel) GetFilmography(ctx context.Context, personID int64, filters Filters) ([]*Credit, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), c.role, c.character, m.id, m.created_at, m.title, m.year, m.runtime, movie_genre_names(m.id), m.version
+		FROM (
+			SELECT movie_id, person_id, role, character FROM movie_cast
+			UNION ALL
+			SELECT movie_id, person_id, job, '' FROM movie_crew
+		) c
+		INNER JOIN movies m ON m.id = c.movie_id
+		WHERE c.person_id = $1
+		ORDER BY %s, m.id ASC, c.role ASC
+		LIMIT $2 OFFSET $3`, filters.orderBy(""))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, personID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	credits := []*Credit{}
+
+	for rows.Next() {
+		credit := Credit{Movie: &Movie{}}
+
+		err := rows.Scan(
+			&totalRecords,
+			&credit.Role,
+			&credit.Character,
+			&credit.Movie.ID,
+			&credit.Movie.CreatedAt,
+			&credit.Movie.Title,
+			&credit.Movie.Year,
+			&credit.Movie.Runtime,
+			pq.Array(&credit.Movie.Genres),
+			&credit.Movie.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		credits = append(credits, &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return credits, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
@@ -28,7 +28,7 @@ type PermissionModel struct {
 }
 
 // GetAllForUser() method returns all permission codes for a specific user in a Permissions slice.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	stmt := `
 		SELECT permissions.code
 		FROM permissions
@@ -37,7 +37,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		WHERE users.id = $1
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, stmt, userID)
@@ -69,15 +69,49 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 
 // Add the permission codes for a specific user.
 // User variadic parameter for the codes to assign multiple permissions in a single call.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+// Codes the user already holds are skipped.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	stmt := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, stmt, userID, pq.Array(codes))
 	return err
 }
+
+// RemoveForUser() takes the permission codes away from a user. Codes the user doesn't hold are ignored.
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	stmt := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = ANY($2)
+	`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID, pq.Array(codes))
+	return err
+}
+
+// GetAll() returns every permission code which can be granted, in alphabetical order.
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var permissions Permissions
+
+	err := m.DB.QueryRowContext(ctx, `SELECT coalesce(array_agg(code ORDER BY code), '{}') FROM permissions`).Scan(pq.Array(&permissions))
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,245 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/micypac/flick-info/internal/validator"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/clock"
+)
+
+// Prefix for personal access tokens. This makes them easy to tell apart from the short-lived session tokens
+// in the Authorization header, and easy to spot if they are accidentally committed to a repository.
+const PersonalAccessTokenPrefix = "fipat_"
+
+// PersonalAccessToken holds the data for a long-lived, named token which a user can create for scripts.
+// Unlike session tokens, it has an optional expiry and is restricted to a subset of the user's permissions.
+type PersonalAccessToken struct {
+	XMLName     xml.Name    `json:"-" xml:"personal_access_token"`
+	ID          int64       `json:"id" xml:"id"`
+	CreatedAt   time.Time   `json:"created_at" xml:"created_at"`
+	UserID      int64       `json:"-" xml:"-"`
+	Name        string      `json:"name" xml:"name"`
+	Plaintext   string      `json:"token,omitempty" xml:"token,omitempty"` // Only populated when the token is first created.
+	Hash        []byte      `json:"-" xml:"-"`
+	HashVersion int16       `json:"-" xml:"-"`
+	Permissions Permissions `json:"permissions" xml:"permissions>permission"`
+	Expiry      *time.Time  `json:"expiry" xml:"expiry,omitempty"` // Nil if the token never expires.
+}
+
+// generatePersonalAccessToken() creates a new token with a random plaintext value and its hash.
+func generatePersonalAccessToken(userID int64, name string, permissions Permissions, expiry *time.Time, hasher TokenHasher) (*PersonalAccessToken, error) {
+	token := &PersonalAccessToken{
+		UserID:      userID,
+		Name:        name,
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+
+	// Use 20 random bytes rather than the 16 used by session tokens, since these tokens live much longer.
+	randomBytes := make([]byte, 20)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Plaintext = PersonalAccessTokenPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	token.Hash = hasher.Hash(token.Plaintext)
+	token.HashVersion = hasher.Version()
+
+	return token, nil
+}
+
+// IsPersonalAccessToken() reports whether the plaintext token looks like a personal access token.
+func IsPersonalAccessToken(tokenPlaintext string) bool {
+	return strings.HasPrefix(tokenPlaintext, PersonalAccessTokenPrefix)
+}
+
+// Check that the plaintext personal access token has the expected prefix and length.
+func ValidatePersonalAccessTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	v.Check(tokenPlaintext != "", "token", "must be provided")
+	v.Check(IsPersonalAccessToken(tokenPlaintext), "token", "must be a personal access token")
+	v.Check(len(tokenPlaintext) == len(PersonalAccessTokenPrefix)+32, "token", "must be 38 bytes long")
+}
+
+// ValidatePersonalAccessToken() checks the token's name, expiry and permissions. The permissions must be a
+// subset of those the user actually holds, so a token can never grant more than its owner has.
+func ValidatePersonalAccessToken(v *validator.Validator, token *PersonalAccessToken, userPermissions Permissions) {
+	v.Check(token.Name != "", "name", "must be provided")
+	v.Check(len(token.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	if token.Expiry != nil {
+		v.Check(token.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+
+	v.Check(len(token.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(token.Permissions), "permissions", "must not contain duplicate values")
+
+	for _, code := range token.Permissions {
+		v.Check(userPermissions.Include(code), "permissions", "must only contain permissions you hold")
+	}
+}
+
+// PersonalAccessTokenModel type.
+type PersonalAccessTokenModel struct {
+	DB      *sql.DB
+	Hashing TokenHashing
+	Clock   clock.Clock
+}
+
+// New() creates a new personal access token for the user and inserts it in the personal_access_tokens table.
+func (m PersonalAccessTokenModel) New(ctx context.Context, userID int64, name string, permissions Permissions, expiry *time.Time) (*PersonalAccessToken, error) {
+	token, err := generatePersonalAccessToken(userID, name, permissions, expiry, m.Hashing.current())
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `
+		INSERT INTO personal_access_tokens (user_id, name, hash, hash_version, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []interface{}{token.UserID, token.Name, token.Hash, token.HashVersion, pq.Array(token.Permissions), token.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, stmt, args...).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// GetAllForUser() returns all of the user's personal access tokens, including expired ones, newest first.
+func (m PersonalAccessTokenModel) GetAllForUser(ctx context.Context, userID int64) ([]*PersonalAccessToken, error) {
+	stmt := `
+		SELECT id, created_at, user_id, name, permissions, expiry
+		FROM personal_access_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tokens := []*PersonalAccessToken{}
+
+	for rows.Next() {
+		var token PersonalAccessToken
+
+		err := rows.Scan(
+			&token.ID,
+			&token.CreatedAt,
+			&token.UserID,
+			&token.Name,
+			pq.Array(&token.Permissions),
+			&token.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// GetUserForToken() retrieves the user owning an unexpired personal access token, along with the token itself
+// so that the caller can restrict the request to the token's permissions.
+func (m PersonalAccessTokenModel) GetUserForToken(ctx context.Context, tokenPlaintext string) (*User, *PersonalAccessToken, error) {
+	stmt := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale, users.version,
+			personal_access_tokens.id, personal_access_tokens.created_at, personal_access_tokens.name,
+			personal_access_tokens.permissions, personal_access_tokens.expiry
+		FROM users
+		INNER JOIN personal_access_tokens
+		ON users.id = personal_access_tokens.user_id
+		WHERE personal_access_tokens.hash = ANY($1)
+		AND (personal_access_tokens.expiry IS NULL OR personal_access_tokens.expiry > $2)`
+
+	var user User
+	var token PersonalAccessToken
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, pq.Array(m.Hashing.candidates(tokenPlaintext)), m.Clock.Now()).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
+		&user.Version,
+		&token.ID,
+		&token.CreatedAt,
+		&token.Name,
+		pq.Array(&token.Permissions),
+		&token.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+
+	return &user, &token, nil
+}
+
+// Delete() removes a personal access token, provided it belongs to the given user.
+func (m PersonalAccessTokenModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	stmt := `
+		DELETE FROM personal_access_tokens
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
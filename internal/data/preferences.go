@@ -0,0 +1,112 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Preferences holds the settings a user has chosen for their account: the kinds of movies they like, which are
+// used as default filters, and which optional emails they want to receive. An empty MaxContentRating means there
+// is no limit.
+type Preferences struct {
+	XMLName            xml.Name `json:"-" xml:"preferences"`
+	FavoriteGenres     []string `json:"favorite_genres" xml:"favorite_genres>genre"`
+	PreferredLanguages []string `json:"preferred_languages" xml:"preferred_languages>language"`
+	MaxContentRating   string   `json:"max_content_rating" xml:"max_content_rating"`
+	WeeklyDigest       bool     `json:"weekly_digest" xml:"weekly_digest"`
+}
+
+func ValidatePreferences(v *validator.Validator, prefs *Preferences) {
+	v.Check(prefs.FavoriteGenres != nil, "favorite_genres", "must be provided")
+	v.Check(len(prefs.FavoriteGenres) <= 10, "favorite_genres", "must not contain more than 10 genres")
+	v.Check(validator.Unique(prefs.FavoriteGenres), "favorite_genres", "must not contain duplicate values")
+
+	v.Check(prefs.PreferredLanguages != nil, "preferred_languages", "must be provided")
+	v.Check(len(prefs.PreferredLanguages) <= 10, "preferred_languages", "must not contain more than 10 languages")
+	v.Check(validator.Unique(prefs.PreferredLanguages), "preferred_languages", "must not contain duplicate values")
+
+	for _, language := range prefs.PreferredLanguages {
+		if !validator.In(language, LanguageCodes...) {
+			v.AddError("preferred_languages", "must only contain ISO 639-1 language codes, such as en")
+			break
+		}
+	}
+
+	v.Check(prefs.MaxContentRating == "" || validator.In(prefs.MaxContentRating, ContentRatings...), "max_content_rating", "must be one of G, PG, PG-13, R or NC-17")
+}
+
+type PreferencesModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the preferences of the user with the given ID.
+func (m PreferencesModel) Get(ctx context.Context, userID int64) (*Preferences, error) {
+	stmt := `
+		SELECT favorite_genres, preferred_languages, max_content_rating, weekly_digest
+		FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var prefs Preferences
+
+	err := m.DB.QueryRowContext(ctx, stmt, userID).Scan(
+		pq.Array(&prefs.FavoriteGenres),
+		pq.Array(&prefs.PreferredLanguages),
+		&prefs.MaxContentRating,
+		&prefs.WeeklyDigest,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &prefs, nil
+}
+
+// Update() saves the preferences of the user with the given ID.
+func (m PreferencesModel) Update(ctx context.Context, userID int64, prefs *Preferences) error {
+	stmt := `
+		UPDATE users
+		SET favorite_genres = $1, preferred_languages = $2, max_content_rating = $3, weekly_digest = $4,
+			version = version + 1
+		WHERE id = $5`
+
+	args := []interface{}{
+		pq.Array(prefs.FavoriteGenres),
+		pq.Array(prefs.PreferredLanguages),
+		prefs.MaxContentRating,
+		prefs.WeeklyDigest,
+		userID,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
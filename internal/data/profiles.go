@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Profile visibility settings. A public profile can be viewed by anyone, while a private profile can only be
+// viewed by the user it belongs to. New accounts start out private.
+const (
+	ProfilePublic  = "public"
+	ProfilePrivate = "private"
+)
+
+// Profile holds the public facing details of a user, which the user controls themselves. It is deliberately
+// separate from the User struct, so that account details like the email address can never leak through it.
+type Profile struct {
+	XMLName     xml.Name `json:"-" xml:"profile"`
+	UserID      int64    `json:"user_id" xml:"user_id"`
+	DisplayName string   `json:"display_name" xml:"display_name"`
+	Bio         string   `json:"bio" xml:"bio"`
+	AvatarURL   string   `json:"avatar_url" xml:"avatar_url"`
+	Visibility  string   `json:"visibility" xml:"visibility"`
+}
+
+// VisibleTo() reports whether the profile can be viewed by the given user.
+func (p *Profile) VisibleTo(user *User) bool {
+	return p.Visibility == ProfilePublic || (!user.IsAnonymous() && user.ID == p.UserID)
+}
+
+func ValidateProfile(v *validator.Validator, profile *Profile) {
+	v.Check(utf8.RuneCountInString(profile.DisplayName) <= 50, "display_name", "must not be more than 50 characters long")
+	v.Check(utf8.RuneCountInString(profile.Bio) <= 500, "bio", "must not be more than 500 characters long")
+
+	if profile.AvatarURL != "" {
+		v.Check(len(profile.AvatarURL) <= 500, "avatar_url", "must not be more than 500 bytes long")
+
+		u, err := url.Parse(profile.AvatarURL)
+		v.Check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "avatar_url", "must be a valid http or https URL")
+	}
+
+	v.Check(validator.In(profile.Visibility, ProfilePublic, ProfilePrivate), "visibility", "must be public or private")
+}
+
+type ProfileModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the profile of the user with the given ID.
+func (m ProfileModel) Get(ctx context.Context, userID int64) (*Profile, error) {
+	stmt := `
+		SELECT id, display_name, bio, avatar_url, profile_visibility
+		FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var profile Profile
+
+	err := m.DB.QueryRowContext(ctx, stmt, userID).Scan(
+		&profile.UserID,
+		&profile.DisplayName,
+		&profile.Bio,
+		&profile.AvatarURL,
+		&profile.Visibility,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &profile, nil
+}
+
+// Update() saves the profile fields on the user's record. The user's version number is bumped as for any
+// other change to the record.
+func (m ProfileModel) Update(ctx context.Context, profile *Profile) error {
+	stmt := `
+		UPDATE users
+		SET display_name = $1, bio = $2, avatar_url = $3, profile_visibility = $4, version = version + 1
+		WHERE id = $5`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, profile.DisplayName, profile.Bio, profile.AvatarURL, profile.Visibility, profile.UserID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Rating is a user's rating of a movie, from 1 to 10. Each user has at most one rating per movie.
+type Rating struct {
+	XMLName   xml.Name  `json:"-" xml:"rating"`
+	ID        int64     `json:"id" xml:"id"`
+	UserID    int64     `json:"user_id" xml:"user_id"`
+	MovieID   int64     `json:"movie_id" xml:"movie_id"`
+	Rating    int       `json:"rating" xml:"value"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+}
+
+func ValidateRating(v *validator.Validator, rating *Rating) {
+	v.Check(rating.Rating != 0, "rating", "must be provided")
+	v.Check(rating.Rating >= 1 && rating.Rating <= 10, "rating", "must be between 1 and 10")
+}
+
+type RatingModel struct {
+	DB *sql.DB
+
+	// Cache, if not nil, is told which movies ratings change.
+	Cache MovieInvalidator
+}
+
+// Upsert() sets the user's rating of the movie, replacing any earlier rating, and reports whether a new rating was
+// created. An earlier rating keeps its ID and creation time. ErrRecordNotFound is returned if the movie doesn't
+// exist, such as when it is deleted at the same time.
+func (m RatingModel) Upsert(ctx context.Context, rating *Rating) (bool, error) {
+	stmt := `
+		INSERT INTO ratings (user_id, movie_id, rating)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, movie_id) DO UPDATE SET rating = EXCLUDED.rating
+		RETURNING id, created_at, xmax = 0`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var created bool
+
+	err := m.DB.QueryRowContext(ctx, stmt, rating.UserID, rating.MovieID, rating.Rating).Scan(&rating.ID, &rating.CreatedAt, &created)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "ratings" violates foreign key constraint "ratings_movie_id_fkey"`:
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	invalidateMovies(ctx, m.Cache, rating.MovieID)
+
+	return created, nil
+}
+
+// GetAllForMovie() returns a page of the ratings of the movie.
+func (m RatingModel) GetAllForMovie(ctx context.Context, movieID int64, filters Filters) ([]*Rating, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, user_id, movie_id, rating, created_at
+		FROM ratings
+		WHERE movie_id = $1
+		ORDER BY %s, id DESC
+		LIMIT $2 OFFSET $3`, filters.orderBy(""))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	ratings := []*Rating{}
+
+	for rows.Next() {
+		var rating Rating
+
+		err := rows.Scan(&totalRecords, &rating.ID, &rating.UserID, &rating.MovieID, &rating.Rating, &rating.CreatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		ratings = append(ratings, &rating)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return ratings, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Delete() deletes the rating, provided it belongs to the user. ErrRecordNotFound is returned otherwise.
+func (m RatingModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var movieID int64
+
+	err := m.DB.QueryRowContext(ctx, `DELETE FROM ratings WHERE id = $1 AND user_id = $2 RETURNING movie_id`, id, userID).Scan(&movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	invalidateMovies(ctx, m.Cache, movieID)
+
+	return nil
+}
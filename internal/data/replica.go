@@ -0,0 +1,90 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// Replica is a read replica of the primary database. Its replication lag is measured by Check(), and reads are
+// only sent to it while the lag is within MaxLag, so that clients don't see data which is too stale. A nil
+// *Replica means there is no replica, and every read goes to the primary.
+type Replica struct {
+	DB     *sql.DB
+	MaxLag time.Duration
+
+	mu        sync.RWMutex
+	lag       time.Duration
+	err       error
+	checkedAt time.Time
+}
+
+// ReplicaStatus is the result of the most recent replication lag check.
+type ReplicaStatus struct {
+	Lag       time.Duration
+	Err       error
+	CheckedAt time.Time
+	InUse     bool
+}
+
+// Check() measures the replica's replication lag, as the time since the last transaction it replayed. A
+// replica which has replayed everything it has received is up to date, however long ago that transaction was.
+func (r *Replica) Check(ctx context.Context) (time.Duration, error) {
+	stmt := `
+		SELECT CASE
+			WHEN NOT pg_is_in_recovery() THEN 0
+			WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var seconds float64
+
+	err := r.DB.QueryRowContext(ctx, stmt).Scan(&seconds)
+	lag := time.Duration(seconds * float64(time.Second))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lag, r.err, r.checkedAt = lag, err, time.Now()
+
+	return lag, err
+}
+
+// Status() returns the result of the most recent check.
+func (r *Replica) Status() ReplicaStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return ReplicaStatus{
+		Lag:       r.lag,
+		Err:       r.err,
+		CheckedAt: r.checkedAt,
+		InUse:     r.usable(),
+	}
+}
+
+// usable() reports whether reads can go to the replica: it has been checked, the check succeeded, and the lag
+// is within MaxLag. The caller must hold the lock.
+func (r *Replica) usable() bool {
+	return !r.checkedAt.IsZero() && r.err == nil && r.lag <= r.MaxLag
+}
+
+// Reader() returns the database to send reads to: the replica if it is usable, and primary otherwise.
+func (r *Replica) Reader(primary *sql.DB) *sql.DB {
+	if r == nil {
+		return primary
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.usable() {
+		return r.DB
+	}
+
+	return primary
+}
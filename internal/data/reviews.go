@@ -0,0 +1,270 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// Moderation statuses of a review. Only approved reviews are shown in the public listings.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+var ErrDuplicateReview = errors.New("duplicate review")
+
+// Review is a user's written review of a movie. Each user can review a movie once. Once its author's personal
+// data has been erased, a review's UserID is 0 and it is shown as written by a "deleted user".
+type Review struct {
+	XMLName     xml.Name   `json:"-" xml:"review"`
+	ID          int64      `json:"id" xml:"id"`
+	UserID      int64      `json:"user_id,omitempty" xml:"user_id,omitempty"`
+	Author      string     `json:"author,omitempty" xml:"author,omitempty"` // ErasedUserName for an anonymized review, otherwise empty.
+	MovieID     int64      `json:"movie_id" xml:"movie_id"`
+	CreatedAt   time.Time  `json:"created_at" xml:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" xml:"updated_at"`
+	Body        string     `json:"body" xml:"body"`
+	Status      string     `json:"status" xml:"status"`
+	ModeratedBy *int64     `json:"-" xml:"-"`
+	ModeratedAt *time.Time `json:"moderated_at" xml:"moderated_at,omitempty"` // Nil until a moderator approves or rejects it.
+	Version     int32      `json:"version" xml:"version"`
+}
+
+// WrittenBy() reports whether the review was written by the given user.
+func (r *Review) WrittenBy(user *User) bool {
+	return !user.IsAnonymous() && r.UserID == user.ID
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Body != "", "body", "must be provided")
+	v.Check(len(review.Body) <= 10000, "body", "must not be more than 10000 bytes long")
+}
+
+// ValidateReviewStatus() checks the status a moderator is setting.
+func ValidateReviewStatus(v *validator.Validator, status string) {
+	v.Check(status != "", "status", "must be provided")
+	v.Check(validator.In(status, ReviewPending, ReviewApproved, ReviewRejected), "status", "must be pending, approved or rejected")
+}
+
+type ReviewModel struct {
+	DB *sql.DB
+}
+
+const reviewColumns = `id, coalesce(user_id, 0), CASE WHEN user_id IS NULL THEN '` + ErasedUserName + `' ELSE '' END,
+	movie_id, created_at, updated_at, body, status, moderated_by, moderated_at, version`
+
+func scanReview(row interface{ Scan(...interface{}) error }, review *Review) error {
+	return row.Scan(
+		&review.ID,
+		&review.UserID,
+		&review.Author,
+		&review.MovieID,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+		&review.Body,
+		&review.Status,
+		&review.ModeratedBy,
+		&review.ModeratedAt,
+		&review.Version,
+	)
+}
+
+// Insert() adds a new, pending, review. ErrDuplicateReview is returned if the user has already reviewed the
+// movie, and ErrRecordNotFound if the movie doesn't exist.
+func (m ReviewModel) Insert(ctx context.Context, review *Review) error {
+	stmt := `
+		INSERT INTO reviews (user_id, movie_id, body)
+		VALUES ($1, $2, $3)
+		RETURNING ` + reviewColumns
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := scanReview(m.DB.QueryRowContext(ctx, stmt, review.UserID, review.MovieID, review.Body), review)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "reviews_user_id_movie_id_key"`:
+			return ErrDuplicateReview
+		case err.Error() == `pq: insert or update on table "reviews" violates foreign key constraint "reviews_movie_id_fkey"`:
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m ReviewModel) Get(ctx context.Context, id int64) (*Review, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var review Review
+
+	err := scanReview(m.DB.QueryRowContext(ctx, `SELECT `+reviewColumns+` FROM reviews WHERE id = $1`, id), &review)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &review, nil
+}
+
+// GetAllForMovie() returns a page of the movie's approved reviews.
+func (m ReviewModel) GetAllForMovie(ctx context.Context, movieID int64, filters Filters) ([]*Review, Metadata, error) {
+	return m.list(ctx, `movie_id = $1 AND status = 'approved'`, movieID, filters)
+}
+
+// GetAllForUser() returns a page of the user's reviews, whatever their status.
+func (m ReviewModel) GetAllForUser(ctx context.Context, userID int64, filters Filters) ([]*Review, Metadata, error) {
+	return m.list(ctx, `user_id = $1`, userID, filters)
+}
+
+// GetApprovedForUser() returns a page of the user's approved reviews, which are shown on their profile.
+func (m ReviewModel) GetApprovedForUser(ctx context.Context, userID int64, filters Filters) ([]*Review, Metadata, error) {
+	return m.list(ctx, `user_id = $1 AND status = 'approved'`, userID, filters)
+}
+
+// GetAllWithStatus() returns a page of the reviews with the status, or all reviews if status is empty, for
+// moderators.
+func (m ReviewModel) GetAllWithStatus(ctx context.Context, status string, filters Filters) ([]*Review, Metadata, error) {
+	return m.list(ctx, `(status = $1 OR $1 = '')`, status, filters)
+}
+
+// list() returns a page of the reviews matching the condition, which has a single placeholder, $1, for arg.
+func (m ReviewModel) list(ctx context.Context, condition string, arg interface{}, filters Filters) ([]*Review, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM reviews
+		WHERE %s
+		ORDER BY %s, id DESC
+		LIMIT $2 OFFSET $3`, reviewColumns, condition, filters.orderBy(""))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, arg, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := []*Review{}
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(
+			&totalRecords,
+			&review.ID,
+			&review.UserID,
+			&review.Author,
+			&review.MovieID,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Body,
+			&review.Status,
+			&review.ModeratedBy,
+			&review.ModeratedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return reviews, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Update() saves an edit of the review's body by its author. The review goes back to pending, as the new text
+// hasn't been moderated. ErrEditConflict is returned if the review has changed since it was read.
+func (m ReviewModel) Update(ctx context.Context, review *Review) error {
+	stmt := `
+		UPDATE reviews
+		SET body = $1, status = 'pending', moderated_by = NULL, moderated_at = NULL, updated_at = now(), version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING ` + reviewColumns
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := scanReview(m.DB.QueryRowContext(ctx, stmt, review.Body, review.ID, review.Version), review)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Moderate() sets the review's status on behalf of the moderator. ErrEditConflict is returned if the review has
+// changed since it was read.
+func (m ReviewModel) Moderate(ctx context.Context, review *Review, status string, moderatorID int64) error {
+	stmt := `
+		UPDATE reviews
+		SET status = $1, moderated_by = $2, moderated_at = now(), version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING ` + reviewColumns
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := scanReview(m.DB.QueryRowContext(ctx, stmt, status, moderatorID, review.ID, review.Version), review)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m ReviewModel) Delete(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM reviews WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -27,6 +27,12 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 	return []byte(quotedJSONValue), nil
 }
 
+// Implement MarshalText() so that encodings without their own marshaler interface, such as XML, use the same
+// '<runtime> mins' format. JSON still uses MarshalJSON(), which takes precedence.
+func (r Runtime) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d mins", r)), nil
+}
+
 // Implement UnmarshalJSON() method on the Runtime type so it satisfies the json.Unmarshaler interface.
 
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
@@ -0,0 +1,311 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/validator"
+)
+
+// MaxSavedSearches is the most saved searches a user can have.
+const MaxSavedSearches = 20
+
+var (
+	ErrDuplicateSavedSearch = errors.New("duplicate saved search")
+	ErrTooManySavedSearches = errors.New("too many saved searches")
+)
+
+// SavedSearch is a named set of movie search criteria, which is checked against newly added movies so that its
+// owner can be notified of new matches. The criteria have the same meaning as the movies listing's title,
+// genres and filter parameters.
+type SavedSearch struct {
+	XMLName     xml.Name  `json:"-" xml:"saved_search"`
+	ID          int64     `json:"id" xml:"id"`
+	UserID      int64     `json:"-" xml:"-"`
+	CreatedAt   time.Time `json:"created_at" xml:"created_at"`
+	Name        string    `json:"name" xml:"name"`
+	Title       string    `json:"title" xml:"title"`
+	Genres      []string  `json:"genres" xml:"genres>genre"`
+	Filter      string    `json:"filter" xml:"filter"`
+	NotifyEmail bool      `json:"notify_email" xml:"notify_email"`
+	// The highest movie ID checked against the search so far. Only movies added after it are new matches.
+	LastMovieID int64 `json:"-" xml:"-"`
+	Version     int32 `json:"version" xml:"version"`
+}
+
+// ValidateSavedSearch() checks the search's name and criteria. A search needs at least one criterion, as one
+// without any would match every new movie.
+func ValidateSavedSearch(v *validator.Validator, search *SavedSearch) {
+	v.Check(search.Name != "", "name", "must be provided")
+	v.Check(utf8.RuneCountInString(search.Name) <= 100, "name", "must not be more than 100 characters long")
+
+	v.Check(len(search.Title) <= 500, "title", "must not be more than 500 bytes long")
+
+	v.Check(len(search.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	v.Check(validator.Unique(search.Genres), "genres", "must not contain duplicate values")
+
+	if search.Filter != "" {
+		if _, err := ParseMovieFilter(search.Filter); err != nil {
+			v.AddError("filter", err.Error())
+		}
+	}
+
+	v.Check(search.Title != "" || len(search.Genres) > 0 || search.Filter != "", "search", "must have a title, genres or filter")
+}
+
+// SavedSearchCheck is a saved search with movies added since it was last checked, along with its owner's
+// details for sending a notification email.
+type SavedSearchCheck struct {
+	Search *SavedSearch
+	Name   string
+	Email  string
+	Locale string
+	// The highest movie ID when the check was selected. Movies with IDs from Search.LastMovieID+1 up to and
+	// including UpTo are new to the search.
+	UpTo int64
+}
+
+type SavedSearchModel struct {
+	DB *sql.DB
+}
+
+const savedSearchColumns = `s.id, s.user_id, s.created_at, s.name, s.title, s.genres, s.filter, s.notify_email, s.last_movie_id, s.version`
+
+func (s *SavedSearch) scanDest() []interface{} {
+	return []interface{}{&s.ID, &s.UserID, &s.CreatedAt, &s.Name, &s.Title, pq.Array(&s.Genres), &s.Filter, &s.NotifyEmail, &s.LastMovieID, &s.Version}
+}
+
+// Insert() adds a saved search, as long as the user has fewer than MaxSavedSearches already. The search only
+// matches movies added after it is saved, so its watermark starts at the highest existing movie ID.
+func (m SavedSearchModel) Insert(ctx context.Context, search *SavedSearch) error {
+	stmt := `
+		INSERT INTO saved_searches (user_id, name, title, genres, filter, notify_email, last_movie_id)
+		SELECT $1, $2, $3, $4, $5, $6, (SELECT coalesce(max(id), 0) FROM movies)
+		WHERE (SELECT count(*) FROM saved_searches WHERE user_id = $1) < $7
+		RETURNING id, created_at, last_movie_id, version`
+
+	args := []interface{}{search.UserID, search.Name, search.Title, pq.Array(search.Genres), search.Filter, search.NotifyEmail, MaxSavedSearches}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&search.ID, &search.CreatedAt, &search.LastMovieID, &search.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrTooManySavedSearches
+		case err.Error() == `pq: duplicate key value violates unique constraint "saved_searches_user_id_name_key"`:
+			return ErrDuplicateSavedSearch
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllForUser() returns all of the user's saved searches, oldest first. There are few enough that they aren't
+// paginated.
+func (m SavedSearchModel) GetAllForUser(ctx context.Context, userID int64) ([]*SavedSearch, error) {
+	stmt := `
+		SELECT ` + savedSearchColumns + `
+		FROM saved_searches s
+		WHERE s.user_id = $1
+		ORDER BY s.id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []*SavedSearch{}
+
+	for rows.Next() {
+		var search SavedSearch
+
+		err := rows.Scan(search.scanDest()...)
+		if err != nil {
+			return nil, err
+		}
+
+		searches = append(searches, &search)
+	}
+
+	return searches, rows.Err()
+}
+
+// Delete() removes the saved search with the given ID, as long as it belongs to the user. ErrRecordNotFound is
+// returned otherwise.
+func (m SavedSearchModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM saved_searches WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Due() returns up to limit saved searches, belonging to activated users, which haven't been checked against the
+// most recently added movies. The searches which have gone longest without a check come first.
+func (m SavedSearchModel) Due(ctx context.Context, limit int) ([]*SavedSearchCheck, error) {
+	stmt := `
+		SELECT ` + savedSearchColumns + `, u.name, u.email, u.locale, latest.id
+		FROM saved_searches s
+		INNER JOIN users u ON u.id = s.user_id,
+		(SELECT coalesce(max(id), 0) AS id FROM movies) latest
+		WHERE s.last_movie_id < latest.id AND u.activated
+		ORDER BY s.last_movie_id ASC, s.id ASC
+		LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := []*SavedSearchCheck{}
+
+	for rows.Next() {
+		check := SavedSearchCheck{Search: &SavedSearch{}}
+
+		err := rows.Scan(append(check.Search.scanDest(), &check.Name, &check.Email, &check.Locale, &check.UpTo)...)
+		if err != nil {
+			return nil, err
+		}
+
+		checks = append(checks, &check)
+	}
+
+	return checks, rows.Err()
+}
+
+// NewMatches() returns up to limit of the movies added since the search was last checked, up to and including
+// the movie with ID upTo, which match the search, newest first. The total number of matches is also returned.
+func (m SavedSearchModel) NewMatches(ctx context.Context, search *SavedSearch, upTo int64, limit int) ([]*Movie, int, error) {
+	// The filter expression is stored as text, so parse it again to build the condition.
+	var where *MovieFilter
+	if search.Filter != "" {
+		var err error
+		where, err = ParseMovieFilter(search.Filter)
+		if err != nil {
+			return nil, 0, fmt.Errorf("saved search %d: %w", search.ID, err)
+		}
+	}
+
+	// The filter expression's placeholders are numbered after the five used here.
+	condition, whereArgs := where.SQL(5)
+
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, movie_genre_names(id), version
+		FROM movies
+		WHERE id > $1 AND id <= $2
+		AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $3) OR $3 = '')
+		AND (%s OR $4 = '{}')
+		AND %s
+		ORDER BY id DESC
+		LIMIT $5`, genreFilterSQL("$4", false), condition)
+
+	args := append([]interface{}{search.LastMovieID, upTo, search.Title, pq.Array(search.Genres), limit}, whereArgs...)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	total := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(&total, &movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Version)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return movies, total, nil
+}
+
+// MarkChecked() records that the search has been checked against the movies up to and including the one with ID
+// upTo. If notification isn't nil it is inserted in the same transaction, so that the same matches are never
+// notified twice. The notification's ID is left as zero if the search had already been checked that far.
+func (m SavedSearchModel) MarkChecked(ctx context.Context, searchID, upTo int64, notification *Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Never move the watermark backwards. If another check of the same search has already got this far, it has
+	// notified the matches too.
+	result, err := tx.ExecContext(ctx, `UPDATE saved_searches SET last_movie_id = $2 WHERE id = $1 AND last_movie_id < $2`, searchID, upTo)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows > 0 && notification != nil {
+		js, err := json.Marshal(notification.Data)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO notifications (user_id, kind, message, data)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at`, notification.UserID, notification.Kind, notification.Message, js).Scan(&notification.ID, &notification.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,398 @@
+package data
+
+import (
+	"context"
+	"encoding/xml"
+	"html"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// MaxSearchQueryLength is the longest search query accepted, in bytes.
+const MaxSearchQueryLength = 200
+
+// SearchWordSimilarity is the pg_trgm word similarity (0-1) of a query to a title above which the title matches
+// even though the words don't, which is what lets a search tolerate typos. It is the default value of
+// pg_trgm.word_similarity_threshold, which the %> operator uses.
+const SearchWordSimilarity = 0.6
+
+// MovieSearchResult is a movie found by a search, with its relevance and its title highlighted.
+type MovieSearchResult struct {
+	XMLName xml.Name `json:"-" xml:"result"`
+	Movie   *Movie   `json:"movie" xml:"movie"`
+	// The relevance of the movie to the query, higher being better. It can only be compared with the ranks of
+	// other results of the same search.
+	Rank float64 `json:"rank" xml:"rank"`
+	// The title as HTML, with the words matching the query wrapped in <mark> elements.
+	Highlight string `json:"highlight" xml:"highlight"`
+}
+
+// SearchTerms() splits a search query into lower case words of letters and digits, which is how the 'simple'
+// text search configuration splits a title. A query without any has no terms.
+func SearchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// prefixTSQuery() returns a tsquery matching the titles with a word starting with each of the terms, such as
+// "godf:* & part:*". The terms only hold letters and digits, so they can't contain tsquery syntax.
+func prefixTSQuery(terms []string) string {
+	prefixes := make([]string, len(terms))
+	for i, term := range terms {
+		prefixes[i] = term + ":*"
+	}
+
+	return strings.Join(prefixes, " & ")
+}
+
+// wordSimilarity() approximates the pg_trgm word_similarity() function: the share of the query's trigrams found
+// in the title. Unlike pg_trgm it doesn't require the shared trigrams to be in one continuous part of the title.
+func wordSimilarity(query, title string) float64 {
+	tq, tt := trigrams(query), trigrams(title)
+	if len(tq) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for t := range tq {
+		if tt[t] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(tq))
+}
+
+// HighlightTerms() returns the text, such as a title or a name, as HTML, with each word which starts with one of
+// the terms, or is similar enough to one to be a typo of it, wrapped in a <mark> element.
+func HighlightTerms(text string, terms []string) string {
+	var sb strings.Builder
+
+	// Split the text into runs of word and non-word characters, keeping both so that the text is unchanged
+	// apart from the marks.
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+
+	runes := []rune(text)
+	for start := 0; start < len(runes); {
+		end := start + 1
+		for end < len(runes) && isWord(runes[end]) == isWord(runes[start]) {
+			end++
+		}
+
+		part := string(runes[start:end])
+
+		if isWord(runes[start]) && matchesTerm(strings.ToLower(part), terms) {
+			sb.WriteString("<mark>" + html.EscapeString(part) + "</mark>")
+		} else {
+			sb.WriteString(html.EscapeString(part))
+		}
+
+		start = end
+	}
+
+	return sb.String()
+}
+
+func matchesTerm(word string, terms []string) bool {
+	for _, term := range terms {
+		if strings.HasPrefix(word, term) || wordSimilarity(term, word) >= SearchWordSimilarity {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Search() returns a page of the movies whose titles match the query, most relevant first. A title matches if
+// it has a word starting with each of the query's terms, so that "godf" finds "The Godfather", or if it is
+// similar enough to the query by pg_trgm's word similarity, so that "godfahter" does too. Movies are ranked by
+// the sum of their text search rank and word similarity, so closer matches come first. The query must have at
+// least one term; see SearchTerms().
+func (m MovieModel) Search(ctx context.Context, query string, filters Filters) ([]*MovieSearchResult, Metadata, error) {
+	terms := SearchTerms(query)
+	if len(terms) == 0 {
+		return []*MovieSearchResult{}, Metadata{}, nil
+	}
+
+	// The trigram comparison is written with %> (title has a word similar to the query) rather than
+	// word_similarity(), so that it can use the trigram index on lower(title).
+	stmt := `
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, movie_genre_names(id), version, synopsis, language, country,
+			coalesce(imdb_id, ''), coalesce(tmdb_id, 0), poster_key,
+			ts_rank(to_tsvector('simple', title), to_tsquery('simple', $1)) + word_similarity($2, lower(title)) AS rank
+		FROM movies
+		WHERE to_tsvector('simple', title) @@ to_tsquery('simple', $1)
+		OR lower(title) %> $2
+		ORDER BY rank DESC, id ASC
+		LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.Replica.Reader(m.DB).QueryContext(ctx, stmt, prefixTSQuery(terms), strings.Join(terms, " "), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	results := []*MovieSearchResult{}
+
+	for rows.Next() {
+		result := MovieSearchResult{Movie: &Movie{}}
+		movie := result.Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.Synopsis,
+			&movie.Language,
+			&movie.Country,
+			&movie.IMDbID,
+			&movie.TMDbID,
+			&movie.PosterKey,
+			&result.Rank,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		result.Highlight = HighlightTerms(movie.Title, terms)
+
+		results = append(results, &result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return results, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Search() gets the first offset+limit results from every shard, and merges them by rank to find the requested
+// page, like GetAll().
+func (m ShardedMovieModel) Search(ctx context.Context, query string, filters Filters) ([]*MovieSearchResult, Metadata, error) {
+	shardFilters := filters
+	shardFilters.Page = 1
+	shardFilters.PageSize = filters.offset() + filters.limit()
+
+	totalRecords := 0
+	results := []*MovieSearchResult{}
+
+	for _, shard := range m.Shards {
+		shardResults, metadata, err := shard.model().Search(ctx, query, shardFilters)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		totalRecords += metadata.TotalRecords
+		results = append(results, shardResults...)
+	}
+
+	sortSearchResults(results)
+
+	start := min(filters.offset(), len(results))
+	end := min(start+filters.limit(), len(results))
+
+	return results[start:end], calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Search() applies the same rules as the PostgreSQL implementation, with an approximation of pg_trgm's
+// word_similarity() and a rank which only counts how many of the title's words match the terms in place of
+// ts_rank().
+func (m memoryMovieModel) Search(ctx context.Context, query string, filters Filters) ([]*MovieSearchResult, Metadata, error) {
+	terms := SearchTerms(query)
+	if len(terms) == 0 {
+		return []*MovieSearchResult{}, Metadata{}, nil
+	}
+
+	joined := strings.Join(terms, " ")
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	results := []*MovieSearchResult{}
+
+	for _, movie := range m.s.movies {
+		words := SearchTerms(movie.Title)
+
+		prefixed := 0
+		for _, term := range terms {
+			for _, word := range words {
+				if strings.HasPrefix(word, term) {
+					prefixed++
+					break
+				}
+			}
+		}
+
+		similarity := wordSimilarity(joined, strings.ToLower(movie.Title))
+
+		if prefixed < len(terms) && similarity < SearchWordSimilarity {
+			continue
+		}
+
+		rank := similarity
+		if prefixed == len(terms) {
+			rank += float64(prefixed) / float64(len(words)) / 10
+		}
+
+		results = append(results, &MovieSearchResult{
+			Movie:     copyMovie(movie),
+			Rank:      rank,
+			Highlight: HighlightTerms(movie.Title, terms),
+		})
+	}
+
+	sortSearchResults(results)
+
+	total := len(results)
+
+	start := min(filters.offset(), total)
+	end := min(start+filters.limit(), total)
+
+	return results[start:end], calculateMetadata(total, filters.Page, filters.PageSize), nil
+}
+
+// sortSearchResults() sorts search results as the SQL query does: highest rank first, then by ID.
+func sortSearchResults(results []*MovieSearchResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+
+		return results[i].Movie.ID < results[j].Movie.ID
+	})
+}
+
+// PersonSearchResult is a person found by a search, with their relevance and their name highlighted.
+type PersonSearchResult struct {
+	XMLName   xml.Name `json:"-" xml:"result"`
+	Person    *Person  `json:"person" xml:"person"`
+	Rank      float64  `json:"rank" xml:"rank"`
+	Highlight string   `json:"highlight" xml:"highlight"`
+}
+
+// Search() returns a page of the people whose names match the query, most relevant first, by the same rules as
+// MovieModel.Search() applies to titles.
+func (m PeopleModel) Search(ctx context.Context, query string, filters Filters) ([]*PersonSearchResult, Metadata, error) {
+	terms := SearchTerms(query)
+	if len(terms) == 0 {
+		return []*PersonSearchResult{}, Metadata{}, nil
+	}
+
+	stmt := `
+		SELECT count(*) OVER(), id, created_at, name, birth_year, bio, version,
+			ts_rank(to_tsvector('simple', name), to_tsquery('simple', $1)) + word_similarity($2, lower(name)) AS rank
+		FROM people
+		WHERE to_tsvector('simple', name) @@ to_tsquery('simple', $1)
+		OR lower(name) %> $2
+		ORDER BY rank DESC, id ASC
+		LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, prefixTSQuery(terms), strings.Join(terms, " "), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	results := []*PersonSearchResult{}
+
+	for rows.Next() {
+		result := PersonSearchResult{Person: &Person{}}
+		person := result.Person
+
+		err := rows.Scan(&totalRecords, &person.ID, &person.CreatedAt, &person.Name, &person.BirthYear, &person.Bio, &person.Version, &result.Rank)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		result.Highlight = HighlightTerms(person.Name, terms)
+
+		results = append(results, &result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return results, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// UserSearchResult is a user found by a search, with their relevance and their name highlighted.
+type UserSearchResult struct {
+	XMLName   xml.Name `json:"-" xml:"result"`
+	User      *User    `json:"user" xml:"user"`
+	Rank      float64  `json:"rank" xml:"rank"`
+	Highlight string   `json:"highlight" xml:"highlight"`
+}
+
+// Search() returns a page of the users whose names match the query, by the same rules as MovieModel.Search()
+// applies to titles, or whose email addresses start with it. An email address match ranks above any name match.
+// Erased users are left out.
+func (m AdminUserModel) Search(ctx context.Context, query string, filters Filters) ([]*UserSearchResult, Metadata, error) {
+	terms := SearchTerms(query)
+	if len(terms) == 0 {
+		return []*UserSearchResult{}, Metadata{}, nil
+	}
+
+	// Escape the LIKE wildcards, so that the query is matched literally.
+	emailPrefix := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(strings.TrimSpace(query))) + "%"
+
+	stmt := `
+		SELECT count(*) OVER(), id, created_at, name, email, activated, locale, version,
+			CASE WHEN lower(email::text) LIKE $3 THEN 1 ELSE 0 END
+				+ ts_rank(to_tsvector('simple', name), to_tsquery('simple', $1)) + word_similarity($2, lower(name)) AS rank
+		FROM users
+		WHERE erased_at IS NULL
+		AND (to_tsvector('simple', name) @@ to_tsquery('simple', $1) OR lower(name) %> $2 OR lower(email::text) LIKE $3)
+		ORDER BY rank DESC, id ASC
+		LIMIT $4 OFFSET $5`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, prefixTSQuery(terms), strings.Join(terms, " "), emailPrefix, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	results := []*UserSearchResult{}
+
+	for rows.Next() {
+		result := UserSearchResult{User: &User{}}
+		user := result.User
+
+		err := rows.Scan(&totalRecords, &user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Activated, &user.Locale, &user.Version, &result.Rank)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		result.Highlight = HighlightTerms(user.Name, terms)
+
+		results = append(results, &result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return results, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
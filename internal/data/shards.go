@@ -0,0 +1,264 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShardSpec describes a database holding the movies with IDs from MinID up to and including MaxID. A MaxID of
+// zero means the range has no upper bound.
+type ShardSpec struct {
+	MinID int64
+	MaxID int64
+	DSN   string
+}
+
+// ParseShardSpec() parses a shard in the form "MIN-MAX=DSN", such as "1000000-1999999=postgres://...", or
+// "MIN-=DSN" for a shard with no upper bound.
+func ParseShardSpec(s string) (ShardSpec, error) {
+	ids, dsn, ok := strings.Cut(s, "=")
+	if !ok || dsn == "" {
+		return ShardSpec{}, errors.New("shard must be in the form MIN-MAX=DSN")
+	}
+
+	lo, hi, ok := strings.Cut(ids, "-")
+	if !ok {
+		return ShardSpec{}, errors.New("shard must be in the form MIN-MAX=DSN")
+	}
+
+	spec := ShardSpec{DSN: dsn}
+
+	var err error
+
+	spec.MinID, err = strconv.ParseInt(lo, 10, 64)
+	if err != nil || spec.MinID < 1 {
+		return ShardSpec{}, fmt.Errorf("invalid shard minimum ID %q", lo)
+	}
+
+	if hi != "" {
+		spec.MaxID, err = strconv.ParseInt(hi, 10, 64)
+		if err != nil || spec.MaxID < spec.MinID {
+			return ShardSpec{}, fmt.Errorf("invalid shard maximum ID %q", hi)
+		}
+	}
+
+	return spec, nil
+}
+
+// ValidateShardSpecs() checks that the shards, in order, cover consecutive ranges of IDs, starting above the IDs
+// kept in the main database, and that only the last is unbounded.
+func ValidateShardSpecs(specs []ShardSpec) error {
+	for i, spec := range specs {
+		last := i == len(specs)-1
+
+		switch {
+		case i == 0 && spec.MinID < 2:
+			return errors.New("the first shard must start above ID 1, as the main database holds the lowest IDs")
+		case i > 0 && spec.MinID != specs[i-1].MaxID+1:
+			return fmt.Errorf("shard starting at ID %d must start straight after the previous shard", spec.MinID)
+		case last && spec.MaxID != 0:
+			return errors.New("the last shard must have no maximum ID, as new movies are inserted into it")
+		case !last && spec.MaxID == 0:
+			return errors.New("only the last shard can have no maximum ID")
+		}
+	}
+
+	return nil
+}
+
+// Shard is a database holding a range of movie IDs. See ShardSpec. Replica, if not nil, is a read replica of
+// the shard.
+type Shard struct {
+	DB      *sql.DB
+	Replica *Replica
+	MinID   int64
+	MaxID   int64
+}
+
+func (s Shard) model() MovieModel {
+	return MovieModel{DB: s.DB, Replica: s.Replica}
+}
+
+func (s Shard) holds(id int64) bool {
+	return id >= s.MinID && (s.MaxID == 0 || id <= s.MaxID)
+}
+
+// PrepareShardSequence() makes sure the shard's movie ID sequence will hand out IDs in its range, by moving it
+// up to the shard's first ID if it is below it. It reports whether the sequence was moved.
+func PrepareShardSequence(ctx context.Context, shard Shard) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var moved bool
+
+	err := shard.DB.QueryRowContext(ctx, `
+		SELECT CASE WHEN last_value < $1 THEN setval('movies_id_seq', $1, false) IS NOT NULL ELSE false END
+		FROM movies_id_seq`, shard.MinID).Scan(&moved)
+
+	return moved, err
+}
+
+// ShardedMovieModel is a MovieStore which splits the movies across several databases by ID range. Lookups by
+// ID go to the shard holding the ID, new movies are inserted into the last shard (which has no upper bound), and
+// listings query every shard and merge the results.
+//
+// The shards must be in ascending order of ID, and each one's movie ID sequence must hand out IDs in its range;
+// PrepareShardSequence() sees to that for the last shard. Other tables which refer to movies, such as lists and
+// ratings, stay in the main database, which is the first shard.
+type ShardedMovieModel struct {
+	Shards []Shard
+}
+
+// shard() returns the model for the shard holding the ID.
+func (m ShardedMovieModel) shard(id int64) (MovieModel, bool) {
+	for _, shard := range m.Shards {
+		if shard.holds(id) {
+			return shard.model(), true
+		}
+	}
+
+	return MovieModel{}, false
+}
+
+// GetAll() gets the first offset+limit matching movies from every shard, and merges them to find the requested
+// page, so deep pages get steadily more expensive. Titles are compared byte by byte when merging, which may
+// order some titles differently from the database's collation.
+func (m ShardedMovieModel) GetAll(ctx context.Context, title string, genres, anyGenres []string, directorID int64, where *MovieFilter, filters Filters) ([]*Movie, Metadata, error) {
+	shardFilters := filters
+	shardFilters.Page = 1
+	shardFilters.PageSize = filters.offset() + filters.limit()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for _, shard := range m.Shards {
+		shardMovies, metadata, err := shard.model().GetAll(ctx, title, genres, anyGenres, directorID, where, shardFilters)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		totalRecords += metadata.TotalRecords
+		movies = append(movies, shardMovies...)
+	}
+
+	keys := filters.sortKeys()
+
+	sort.SliceStable(movies, func(i, j int) bool {
+		a, b := movies[i], movies[j]
+
+		if c := compareMovies(a, b, keys); c != 0 {
+			return c < 0
+		}
+
+		return a.ID < b.ID
+	})
+
+	start := min(filters.offset(), len(movies))
+	end := min(start+filters.limit(), len(movies))
+
+	return movies[start:end], calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// compareMovies() compares movies a and b on each of the sort keys in turn, returning a negative number if a
+// sorts first, a positive number if b does, and zero if they're equal on every key.
+func compareMovies(a, b *Movie, keys []sortKey) int {
+	for _, key := range keys {
+		var c int
+		switch key.column {
+		case "title":
+			c = strings.Compare(a.Title, b.Title)
+		case "year":
+			c = cmp.Compare(a.Year, b.Year)
+		case "runtime":
+			c = cmp.Compare(a.Runtime, b.Runtime)
+		default:
+			c = cmp.Compare(a.ID, b.ID)
+		}
+
+		if key.descending {
+			c = -c
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// Insert() adds the movie to the last shard.
+func (m ShardedMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	return m.Shards[len(m.Shards)-1].model().Insert(ctx, movie)
+}
+
+func (m ShardedMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	shard, ok := m.shard(id)
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return shard.Get(ctx, id)
+}
+
+func (m ShardedMovieModel) Update(ctx context.Context, movie *Movie) error {
+	shard, ok := m.shard(movie.ID)
+	if !ok {
+		return ErrEditConflict
+	}
+
+	return shard.Update(ctx, movie)
+}
+
+func (m ShardedMovieModel) Delete(ctx context.Context, id int64) error {
+	shard, ok := m.shard(id)
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	return shard.Delete(ctx, id)
+}
+
+// PossibleDuplicates() returns up to 5 likely duplicates from across the shards, those from the lowest IDs'
+// shards first.
+func (m ShardedMovieModel) PossibleDuplicates(ctx context.Context, movie *Movie) ([]*Movie, error) {
+	movies := []*Movie{}
+
+	for _, shard := range m.Shards {
+		shardMovies, err := shard.model().PossibleDuplicates(ctx, movie)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, shardMovies...)
+		if len(movies) >= 5 {
+			return movies[:5], nil
+		}
+	}
+
+	return movies, nil
+}
+
+// Stream() streams the movies from each shard in turn. As the shards hold ascending ranges of IDs, the movies
+// are still in ascending ID order.
+func (m ShardedMovieModel) Stream(ctx context.Context, title string, genres []string, afterID int64, batchSize int, fn func(*Movie) error) error {
+	for _, shard := range m.Shards {
+		if shard.MaxID != 0 && shard.MaxID <= afterID {
+			continue
+		}
+
+		err := shard.model().Stream(ctx, title, genres, max(afterID, shard.MinID-1), batchSize, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// Token hashing algorithm versions. The version is stored alongside each token hash, so that the
+// scheme can change without invalidating tokens which have already been issued.
+const (
+	TokenHashSHA256     int16 = 1
+	TokenHashHMACSHA256 int16 = 2
+)
+
+// TokenHasher computes the hash of a plaintext token which is stored in the tokens table.
+type TokenHasher interface {
+	Version() int16
+	Hash(tokenPlaintext string) []byte
+}
+
+// SHA256Hasher hashes tokens with a plain SHA-256 digest.
+type SHA256Hasher struct{}
+
+func (SHA256Hasher) Version() int16 {
+	return TokenHashSHA256
+}
+
+func (SHA256Hasher) Hash(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+
+// HMACHasher hashes tokens with HMAC-SHA-256 keyed with a server secret. Unlike a plain digest, a leaked
+// copy of the tokens table can't be used to check guesses without also knowing the key.
+type HMACHasher struct {
+	Key []byte
+}
+
+func (HMACHasher) Version() int16 {
+	return TokenHashHMACSHA256
+}
+
+func (h HMACHasher) Hash(tokenPlaintext string) []byte {
+	mac := hmac.New(sha256.New, h.Key)
+	mac.Write([]byte(tokenPlaintext))
+	return mac.Sum(nil)
+}
+
+// TokenHashing holds the hasher used for newly issued tokens, plus any older hashers whose tokens are
+// still accepted until they expire. The zero value uses SHA-256 for everything.
+type TokenHashing struct {
+	Current TokenHasher
+	Legacy  []TokenHasher
+}
+
+// current() returns the hasher for new tokens, falling back to SHA-256 if none is configured.
+func (th TokenHashing) current() TokenHasher {
+	if th.Current == nil {
+		return SHA256Hasher{}
+	}
+
+	return th.Current
+}
+
+// candidates() returns the hash of the plaintext token under every accepted hasher, current one first.
+// These are used to look up a token regardless of which algorithm version it was stored with.
+func (th TokenHashing) candidates(tokenPlaintext string) [][]byte {
+	hashes := [][]byte{th.current().Hash(tokenPlaintext)}
+
+	for _, h := range th.Legacy {
+		hashes = append(hashes, h.Hash(tokenPlaintext))
+	}
+
+	return hashes
+}
+
+// VerifyTokenHash() reports whether the plaintext token hashes to the given value under the hasher. The
+// comparison runs in constant time, so it can be used wherever a hash is checked in application code.
+func VerifyTokenHash(h TokenHasher, tokenPlaintext string, hash []byte) bool {
+	return subtle.ConstantTimeCompare(h.Hash(tokenPlaintext), hash) == 1
+}
+
+// hasher() returns the accepted hasher with the given version, or nil if tokens hashed with that version are no
+// longer accepted.
+func (th TokenHashing) hasher(version int16) TokenHasher {
+	if th.current().Version() == version {
+		return th.current()
+	}
+
+	for _, h := range th.Legacy {
+		if h.Version() == version {
+			return h
+		}
+	}
+
+	return nil
+}
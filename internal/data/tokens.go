@@ -3,36 +3,70 @@ package data
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/xml"
+	"errors"
 	"time"
 
 	"github.com/micypac/flick-info/internal/validator"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/clock"
 )
 
 // Define constants for the token scope.
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeEmailChange    = "email-change"
 )
 
+// TokenMetadata holds details about the client which requested a token, captured when the token is created.
+type TokenMetadata struct {
+	ClientIP   string `json:"client_ip" xml:"client_ip"`
+	UserAgent  string `json:"user_agent" xml:"user_agent"`
+	DeviceName string `json:"device_name,omitempty" xml:"device_name,omitempty"` // Optional name supplied by the client, e.g. "Work laptop".
+}
+
 // Token struct definition that holds the data for a token.
-// This includes plaintext and hashed versions of the token, associated user ID, expiry time, and scope.
+// This includes plaintext and hashed versions of the token, associated user ID, expiry time, scope, and client metadata.
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	XMLName     xml.Name      `json:"-" xml:"token"`
+	Plaintext   string        `json:"token" xml:"token"`
+	Hash        []byte        `json:"-" xml:"-"`
+	HashVersion int16         `json:"-" xml:"-"`
+	UserID      int64         `json:"-" xml:"-"`
+	Expiry      time.Time     `json:"expiry" xml:"expiry"`
+	Scope       string        `json:"-" xml:"-"`
+	Metadata    TokenMetadata `json:"-" xml:"-"`
 }
 
-func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	// Create Token instance containing the userID, expiry, and scope information.
+// The last use of an authentication token is only recorded when the previous one is at least this old, so that
+// the tokens table isn't written to on every request.
+const tokenLastUsedInterval = time.Minute
+
+// Session describes an outstanding authentication token, so that users can see where they're logged in and
+// revoke the logins they don't recognize.
+type Session struct {
+	XMLName    xml.Name   `json:"-" xml:"session"`
+	ID         int64      `json:"id" xml:"id"`
+	CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+	Expiry     time.Time  `json:"expiry" xml:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at" xml:"last_used_at,omitempty"` // Nil if the token has never been used.
+	TokenMetadata
+	Current bool `json:"current" xml:"current"` // Whether this is the token the request was made with.
+}
+
+func generateToken(userID int64, expiry time.Time, scope string, hasher TokenHasher, metadata TokenMetadata) (*Token, error) {
+	// Create Token instance containing the userID, expiry, scope, and client metadata information.
 	token := &Token{
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		UserID:   userID,
+		Expiry:   expiry,
+		Scope:    scope,
+		Metadata: metadata,
 	}
 
 	// Initialize a zero-value byte slice with a length of 16 bytes.
@@ -50,9 +84,9 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	// Note: By default base32 string may be padded at the end with '=' character. Use WithPadding(base32.NoPadding) to omit them.
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 
-	// Generate a SHA-256 hash of plaintext token string.
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	// Hash the plaintext token string, recording which algorithm version was used.
+	token.Hash = hasher.Hash(token.Plaintext)
+	token.HashVersion = hasher.Version()
 
 	return token, nil
 }
@@ -63,43 +97,327 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
+// Check that the optional client-supplied device name is a sensible length.
+func ValidateDeviceName(v *validator.Validator, deviceName string) {
+	v.Check(len(deviceName) <= 100, "device_name", "must not be more than 100 bytes long")
+}
+
+// SlidingExpiry holds the settings for extending authentication tokens while they are in active use.
+// Each use moves the expiry to TTL from now, but never beyond MaxLifetime after the token was created. To avoid
+// writing to the tokens table on every request, the expiry is only bumped once it would move by at least Interval.
+type SlidingExpiry struct {
+	Enabled     bool
+	TTL         time.Duration
+	MaxLifetime time.Duration
+	Interval    time.Duration
+}
+
+// next() returns the new expiry, as of now, for a token with the given current expiry and creation time, and
+// whether it has moved far enough to be worth saving.
+func (s SlidingExpiry) next(now, expiry, createdAt time.Time) (time.Time, bool) {
+	newExpiry := now.Add(s.TTL)
+
+	if limit := createdAt.Add(s.MaxLifetime); newExpiry.After(limit) {
+		newExpiry = limit
+	}
+
+	return newExpiry, newExpiry.Sub(expiry) >= s.Interval
+}
+
 // TokenModel type.
 type TokenModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Hashing TokenHashing
+	Clock   clock.Clock
 }
 
 // New() method creates a new Token struct then inserts the data in the tokens table.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	token, err := generateToken(userID, ttl, scope)
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string, metadata TokenMetadata) (*Token, error) {
+	token, err := generateToken(userID, m.Clock.Now().Add(ttl), scope, m.Hashing.current(), metadata)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
 // Insert() method adds the data for a specific token to the tokens table.
-func (m TokenModel) Insert(token *Token) error {
-	stmt := `INSERT INTO tokens (hash, user_id, expiry, scope) VALUES($1, $2, $3, $4)`
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	defer cancel()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return insertToken(ctx, m.DB, token)
+}
 
-	defer cancel()
+// insertToken() adds the token to the tokens table, using either the connection pool or a transaction.
+func insertToken(ctx context.Context, db interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}, token *Token) error {
+	stmt := `
+		INSERT INTO tokens (hash, hash_version, user_id, expiry, scope, client_ip, user_agent, device_name)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)`
 
-	_, err := m.DB.ExecContext(ctx, stmt, args...)
+	args := []interface{}{
+		token.Hash,
+		token.HashVersion,
+		token.UserID,
+		token.Expiry,
+		token.Scope,
+		token.Metadata.ClientIP,
+		token.Metadata.UserAgent,
+		token.Metadata.DeviceName,
+	}
+
+	_, err := db.ExecContext(ctx, stmt, args...)
 	return err
 }
 
+// Refresh() exchanges a refresh token for a new authentication token and a new refresh token, with the given
+// lifetimes. The old refresh token is deleted in the same transaction, so each refresh token can only be used
+// once, and a stolen refresh token stops working as soon as its owner refreshes. The new tokens keep the device
+// name of the old one, with the client details from metadata. If the refresh token is invalid, expired or has
+// already been used, ErrRecordNotFound is returned.
+func (m TokenModel) Refresh(ctx context.Context, refreshPlaintext string, authTTL, refreshTTL time.Duration, metadata TokenMetadata) (*Token, *Token, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+		DELETE FROM tokens
+		WHERE hash = ANY($1) AND scope = $2 AND expiry > $3
+		RETURNING user_id, device_name`
+
+	now := m.Clock.Now()
+
+	var userID int64
+
+	err = tx.QueryRowContext(ctx, stmt, pq.Array(m.Hashing.candidates(refreshPlaintext)), ScopeRefresh, now).Scan(&userID, &metadata.DeviceName)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	authToken, err := generateToken(userID, now.Add(authTTL), ScopeAuthentication, m.Hashing.current(), metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := generateToken(userID, now.Add(refreshTTL), ScopeRefresh, m.Hashing.current(), metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, token := range []*Token{authToken, refreshToken} {
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return authToken, refreshToken, nil
+}
+
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	stmt := `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, stmt, scope, userID)
 	return err
 }
+
+// DeleteByHash() deletes the token of the scope with the plaintext, which is found by its hash under every
+// accepted hashing algorithm version. Deleting a token which doesn't exist isn't an error, so revoking a token
+// twice is harmless.
+func (m TokenModel) DeleteByHash(ctx context.Context, scope, tokenPlaintext string) error {
+	stmt := `DELETE FROM tokens WHERE scope = $1 AND hash = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, stmt, scope, pq.Array(m.Hashing.candidates(tokenPlaintext)))
+	return err
+}
+
+// GetSessionsForUser() returns the user's unexpired authentication tokens, most recently created first. The one
+// whose plaintext is currentPlaintext, if any, is marked as the current session.
+func (m TokenModel) GetSessionsForUser(ctx context.Context, userID int64, currentPlaintext string) ([]*Session, error) {
+	stmt := `
+		SELECT id, created_at, expiry, last_used_at, client_ip, user_agent, device_name, hash = ANY($4)
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND expiry > $3
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{ScopeAuthentication, userID, m.Clock.Now(), pq.Array(m.Hashing.candidates(currentPlaintext))}
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.Expiry,
+			&session.LastUsedAt,
+			&session.ClientIP,
+			&session.UserAgent,
+			&session.DeviceName,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession() revokes one of the user's authentication tokens by its ID. If the user has no such token,
+// ErrRecordNotFound is returned. The refresh token issued alongside it isn't linked to it, so it's left alone.
+func (m TokenModel) DeleteSession(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	stmt := `
+		DELETE FROM tokens
+		WHERE id = $1 AND user_id = $2 AND scope = $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, stmt, id, userID, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// IsKnownDevice() reports whether the user already holds a token of the given scope which was issued to the
+// same client IP address or user agent. A user with no tokens at all is treated as known, so that the very
+// first login isn't flagged. This is used to spot logins from unrecognized devices.
+func (m TokenModel) IsKnownDevice(ctx context.Context, scope string, userID int64, metadata TokenMetadata) (bool, error) {
+	stmt := `
+		SELECT count(*), count(*) FILTER (WHERE client_ip = $3 OR user_agent = $4)
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2`
+
+	var total, matching int
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, scope, userID, metadata.ClientIP, metadata.UserAgent).Scan(&total, &matching)
+	if err != nil {
+		return false, err
+	}
+
+	return total == 0 || matching > 0, nil
+}
+
+// DeleteExpired() deletes all expired tokens, regardless of the user or scope. The rows are deleted in
+// batches of batchSize so that a large backlog doesn't hold locks on the tokens table for too long.
+// It returns the total number of rows deleted.
+func (m TokenModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	stmt := `
+		DELETE FROM tokens
+		WHERE hash IN (
+			SELECT hash FROM tokens
+			WHERE expiry < $1
+			LIMIT $2
+		)`
+
+	var total int64
+
+	for {
+		ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+
+		result, err := m.DB.ExecContext(ctx, stmt, m.Clock.Now(), batchSize)
+		cancel()
+		if err != nil {
+			return total, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+
+		total += rowsAffected
+
+		// A partial batch means there are no more expired tokens left to delete.
+		if rowsAffected < int64(batchSize) {
+			return total, nil
+		}
+	}
+}
+
+// consumeToken() deletes a single token with the given scope, which hasn't expired as of now, inside the
+// transaction tx and returns the ID of the user it belonged to. Because the DELETE takes a row lock, a concurrent
+// attempt to consume the same token blocks until tx finishes and then finds no row, so each token can only ever
+// be redeemed once. If there is no matching token, ErrRecordNotFound is returned.
+func consumeToken(ctx context.Context, tx *sql.Tx, hashing TokenHashing, scope, tokenPlaintext string, now time.Time) (int64, error) {
+	stmt := `
+		DELETE FROM tokens
+		WHERE hash = ANY($1) AND scope = $2 AND expiry > $3
+		RETURNING user_id`
+
+	var userID int64
+
+	err := tx.QueryRowContext(ctx, stmt, pq.Array(hashing.candidates(tokenPlaintext)), scope, now).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// UserState is what a particular user has done with a movie: whether they've watched it, whether it's on their
+// watchlist, and their rating out of 10 (nil if they haven't rated it).
+type UserState struct {
+	XMLName     xml.Name `json:"-" xml:"user_state"`
+	Watched     bool     `json:"watched" xml:"watched"`
+	InWatchlist bool     `json:"in_watchlist" xml:"in_watchlist"`
+	UserRating  *int     `json:"user_rating" xml:"user_rating,omitempty"`
+}
+
+type UserStateModel struct {
+	DB *sql.DB
+}
+
+// Attach() sets the UserState of each movie for the given user. The state of all the movies is looked up with a
+// single query, so that listing a page of movies doesn't take a query per movie.
+func (m UserStateModel) Attach(ctx context.Context, userID int64, movies ...*Movie) error {
+	if len(movies) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(movies))
+	for i, movie := range movies {
+		ids[i] = movie.ID
+	}
+
+	stmt := `
+		SELECT m.id,
+			EXISTS (SELECT 1 FROM watch_history h WHERE h.user_id = $1 AND h.movie_id = m.id),
+			EXISTS (SELECT 1 FROM watchlist w WHERE w.user_id = $1 AND w.movie_id = m.id),
+			r.rating
+		FROM unnest($2::bigint[]) AS m(id)
+		LEFT JOIN ratings r ON r.user_id = $1 AND r.movie_id = m.id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	states := make(map[int64]*UserState, len(movies))
+
+	for rows.Next() {
+		var id int64
+		var state UserState
+		var rating sql.NullInt32
+
+		err := rows.Scan(&id, &state.Watched, &state.InWatchlist, &rating)
+		if err != nil {
+			return err
+		}
+
+		if rating.Valid {
+			value := int(rating.Int32)
+			state.UserRating = &value
+		}
+
+		states[id] = &state
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, movie := range movies {
+		movie.UserState = states[movie.ID]
+	}
+
+	return nil
+}
@@ -2,13 +2,16 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
+	"encoding/xml"
 	"errors"
 	"time"
 
 	"github.com/micypac/flick-info/internal/validator"
 	"golang.org/x/crypto/bcrypt"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/clock"
 )
 
 // Custom ErrDuplicateEmail error to represent a violation of the "users_email_key" constraint.
@@ -20,19 +23,41 @@ var AnonymousUser = &User{}
 
 // Definition of User struct to represent individual user records.
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	XMLName   xml.Name  `json:"-" xml:"user"`
+	ID        int64     `json:"id" xml:"id"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+	Name      string    `json:"name" xml:"name"`
+	Email     string    `json:"email" xml:"email"`
+	Password  password  `json:"-" xml:"-"`
+	Activated bool      `json:"activated" xml:"activated"`
+	Locale    string    `json:"locale" xml:"locale"` // Language of the user's emails, as an ISO 639-1 code.
+	Version   int       `json:"-" xml:"-"`
 }
 
+// DefaultLocale is the locale of users who haven't chosen one.
+const DefaultLocale = "en"
+
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// PasswordCost is the bcrypt cost used to hash new passwords. It should only be changed at startup, before any
+// passwords are hashed. Passwords hashed with a different cost still match, as the cost is stored in the hash.
+var PasswordCost = 12
+
+// BenchmarkPasswordCost() returns how long it takes to hash a password with the given bcrypt cost. Logins take
+// about this long, as checking a password costs the same as hashing it.
+func BenchmarkPasswordCost(cost int) (time.Duration, error) {
+	start := time.Now()
+
+	_, err := bcrypt.GenerateFromPassword([]byte("benchmark password"), cost)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
+
 // Custom password type containing the plain text and hashed versions of the password.
 type password struct {
 	plaintext *string
@@ -41,7 +66,7 @@ type password struct {
 
 // Set() method calculates the bcrypt hash of the plaintext password and stores both the plain and hashed version in the struct.
 func (p *password) Set(plaintextPW string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPW), 12)
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPW), PasswordCost)
 	if err != nil {
 		return err
 	}
@@ -84,6 +109,8 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 	ValidateEmail(v, user.Email)
 
+	v.Check(ValidLanguage(user.Locale), "locale", "must be a lower case ISO 639-1 language code, such as en")
+
 	// If the password plaintext is not nil, call the ValidatePasswordPlaintext() helper.
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plaintext)
@@ -96,20 +123,23 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // UserModel struct to hold the methods for querying and modifying user records in the database.
 type UserModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Hashing TokenHashing
+	Sliding SlidingExpiry
+	Clock   clock.Clock
 }
 
 // Insert() method to add a new user record to the users table.
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	stmt := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO users (name, email, password_hash, activated, locale)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, created_at, version
 	`
 
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.Locale}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// If the table already contains a user with the same email address, the query will fail with a UNIQUE constraint.
@@ -126,16 +156,55 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Retrieve the user details from the db based on the user ID.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	stmt := `
+		SELECT id, created_at, name, email, password_hash, activated, locale, version
+		FROM users
+		WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 // Retrieve the user details from the db based on the email address.
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	stmt := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, password_hash, activated, locale, version
 		FROM users
 		WHERE email = $1`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, stmt, email).Scan(
@@ -145,6 +214,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
 		&user.Version,
 	)
 
@@ -161,11 +231,11 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 
 // Update user information in the db.
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	stmt := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4, locale = $5, version = version + 1
+		WHERE id = $6 AND version = $7
 		RETURNING version`
 
 	args := []interface{}{
@@ -173,11 +243,12 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Locale,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&user.Version)
@@ -195,26 +266,30 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, TokenPlaintext string) (*User, error) {
-	// Calculate SHA-256 hash of the plaintext token.
-	tokenHash := sha256.Sum256([]byte(TokenPlaintext))
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, TokenPlaintext string) (*User, error) {
+	// Calculate the hash of the plaintext token under every accepted hashing algorithm version.
+	tokenHashes := m.Hashing.candidates(TokenPlaintext)
 
 	stmt := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale, users.version,
+			tokens.hash, tokens.expiry, tokens.created_at, tokens.last_used_at
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
-		WHERE tokens.hash = $1
+		WHERE tokens.hash = ANY($1)
 		AND tokens.scope = $2
 		AND tokens.expiry > $3
 	`
 
 	// Create a slice containing the query arguments.
-	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+	args := []interface{}{pq.Array(tokenHashes), tokenScope, m.Clock.Now()}
 
 	var user User
+	var token Token
+	var tokenCreatedAt time.Time
+	var tokenLastUsedAt *time.Time
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Execute the query and scan the result into the user struct.
@@ -225,6 +300,283 @@ func (m UserModel) GetForToken(tokenScope, TokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
+		&user.Version,
+		&token.Hash,
+		&token.Expiry,
+		&tokenCreatedAt,
+		&tokenLastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	// Record the last use of an authentication token, for listing sessions, at most once every
+	// tokenLastUsedInterval. If sliding expiration is enabled, also push its expiry forward.
+	if tokenScope == ScopeAuthentication {
+		now := m.Clock.Now()
+		save := tokenLastUsedAt == nil || now.Sub(*tokenLastUsedAt) >= tokenLastUsedInterval
+
+		if m.Sliding.Enabled {
+			newExpiry, ok := m.Sliding.next(now, token.Expiry, tokenCreatedAt)
+			if ok {
+				token.Expiry = newExpiry
+				save = true
+			}
+		}
+
+		if save {
+			_, err = m.DB.ExecContext(ctx, `UPDATE tokens SET expiry = $1, last_used_at = $2 WHERE hash = $3`, token.Expiry, now, token.Hash)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &user, nil
+}
+
+// Activate() redeems an activation token and marks the associated user as activated. The token is deleted,
+// the user updated, and any other activation tokens for the user removed in a single transaction, so the same
+// token can never be redeemed twice, even by concurrent requests. If the token is invalid, expired, or has
+// already been used, ErrRecordNotFound is returned.
+func (m UserModel) Activate(ctx context.Context, tokenPlaintext string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	userID, err := consumeToken(ctx, tx, m.Hashing, ScopeActivation, tokenPlaintext, m.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `
+		UPDATE users
+		SET activated = true, version = version + 1
+		WHERE id = $1
+		RETURNING id, created_at, name, email, password_hash, activated, locale, version`
+
+	var user User
+
+	err = tx.QueryRowContext(ctx, stmt, userID).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
+		&user.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete any other outstanding activation tokens for the user.
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`, ScopeActivation, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// RequestEmailChange() updates the user in the same way as Update(), and records email as their pending email
+// address, replacing any earlier one, until it's confirmed with ConfirmEmailChange(). Both are done in a single
+// transaction, so nothing is changed if the update gets an edit conflict or another user already has the address,
+// in which case ErrEditConflict or ErrDuplicateEmail is returned.
+func (m UserModel) RequestEmailChange(ctx context.Context, user *User, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed.
+	defer tx.Rollback()
+
+	stmt := `
+		UPDATE users
+		SET name = $1, email = $2, password_hash = $3, activated = $4, locale = $5, pending_email = $6, version = version + 1
+		WHERE id = $7 AND version = $8
+		RETURNING version`
+
+	args := []interface{}{
+		user.Name,
+		user.Email,
+		user.Password.hash,
+		user.Activated,
+		user.Locale,
+		email,
+		user.ID,
+		user.Version,
+	}
+
+	var version int
+
+	err = tx.QueryRowContext(ctx, stmt, args...).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	var taken bool
+
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE email = $1 AND id <> $2)`, email, user.ID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+
+	if taken {
+		return ErrDuplicateEmail
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	user.Version = version
+
+	return nil
+}
+
+// ConfirmEmailChange() redeems an email change token, replacing the user's email address with their pending one,
+// and returns the updated user along with their old address so that it can be told about the change. As with
+// Activate(), the token is consumed in the same transaction as the update, and the user's other email change
+// tokens are deleted. If the token is invalid, expired or already used, or there's no pending address,
+// ErrRecordNotFound is returned. If someone else took the address in the meantime, ErrDuplicateEmail is returned.
+func (m UserModel) ConfirmEmailChange(ctx context.Context, tokenPlaintext string) (*User, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeToken(ctx, tx, m.Hashing, ScopeEmailChange, tokenPlaintext, m.Clock.Now())
+	if err != nil {
+		return nil, "", err
+	}
+
+	var oldEmail string
+
+	err = tx.QueryRowContext(ctx, `SELECT email FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&oldEmail)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stmt := `
+		UPDATE users
+		SET email = pending_email, pending_email = NULL, version = version + 1
+		WHERE id = $1 AND pending_email IS NOT NULL
+		RETURNING id, created_at, name, email, password_hash, activated, locale, version`
+
+	var user User
+
+	err = tx.QueryRowContext(ctx, stmt, userID).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return nil, "", ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, "", ErrRecordNotFound
+		default:
+			return nil, "", err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`, ScopeEmailChange, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &user, oldEmail, nil
+}
+
+// ResetPassword() redeems a password reset token and sets the user's password. As with Activate(), the token is
+// consumed in the same transaction as the update, so it can only be used once. The user's other password reset
+// tokens and their authentication and refresh tokens are deleted too, logging out any sessions started with the
+// old password.
+// If the token is invalid, expired or already used, or the user isn't activated, ErrRecordNotFound is returned.
+func (m UserModel) ResetPassword(ctx context.Context, tokenPlaintext, plaintextPassword string) (*User, error) {
+	// Hash the new password before starting the transaction, as bcrypt is deliberately slow.
+	var pw password
+
+	err := pw.Set(plaintextPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeToken(ctx, tx, m.Hashing, ScopePasswordReset, tokenPlaintext, m.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `
+		UPDATE users
+		SET password_hash = $1, version = version + 1
+		WHERE id = $2 AND activated = true
+		RETURNING id, created_at, name, email, password_hash, activated, locale, version`
+
+	var user User
+
+	err = tx.QueryRowContext(ctx, stmt, pw.hash, userID).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
 		&user.Version,
 	)
 	if err != nil {
@@ -236,5 +588,16 @@ func (m UserModel) GetForToken(tokenScope, TokenPlaintext string) (*User, error)
 		}
 	}
 
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE scope = ANY($1) AND user_id = $2`,
+		pq.Array([]string{ScopePasswordReset, ScopeAuthentication, ScopeRefresh}), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
 	return &user, nil
 }
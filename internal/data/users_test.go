@@ -0,0 +1,151 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micypac/flick-info/internal/clock"
+)
+
+// testDSNEnv names the environment variable holding the DSN of a migrated PostgreSQL database to run the
+// database tests against. They're skipped if it isn't set.
+const testDSNEnv = "FLICKINFO_TEST_DB_DSN"
+
+// testModels() returns the models to run a test against: the in-memory models, plus the database models if
+// testDSNEnv is set.
+func testModels(t *testing.T) map[string]Models {
+	t.Helper()
+
+	opts := ModelOptions{Clock: clock.Real{}}
+	models := map[string]Models{"memory": NewMemoryModels(opts)}
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Logf("%s isn't set, skipping the database", testDSNEnv)
+		return models
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	models["postgres"] = NewModels(db, opts)
+
+	return models
+}
+
+// insertTestUser() inserts a user with a unique email address. Users inserted into the database are deleted again,
+// along with their tokens, when the test finishes.
+func insertTestUser(t *testing.T, models Models, activated bool) *User {
+	t.Helper()
+
+	user := &User{
+		Name:      "Race Test",
+		Email:     fmt.Sprintf("race-%d@example.com", time.Now().UnixNano()),
+		Activated: activated,
+		Locale:    DefaultLocale,
+	}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m, ok := models.Users.(UserModel); ok {
+		t.Cleanup(func() { m.DB.Exec(`DELETE FROM users WHERE id = $1`, user.ID) })
+	}
+
+	return user
+}
+
+// redeemConcurrently() calls redeem from n goroutines at once, and returns how many calls succeeded. Every
+// failure must be ErrRecordNotFound.
+func redeemConcurrently(t *testing.T, n int, redeem func() error) int {
+	t.Helper()
+
+	var (
+		wg        sync.WaitGroup
+		start     = make(chan struct{})
+		errs      = make(chan error, n)
+		successes int
+	)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs <- redeem()
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		switch {
+		case err == nil:
+			successes++
+		case !errors.Is(err, ErrRecordNotFound):
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	return successes
+}
+
+func TestActivateRedeemsTokenOnce(t *testing.T) {
+	for name, models := range testModels(t) {
+		t.Run(name, func(t *testing.T) {
+			user := insertTestUser(t, models, false)
+
+			token, err := models.Tokens.New(context.Background(), user.ID, time.Hour, ScopeActivation, TokenMetadata{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			successes := redeemConcurrently(t, 2, func() error {
+				_, err := models.Users.Activate(context.Background(), token.Plaintext)
+				return err
+			})
+			if successes != 1 {
+				t.Errorf("got %d successful activations; want 1", successes)
+			}
+		})
+	}
+}
+
+func TestResetPasswordRedeemsTokenOnce(t *testing.T) {
+	for name, models := range testModels(t) {
+		t.Run(name, func(t *testing.T) {
+			user := insertTestUser(t, models, true)
+
+			token, err := models.Tokens.New(context.Background(), user.ID, time.Hour, ScopePasswordReset, TokenMetadata{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			successes := redeemConcurrently(t, 2, func() error {
+				_, err := models.Users.ResetPassword(context.Background(), token.Plaintext, "n3wpa55word1234")
+				return err
+			})
+			if successes != 1 {
+				t.Errorf("got %d successful password resets; want 1", successes)
+			}
+		})
+	}
+}
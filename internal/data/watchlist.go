@@ -0,0 +1,127 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrDuplicateWatchlistEntry = errors.New("duplicate watchlist entry")
+
+// WatchlistEntry is a movie on a user's watchlist, and when it was added.
+type WatchlistEntry struct {
+	XMLName xml.Name  `json:"-" xml:"entry"`
+	Movie   *Movie    `json:"movie" xml:"movie"`
+	AddedAt time.Time `json:"added_at" xml:"added_at"`
+}
+
+type WatchlistModel struct {
+	DB *sql.DB
+}
+
+// Add() puts the movie on the user's watchlist, and returns the new entry. ErrDuplicateWatchlistEntry is
+// returned if it is already there, and ErrRecordNotFound if the movie doesn't exist.
+func (m WatchlistModel) Add(ctx context.Context, userID, movieID int64) (*WatchlistEntry, error) {
+	stmt := `
+		INSERT INTO watchlist (user_id, movie_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+		RETURNING added_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	entry := &WatchlistEntry{Movie: &Movie{ID: movieID}}
+
+	err := m.DB.QueryRowContext(ctx, stmt, userID, movieID).Scan(&entry.AddedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrDuplicateWatchlistEntry
+		case err.Error() == `pq: insert or update on table "watchlist" violates foreign key constraint "watchlist_movie_id_fkey"`:
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// GetAllForUser() returns a page of the movies on the user's watchlist. Sorting is by when the movies were
+// added, or by the movies' title or year.
+func (m WatchlistModel) GetAllForUser(ctx context.Context, userID int64, filters Filters) ([]*WatchlistEntry, Metadata, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(), w.added_at, m.id, m.created_at, m.title, m.year, m.runtime, movie_genre_names(m.id), m.version
+		FROM watchlist w
+		INNER JOIN movies m ON m.id = w.movie_id
+		WHERE w.user_id = $1
+		ORDER BY %s, m.id ASC
+		LIMIT $2 OFFSET $3`, filters.orderBy(""))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*WatchlistEntry{}
+
+	for rows.Next() {
+		entry := WatchlistEntry{Movie: &Movie{}}
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.AddedAt,
+			&entry.Movie.ID,
+			&entry.Movie.CreatedAt,
+			&entry.Movie.Title,
+			&entry.Movie.Year,
+			&entry.Movie.Runtime,
+			pq.Array(&entry.Movie.Genres),
+			&entry.Movie.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return entries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Remove() takes the movie off the user's watchlist. ErrRecordNotFound is returned if it wasn't on it.
+func (m WatchlistModel) Remove(ctx context.Context, userID, movieID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM watchlist WHERE user_id = $1 AND movie_id = $2`, userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,337 @@
+// Package dbmigrate applies and rolls back the migrations in a directory of migration files, such as
+// ./migrations.
+//
+// It reads and writes the same schema_migrations table as the migrate CLI, so the two can be used on the same
+// database.
+package dbmigrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Arbitrary key for the advisory lock which stops two processes migrating the same database at once.
+const lockKey = 7206135942
+
+// Migration is a single up or down migration file.
+type Migration struct {
+	Version int64
+	Name    string
+}
+
+// Up() applies, in order, every up migration in fsys newer than the database's current version, and returns
+// the migrations which were applied. Each migration runs in its own transaction along with the update to the
+// schema_migrations table, so a failed migration is rolled back and the database is left at the last version
+// which succeeded.
+func Up(db *sql.DB, fsys fs.FS) ([]Migration, error) {
+	migrations, err := list(fsys, "up")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	conn, current, unlock, err := lock(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied := []Migration{}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		err = apply(ctx, conn, fsys, m, m.Version)
+		if err != nil {
+			return applied, fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
+
+// Down() rolls back the newest steps migrations which have been applied, running their down migrations in
+// fsys newest first, and returns the migrations which were run. Like Up(), each runs in its own transaction, and
+// leaves the database at the version of the migration before it, or with no version once the first migration
+// has been rolled back.
+func Down(db *sql.DB, fsys fs.FS, steps int) ([]Migration, error) {
+	ups, err := list(fsys, "up")
+	if err != nil {
+		return nil, err
+	}
+
+	downs, err := list(fsys, "down")
+	if err != nil {
+		return nil, err
+	}
+
+	downFiles := make(map[int64]Migration, len(downs))
+	for _, m := range downs {
+		downFiles[m.Version] = m
+	}
+
+	ctx := context.Background()
+
+	conn, current, unlock, err := lock(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rolledBack := []Migration{}
+
+	for i := len(ups) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+		if ups[i].Version > current {
+			continue
+		}
+
+		if ups[i].Version < current && len(rolledBack) == 0 {
+			return nil, fmt.Errorf("database is at version %d, which has no migration file", current)
+		}
+
+		m, ok := downFiles[ups[i].Version]
+		if !ok {
+			return rolledBack, fmt.Errorf("migration %s has no down migration", ups[i].Name)
+		}
+
+		// The version before this one, or -1 for none, which removes the version from schema_migrations.
+		var previous int64 = -1
+		if i > 0 {
+			previous = ups[i-1].Version
+		}
+
+		err = apply(ctx, conn, fsys, m, previous)
+		if err != nil {
+			return rolledBack, fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+
+		rolledBack = append(rolledBack, m)
+		current = previous
+	}
+
+	return rolledBack, nil
+}
+
+// Force() sets the database's schema version, and clears the dirty flag, without running any migrations. It's
+// for recovering from a migration which failed part way through, once the database has been fixed by hand to
+// match the version. A version of -1 removes the version, as if no migrations had been applied.
+func Force(db *sql.DB, version int64) error {
+	ctx := context.Background()
+
+	conn, _, unlock, err := lockDirty(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = setVersion(ctx, tx, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lock() takes the migration lock on a connection of its own, creating the schema_migrations table if it
+// doesn't exist yet, and returns the connection along with the database's current version (-1 if there isn't
+// one) and a function which releases them. A dirty database can't be migrated.
+func lock(ctx context.Context, db *sql.DB) (*sql.Conn, int64, func(), error) {
+	conn, current, unlock, err := lockDirty(ctx, db)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	var dirty bool
+
+	err = conn.QueryRowContext(ctx, `SELECT dirty FROM schema_migrations LIMIT 1`).Scan(&dirty)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		unlock()
+		return nil, 0, nil, err
+	}
+
+	// A dirty version means a migration failed part way through when run by the migrate CLI, which doesn't
+	// always use a transaction. That needs fixing by hand.
+	if dirty {
+		unlock()
+		return nil, 0, nil, fmt.Errorf("database is dirty at version %d, fix it and then force the version", current)
+	}
+
+	return conn, current, unlock, nil
+}
+
+// lockDirty() is lock() without the check that the database isn't dirty.
+func lockDirty(ctx context.Context, db *sql.DB) (*sql.Conn, int64, func(), error) {
+	// Advisory locks belong to a session, so take the lock and run the migrations on a single connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		conn.Close()
+		return nil, 0, nil, err
+	}
+
+	unlock := func() {
+		conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey)
+		conn.Close()
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+	if err != nil {
+		unlock()
+		return nil, 0, nil, err
+	}
+
+	var current int64 = -1
+
+	err = conn.QueryRowContext(ctx, `SELECT version FROM schema_migrations LIMIT 1`).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		unlock()
+		return nil, 0, nil, err
+	}
+
+	return conn, current, unlock, nil
+}
+
+// Version() returns the database's current schema version, and whether it is dirty. The version is -1 if no
+// migrations have been applied.
+func Version(db *sql.DB) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var version int64 = -1
+	var dirty bool
+
+	err := db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		// Before the first migration, there may be no schema_migrations table at all (SQLSTATE 42P01,
+		// undefined_table).
+		var pqErr interface{ SQLState() string }
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return -1, false, nil
+		case errors.As(err, &pqErr) && pqErr.SQLState() == "42P01":
+			return -1, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+// Latest() returns the version of the newest up migration in fsys, or -1 if there are none.
+func Latest(fsys fs.FS) (int64, error) {
+	migrations, err := list(fsys, "up")
+	if err != nil {
+		return 0, err
+	}
+
+	if len(migrations) == 0 {
+		return -1, nil
+	}
+
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// list() returns the up or down migrations in fsys sorted by version. Migration files are named like
+// 000001_create_movies_table.up.sql and 000001_create_movies_table.down.sql.
+func list(fsys fs.FS, direction string) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*."+direction+".sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(names))
+
+	for _, name := range names {
+		prefix, _, found := strings.Cut(name, "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s: name must start with a version number and an underscore", name)
+		}
+
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version number", name)
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: name})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", migrations[i-1].Name, migrations[i].Name)
+		}
+	}
+
+	return migrations, nil
+}
+
+// apply() runs the migration file, and sets the database's version to version, in a transaction.
+func apply(ctx context.Context, conn *sql.Conn, fsys fs.FS, m Migration, version int64) error {
+	stmt, err := fs.ReadFile(fsys, m.Name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// Without any arguments, the whole file is sent as a simple query, so it can contain several statements.
+	_, err = tx.ExecContext(ctx, string(stmt))
+	if err != nil {
+		return err
+	}
+
+	err = setVersion(ctx, tx, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setVersion() replaces the version in schema_migrations, or removes it if the version is -1.
+func setVersion(ctx context.Context, tx *sql.Tx, version int64) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version == -1 {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+	return err
+}
@@ -0,0 +1,325 @@
+// Package fixtures loads declarative fixture files into the database, for tests and local development.
+//
+// A fixture file is a YAML or JSON document listing the users, permissions, movies and reviews to create. Each
+// user and movie can be given a ref, a name which other entries use to refer to it in place of a database ID,
+// since IDs are only known once the rows have been inserted. Loading a set of fixtures first truncates the tables
+// they cover, so the database ends up holding exactly what the files describe.
+package fixtures
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/micypac/flick-info/internal/data"
+	"github.com/micypac/flick-info/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Set holds the entities from one or more fixture files.
+type Set struct {
+	Users       []User       `json:"users"`
+	Permissions []Permission `json:"permissions"`
+	Movies      []Movie      `json:"movies"`
+	Reviews     []Review     `json:"reviews"`
+}
+
+type User struct {
+	Ref       string `json:"ref"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	Activated bool   `json:"activated"`
+}
+
+// Permission grants the permission codes to the user with the given ref. The codes must already exist in the
+// permissions table, where they are inserted by the migrations.
+type Permission struct {
+	User  string   `json:"user"`
+	Codes []string `json:"codes"`
+}
+
+type Movie struct {
+	Ref     string       `json:"ref"`
+	Title   string       `json:"title"`
+	Year    int32        `json:"year"`
+	Runtime data.Runtime `json:"runtime"`
+	Genres  []string     `json:"genres"`
+}
+
+// Review is a review by the user with the given ref of the movie with the given ref. Its status defaults to
+// pending.
+type Review struct {
+	User   string `json:"user"`
+	Movie  string `json:"movie"`
+	Body   string `json:"body"`
+	Status string `json:"status"`
+}
+
+// The tables emptied before fixtures are loaded. CASCADE also empties every table which references them, such
+// as tokens, lists and reviews, so no rows are left pointing at users or movies which no longer exist.
+const truncateStmt = `TRUNCATE users, movies, genres RESTART IDENTITY CASCADE`
+
+// Load() reads and merges the fixture files at the given paths, in order.
+func Load(paths ...string) (*Set, error) {
+	var set Set
+
+	for _, path := range paths {
+		var parse func(io.Reader) (*Set, error)
+
+		switch ext := filepath.Ext(path); ext {
+		case ".yaml", ".yml":
+			parse = ParseYAML
+		case ".json":
+			parse = Parse
+		default:
+			return nil, fmt.Errorf("%s: unsupported fixture file extension %q", path, ext)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		set.Users = append(set.Users, file.Users...)
+		set.Permissions = append(set.Permissions, file.Permissions...)
+		set.Movies = append(set.Movies, file.Movies...)
+		set.Reviews = append(set.Reviews, file.Reviews...)
+	}
+
+	return &set, nil
+}
+
+// Parse() reads a single JSON fixture file.
+func Parse(r io.Reader) (*Set, error) {
+	var set Set
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(&set)
+	if err != nil {
+		return nil, err
+	}
+
+	return &set, nil
+}
+
+// Empty() reports whether the tables covered by fixtures hold no rows, which means fixtures can be loaded
+// without losing any data.
+func Empty(db *sql.DB) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var empty bool
+
+	err := db.QueryRowContext(ctx, `SELECT NOT EXISTS (SELECT 1 FROM users) AND NOT EXISTS (SELECT 1 FROM movies)`).Scan(&empty)
+	return empty, err
+}
+
+// Validate() checks every entity with the same rules the API applies, and that every ref is unique and every
+// reference points at an entity in the set. The returned validator's errors are keyed by the entity's position,
+// e.g. "users[2].email".
+func (s *Set) Validate() *validator.Validator {
+	v := validator.New()
+
+	userRefs := make(map[string]bool)
+
+	for i, u := range s.Users {
+		uv := validator.New()
+
+		uv.Check(u.Name != "", "name", "must be provided")
+		uv.Check(len(u.Name) <= 500, "name", "must not be more than 500 bytes long")
+		data.ValidateEmail(uv, u.Email)
+		data.ValidatePasswordPlaintext(uv, u.Password)
+
+		if u.Ref != "" {
+			uv.Check(!userRefs[u.Ref], "ref", "must be unique")
+			userRefs[u.Ref] = true
+		}
+
+		addErrors(v, fmt.Sprintf("users[%d]", i), uv)
+	}
+
+	for i, p := range s.Permissions {
+		pv := validator.New()
+
+		pv.Check(userRefs[p.User], "user", "must be the ref of a user")
+		pv.Check(len(p.Codes) >= 1, "codes", "must contain at least 1 permission")
+
+		addErrors(v, fmt.Sprintf("permissions[%d]", i), pv)
+	}
+
+	movieRefs := make(map[string]bool)
+
+	for i, m := range s.Movies {
+		mv := validator.New()
+
+		data.ValidateMovie(mv, &data.Movie{Title: m.Title, Year: m.Year, Runtime: m.Runtime, Genres: m.Genres})
+
+		if m.Ref != "" {
+			mv.Check(!movieRefs[m.Ref], "ref", "must be unique")
+			movieRefs[m.Ref] = true
+		}
+
+		addErrors(v, fmt.Sprintf("movies[%d]", i), mv)
+	}
+
+	// Each user can review a movie once.
+	reviewed := make(map[[2]string]bool)
+
+	for i, r := range s.Reviews {
+		rv := validator.New()
+
+		rv.Check(userRefs[r.User], "user", "must be the ref of a user")
+		rv.Check(movieRefs[r.Movie], "movie", "must be the ref of a movie")
+		rv.Check(!reviewed[[2]string{r.User, r.Movie}], "movie", "must only be reviewed once by each user")
+		data.ValidateReview(rv, &data.Review{Body: r.Body})
+
+		if r.Status != "" {
+			data.ValidateReviewStatus(rv, r.Status)
+		}
+
+		reviewed[[2]string{r.User, r.Movie}] = true
+
+		addErrors(v, fmt.Sprintf("reviews[%d]", i), rv)
+	}
+
+	return v
+}
+
+func addErrors(v *validator.Validator, prefix string, ev *validator.Validator) {
+	for key, message := range ev.Errors {
+		v.AddError(prefix+"."+key, message)
+	}
+}
+
+// Apply() truncates the tables covered by the fixtures and inserts the entities in the set, all in a single
+// transaction, so a failure part of the way through leaves the database as it was. The set should be validated
+// first.
+func (s *Set) Apply(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, truncateStmt)
+	if err != nil {
+		return err
+	}
+
+	// Map the refs to the IDs of the inserted rows, so that later entities can refer to them.
+	userIDs := make(map[string]int64)
+
+	for _, u := range s.Users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), data.PasswordCost)
+		if err != nil {
+			return err
+		}
+
+		var id int64
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO users (name, email, password_hash, activated)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id`, u.Name, u.Email, hash, u.Activated).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("user %q: %w", u.Email, err)
+		}
+
+		if u.Ref != "" {
+			userIDs[u.Ref] = id
+		}
+	}
+
+	for _, p := range s.Permissions {
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO users_permissions
+			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`, userIDs[p.User], pq.Array(p.Codes))
+		if err != nil {
+			return fmt.Errorf("permissions for %q: %w", p.User, err)
+		}
+
+		// Unlike the API, which only grants known codes, a fixture naming a code which doesn't exist is a mistake.
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if int(n) != len(p.Codes) {
+			return fmt.Errorf("permissions for %q: unknown permission code in %s", p.User, strings.Join(p.Codes, ", "))
+		}
+	}
+
+	movieIDs := make(map[string]int64)
+
+	for _, m := range s.Movies {
+		var movieID int64
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO movies (title, year, runtime)
+			VALUES ($1, $2, $3)
+			RETURNING id`, m.Title, m.Year, m.Runtime).Scan(&movieID)
+		if err != nil {
+			return fmt.Errorf("movie %q: %w", m.Title, err)
+		}
+
+		if m.Ref != "" {
+			movieIDs[m.Ref] = movieID
+		}
+
+		// Unlike the API, which only accepts existing genres, fixtures create the genres they name.
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO genres (name)
+			SELECT unnest($1::text[])
+			ON CONFLICT (name) DO NOTHING`, pq.Array(m.Genres))
+		if err != nil {
+			return fmt.Errorf("genres of movie %q: %w", m.Title, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO movies_genres (movie_id, genre_id, position)
+			SELECT $1, g.id, t.position
+			FROM unnest($2::text[]) WITH ORDINALITY AS t(name, position)
+			INNER JOIN genres g ON g.name = t.name`, movieID, pq.Array(m.Genres))
+		if err != nil {
+			return fmt.Errorf("genres of movie %q: %w", m.Title, err)
+		}
+	}
+
+	for _, r := range s.Reviews {
+		status := r.Status
+		if status == "" {
+			status = data.ReviewPending
+		}
+
+		// Reviews which have been moderated get a moderation time, but no moderator.
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO reviews (user_id, movie_id, body, status, moderated_at)
+			VALUES ($1, $2, $3, $4, CASE WHEN $4 = 'pending' THEN NULL ELSE now() END)`,
+			userIDs[r.User], movieIDs[r.Movie], r.Body, status)
+		if err != nil {
+			return fmt.Errorf("review of %q by %q: %w", r.Movie, r.User, err)
+		}
+	}
+
+	return tx.Commit()
+}
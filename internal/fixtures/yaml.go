@@ -0,0 +1,358 @@
+package fixtures
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ParseYAML() reads a single YAML fixture file. Rather than pull in a YAML library, it understands the subset of
+// YAML which fixture files need: block mappings and sequences nested by indentation, flow sequences of scalars
+// such as [action, comedy], quoted and plain scalars, and comments. Anchors, flow mappings, multi-line strings
+// and tabs for indentation are not supported. The document is decoded with the same rules as a JSON fixture file.
+func ParseYAML(r io.Reader) (*Set, error) {
+	lines, err := readYAMLLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := yamlParser{lines: lines}
+
+	var doc interface{}
+
+	if len(lines) > 0 {
+		doc, err = p.parseBlock(lines[0].indent)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.pos < len(lines) {
+			return nil, fmt.Errorf("line %d: unexpected indentation", lines[p.pos].n)
+		}
+	}
+
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(bytes.NewReader(js))
+}
+
+type yamlLine struct {
+	n      int // The line number in the file.
+	indent int
+	text   string // The line without its indentation or any comment.
+}
+
+// readYAMLLines() returns the lines of a YAML document which hold content, skipping blank lines, comments and
+// the document start marker.
+func readYAMLLines(r io.Reader) ([]yamlLine, error) {
+	var lines []yamlLine
+
+	scanner := bufio.NewScanner(r)
+
+	for n := 1; scanner.Scan(); n++ {
+		raw := scanner.Text()
+		text := strings.TrimLeft(raw, " ")
+
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", n)
+		}
+
+		text = strings.TrimSpace(stripYAMLComment(text))
+		if text == "" || (text == "---" && len(lines) == 0) {
+			continue
+		}
+
+		lines = append(lines, yamlLine{n: n, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+
+	return lines, scanner.Err()
+}
+
+// stripYAMLComment() removes a comment from the end of a line. A # only starts a comment at the start of the line
+// or after whitespace, and not inside a quoted string.
+func stripYAMLComment(s string) string {
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+
+	return s
+}
+
+// yamlKeyRX matches the keys of a block mapping, which in fixture files are always plain.
+var yamlKeyRX = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseBlock() parses the mapping or sequence whose entries start at the current line and are indented by
+// indent spaces.
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if isYAMLSequenceEntry(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+
+	return p.parseMapping(indent)
+}
+
+func isYAMLSequenceEntry(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseSequence(indent int) ([]interface{}, error) {
+	seq := []interface{}{}
+
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLSequenceEntry(p.lines[p.pos].text) {
+		line := p.lines[p.pos]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+
+		var (
+			value interface{}
+			err   error
+		)
+
+		switch {
+		case rest == "":
+			// The entry's value is the block on the following lines.
+			p.pos++
+			value, err = p.parseNested(indent)
+
+		case isYAMLMappingEntry(rest):
+			// A mapping which starts on the same line as the "-". Its other keys line up with the first one, so
+			// treat the rest of the line as the mapping's first line, at that indentation.
+			column := indent + len(line.text) - len(rest)
+			p.lines[p.pos] = yamlLine{n: line.n, indent: column, text: rest}
+			value, err = p.parseMapping(column)
+
+		default:
+			p.pos++
+			value, err = parseYAMLValue(rest)
+			if err != nil {
+				err = fmt.Errorf("line %d: %w", line.n, err)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		seq = append(seq, value)
+	}
+
+	return seq, nil
+}
+
+// isYAMLMappingEntry() reports whether a line is a "key: value" or "key:" mapping entry, rather than a scalar.
+func isYAMLMappingEntry(text string) bool {
+	key, _, ok := cutYAMLKey(text)
+	return ok && yamlKeyRX.MatchString(key)
+}
+
+// cutYAMLKey() splits a mapping entry at the colon following its key.
+func cutYAMLKey(text string) (string, string, bool) {
+	if strings.HasSuffix(text, ":") {
+		return text[:len(text)-1], "", true
+	}
+
+	return strings.Cut(text, ": ")
+}
+
+func (p *yamlParser) parseMapping(indent int) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+
+		key, rest, ok := cutYAMLKey(line.text)
+		key = strings.TrimSpace(key)
+		if !ok || !yamlKeyRX.MatchString(key) {
+			return nil, fmt.Errorf("line %d: expected key: value", line.n)
+		}
+
+		if _, exists := m[key]; exists {
+			return nil, fmt.Errorf("line %d: %s is set more than once", line.n, key)
+		}
+
+		p.pos++
+
+		var (
+			value interface{}
+			err   error
+		)
+
+		rest = strings.TrimSpace(rest)
+
+		switch {
+		case rest != "":
+			value, err = parseYAMLValue(rest)
+			if err != nil {
+				err = fmt.Errorf("line %d: %w", line.n, err)
+			}
+
+		// YAML allows a sequence which is a mapping's value to be indented no further than its key.
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLSequenceEntry(p.lines[p.pos].text):
+			value, err = p.parseSequence(indent)
+
+		default:
+			value, err = p.parseNested(indent)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		m[key] = value
+	}
+
+	return m, nil
+}
+
+// parseNested() parses the block which is the value of an entry, if the current line is indented further than
+// the entry. Otherwise the entry has no value, which is null. A line left over at an indentation which matches
+// no enclosing block stops every block, and is reported by ParseYAML().
+func (p *yamlParser) parseNested(indent int) (interface{}, error) {
+	if p.pos == len(p.lines) || p.lines[p.pos].indent <= indent {
+		return nil, nil
+	}
+
+	return p.parseBlock(p.lines[p.pos].indent)
+}
+
+// parseYAMLValue() parses a value which follows a key or "-" on the same line: a flow sequence or a scalar.
+func parseYAMLValue(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "{"):
+		return nil, errors.New("flow mappings are not supported")
+
+	case strings.HasPrefix(s, "&"), strings.HasPrefix(s, "*"):
+		return nil, errors.New("anchors and aliases are not supported")
+
+	case strings.HasPrefix(s, "|"), strings.HasPrefix(s, ">"):
+		return nil, errors.New("multi-line strings are not supported")
+
+	case !strings.HasPrefix(s, "["):
+		value, rest, err := parseYAMLScalar(s, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if rest = strings.TrimSpace(rest); rest != "" {
+			return nil, fmt.Errorf("unexpected %q after value", rest)
+		}
+
+		return value, nil
+	}
+
+	values := []interface{}{}
+	s = strings.TrimSpace(s[1:])
+
+	for !strings.HasPrefix(s, "]") {
+		value, rest, err := parseYAMLScalar(s, true)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+		s = strings.TrimSpace(rest)
+
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = strings.TrimSpace(s[1:])
+		case !strings.HasPrefix(s, "]"):
+			return nil, errors.New("expected , or ] in sequence")
+		}
+	}
+
+	if rest := strings.TrimSpace(s[1:]); rest != "" {
+		return nil, fmt.Errorf("unexpected %q after sequence", rest)
+	}
+
+	return values, nil
+}
+
+// yamlNumberRX matches the integers and decimal numbers which a plain scalar can be.
+var yamlNumberRX = regexp.MustCompile(`^[-+]?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// parseYAMLScalar() parses a scalar at the start of s, and returns it along with the rest of s. A plain scalar
+// in a flow sequence ends at the next , or ]. Plain scalars which spell a number, boolean or null are returned
+// as that type, so that they decode into the fixture's fields as they would from JSON.
+func parseYAMLScalar(s string, inFlow bool) (interface{}, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		// Find the closing quote, skipping escaped characters. The escapes fixture files need are a subset of
+		// Go's.
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				value, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return nil, "", errors.New("invalid string")
+				}
+				return value, s[i+1:], nil
+			}
+		}
+		return nil, "", errors.New("unterminated string")
+
+	case strings.HasPrefix(s, "'"):
+		// In a single-quoted string, '' is an escaped quote.
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '\'' {
+				i++
+				continue
+			}
+			return strings.ReplaceAll(s[1:i], "''", "'"), s[i+1:], nil
+		}
+		return nil, "", errors.New("unterminated string")
+	}
+
+	end := len(s)
+	if inFlow {
+		if i := strings.IndexAny(s, ",]"); i != -1 {
+			end = i
+		}
+	}
+
+	value := strings.TrimSpace(s[:end])
+	if value == "" {
+		return nil, "", errors.New("missing value")
+	}
+
+	switch {
+	case value == "null" || value == "~":
+		return nil, s[end:], nil
+	case value == "true" || value == "false":
+		return value == "true", s[end:], nil
+	case yamlNumberRX.MatchString(value):
+		return json.Number(value), s[end:], nil
+	}
+
+	return value, s[end:], nil
+}
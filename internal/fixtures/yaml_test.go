@@ -0,0 +1,160 @@
+package fixtures
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// developmentYAML is fixtures/development.json written as YAML, in the styles fixture files are likely to use.
+const developmentYAML = `---
+# Sample data for local development.
+users:
+  - ref: admin
+    name: Admin User
+    email: admin@example.com
+    password: "pa55word1234"
+    activated: true
+  - ref: alice
+    name: 'Alice Smith'
+    email: alice@example.com
+    password: pa55word1234
+    activated: true
+  - ref: bob
+    name: Bob Jones
+    email: bob@example.com   # Not activated yet.
+    password: pa55word1234
+    activated: false
+
+permissions:
+- user: admin
+  codes: [movies:read, movies:write, account:read, account:write, lists:read, lists:write, users:erase, debug:read, analytics:read, ratelimit:manage, reviews:moderate]
+- user: alice
+  codes:
+    - movies:read
+    - account:read
+    - account:write
+    - lists:read
+    - lists:write
+- user: bob
+  codes: ["movies:read", "account:read", "account:write", "lists:read", "lists:write"]
+
+movies:
+  - ref: moana
+    title: Moana
+    year: 2016
+    runtime: 107 mins
+    genres: [animation, adventure]
+  - ref: black-panther
+    title: Black Panther
+    year: 2018
+    runtime: "134 mins"
+    genres: [action, adventure]
+  - ref: deadpool
+    title: Deadpool
+    year: 2016
+    runtime: 108 mins
+    genres: [action, comedy]
+  - ref: breakfast-club
+    title: The Breakfast Club
+    year: 1986
+    runtime: 96 mins
+    genres: [drama]
+
+reviews:
+  - user: alice
+    movie: moana
+    body: Gorgeous animation and a soundtrack I haven't stopped humming.
+    status: approved
+  - user: alice
+    movie: deadpool
+    body: Crude, self-aware and very funny.
+    status: approved
+  - user: bob
+    movie: black-panther
+    body: Wakanda is the best-designed world in the whole series.
+    status: pending
+  - user: bob
+    movie: breakfast-club
+    body: 'Spam spam spam, visit my site!'
+    status: rejected
+`
+
+func TestParseYAMLMatchesJSON(t *testing.T) {
+	got, err := ParseYAML(strings.NewReader(developmentYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open("../../fixtures/development.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	want, err := Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+
+	if v := got.Validate(); !v.Valid() {
+		t.Errorf("got validation errors %v", v.Errors)
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"flow mapping", "movies:\n  - {title: Moana}\n", "line 2: flow mappings are not supported"},
+		{"unknown field", "users:\n  - nickname: al\n", `unknown field "nickname"`},
+		{"wrong type", "movies:\n  - year: soon\n", "cannot unmarshal string"},
+		{"duplicate key", "users:\n  - name: a\n    name: b\n", "line 3: name is set more than once"},
+		{"bad indentation", "users:\n    - name: a\n  - name: b\n", "line 3: unexpected indentation"},
+		{"tab", "users:\n\t- name: a\n", "line 2: tabs can't be used for indentation"},
+		{"unterminated string", "users:\n  - name: \"a\n", "line 2: unterminated string"},
+		{"multi-line string", "reviews:\n  - body: |\n      Good.\n", "line 2: multi-line strings are not supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseYAML(strings.NewReader(tt.doc))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v; want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReviews(t *testing.T) {
+	set := &Set{
+		Users:  []User{{Ref: "alice", Name: "Alice", Email: "alice@example.com", Password: "pa55word1234"}},
+		Movies: []Movie{{Ref: "moana", Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}},
+		Reviews: []Review{
+			{User: "alice", Movie: "moana", Body: "Good."},
+			{User: "alice", Movie: "moana", Body: "Good again."},
+			{User: "bob", Movie: "frozen", Body: "", Status: "hidden"},
+		},
+	}
+
+	v := set.Validate()
+
+	want := map[string]string{
+		"reviews[1].movie":  "must only be reviewed once by each user",
+		"reviews[2].user":   "must be the ref of a user",
+		"reviews[2].movie":  "must be the ref of a movie",
+		"reviews[2].body":   "must be provided",
+		"reviews[2].status": "must be pending, approved or rejected",
+	}
+
+	if !reflect.DeepEqual(v.Errors, want) {
+		t.Errorf("got errors %v; want %v", v.Errors, want)
+	}
+}
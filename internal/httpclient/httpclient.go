@@ -0,0 +1,252 @@
+// Package httpclient provides an HTTP client for calling third-party services, which stops a slow or failing
+// service from tying up the API. Every attempt has a timeout, failed requests are retried with jittered
+// exponential backoff, and each host gets its own rate limit, concurrency limit and circuit breaker.
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	// ErrCircuitOpen is returned without making a request while a host's circuit breaker is open.
+	ErrCircuitOpen = errors.New("httpclient: circuit breaker open")
+	// ErrHostBusy is returned without making a request when a host already has the maximum number of requests
+	// in flight.
+	ErrHostBusy = errors.New("httpclient: too many concurrent requests to host")
+)
+
+// Config holds the client settings. The limits apply to each host separately.
+type Config struct {
+	Timeout          time.Duration // Timeout for each attempt, including reading the response headers.
+	MaxRetries       int           // Retries after the first attempt.
+	BaseBackoff      time.Duration // Upper bound of the delay before the first retry, doubled for each retry.
+	MaxBackoff       time.Duration
+	RateLimit        rate.Limit // Requests per second.
+	Burst            int
+	MaxConcurrent    int
+	BreakerThreshold int           // Consecutive failures which open the circuit breaker.
+	BreakerCooldown  time.Duration // How long the breaker stays open before a trial request is let through.
+}
+
+// DefaultConfig() returns settings suitable for most third-party APIs.
+func DefaultConfig() Config {
+	return Config{
+		Timeout:          5 * time.Second,
+		MaxRetries:       2,
+		BaseBackoff:      200 * time.Millisecond,
+		MaxBackoff:       5 * time.Second,
+		RateLimit:        10,
+		Burst:            20,
+		MaxConcurrent:    10,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// Client sends requests with the limits in its Config. It is safe for concurrent use.
+type Client struct {
+	cfg  Config
+	http *http.Client
+
+	mu    sync.Mutex
+	hosts map[string]*host
+}
+
+// host holds the per-host limits and circuit breaker state.
+type host struct {
+	limiter  *rate.Limiter
+	inFlight chan struct{}
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // Whether a trial request is in progress while the breaker is half open.
+}
+
+// Return a new Client with the given settings.
+func New(cfg Config) *Client {
+	return &Client{
+		cfg:   cfg,
+		http:  &http.Client{Timeout: cfg.Timeout},
+		hosts: make(map[string]*host),
+	}
+}
+
+// Do() sends the request, retrying after network errors and 429, 502, 503 and 504 responses. A request with a
+// body is only retried if req.GetBody is set, as it is by http.NewRequest() for in-memory bodies. The response
+// to the last attempt is returned; as with http.Client, the caller must close its body.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	h := c.host(req.URL.Host)
+	ctx := req.Context()
+
+	canRetry := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	var res *http.Response
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		res, err = c.attempt(ctx, h, req)
+
+		if !canRetry || attempt >= c.cfg.MaxRetries || !retryable(res, err) {
+			return res, err
+		}
+
+		delay := c.backoff(attempt, res)
+
+		// Discard the body of the failed response, so the connection can be reused.
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+			res.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// attempt() makes a single attempt at the request, within the host's limits.
+func (c *Client) attempt(ctx context.Context, h *host, req *http.Request) (*http.Response, error) {
+	if !h.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	select {
+	case h.inFlight <- struct{}{}:
+		defer func() { <-h.inFlight }()
+	default:
+		h.record(false, c.cfg.BreakerThreshold, c.cfg.BreakerCooldown, true)
+		return nil, ErrHostBusy
+	}
+
+	err := h.limiter.Wait(ctx)
+	if err != nil {
+		h.record(false, c.cfg.BreakerThreshold, c.cfg.BreakerCooldown, true)
+		return nil, err
+	}
+
+	res, err := c.http.Do(req)
+
+	// Server errors and timeouts count towards opening the breaker; client errors like 404 don't, as the host is
+	// working.
+	failed := err != nil || res.StatusCode >= 500
+	h.record(!failed, c.cfg.BreakerThreshold, c.cfg.BreakerCooldown, false)
+
+	return res, err
+}
+
+// host() returns the state for the named host, creating it on first use.
+func (c *Client) host(name string) *host {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.hosts[name]
+	if !ok {
+		h = &host{
+			limiter:  rate.NewLimiter(c.cfg.RateLimit, c.cfg.Burst),
+			inFlight: make(chan struct{}, c.cfg.MaxConcurrent),
+		}
+		c.hosts[name] = h
+	}
+
+	return h
+}
+
+// backoff() returns the delay before the retry following the given attempt: a random duration up to
+// BaseBackoff doubled for each attempt so far ("full jitter"), so that many clients retrying at once are spread
+// out. A Retry-After header in seconds takes precedence. Both are capped at MaxBackoff.
+func (c *Client) backoff(attempt int, res *http.Response) time.Duration {
+	if res != nil {
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, c.cfg.MaxBackoff)
+		}
+	}
+
+	ceiling := min(c.cfg.BaseBackoff<<attempt, c.cfg.MaxBackoff)
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
+
+// retryable() reports whether an attempt failed in a way which another attempt might not.
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		// There's no point retrying when the breaker or the concurrency limit stopped the request, or the
+		// caller has given up.
+		return !errors.Is(err, ErrCircuitOpen) && !errors.Is(err, ErrHostBusy) &&
+			!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// allow() reports whether a request may be sent. While the breaker is open, nothing is allowed until the cooldown
+// has passed; then a single trial request is let through, and its result decides whether the breaker closes.
+func (h *host) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.openUntil.IsZero() {
+		return true
+	}
+
+	if time.Now().Before(h.openUntil) || h.trial {
+		return false
+	}
+
+	h.trial = true
+
+	return true
+}
+
+// record() updates the breaker with the outcome of an attempt. A local failure, such as the concurrency limit
+// being hit, only ends a trial request, without counting as a failure of the host.
+func (h *host) record(ok bool, threshold int, cooldown time.Duration, local bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	wasTrial := h.trial
+	h.trial = false
+
+	if local {
+		return
+	}
+
+	if ok {
+		h.failures = 0
+		h.openUntil = time.Time{}
+		return
+	}
+
+	h.failures++
+
+	// Open the breaker after too many consecutive failures, or straight away again if the trial failed.
+	if h.failures >= threshold || wasTrial {
+		h.openUntil = time.Now().Add(cooldown)
+	}
+}
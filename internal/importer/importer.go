@@ -0,0 +1,241 @@
+// Package importer parses the CSV exports of a user's personal movie data from other services, so that it can be
+// imported into Flickinfo.
+//
+// The supported exports are:
+//
+//   - Letterboxd: watched.csv, diary.csv, ratings.csv and watchlist.csv.
+//   - IMDb: the ratings export and the watchlist (or any list) export.
+//
+// The service and the kind of file are detected from the CSV header, except that Letterboxd's watched.csv and
+// watchlist.csv have identical headers, so the caller says which one it is.
+package importer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxRows is the maximum number of data rows in a single import.
+const MaxRows = 5000
+
+// The services whose exports can be imported.
+const (
+	SourceLetterboxd = "letterboxd"
+	SourceIMDb       = "imdb"
+)
+
+var (
+	ErrUnrecognizedFormat = errors.New("unrecognized CSV format")
+	ErrTooManyRows        = fmt.Errorf("too many rows, the maximum is %d", MaxRows)
+)
+
+// Row is a single movie from an export, along with what should be recorded for it. Rows which can't be imported
+// have Skip set to the reason.
+type Row struct {
+	Line       int       // Line number in the CSV file, counting the header as line 1.
+	Title      string    // Movie title.
+	Year       int32     // Release year, or 0 if it was missing.
+	ExternalID string    // The service's own ID for the movie, if it has one (e.g. an IMDb "tt" ID).
+	WatchedOn  time.Time // Date the movie was watched, or the zero time if it wasn't.
+	Rating     int       // Rating out of 10, or 0 if it wasn't rated.
+	Watchlist  bool      // Whether the movie should be added to the watchlist.
+	Skip       string    // Reason the row can't be imported, or an empty string.
+}
+
+// Parse() reads a CSV export and returns the service it came from and its rows. The watchlist argument says
+// whether an ambiguous Letterboxd file is a watchlist, rather than a list of watched movies.
+func Parse(r io.Reader, watchlist bool) (string, []Row, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", nil, ErrUnrecognizedFormat
+		}
+		return "", nil, err
+	}
+
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		// Strip any byte order mark, which some spreadsheet programs add when saving a CSV file.
+		cols[strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")] = i
+	}
+
+	var source string
+	var parse func(get func(string) string, row *Row)
+
+	switch {
+	case has(cols, "Letterboxd URI", "Name", "Year"):
+		source = SourceLetterboxd
+		parse = letterboxdParser(cols, watchlist)
+	case has(cols, "Const", "Title", "Year"):
+		source = SourceIMDb
+		parse = imdbParser(cols)
+	default:
+		return "", nil, ErrUnrecognizedFormat
+	}
+
+	rows := []Row{}
+
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+
+		if len(rows) == MaxRows {
+			return "", nil, ErrTooManyRows
+		}
+
+		get := func(name string) string {
+			i, ok := cols[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		row := Row{Line: line}
+		parse(get, &row)
+
+		if row.Skip == "" && row.Title == "" {
+			row.Skip = "missing title"
+		}
+
+		rows = append(rows, row)
+	}
+
+	return source, rows, nil
+}
+
+// letterboxdParser() returns a function which parses a row of one of the Letterboxd exports. Letterboxd counts
+// a rated movie as watched, so rows in the ratings and diary exports are recorded as watches too.
+func letterboxdParser(cols map[string]int, watchlist bool) func(get func(string) string, row *Row) {
+	_, diary := cols["Watched Date"]
+	_, ratings := cols["Rating"]
+
+	return func(get func(string) string, row *Row) {
+		row.Title = get("Name")
+		row.Year = parseYear(get("Year"), row)
+		row.ExternalID = get("Letterboxd URI")
+
+		switch {
+		case diary:
+			row.WatchedOn = parseDate(get("Watched Date"), row)
+			row.Rating = parseStars(get("Rating"), row)
+		case ratings:
+			row.WatchedOn = parseDate(get("Date"), row)
+			row.Rating = parseStars(get("Rating"), row)
+		case watchlist:
+			row.Watchlist = true
+		default:
+			row.WatchedOn = parseDate(get("Date"), row)
+		}
+	}
+}
+
+// imdbParser() returns a function which parses a row of one of the IMDb exports. Rows with a "Your Rating" are
+// recorded as a rating and a watch, and rows without are added to the watchlist. Series and episodes are skipped,
+// as only movies are in the catalog.
+func imdbParser(cols map[string]int) func(get func(string) string, row *Row) {
+	_, ratings := cols["Your Rating"]
+
+	return func(get func(string) string, row *Row) {
+		row.Title = get("Title")
+		row.Year = parseYear(get("Year"), row)
+		row.ExternalID = get("Const")
+
+		titleType := strings.ToLower(get("Title Type"))
+		if strings.Contains(titleType, "series") || strings.Contains(titleType, "episode") {
+			row.Skip = "not a movie"
+			return
+		}
+
+		if ratings {
+			row.WatchedOn = parseDate(get("Date Rated"), row)
+			row.Rating = parseRating(get("Your Rating"), row)
+		} else {
+			row.Watchlist = true
+		}
+	}
+}
+
+func has(cols map[string]int, names ...string) bool {
+	for _, name := range names {
+		if _, ok := cols[name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseYear(s string, row *Row) int32 {
+	if s == "" {
+		return 0
+	}
+
+	year, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || year < 1888 {
+		row.Skip = "invalid year"
+		return 0
+	}
+
+	return int32(year)
+}
+
+// parseDate() parses a date in the YYYY-MM-DD format used by both services. A missing date is taken to mean
+// today, since the movie was still watched.
+func parseDate(s string, row *Row) time.Time {
+	if s == "" {
+		return time.Now().UTC().Truncate(24 * time.Hour)
+	}
+
+	date, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		row.Skip = "invalid date"
+		return time.Time{}
+	}
+
+	return date
+}
+
+// parseStars() converts a Letterboxd rating of 0.5 to 5 stars to a rating out of 10.
+func parseStars(s string, row *Row) int {
+	if s == "" {
+		return 0
+	}
+
+	stars, err := strconv.ParseFloat(s, 64)
+	if err != nil || stars < 0.5 || stars > 5 || stars*2 != float64(int(stars*2)) {
+		row.Skip = "invalid rating"
+		return 0
+	}
+
+	return int(stars * 2)
+}
+
+// parseRating() parses an IMDb rating out of 10.
+func parseRating(s string, row *Row) int {
+	if s == "" {
+		return 0
+	}
+
+	rating, err := strconv.Atoi(s)
+	if err != nil || rating < 1 || rating > 10 {
+		row.Skip = "invalid rating"
+		return 0
+	}
+
+	return rating
+}
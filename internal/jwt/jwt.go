@@ -0,0 +1,106 @@
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpired      = errors.New("token has expired")
+)
+
+// The clock skew allowed between the server which issued a token and the one verifying it.
+const leeway = 30 * time.Second
+
+// header is the only JOSE header issued and accepted: HMAC-SHA-256 signed JWTs.
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims are the registered claims carried by a token. Times are Unix timestamps, as in the JWT spec.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Signer issues and verifies JSON Web Tokens signed with HS256. Any server holding the key can verify a token
+// without looking anything up, so a token can't be revoked before it expires.
+type Signer struct {
+	key    []byte
+	issuer string
+}
+
+// Return a new Signer using the given secret key, which issues tokens from, and only accepts tokens from, the
+// issuer.
+func New(key []byte, issuer string) *Signer {
+	return &Signer{key: key, issuer: issuer}
+}
+
+// Sign() returns a token for the subject, issued at now and expiring after ttl.
+func (s *Signer) Sign(subject string, now time.Time, ttl time.Duration) (string, error) {
+	payload, err := json.Marshal(Claims{
+		Issuer:    s.issuer,
+		Subject:   subject,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return unsigned + "." + s.signature(unsigned), nil
+}
+
+// Verify() checks the token's signature, that it was issued by the signer's issuer, and that it hasn't expired
+// at now, and returns its claims.
+func (s *Signer) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	// Only accept the header which is issued, so that a token can't choose its own algorithm, such as "none".
+	// The signatures are compared in constant time.
+	if parts[0] != header || !hmac.Equal([]byte(parts[2]), []byte(s.signature(parts[0]+"."+parts[1]))) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Issuer != s.issuer || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	if !now.Before(time.Unix(claims.ExpiresAt, 0).Add(leeway)) {
+		return nil, ErrExpired
+	}
+
+	return &claims, nil
+}
+
+// IsToken() reports whether the token has the shape of a JWT, three dot separated parts, so that it can be told
+// apart from other kinds of token without verifying it.
+func IsToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (s *Signer) signature(unsigned string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(unsigned))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,240 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/micypac/flick-info/internal/tracing"
+)
+
+// ErrCircuitOpen is returned without trying to send the message while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("mailer: circuit breaker open")
+
+// Instrumented wraps another Sender, retrying failed sends and counting the sent, retried and permanently failed
+// messages for each template. The counts are published through expvar as mail_sent_total, mail_retried_total and
+// mail_failed_total, with the messages which the circuit breaker refused also counted in mail_rejected_total.
+//
+// After BreakerThreshold consecutive failed attempts, the circuit breaker opens, and messages fail straight away
+// with ErrCircuitOpen, rather than each one waiting through its retries while the SMTP server is down. Once
+// BreakerCooldown has passed, a single trial attempt is let through, and its result decides whether the breaker
+// closes. Template errors don't count as failures, as they say nothing about the SMTP server. Whether the
+// breaker is open is published as mail_circuit_open.
+//
+// Permanent failures are also tracked over a fixed window. When at least AlertMinSamples messages for a template
+// have finished in the current window and the fraction which failed reaches AlertThreshold, Alert is called. It is
+// called at most once per template per window, so a broken SMTP server doesn't produce an alert for every email.
+//
+// If Tracer is set, each message is also recorded as a trace span, covering every attempt to send it.
+type Instrumented struct {
+	Sender           Sender
+	Attempts         int           // Total attempts for each message, including the first.
+	Backoff          time.Duration // Delay before the first retry, doubled before each following retry.
+	AlertThreshold   float64       // Fraction (0-1] of failed messages which triggers an alert. Zero disables alerts.
+	AlertMinSamples  int
+	AlertWindow      time.Duration
+	Alert            func(templateFile string, failed, total int)
+	Tracer           *tracing.Tracer
+	BreakerThreshold int           // Consecutive failed attempts which open the breaker. Zero disables it.
+	BreakerCooldown  time.Duration // How long the breaker stays open before a trial attempt is let through.
+
+	sent     *expvar.Map
+	retried  *expvar.Map
+	failed   *expvar.Map
+	rejected *expvar.Map
+
+	mu      sync.Mutex
+	windows map[string]*failureWindow
+
+	breaker breaker
+}
+
+// breaker holds the circuit breaker state.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // Whether a trial attempt is in progress while the breaker is half open.
+}
+
+// failureWindow holds the outcomes for a template since the window started.
+type failureWindow struct {
+	start   time.Time
+	total   int
+	failed  int
+	alerted bool
+}
+
+// Return a new Instrumented sender wrapping s. Like expvar.NewMap(), this panics if it is called more than once.
+func NewInstrumented(s Sender) *Instrumented {
+	m := &Instrumented{
+		Sender:           s,
+		Attempts:         3,
+		Backoff:          500 * time.Millisecond,
+		AlertThreshold:   0.5,
+		AlertMinSamples:  5,
+		AlertWindow:      15 * time.Minute,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+		sent:             expvar.NewMap("mail_sent_total"),
+		retried:          expvar.NewMap("mail_retried_total"),
+		failed:           expvar.NewMap("mail_failed_total"),
+		rejected:         expvar.NewMap("mail_rejected_total"),
+		windows:          make(map[string]*failureWindow),
+	}
+
+	expvar.Publish("mail_circuit_open", expvar.Func(func() interface{} { return m.breakerOpen() }))
+
+	return m
+}
+
+// Send() sends the message with the wrapped Sender, retrying with exponential backoff if it fails. Template errors
+// aren't retried, as they would fail the same way every time, and nor is a message which the circuit breaker
+// refuses.
+func (m *Instrumented) Send(recipient, templateFile string, data interface{}) error {
+	// Emails are sent in the background, after the request which triggered them has finished, so each one starts a
+	// trace of its own.
+	_, span := m.Tracer.Start(context.Background(), "mailer.Send", tracing.KindClient)
+	defer span.End()
+
+	span.SetAttribute("mail.template", templateFile)
+
+	backoff := m.Backoff
+
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		if !m.allow() {
+			err = ErrCircuitOpen
+			m.rejected.Add(templateFile, 1)
+			break
+		}
+
+		err = m.Sender.Send(recipient, templateFile, data)
+		m.recordAttempt(err == nil || errors.Is(err, ErrTemplate))
+
+		if err == nil || errors.Is(err, ErrTemplate) || attempt >= m.Attempts {
+			break
+		}
+
+		m.retried.Add(templateFile, 1)
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	span.SetAttribute("mail.attempts", attempt)
+	span.RecordError(err)
+
+	if err != nil {
+		m.failed.Add(templateFile, 1)
+	} else {
+		m.sent.Add(templateFile, 1)
+	}
+
+	m.record(templateFile, err != nil)
+
+	return err
+}
+
+// record() adds an outcome to the template's failure window and calls the alert hook if the failure rate is
+// over the threshold.
+func (m *Instrumented) record(templateFile string, failed bool) {
+	if m.AlertThreshold <= 0 || m.Alert == nil {
+		return
+	}
+
+	m.mu.Lock()
+
+	now := time.Now()
+
+	w, ok := m.windows[templateFile]
+	if !ok || now.Sub(w.start) >= m.AlertWindow {
+		w = &failureWindow{start: now}
+		m.windows[templateFile] = w
+	}
+
+	w.total++
+	if failed {
+		w.failed++
+	}
+
+	alert := !w.alerted && w.total >= m.AlertMinSamples && float64(w.failed)/float64(w.total) >= m.AlertThreshold
+	if alert {
+		w.alerted = true
+	}
+
+	failedCount, total := w.failed, w.total
+
+	m.mu.Unlock()
+
+	// Call the hook without holding the lock, in case it is slow.
+	if alert {
+		m.Alert(templateFile, failedCount, total)
+	}
+}
+
+// allow() reports whether an attempt may be made. While the breaker is open, nothing is allowed until the
+// cooldown has passed; then a single trial attempt is let through.
+func (m *Instrumented) allow() bool {
+	if m.BreakerThreshold <= 0 {
+		return true
+	}
+
+	b := &m.breaker
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+
+	b.trial = true
+
+	return true
+}
+
+// recordAttempt() updates the breaker with the outcome of an attempt.
+func (m *Instrumented) recordAttempt(ok bool) {
+	if m.BreakerThreshold <= 0 {
+		return
+	}
+
+	b := &m.breaker
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasTrial := b.trial
+	b.trial = false
+
+	if ok {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+
+	// Open the breaker after too many consecutive failures, or straight away again if the trial failed.
+	if b.failures >= m.BreakerThreshold || wasTrial {
+		b.openUntil = time.Now().Add(m.BreakerCooldown)
+	}
+}
+
+// breakerOpen() reports whether the breaker is refusing messages.
+func (m *Instrumented) breakerOpen() bool {
+	b := &m.breaker
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !b.openUntil.IsZero() && (time.Now().Before(b.openUntil) || b.trial)
+}
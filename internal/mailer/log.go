@@ -0,0 +1,19 @@
+package mailer
+
+import "github.com/micypac/flick-info/internal/jsonlog"
+
+// Log writes emails to a logger instead of sending them, which is useful when there is no email service, such as
+// in development or when running a demo. Only the subject and plain text body are logged.
+type Log struct {
+	Logger *jsonlog.Logger
+}
+
+func (t Log) Send(msg *Message) error {
+	t.Logger.PrintInfo("email not sent", map[string]string{
+		"to":      msg.To,
+		"subject": msg.Subject,
+		"body":    msg.PlainBody,
+	})
+
+	return nil
+}
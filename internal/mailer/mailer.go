@@ -3,10 +3,11 @@ package mailer
 import (
 	"bytes"
 	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
 	"text/template"
-	"time"
-
-	"github.com/go-mail/mail/v2"
 )
 
 // Declare a variable with type embed.FS to hold the email templates.
@@ -16,68 +17,107 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-// Mailer struct definition which contains a mail.Dialer instance (used to connect to the SMTP server),
-// and the sender information for the email.
+// ErrTemplate is wrapped by the errors returned when an email template can't be parsed or executed.
+var ErrTemplate = errors.New("mailer: template error")
+
+// Mailer renders emails from the templates and sends them with a Transport, such as SMTP or the API of an email
+// service, from the sender address.
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	transport Transport
+	sender    string
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
-
+func New(transport Transport, sender string) Mailer {
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
 	}
 }
 
+// Sender is implemented by anything which can send an email built from one of the templates.
+type Sender interface {
+	Send(recipient, templateFile string, data interface{}) error
+}
+
 // Send() method on the Mailer type. This takes the recipient email address, name of the file containing the templates,
 // and any dynamic data for the templates as an interface{} parameter.
 func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	// Use the ParseFS() method to parse the required template file from the embedded file system.
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	subject, plainBody, htmlBody, err := render(templateFile, data)
 	if err != nil {
 		return err
 	}
 
-	// Execute the named template/s "subject/plainBody/htmlBody", passing in the dynamic data and storing the result in a
-	// bytes.Buffer variable.
-	subject := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(subject, "subject", data)
-	if err != nil {
-		return err
+	return m.transport.Send(&Message{
+		From:      m.sender,
+		To:        recipient,
+		Subject:   subject,
+		PlainBody: plainBody,
+		HTMLBody:  htmlBody,
+	})
+}
+
+// Check() confirms that emails can be sent, if the transport has a way of doing so without sending one, such as
+// connecting to the SMTP server.
+func (m Mailer) Check() error {
+	if checker, ok := m.transport.(interface{ Check() error }); ok {
+		return checker.Check()
 	}
 
-	plainBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
-	if err != nil {
-		return err
+	return nil
+}
+
+// layoutFile holds the layout shared by every email, which is parsed before the email's own template file.
+const layoutFile = "layout.tmpl.html"
+
+// Localize() returns the name of the locale's variant of the template file, such as user_welcome.fr.tmpl.html
+// for user_welcome.tmpl.html and the locale fr, or the template file itself if there's no variant for the locale.
+func Localize(templateFile, locale string) string {
+	base, ok := strings.CutSuffix(templateFile, ".tmpl.html")
+	if !ok || locale == "" || strings.ContainsAny(locale, "./") {
+		return templateFile
 	}
 
-	htmlBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
-	if err != nil {
-		return err
+	variant := base + "." + locale + ".tmpl.html"
+
+	if _, err := fs.Stat(templateFS, "templates/"+variant); err != nil {
+		return templateFile
 	}
 
-	// Use the mail.NewMessage() function to initialize a new mail.
-	// Note: AddAlternative should always be called after SetBody.
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	// Call the DialAndSend() method on the dialer to connect to the SMTP server and send the email.
-	// This opens a connection to the SMTP server, sends the message, then closes the connection.
-	// If there is a timeout, it will return an error.
-	err = m.dialer.DialAndSend(msg)
+	return variant
+}
+
+// render() executes the named templates "subject", "plainBody" and "htmlBody" in the template file, passing in
+// the dynamic data. The layout defines "htmlBody" around the template's "content", unless the template defines
+// "htmlBody" itself. If the template doesn't define "plainBody", the plain text body is generated from the HTML.
+func render(templateFile string, data interface{}) (subject, plainBody, htmlBody string, err error) {
+	// Use the ParseFS() method to parse the layout and the required template file from the embedded file system.
+	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+layoutFile, "templates/"+templateFile)
 	if err != nil {
-		return err
+		return "", "", "", fmt.Errorf("%w: %v", ErrTemplate, err)
 	}
 
-	return nil
+	names := []string{"subject", "htmlBody"}
+	if tmpl.Lookup("plainBody") != nil {
+		names = append(names, "plainBody")
+	}
+
+	// Execute each named template, storing the result in a bytes.Buffer variable.
+	parts := make(map[string]string, len(names))
+	for _, name := range names {
+		buf := new(bytes.Buffer)
+
+		err = tmpl.ExecuteTemplate(buf, name, data)
+		if err != nil {
+			return "", "", "", fmt.Errorf("%w: %v", ErrTemplate, err)
+		}
+
+		parts[name] = buf.String()
+	}
+
+	plainBody, ok := parts["plainBody"]
+	if !ok {
+		plainBody = htmlToText(parts["htmlBody"])
+	}
+
+	return parts["subject"], plainBody, parts["htmlBody"], nil
 }
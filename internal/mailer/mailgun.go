@@ -0,0 +1,67 @@
+package mailer
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MailgunOptions configures the Mailgun transport.
+type MailgunOptions struct {
+	Domain string // Sending domain, such as mg.example.com.
+	APIKey string
+
+	// Endpoint is the base URL of the Mailgun API, https://api.mailgun.net if empty. Domains in the EU region
+	// need https://api.eu.mailgun.net.
+	Endpoint string
+}
+
+// Mailgun sends emails through the Mailgun messages API, from a domain set up in Mailgun.
+type Mailgun struct {
+	apiKey string
+	url    string
+	client *http.Client
+}
+
+func NewMailgun(opts MailgunOptions) (*Mailgun, error) {
+	if opts.Domain == "" || opts.APIKey == "" {
+		return nil, errors.New("mailer: Mailgun domain and API key must be provided")
+	}
+
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.mailgun.net"
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("mailer: Mailgun endpoint must be an http or https URL")
+	}
+
+	return &Mailgun{
+		apiKey: opts.APIKey,
+		url:    strings.TrimSuffix(endpoint, "/") + "/v3/" + url.PathEscape(opts.Domain) + "/messages",
+		client: &http.Client{Timeout: httpTimeout},
+	}, nil
+}
+
+func (t *Mailgun) Send(msg *Message) error {
+	form := url.Values{
+		"from":    {msg.From},
+		"to":      {msg.To},
+		"subject": {msg.Subject},
+		"text":    {msg.PlainBody},
+		"html":    {msg.HTMLBody},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth("api", t.apiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return do(t.client, req)
+}
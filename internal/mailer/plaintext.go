@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Elements whose contents aren't shown, along with the contents.
+	hiddenRX = regexp.MustCompile(`(?is)<(head|style|script)\b.*?</(head|style|script)>`)
+	// Links, which are written as their text followed by the URL in brackets.
+	linkRX = regexp.MustCompile(`(?is)<a\b[^>]*\bhref="([^"]*)"[^>]*>(.*?)</a>`)
+	// Tags which end a line or a paragraph, and list items, which start a line with a dash.
+	lineBreakRX = regexp.MustCompile(`(?i)<br\s*/?>|</(li|tr)>`)
+	paragraphRX = regexp.MustCompile(`(?i)</(p|div|h[1-6]|ul|ol|table|pre|blockquote)>`)
+	listItemRX  = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	tagRX       = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacesRX    = regexp.MustCompile(`[ \t]+`)
+	blankRX     = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText() returns a plain text version of an HTML email body, for templates which don't define a
+// "plainBody" of their own: paragraphs are separated by blank lines, list items start with a dash, and links are
+// followed by their URLs. It only handles the simple markup the email templates use.
+func htmlToText(body string) string {
+	// Line breaks in the HTML source are only whitespace, so they're replaced before the tags add the real ones.
+	text := hiddenRX.ReplaceAllString(body, "")
+	text = strings.NewReplacer("\r\n", " ", "\n", " ").Replace(text)
+	text = linkRX.ReplaceAllString(text, "$2 ($1)")
+	text = listItemRX.ReplaceAllString(text, "\n- ")
+	text = lineBreakRX.ReplaceAllString(text, "\n")
+	text = paragraphRX.ReplaceAllString(text, "\n\n")
+	text = tagRX.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	// Collapse the indentation of the HTML source.
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(spacesRX.ReplaceAllString(line, " "))
+	}
+
+	text = strings.Join(lines, "\n")
+	text = blankRX.ReplaceAllString(text, "\n\n")
+
+	return strings.TrimSpace(text) + "\n"
+}
@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+)
+
+// sendGridURL is the endpoint of the SendGrid v3 mail send API.
+const sendGridURL = "https://api.sendgrid.com/v3/mail/send"
+
+// SendGrid sends emails through the SendGrid v3 API. The sender address must be verified in SendGrid.
+type SendGrid struct {
+	apiKey string
+	url    string
+	client *http.Client
+}
+
+func NewSendGrid(apiKey string) (*SendGrid, error) {
+	if apiKey == "" {
+		return nil, errors.New("mailer: SendGrid API key must be provided")
+	}
+
+	return &SendGrid{apiKey: apiKey, url: sendGridURL, client: &http.Client{Timeout: httpTimeout}}, nil
+}
+
+// sendGridAddress is an email address in a mail send request, with an optional display name.
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func (t *SendGrid) Send(msg *Message) error {
+	// SendGrid takes the sender's display name separately from the address.
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+
+	type personalization struct {
+		To []sendGridAddress `json:"to"`
+	}
+
+	input := struct {
+		Personalizations []personalization `json:"personalizations"`
+		From             sendGridAddress   `json:"from"`
+		Subject          string            `json:"subject"`
+		Content          []sendGridContent `json:"content"`
+	}{
+		Personalizations: []personalization{{To: []sendGridAddress{{Email: msg.To}}}},
+		From:             sendGridAddress{Email: from.Address, Name: from.Name},
+		Subject:          msg.Subject,
+		// The plain text must come before the HTML.
+		Content: []sendGridContent{
+			{Type: "text/plain", Value: msg.PlainBody},
+			{Type: "text/html", Value: msg.HTMLBody},
+		},
+	}
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	return do(t.client, req)
+}
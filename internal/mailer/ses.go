@@ -0,0 +1,101 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/micypac/flick-info/internal/awsv4"
+)
+
+// SESOptions configures the Amazon SES transport.
+type SESOptions struct {
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// Endpoint is the base URL of the SES API, https://email.<region>.amazonaws.com if empty.
+	Endpoint string
+}
+
+// SES sends emails through the Amazon SES v2 API, with requests signed with AWS Signature Version 4. The sender
+// address must be verified in SES.
+type SES struct {
+	creds  awsv4.Credentials
+	url    string
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewSES(opts SESOptions) (*SES, error) {
+	if opts.Region == "" || opts.AccessKey == "" || opts.SecretKey == "" {
+		return nil, errors.New("mailer: SES region, access key and secret key must be provided")
+	}
+
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = "https://email." + opts.Region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("mailer: SES endpoint must be an http or https URL")
+	}
+
+	return &SES{
+		creds:  awsv4.Credentials{Region: opts.Region, AccessKey: opts.AccessKey, SecretKey: opts.SecretKey},
+		url:    strings.TrimSuffix(endpoint, "/") + "/v2/email/outbound-emails",
+		client: &http.Client{Timeout: httpTimeout},
+		now:    time.Now,
+	}, nil
+}
+
+// sesContent is the text of a subject or body in a SendEmail request.
+type sesContent struct {
+	Data    string `json:"Data"`
+	Charset string `json:"Charset"`
+}
+
+func (t *SES) Send(msg *Message) error {
+	var input struct {
+		FromEmailAddress string `json:"FromEmailAddress"`
+		Destination      struct {
+			ToAddresses []string `json:"ToAddresses"`
+		} `json:"Destination"`
+		Content struct {
+			Simple struct {
+				Subject sesContent `json:"Subject"`
+				Body    struct {
+					Text sesContent `json:"Text"`
+					Html sesContent `json:"Html"`
+				} `json:"Body"`
+			} `json:"Simple"`
+		} `json:"Content"`
+	}
+
+	input.FromEmailAddress = msg.From
+	input.Destination.ToAddresses = []string{msg.To}
+	input.Content.Simple.Subject = sesContent{Data: msg.Subject, Charset: "UTF-8"}
+	input.Content.Simple.Body.Text = sesContent{Data: msg.PlainBody, Charset: "UTF-8"}
+	input.Content.Simple.Body.Html = sesContent{Data: msg.HTMLBody, Charset: "UTF-8"}
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	awsv4.Sign(req, body, "ses", t.creds, t.now())
+
+	return do(t.client, req)
+}
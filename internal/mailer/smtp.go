@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// SMTP sends emails through an SMTP server, opening a new connection for each one.
+type SMTP struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTP(host string, port int, username, password string) *SMTP {
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTP{dialer: dialer}
+}
+
+func (t *SMTP) Send(m *Message) error {
+	// Use the mail.NewMessage() function to initialize a new mail.
+	// Note: AddAlternative should always be called after SetBody.
+	msg := mail.NewMessage()
+	msg.SetHeader("To", m.To)
+	msg.SetHeader("From", m.From)
+	msg.SetHeader("Subject", m.Subject)
+	msg.SetBody("text/plain", m.PlainBody)
+	msg.AddAlternative("text/html", m.HTMLBody)
+
+	// Call the DialAndSend() method on the dialer to connect to the SMTP server and send the email.
+	// This opens a connection to the SMTP server, sends the message, then closes the connection.
+	// If there is a timeout, it will return an error.
+	return t.dialer.DialAndSend(msg)
+}
+
+// Check() connects to the SMTP server and authenticates, without sending anything, to confirm that emails can be
+// sent.
+func (t *SMTP) Check() error {
+	conn, err := t.dialer.Dial()
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
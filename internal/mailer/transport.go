@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Message is a rendered email, ready to be sent by a Transport.
+type Message struct {
+	From      string // Address of the sender, optionally with a display name, such as "Flickinfo <no-reply@...>".
+	To        string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+}
+
+// Transport delivers rendered emails, over SMTP or through the API of an email service. Implementations are safe
+// for concurrent use.
+type Transport interface {
+	Send(msg *Message) error
+}
+
+// httpTimeout limits each request made by the transports which send emails through an HTTP API.
+const httpTimeout = 10 * time.Second
+
+// do() sends an API request, returning an error describing the response, including the start of its body, unless
+// it succeeded.
+func do(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("mailer: unexpected response %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
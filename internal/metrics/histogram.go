@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Default bucket upper bounds for request latency (in seconds) and response size (in bytes).
+var (
+	LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	SizeBuckets    = []float64{100, 500, 1_000, 5_000, 10_000, 50_000, 100_000, 500_000, 1_000_000}
+)
+
+// Histogram counts observations into a fixed set of buckets. Each bucket holds the number of observations
+// less than or equal to its upper bound, plus an implicit +Inf bucket for everything larger.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Return a new Histogram with the given bucket upper bounds. The bounds are sorted in ascending order.
+func NewHistogram(buckets []float64) *Histogram {
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+
+	return &Histogram{
+		buckets: b,
+		counts:  make([]uint64, len(b)+1),
+	}
+}
+
+// Observe() records a single value in the histogram.
+func (h *Histogram) Observe(value float64) {
+	// Find the first bucket whose upper bound is >= value. If there is none, the value goes in +Inf.
+	i := sort.SearchFloat64s(h.buckets, value)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[i]++
+	h.count++
+	h.sum += value
+}
+
+// HistogramSnapshot holds a point-in-time copy of a histogram, including the estimated quantiles.
+type HistogramSnapshot struct {
+	Count   uint64    `json:"count"`
+	Sum     float64   `json:"sum"`
+	P50     float64   `json:"p50"`
+	P95     float64   `json:"p95"`
+	P99     float64   `json:"p99"`
+	Buckets []float64 `json:"-"`
+	Counts  []uint64  `json:"-"` // Non-cumulative counts, one per bucket plus the trailing +Inf bucket.
+}
+
+// Snapshot() returns a copy of the current histogram state.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := HistogramSnapshot{
+		Count:   h.count,
+		Sum:     h.sum,
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.counts)),
+	}
+	copy(s.Counts, h.counts)
+
+	s.P50 = s.Quantile(0.50)
+	s.P95 = s.Quantile(0.95)
+	s.P99 = s.Quantile(0.99)
+
+	return s
+}
+
+// Quantile() estimates the q-th quantile (0 <= q <= 1) by linear interpolation inside the bucket that contains it.
+// Values falling in the +Inf bucket are reported as the largest finite bucket bound.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+
+	rank := q * float64(s.Count)
+
+	var cumulative uint64
+	for i, c := range s.Counts {
+		if c == 0 || float64(cumulative+c) < rank {
+			cumulative += c
+			continue
+		}
+
+		if i == len(s.Buckets) {
+			return s.Buckets[len(s.Buckets)-1]
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = s.Buckets[i-1]
+		}
+		upper := s.Buckets[i]
+
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(c)
+	}
+
+	return s.Buckets[len(s.Buckets)-1]
+}
+
+// HistogramVec is a collection of histograms sharing the same name and buckets, partitioned by label values.
+type HistogramVec struct {
+	Name       string
+	Help       string
+	LabelNames []string
+
+	mu         sync.RWMutex
+	buckets    []float64
+	histograms map[string]*Histogram
+	labels     map[string][]string
+}
+
+// Registry of all histogram vectors created with NewHistogramVec(), in the same spirit as expvar's
+// global registry of variables.
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*HistogramVec)
+)
+
+// Return a new HistogramVec with the given metric name, help text, label names, and bucket upper bounds.
+// The vector is registered globally so that it is exported by Handler(). Like expvar.Publish(), this panics
+// if a vector with the same name has already been registered.
+func NewHistogramVec(name, help string, labelNames []string, buckets []float64) *HistogramVec {
+	v := &HistogramVec{
+		Name:       name,
+		Help:       help,
+		LabelNames: labelNames,
+		buckets:    buckets,
+		histograms: make(map[string]*Histogram),
+		labels:     make(map[string][]string),
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic("reuse of histogram name: " + name)
+	}
+	registry[name] = v
+
+	return v
+}
+
+// registered() returns all registered histogram vectors sorted by name.
+func registered() []*HistogramVec {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	vecs := make([]*HistogramVec, 0, len(registry))
+	for _, v := range registry {
+		vecs = append(vecs, v)
+	}
+
+	sort.Slice(vecs, func(i, j int) bool { return vecs[i].Name < vecs[j].Name })
+
+	return vecs
+}
+
+// WithLabelValues() returns the histogram for the given label values, creating it if it doesn't exist yet.
+// The values must be provided in the same order as the vector's label names.
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	h, ok := v.histograms[key]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// Check again in case another goroutine created the histogram between the two locks.
+	if h, ok := v.histograms[key]; ok {
+		return h
+	}
+
+	h = NewHistogram(v.buckets)
+	v.histograms[key] = h
+	v.labels[key] = append([]string(nil), values...)
+
+	return h
+}
+
+// Each() calls fn for every histogram in the vector, in a stable order sorted by label values.
+func (v *HistogramVec) Each(fn func(labelValues []string, s HistogramSnapshot)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.histograms))
+	for key := range v.histograms {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		h, values := v.histograms[key], v.labels[key]
+		v.mu.RUnlock()
+
+		fn(values, h.Snapshot())
+	}
+}
+
+// Summary() returns the snapshots keyed by their label values joined with a space. This is suitable
+// for publishing through expvar.
+func (v *HistogramVec) Summary() map[string]HistogramSnapshot {
+	summary := make(map[string]HistogramSnapshot)
+
+	v.Each(func(labelValues []string, s HistogramSnapshot) {
+		summary[strings.Join(labelValues, " ")] = s
+	})
+
+	return summary
+}
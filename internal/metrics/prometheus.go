@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Handler() returns an http.Handler which writes every registered histogram vector, along with every numeric
+// expvar variable, in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		bw := bufio.NewWriter(w)
+		defer bw.Flush()
+
+		writeExpvars(bw)
+
+		for _, vec := range registered() {
+			WriteHistogramVec(bw, vec)
+		}
+	})
+}
+
+// WriteHistogramVec() writes a single histogram vector in the Prometheus text exposition format.
+func WriteHistogramVec(w io.Writer, vec *HistogramVec) {
+	name := sanitizeName(vec.Name)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, vec.Help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	vec.Each(func(labelValues []string, s HistogramSnapshot) {
+		labels := formatLabels(vec.LabelNames, labelValues)
+
+		// Prometheus buckets are cumulative, so keep a running total.
+		var cumulative uint64
+		for i, bound := range s.Buckets {
+			cumulative += s.Counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, joinLabels(labels, `le="`+formatFloat(bound)+`"`), cumulative)
+		}
+		cumulative += s.Counts[len(s.Buckets)]
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, joinLabels(labels, `le="+Inf"`), cumulative)
+
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(s.Sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, s.Count)
+	})
+}
+
+// writeExpvars() writes every expvar.Int, expvar.Float and expvar.Map (of numeric values) as untyped metrics.
+// Other variable types, such as strings and funcs, are skipped.
+func writeExpvars(w io.Writer) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		name := sanitizeName(kv.Key)
+
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			fmt.Fprintf(w, "# TYPE %s untyped\n%s %d\n", name, name, v.Value())
+		case *expvar.Float:
+			fmt.Fprintf(w, "# TYPE %s untyped\n%s %s\n", name, name, formatFloat(v.Value()))
+		case *expvar.Map:
+			fmt.Fprintf(w, "# TYPE %s untyped\n", name)
+			v.Do(func(entry expvar.KeyValue) {
+				labels := formatLabels([]string{"key"}, []string{entry.Key})
+
+				switch ev := entry.Value.(type) {
+				case *expvar.Int:
+					fmt.Fprintf(w, "%s{%s} %d\n", name, labels, ev.Value())
+				case *expvar.Float:
+					fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(ev.Value()))
+				}
+			})
+		}
+	})
+}
+
+// sanitizeName() replaces any character that isn't valid in a Prometheus metric name with an underscore.
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, 0, len(names))
+
+	for i := range names {
+		pairs = append(pairs, names[i]+"="+strconv.Quote(values[i]))
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+
+	return labels + "," + extra
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,309 @@
+// Package redis is a minimal Redis client. It speaks enough of the RESP2 protocol to run commands and Lua
+// scripts over a small pool of connections, which is all the API needs Redis for.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is an error reply from the server, such as "NOSCRIPT No matching script". The connection can still be
+// used after one.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Options configures a Client.
+type Options struct {
+	Addr     string // host:port
+	Password string
+	DB       int
+
+	// DialTimeout limits connecting, and Timeout limits each command when the context has no earlier deadline.
+	DialTimeout time.Duration
+	Timeout     time.Duration
+
+	// PoolSize is the most idle connections kept for reuse.
+	PoolSize int
+}
+
+// Client runs commands on a Redis server. It is safe for concurrent use.
+type Client struct {
+	opts Options
+	idle chan *conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// New() returns a client for the server. No connection is made until the first command.
+func New(opts Options) *Client {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+
+	return &Client{opts: opts, idle: make(chan *conn, opts.PoolSize)}
+}
+
+// ParseURL() parses a URL such as "redis://:password@localhost:6379/0" into options. The port defaults to 6379
+// and the database to 0.
+func ParseURL(rawURL string) (Options, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Options{}, err
+	}
+
+	if u.Scheme != "redis" || u.Host == "" {
+		return Options{}, errors.New("redis URL must be in the form redis://[:password@]host[:port][/db]")
+	}
+
+	opts := Options{Addr: u.Host}
+
+	if u.Port() == "" {
+		opts.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if password, ok := u.User.Password(); ok {
+		opts.Password = password
+	}
+
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		opts.DB, err = strconv.Atoi(db)
+		if err != nil || opts.DB < 0 {
+			return Options{}, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+
+	return opts, nil
+}
+
+// Do() runs the command and returns its reply: a string, an int64, nil, or a []interface{} of those. An error
+// reply is returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := cn.do(ctx, c.opts.Timeout, args)
+
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may be part way through a reply, so it can't be reused.
+		cn.Close()
+		return nil, err
+	}
+
+	c.put(cn)
+
+	return reply, err
+}
+
+// Ping() checks that the server can be reached.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Do(ctx, "PING")
+	return err
+}
+
+// Script is a Lua script which is run with EVALSHA, falling back to EVAL the first time it is run on a server
+// which hasn't cached it.
+type Script struct {
+	src  string
+	hash string
+}
+
+func NewScript(src string) *Script {
+	sum := sha1.Sum([]byte(src))
+	return &Script{src: src, hash: hex.EncodeToString(sum[:])}
+}
+
+// Run() runs the script with the keys and arguments.
+func (s *Script) Run(ctx context.Context, c *Client, keys []string, args ...string) (interface{}, error) {
+	cmd := func(name, script string) []string {
+		cmd := append([]string{name, script, strconv.Itoa(len(keys))}, keys...)
+		return append(cmd, args...)
+	}
+
+	reply, err := c.Do(ctx, cmd("EVALSHA", s.hash)...)
+
+	var replyErr Error
+	if errors.As(err, &replyErr) && strings.HasPrefix(string(replyErr), "NOSCRIPT") {
+		return c.Do(ctx, cmd("EVAL", s.src)...)
+	}
+
+	return reply, err
+}
+
+// Close() closes the idle connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: c.opts.DialTimeout}
+
+	nc, err := dialer.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+
+	if c.opts.Password != "" {
+		_, err = cn.do(ctx, c.opts.Timeout, []string{"AUTH", c.opts.Password})
+		if err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+
+	if c.opts.DB != 0 {
+		_, err = cn.do(ctx, c.opts.Timeout, []string{"SELECT", strconv.Itoa(c.opts.DB)})
+		if err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// do() sends the command as an array of bulk strings and reads the reply.
+func (cn *conn) do(ctx context.Context, timeout time.Duration, args []string) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	err := cn.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err = io.WriteString(cn, b.String())
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := readReply(cn.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if replyErr, ok := reply.(Error); ok {
+		return nil, replyErr
+	}
+
+	return reply, nil
+}
+
+// readReply() reads a single reply. Error replies are returned as Error values rather than errors, so that
+// errors inside arrays don't stop the rest of the array being read.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: invalid bulk string length %q", line[1:])
+		}
+
+		if n == -1 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: invalid array length %q", line[1:])
+		}
+
+		if n == -1 {
+			return nil, nil
+		}
+
+		values := make([]interface{}, n)
+
+		for i := range values {
+			values[i], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,45 @@
+// Package storage keeps uploaded files, such as movie posters, either on the local disk or in an S3-compatible
+// object store. Every instance of the API must use the same store, so the local disk is only suitable for a
+// single instance or a shared volume.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+)
+
+var (
+	// ErrNotFound is returned when there is no file with the key.
+	ErrNotFound = errors.New("storage: file not found")
+	// ErrInvalidKey is returned for a key which doesn't match ValidKey().
+	ErrInvalidKey = errors.New("storage: invalid key")
+)
+
+// keyRX matches the keys files can be stored under. They can't contain a slash, or start with a dot, so that a
+// key can't name a file outside the local store's directory.
+var keyRX = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,199}$`)
+
+// ValidKey() reports whether the key can be used to store a file: up to 200 lower case letters, digits, dots,
+// underscores and hyphens, starting with a letter or digit.
+func ValidKey(key string) bool {
+	return keyRX.MatchString(key)
+}
+
+// File is a stored file being read. The caller must close Body.
+type File struct {
+	Body        io.ReadCloser
+	ContentType string
+	Size        int64
+}
+
+// Store keeps files under keys which must match ValidKey(). Implementations are safe for concurrent use.
+type Store interface {
+	// Put() stores the data under the key, replacing any file already there.
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get() opens the file with the key, returning ErrNotFound if there isn't one.
+	Get(ctx context.Context, key string) (*File, error)
+	// Delete() removes the file with the key. Deleting a file which doesn't exist isn't an error.
+	Delete(ctx context.Context, key string) error
+}
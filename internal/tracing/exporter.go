@@ -0,0 +1,298 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Exporter settings. Spans are sent when a batch fills up, or at least every exportInterval, and ended spans are
+// dropped rather than slowing the API down if the collector can't keep up with them.
+const (
+	queueSize      = 2048
+	batchSize      = 512
+	exportInterval = 5 * time.Second
+	exportTimeout  = 10 * time.Second
+)
+
+// exporter sends ended spans to an OTLP/HTTP collector in batches, from a goroutine of its own.
+type exporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+
+	queue   chan *Span
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	exported atomic.Int64
+	dropped  atomic.Int64
+	failed   atomic.Int64
+}
+
+// Stats counts the spans handled by a tracer's exporter since it started, for the tracing expvar variable.
+type Stats struct {
+	Exported int64 `json:"exported"`
+	Dropped  int64 `json:"dropped"`
+	Failed   int64 `json:"failed"`
+}
+
+func newExporter(url, serviceName string) *exporter {
+	e := &exporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		queue:       make(chan *Span, queueSize),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	go e.run()
+
+	return e
+}
+
+func (e *exporter) stats() Stats {
+	return Stats{Exported: e.exported.Load(), Dropped: e.dropped.Load(), Failed: e.failed.Load()}
+}
+
+// enqueue() adds the span to the next batch, or drops it if the queue is full or the exporter has stopped.
+func (e *exporter) enqueue(span *Span) {
+	select {
+	case <-e.done:
+		e.dropped.Add(1)
+		return
+	default:
+	}
+
+	select {
+	case e.queue <- span:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// run() collects the queued spans into batches and exports them, until shutdown() is called, when it exports
+// whatever is left in the queue.
+func (e *exporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+
+	send := func() {
+		if len(batch) > 0 {
+			e.export(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) == batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case <-e.done:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+					if len(batch) == batchSize {
+						send()
+					}
+				default:
+					send()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *exporter) shutdown(ctx context.Context) error {
+	e.once.Do(func() { close(e.done) })
+
+	select {
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// export() sends the batch to the collector, counting its spans as failed if it can't be sent. Failed batches
+// aren't retried, as traces are only a diagnostic aid and newer spans are more useful than older ones.
+func (e *exporter) export(batch []*Span) {
+	body, err := json.Marshal(e.request(batch))
+	if err == nil {
+		err = e.post(body)
+	}
+
+	if err != nil {
+		e.failed.Add(int64(len(batch)))
+		return
+	}
+
+	e.exported.Add(int64(len(batch)))
+}
+
+func (e *exporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Read the body so that the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("tracing: collector responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of an ExportTraceServiceRequest, limited to the fields the tracer sets. Trace and
+// span IDs are hex strings, and 64-bit integers are decimal strings, as the protocol's JSON mapping requires.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              SpanKind        `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 2 is STATUS_CODE_ERROR.
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// instrumentationScope names the code which recorded the spans.
+const instrumentationScope = "github.com/micypac/flick-info/internal/tracing"
+
+func (e *exporter) request(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, len(batch))
+
+	for i, s := range batch {
+		s.mu.Lock()
+
+		span := otlpSpan{
+			TraceID:           s.sc.TraceID.String(),
+			SpanID:            s.sc.SpanID.String(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+
+		switch {
+		case s.parent != nil:
+			span.ParentSpanID = s.parent.sc.SpanID.String()
+		case s.remote != SpanID{}:
+			span.ParentSpanID = s.remote.String()
+		}
+
+		if s.failed {
+			span.Status = &otlpStatus{Code: 2, Message: s.errMessage}
+		}
+
+		s.mu.Unlock()
+
+		spans[i] = span
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes([]Attribute{
+			{Key: "service.name", Value: e.serviceName},
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: instrumentationScope},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func otlpAttributes(attributes []Attribute) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attributes))
+
+	for _, attr := range attributes {
+		var value otlpValue
+
+		switch v := attr.Value.(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+
+		encoded = append(encoded, otlpAttribute{Key: attr.Key, Value: value})
+	}
+
+	return encoded
+}
@@ -0,0 +1,161 @@
+package tracing
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"unicode"
+)
+
+// maxStatementLength is the most bytes of a query recorded in a span's db.statement attribute.
+const maxStatementLength = 4096
+
+// WrapConnector() returns a connector for sql.OpenDB() which records a span for every query and statement run
+// through the connections of the wrapped connector, with the SQL in its db.statement attribute. The argument
+// values aren't recorded, as they may hold personal data.
+//
+// Only queries run in a context holding a span are recorded, as children of it, so that the queries of a
+// request show up in its trace, while the periodic ones made by background jobs and health checks don't each
+// start a trace of their own.
+func WrapConnector(connector driver.Connector, tracer *Tracer, system string) driver.Connector {
+	if tracer == nil {
+		return connector
+	}
+
+	return &tracedConnector{Connector: connector, tracer: tracer, system: system}
+}
+
+type tracedConnector struct {
+	driver.Connector
+	tracer *Tracer
+	system string
+}
+
+func (c *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tracedConn{Conn: conn, connector: c}, nil
+}
+
+// tracedConn passes everything through to the wrapped connection, recording spans for queries and statements.
+// The optional interfaces which database/sql checks for are implemented by falling back to what database/sql
+// would do if the wrapped connection doesn't implement them.
+type tracedConn struct {
+	driver.Conn
+	connector *tracedConnector
+}
+
+// start() starts a span for the query if ctx holds one, returning nil otherwise.
+func (c *tracedConn) start(ctx context.Context, query string) *Span {
+	if SpanFromContext(ctx) == nil {
+		return nil
+	}
+
+	// Name the span after the SQL command, such as SELECT, which is the first word of the query.
+	operation := strings.TrimSpace(query)
+	if i := strings.IndexFunc(operation, unicode.IsSpace); i >= 0 {
+		operation = operation[:i]
+	}
+	operation = strings.ToUpper(operation)
+
+	if len(query) > maxStatementLength {
+		query = query[:maxStatementLength]
+	}
+
+	_, span := c.connector.tracer.Start(ctx, operation, KindClient)
+	span.SetAttributes(
+		Attribute{Key: "db.system", Value: c.connector.system},
+		Attribute{Key: "db.operation", Value: operation},
+		Attribute{Key: "db.statement", Value: query},
+	)
+
+	return span
+}
+
+// end() ends the span, recording the error unless it is driver.ErrSkip, which only tells database/sql to try
+// another way of running the query.
+func (c *tracedConn) end(span *Span, err error) {
+	if err != nil && err != driver.ErrSkip {
+		span.RecordError(err)
+	}
+
+	span.End()
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	span := c.start(ctx, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	c.end(span, err)
+
+	return rows, err
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	span := c.start(ctx, query)
+	result, err := execer.ExecContext(ctx, query, args)
+	c.end(span, err)
+
+	return result, err
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+
+	return c.Conn.Prepare(query)
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+
+	// This is what database/sql does for drivers without BeginTx().
+	return c.Conn.Begin()
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+
+	return true
+}
+
+func (c *tracedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+
+	return driver.ErrSkip
+}
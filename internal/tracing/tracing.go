@@ -0,0 +1,333 @@
+// Package tracing records OpenTelemetry trace spans and exports them to a collector with the OTLP/HTTP JSON
+// protocol. It implements the small part of OpenTelemetry the API needs: spans with attributes and an error
+// status, parent-based ratio sampling, and W3C Trace Context propagation through the traceparent header.
+//
+// A nil *Tracer is valid and records nothing, as is the nil *Span it starts, so code can be instrumented
+// whether or not tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace: every span started from the same root has the same one.
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span within its trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is the part of a span which is propagated to its children, in this process or another one.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid() reports whether the trace and span IDs are set. The W3C spec reserves all zeros as invalid.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent() returns the span context as the value of a W3C traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent() parses the value of a W3C traceparent header, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", returning false if it isn't valid. Versions after
+// 00 are accepted as long as they start with the fields of version 00, as the spec asks.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+
+	if len(s) < 55 || (len(s) > 55 && s[55] != '-') {
+		return sc, false
+	}
+
+	version, traceID, spanID, flags := s[0:2], s[3:35], s[36:52], s[53:55]
+
+	if s[2] != '-' || s[35] != '-' || s[52] != '-' || version == "ff" || (version == "00" && len(s) != 55) {
+		return sc, false
+	}
+
+	for _, field := range []string{version, traceID, spanID, flags} {
+		if strings.ToLower(field) != field {
+			return sc, false
+		}
+	}
+
+	var flagBytes [1]byte
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(traceID)); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(spanID)); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(flagBytes[:], []byte(flags)); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.DecodeString(version); err != nil {
+		return SpanContext{}, false
+	}
+
+	sc.Sampled = flagBytes[0]&1 == 1
+
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+
+	return sc, true
+}
+
+// SpanKind describes the relationship of a span to the work around it, as in the OTLP protocol.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Attribute is a key-value pair describing a span, such as "http.route" = "/v1/movies/:id".
+type Attribute struct {
+	Key   string
+	Value interface{} // A string, bool, int, int64 or float64.
+}
+
+// Span is a timed operation in a trace. Its methods are safe for concurrent use, and do nothing on a nil
+// *Span.
+type Span struct {
+	tracer *Tracer
+	parent *Span
+	name   string
+	kind   SpanKind
+	sc     SpanContext
+	remote SpanID // ID of the parent span, if it is in another process.
+	start  time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []Attribute
+	errMessage string
+	failed     bool
+	ended      bool
+}
+
+// Context() returns the span's context, for propagating it to another process.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// Parent() returns the span's parent in this process, or nil if it is a root span or its parent is remote.
+func (s *Span) Parent() *Span {
+	if s == nil {
+		return nil
+	}
+	return s.parent
+}
+
+// TraceID() returns the hex ID of the span's trace, for correlating logs with it, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.sc.TraceID.String()
+}
+
+// SetAttributes() adds the attributes to the span, replacing any already set with the same keys.
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, attr := range attributes {
+		replaced := false
+		for i := range s.attributes {
+			if s.attributes[i].Key == attr.Key {
+				s.attributes[i] = attr
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			s.attributes = append(s.attributes, attr)
+		}
+	}
+}
+
+// SetAttribute() adds a single attribute to the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.SetAttributes(Attribute{Key: key, Value: value})
+}
+
+// RecordError() marks the span as failed with the error's message. A nil error is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.SetError(err.Error())
+}
+
+// SetError() marks the span as failed with the message, for failures which aren't Go errors, such as a 500
+// response.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed = true
+	s.errMessage = message
+}
+
+// End() records the end of the span and queues it for export if it was sampled. Only the first call has any
+// effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.tracer.exporter.enqueue(s)
+	}
+}
+
+type contextKey int
+
+const (
+	spanContextKey contextKey = iota
+	remoteContextKey
+)
+
+// ContextWithSpan() returns a copy of ctx holding the span, which spans started from it will be children of.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey, span)
+}
+
+// SpanFromContext() returns the span in ctx, or nil if there isn't one.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey).(*Span)
+	return span
+}
+
+// ContextWithRemoteParent() returns a copy of ctx holding the span context of a span in another process, such as
+// one read from a traceparent header, which the next span started from it will be a child of.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteContextKey, sc)
+}
+
+// Tracer starts spans and exports the sampled ones. It is safe for concurrent use.
+type Tracer struct {
+	sampleRatio float64
+	exporter    *exporter
+}
+
+// Config holds the tracer settings.
+type Config struct {
+	Endpoint    string  // Base URL of the OTLP/HTTP collector, such as http://localhost:4318.
+	ServiceName string  // Reported as the service.name resource attribute.
+	SampleRatio float64 // Fraction (0-1) of new traces which are recorded.
+}
+
+// New() returns a tracer which exports its spans to the collector in the config. It starts a goroutine to send
+// them in batches, which Shutdown() stops.
+func New(cfg Config) *Tracer {
+	return &Tracer{
+		sampleRatio: cfg.SampleRatio,
+		exporter:    newExporter(strings.TrimRight(cfg.Endpoint, "/")+"/v1/traces", cfg.ServiceName),
+	}
+}
+
+// Start() starts a span, returning it along with a copy of ctx holding it. The span is a child of the span in
+// ctx, or of the remote parent if there is one, and is sampled if its parent was. A new trace is sampled with the
+// configured ratio. Calling Start() on a nil *Tracer returns ctx and a nil *Span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.parent = parent
+		span.sc.TraceID = parent.sc.TraceID
+		span.sc.Sampled = parent.sc.Sampled
+	} else if remote, ok := ctx.Value(remoteContextKey).(SpanContext); ok && remote.IsValid() {
+		span.remote = remote.SpanID
+		span.sc.TraceID = remote.TraceID
+		span.sc.Sampled = remote.Sampled
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = t.sample(span.sc.TraceID)
+	}
+
+	rand.Read(span.sc.SpanID[:])
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// sample() decides whether to record a new trace, from the last 8 bytes of its random ID, so that every
+// process sampling the same trace with the same ratio agrees.
+func (t *Tracer) sample(id TraceID) bool {
+	switch {
+	case t.sampleRatio >= 1:
+		return true
+	case t.sampleRatio <= 0:
+		return false
+	}
+
+	return binary.BigEndian.Uint64(id[8:]) < uint64(t.sampleRatio*math.MaxUint64)
+}
+
+// Stats() returns the numbers of spans exported, dropped because the queue was full, and lost to failed
+// exports.
+func (t *Tracer) Stats() Stats {
+	return t.exporter.stats()
+}
+
+// Shutdown() exports the queued spans and stops the exporter, giving up when ctx is done. Spans ended after
+// Shutdown() are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.shutdown(ctx)
+}
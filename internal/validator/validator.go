@@ -36,6 +36,15 @@ func (v *Validator) Check(ok bool, key, message string) {
 	}
 }
 
+// Keep removes the error messages for every key other than the given ones.
+func (v *Validator) Keep(keys ...string) {
+	for key := range v.Errors {
+		if !In(key, keys...) {
+			delete(v.Errors, key)
+		}
+	}
+}
+
 // Returns true if 'value' is in the 'list'.
 func In(value string, list ...string) bool {
 	for i := range list {
@@ -0,0 +1,113 @@
+// Package wire encodes API responses in compact binary formats for high-volume consumers: Protocol Buffers
+// (for the movie responses described in proto/flickinfo/v1/movies.proto) and MessagePack (for any response).
+package wire
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/micypac/flick-info/internal/data"
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// protoBuffer accumulates an encoded protocol buffer message. Fields with zero values are skipped, as in proto3.
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field, wireType int) {
+	*b = binary.AppendUvarint(*b, uint64(field<<3|wireType))
+}
+
+func (b *protoBuffer) varint(field int, v int64) {
+	if v == 0 {
+		return
+	}
+
+	b.tag(field, wireVarint)
+	*b = binary.AppendUvarint(*b, uint64(v))
+}
+
+// double encodes an optional double field, which unlike the others is written whenever it's set, even to zero.
+func (b *protoBuffer) double(field int, v *float64) {
+	if v == nil {
+		return
+	}
+
+	b.tag(field, wireFixed64)
+	*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(*v))
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, wireBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+	if v == "" {
+		return
+	}
+
+	b.bytes(field, []byte(v))
+}
+
+func encodeMovie(movie *data.Movie) []byte {
+	var b protoBuffer
+
+	b.varint(1, movie.ID)
+	b.string(2, movie.Title)
+	b.varint(3, int64(movie.Year))
+	b.varint(4, int64(movie.Runtime))
+	for _, genre := range movie.Genres {
+		b.bytes(5, []byte(genre))
+	}
+	b.varint(6, int64(movie.Version))
+	b.string(7, movie.Synopsis)
+	b.string(8, movie.Language)
+	b.string(9, movie.Country)
+	b.string(10, movie.IMDbID)
+	b.varint(11, movie.TMDbID)
+	b.string(12, movie.PosterURL)
+	b.double(13, movie.AverageRating)
+	b.varint(14, movie.RatingsCount)
+
+	return b
+}
+
+func encodeMetadata(metadata data.Metadata) []byte {
+	var b protoBuffer
+
+	b.varint(1, int64(metadata.CurrentPage))
+	b.varint(2, int64(metadata.PageSize))
+	b.varint(3, int64(metadata.FirstPage))
+	b.varint(4, int64(metadata.LastPage))
+	b.varint(5, int64(metadata.TotalRecords))
+
+	return b
+}
+
+// MarshalMovieResponse encodes a flickinfo.v1.MovieResponse message.
+func MarshalMovieResponse(movie *data.Movie) []byte {
+	var b protoBuffer
+
+	b.bytes(1, encodeMovie(movie))
+
+	return b
+}
+
+// MarshalMovieListResponse encodes a flickinfo.v1.MovieListResponse message.
+func MarshalMovieListResponse(movies []*data.Movie, metadata data.Metadata) []byte {
+	var b protoBuffer
+
+	for _, movie := range movies {
+		b.bytes(1, encodeMovie(movie))
+	}
+	b.bytes(2, encodeMetadata(metadata))
+
+	return b
+}
@@ -0,0 +1 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS hash_version smallint NOT NULL DEFAULT 1;
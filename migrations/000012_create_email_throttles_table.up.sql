@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS email_throttles (
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  scope text NOT NULL,
+  sent_at timestamp(0) with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS email_throttles_user_id_scope_idx ON email_throttles (user_id, scope, sent_at);
@@ -0,0 +1,7 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_profile_visibility_check;
+
+ALTER TABLE users
+  DROP COLUMN IF EXISTS display_name,
+  DROP COLUMN IF EXISTS bio,
+  DROP COLUMN IF EXISTS avatar_url,
+  DROP COLUMN IF EXISTS profile_visibility;
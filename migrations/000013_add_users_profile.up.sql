@@ -0,0 +1,7 @@
+ALTER TABLE users
+  ADD COLUMN IF NOT EXISTS display_name text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS bio text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS avatar_url text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS profile_visibility text NOT NULL DEFAULT 'private';
+
+ALTER TABLE users ADD CONSTRAINT users_profile_visibility_check CHECK (profile_visibility IN ('public', 'private'));
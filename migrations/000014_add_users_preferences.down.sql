@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS users_weekly_digest_idx;
+
+ALTER TABLE users
+  DROP COLUMN IF EXISTS favorite_genres,
+  DROP COLUMN IF EXISTS weekly_digest,
+  DROP COLUMN IF EXISTS digest_sent_at;
@@ -0,0 +1,6 @@
+ALTER TABLE users
+  ADD COLUMN IF NOT EXISTS favorite_genres text[] NOT NULL DEFAULT '{}',
+  ADD COLUMN IF NOT EXISTS weekly_digest boolean NOT NULL DEFAULT false,
+  ADD COLUMN IF NOT EXISTS digest_sent_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS users_weekly_digest_idx ON users (digest_sent_at) WHERE weekly_digest;
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS lists_popular_idx;
+
+ALTER TABLE lists DROP CONSTRAINT IF EXISTS lists_visibility_check;
+
+ALTER TABLE lists
+  DROP COLUMN IF EXISTS visibility,
+  DROP COLUMN IF EXISTS slug,
+  DROP COLUMN IF EXISTS view_count;
@@ -0,0 +1,8 @@
+ALTER TABLE lists
+  ADD COLUMN IF NOT EXISTS visibility text NOT NULL DEFAULT 'private',
+  ADD COLUMN IF NOT EXISTS slug text UNIQUE,
+  ADD COLUMN IF NOT EXISTS view_count bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE lists ADD CONSTRAINT lists_visibility_check CHECK (visibility IN ('private', 'unlisted', 'public'));
+
+CREATE INDEX IF NOT EXISTS lists_popular_idx ON lists (view_count DESC, id) WHERE visibility = 'public';
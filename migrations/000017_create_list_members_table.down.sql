@@ -0,0 +1,3 @@
+ALTER TABLE list_entries DROP COLUMN IF EXISTS added_by;
+
+DROP TABLE IF EXISTS list_members;
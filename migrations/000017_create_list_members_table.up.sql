@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS list_members (
+  list_id bigint NOT NULL REFERENCES lists ON DELETE CASCADE,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  role text NOT NULL CHECK (role IN ('viewer', 'editor')),
+  added_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  PRIMARY KEY (list_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS list_members_user_id_idx ON list_members (user_id);
+
+ALTER TABLE list_entries ADD COLUMN IF NOT EXISTS added_by bigint REFERENCES users ON DELETE SET NULL;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS watch_history (
+  id bigserial PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  watched_on date NOT NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  UNIQUE (user_id, movie_id, watched_on)
+);
+
+CREATE TABLE IF NOT EXISTS ratings (
+  id bigserial PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  rating smallint NOT NULL CHECK (rating BETWEEN 1 AND 10),
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  UNIQUE (user_id, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS ratings_movie_id_idx ON ratings (movie_id);
+
+CREATE TABLE IF NOT EXISTS watchlist (
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  added_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  PRIMARY KEY (user_id, movie_id)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users
+  DROP COLUMN IF EXISTS preferred_languages,
+  DROP COLUMN IF EXISTS max_content_rating;
@@ -0,0 +1,3 @@
+ALTER TABLE users
+  ADD COLUMN IF NOT EXISTS preferred_languages text[] NOT NULL DEFAULT '{}',
+  ADD COLUMN IF NOT EXISTS max_content_rating text NOT NULL DEFAULT '';
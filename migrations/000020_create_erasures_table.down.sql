@@ -0,0 +1,5 @@
+DELETE FROM permissions WHERE code = 'users:erase';
+
+DROP TABLE IF EXISTS erasures;
+
+ALTER TABLE users DROP COLUMN IF EXISTS erased_at;
@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS erased_at timestamp(0) with time zone;
+
+CREATE TABLE IF NOT EXISTS erasures (
+  id bigserial PRIMARY KEY,
+  user_id bigint NOT NULL,
+  requested_by bigint NOT NULL,
+  completed_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  report jsonb NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS erasures_user_id_idx ON erasures (user_id);
+
+INSERT INTO permissions (code) VALUES ('users:erase');
@@ -0,0 +1,12 @@
+-- normalize_title() reduces a title to the form compared when looking for duplicate movies: lower case, with
+-- punctuation collapsed into single spaces and any leading article removed. Keep it in step with NormalizeTitle()
+-- in internal/data/duplicates.go.
+CREATE OR REPLACE FUNCTION normalize_title(title text) RETURNS text
+LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+  SELECT regexp_replace(trim(regexp_replace(lower(title), '[^[:alnum:]]+', ' ', 'g')), '^(the|a|an) ', '')
+$$;
+
+CREATE INDEX IF NOT EXISTS movies_normalized_title_year_idx ON movies (normalize_title(title), year);
+
+-- Needs the pg_trgm extension, which (like citext) isn't created here.
+CREATE INDEX IF NOT EXISTS movies_title_trgm_idx ON movies USING GIN (lower(title) gin_trgm_ops);
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS saved_searches (
+  id bigserial PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  name text NOT NULL,
+  title text NOT NULL DEFAULT '',
+  genres text[] NOT NULL DEFAULT '{}',
+  filter text NOT NULL DEFAULT '',
+  notify_email boolean NOT NULL DEFAULT true,
+  -- The highest movie ID which has been checked against the search. Only movies added after it are new matches.
+  last_movie_id bigint NOT NULL DEFAULT 0,
+  version integer NOT NULL DEFAULT 1,
+  UNIQUE (user_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS saved_searches_last_movie_id_idx ON saved_searches (last_movie_id);
+
+CREATE TABLE IF NOT EXISTS notifications (
+  id bigserial PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  kind text NOT NULL,
+  message text NOT NULL,
+  data jsonb NOT NULL DEFAULT '{}',
+  read_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, id DESC);
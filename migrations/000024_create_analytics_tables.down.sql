@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code = 'analytics:read';
+DROP INDEX IF EXISTS users_created_at_idx;
+DROP TABLE IF EXISTS movie_views;
+DROP TABLE IF EXISTS request_counts;
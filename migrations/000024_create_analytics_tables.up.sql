@@ -0,0 +1,20 @@
+-- Request counts by route, aggregated per day (UTC). The route is the pattern, such as /v1/movies/:id.
+CREATE TABLE IF NOT EXISTS request_counts (
+  day date NOT NULL,
+  method text NOT NULL,
+  route text NOT NULL,
+  count bigint NOT NULL,
+  PRIMARY KEY (day, method, route)
+);
+
+-- Views of each movie's page, aggregated per day (UTC).
+CREATE TABLE IF NOT EXISTS movie_views (
+  day date NOT NULL,
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  count bigint NOT NULL,
+  PRIMARY KEY (day, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at);
+
+INSERT INTO permissions (code) VALUES ('analytics:read');
@@ -0,0 +1,12 @@
+-- An audit record of each rename or merge of genres.
+CREATE TABLE IF NOT EXISTS genre_changes (
+  id bigserial PRIMARY KEY,
+  kind text NOT NULL,
+  sources text[] NOT NULL,
+  target text NOT NULL,
+  requested_by bigint NOT NULL,
+  completed_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  movies_updated bigint NOT NULL,
+  users_updated bigint NOT NULL,
+  saved_searches_updated bigint NOT NULL
+);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS reviews (
+  id bigserial PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  updated_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  body text NOT NULL,
+  -- Reviews are pending until a moderator approves or rejects them. Editing a review makes it pending again.
+  status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+  moderated_by bigint REFERENCES users ON DELETE SET NULL,
+  moderated_at timestamp(0) with time zone,
+  version integer NOT NULL DEFAULT 1,
+  UNIQUE (user_id, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_movie_id_status_idx ON reviews (movie_id, status);
+CREATE INDEX IF NOT EXISTS reviews_status_created_at_idx ON reviews (status, created_at);
+
+INSERT INTO permissions (code) VALUES ('reviews:moderate');
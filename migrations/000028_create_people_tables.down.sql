@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS movie_cast;
+DROP TABLE IF EXISTS people;
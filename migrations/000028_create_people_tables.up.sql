@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS people (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  name text NOT NULL,
+  birth_year integer NOT NULL DEFAULT 0,
+  bio text NOT NULL DEFAULT '',
+  version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS people_name_idx ON people USING GIN (to_tsvector('simple', name));
+
+-- The people who worked on each movie. A person can have several roles in the same movie, such as director and
+-- actor. Position orders the credits within the movie.
+CREATE TABLE IF NOT EXISTS movie_cast (
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  person_id bigint NOT NULL REFERENCES people ON DELETE CASCADE,
+  role text NOT NULL,
+  character text NOT NULL DEFAULT '',
+  position integer NOT NULL,
+  PRIMARY KEY (movie_id, person_id, role)
+);
+
+CREATE INDEX IF NOT EXISTS movie_cast_person_id_idx ON movie_cast (person_id);
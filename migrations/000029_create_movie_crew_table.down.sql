@@ -0,0 +1,6 @@
+INSERT INTO movie_cast (movie_id, person_id, role, position)
+SELECT c.movie_id, c.person_id, c.job, (SELECT coalesce(max(position), 0) FROM movie_cast WHERE movie_id = c.movie_id) + c.position
+FROM movie_crew c
+ON CONFLICT DO NOTHING;
+
+DROP TABLE IF EXISTS movie_crew;
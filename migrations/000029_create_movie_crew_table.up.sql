@@ -0,0 +1,20 @@
+-- The crew of each movie, such as its directors and writers. A person can have several jobs in the same movie.
+-- Position orders the credits within the movie.
+CREATE TABLE IF NOT EXISTS movie_crew (
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  person_id bigint NOT NULL REFERENCES people ON DELETE CASCADE,
+  job text NOT NULL,
+  position integer NOT NULL,
+  PRIMARY KEY (movie_id, person_id, job)
+);
+
+CREATE INDEX IF NOT EXISTS movie_crew_person_id_idx ON movie_crew (person_id, job);
+
+-- Crew credits were previously kept in the cast with their job as the role.
+INSERT INTO movie_crew (movie_id, person_id, job, position)
+SELECT movie_id, person_id, role, row_number() OVER (PARTITION BY movie_id ORDER BY position)
+FROM movie_cast
+WHERE role <> 'actor'
+ON CONFLICT DO NOTHING;
+
+DELETE FROM movie_cast WHERE role <> 'actor';
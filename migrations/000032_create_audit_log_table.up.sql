@@ -0,0 +1,16 @@
+-- User IDs aren't foreign keys, so that the log outlives the users and entities it refers to.
+CREATE TABLE IF NOT EXISTS audit_log (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  user_id bigint,
+  request_id text NOT NULL DEFAULT '',
+  entity text NOT NULL,
+  entity_id bigint NOT NULL,
+  action text NOT NULL,
+  changes jsonb NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity, entity_id);
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id);
+
+INSERT INTO permissions (code) VALUES ('audit:read');
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS movies_language_idx;
+
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_synopsis_length_check;
+
+ALTER TABLE movies
+  DROP COLUMN IF EXISTS synopsis,
+  DROP COLUMN IF EXISTS language,
+  DROP COLUMN IF EXISTS country;
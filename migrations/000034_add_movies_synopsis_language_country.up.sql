@@ -0,0 +1,8 @@
+ALTER TABLE movies
+  ADD COLUMN IF NOT EXISTS synopsis text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS language text NOT NULL DEFAULT '',
+  ADD COLUMN IF NOT EXISTS country text NOT NULL DEFAULT '';
+
+ALTER TABLE movies ADD CONSTRAINT movies_synopsis_length_check CHECK (octet_length(synopsis) <= 5000);
+
+CREATE INDEX IF NOT EXISTS movies_language_idx ON movies (language);
@@ -0,0 +1,6 @@
+ALTER TABLE movies
+  ADD COLUMN IF NOT EXISTS imdb_id text,
+  ADD COLUMN IF NOT EXISTS tmdb_id bigint;
+
+ALTER TABLE movies ADD CONSTRAINT movies_imdb_id_key UNIQUE (imdb_id);
+ALTER TABLE movies ADD CONSTRAINT movies_tmdb_id_key UNIQUE (tmdb_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_name_trgm_idx;
+DROP INDEX IF EXISTS people_name_trgm_idx;
@@ -0,0 +1,4 @@
+-- Trigram indexes for the typo-tolerant search of people's and users' names. Like movies_title_trgm_idx, they
+-- need the pg_trgm extension.
+CREATE INDEX IF NOT EXISTS people_name_trgm_idx ON people USING GIN (lower(name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING GIN (lower(name) gin_trgm_ops);
@@ -0,0 +1,5 @@
+DROP FUNCTION IF EXISTS movie_genre_names(bigint);
+
+DROP TABLE IF EXISTS movies_genres;
+
+DROP TABLE IF EXISTS genres;
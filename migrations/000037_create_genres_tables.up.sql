@@ -0,0 +1,42 @@
+-- Genres become rows of their own, which movies refer to through movies_genres, in place of the free-text genres
+-- array on each movie. The array is still written, so that instances of the previous version keep working during
+-- a deploy, but no longer read; it will be dropped by a later migration.
+CREATE TABLE IF NOT EXISTS genres (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  name text NOT NULL,
+  version integer NOT NULL DEFAULT 1,
+  CONSTRAINT genres_name_key UNIQUE (name)
+);
+
+-- A movie's genres, in the order given by position. A genre can't be deleted while movies have it.
+CREATE TABLE IF NOT EXISTS movies_genres (
+  movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+  genre_id bigint NOT NULL REFERENCES genres,
+  position integer NOT NULL,
+  PRIMARY KEY (movie_id, genre_id)
+);
+
+CREATE INDEX IF NOT EXISTS movies_genres_genre_id_idx ON movies_genres (genre_id);
+
+INSERT INTO genres (name)
+SELECT DISTINCT genre FROM movies, unnest(genres) AS genre
+ORDER BY genre
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO movies_genres (movie_id, genre_id, position)
+SELECT m.id, g.id, t.position
+FROM movies m
+CROSS JOIN LATERAL unnest(m.genres) WITH ORDINALITY AS t(name, position)
+INNER JOIN genres g ON g.name = t.name
+ON CONFLICT (movie_id, genre_id) DO NOTHING;
+
+-- movie_genre_names() returns the names of a movie's genres, in order, for the queries which show movies or filter
+-- them by genre.
+CREATE OR REPLACE FUNCTION movie_genre_names(movie_id bigint) RETURNS text[]
+LANGUAGE sql STABLE PARALLEL SAFE AS $$
+  SELECT coalesce(array_agg(g.name ORDER BY mg.position), '{}')
+  FROM movies_genres mg
+  INNER JOIN genres g ON g.id = mg.genre_id
+  WHERE mg.movie_id = $1
+$$;
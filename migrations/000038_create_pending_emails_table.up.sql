@@ -0,0 +1,11 @@
+-- Emails which were still waiting to be sent when the API shut down, saved with -shutdown-persist-emails so that
+-- they can be sent once it has restarted. The template data may hold one-time tokens, so the rows are deleted as
+-- soon as they are picked up.
+CREATE TABLE IF NOT EXISTS pending_emails (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  task text NOT NULL,
+  recipient text NOT NULL,
+  template text NOT NULL,
+  data jsonb NOT NULL
+);
@@ -0,0 +1,16 @@
+DELETE FROM permissions WHERE code = 'emails:manage';
+
+CREATE TABLE IF NOT EXISTS pending_emails (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  task text NOT NULL,
+  recipient text NOT NULL,
+  template text NOT NULL,
+  data jsonb NOT NULL
+);
+
+-- Keep the emails which haven't been sent yet.
+INSERT INTO pending_emails (created_at, task, recipient, template, data)
+SELECT created_at, task, recipient, template, data FROM email_outbox WHERE status = 'pending' ORDER BY id;
+
+DROP TABLE IF EXISTS email_outbox;
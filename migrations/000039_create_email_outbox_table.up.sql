@@ -0,0 +1,25 @@
+-- The outbox of emails to send. Emails are queued here and sent by the outbox workers, which retry failures with
+-- exponential backoff, so that no email is lost to a restart or an SMTP outage. An email is deleted once it has
+-- been sent, as the template data may hold one-time tokens, and marked failed when it runs out of attempts.
+CREATE TABLE IF NOT EXISTS email_outbox (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT now(),
+  task text NOT NULL,
+  recipient text NOT NULL,
+  template text NOT NULL,
+  data jsonb NOT NULL,
+  status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'failed')),
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt_at timestamp(3) with time zone NOT NULL DEFAULT now(),
+  last_error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS email_outbox_due_idx ON email_outbox (next_attempt_at) WHERE status = 'pending';
+
+-- The emails saved at shutdown are queued in the outbox instead.
+INSERT INTO email_outbox (created_at, task, recipient, template, data)
+SELECT created_at, task, recipient, template, data FROM pending_emails ORDER BY id;
+
+DROP TABLE IF EXISTS pending_emails;
+
+INSERT INTO permissions (code) VALUES ('emails:manage') ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+-- The language emails are sent to the user in, as an ISO 639-1 code. Templates without a variant for it are sent
+-- in English.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT 'en';
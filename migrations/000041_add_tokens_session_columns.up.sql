@@ -0,0 +1,3 @@
+-- Authentication tokens are listed as sessions, which are revoked by ID since the plaintext isn't stored.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS id bigserial UNIQUE;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone;
@@ -0,0 +1,3 @@
+-- A new email address waiting to be confirmed, which replaces the current one once the user follows the link
+-- sent to it.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email citext;
@@ -0,0 +1 @@
+DELETE FROM permissions WHERE code IN ('account:read', 'account:write', 'lists:read', 'lists:write');
@@ -0,0 +1,14 @@
+INSERT INTO permissions (code)
+VALUES
+  ('account:read'),
+  ('account:write'),
+  ('lists:read'),
+  ('lists:write');
+
+-- Every user may manage their own account and lists. The permissions exist so that personal access tokens and API
+-- keys can be scoped to them, so they're granted to all the existing users as they are on registration.
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users.id, permissions.id
+FROM users CROSS JOIN permissions
+WHERE permissions.code IN ('account:read', 'account:write', 'lists:read', 'lists:write')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,8 @@
+-- Genre filters find the matching movies through movies_genres, looking up each genre's movies by genre_id, so the
+-- index on genre_id alone is widened to cover movie_id as well.
+CREATE INDEX IF NOT EXISTS movies_genres_genre_id_movie_id_idx ON movies_genres (genre_id, movie_id);
+DROP INDEX IF EXISTS movies_genres_genre_id_idx;
+
+-- The genres array on each movie was replaced by movies_genres and is no longer read or written. Dropping it also
+-- drops its GIN index.
+ALTER TABLE movies DROP COLUMN IF EXISTS genres;
@@ -0,0 +1,3 @@
+-- When a user's data is erased their reviews are kept, but no longer linked to them. UNIQUE (user_id, movie_id)
+-- allows any number of reviews with a null user_id.
+ALTER TABLE reviews ALTER COLUMN user_id DROP NOT NULL;
@@ -0,0 +1,7 @@
+// Package migrations embeds the SQL migration files, so that the API can apply them itself in dev mode.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS